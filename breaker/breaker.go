@@ -0,0 +1,198 @@
+// Package breaker implements a wrapper for a cache backend that stops using
+// the backend while it is failing.
+//
+// A [Cache] counts consecutive failures of the underlying backend. When the
+// count reaches a threshold, the breaker "trips" (opens), and for a cool-down
+// period the Cache does not call the backend at all: Get reports a cache miss,
+// and Put reports [ErrOpen]. After the cool-down, the next operation is passed
+// through as a probe. If it succeeds, the breaker closes and normal operation
+// resumes; otherwise the breaker opens for another cool-down period.
+//
+// This keeps builds fast while a shared cache is down, instead of waiting for
+// every request to fail or time out. To keep failed puts from being reported
+// to the toolchain, use the Cache with [gocache.Server.ErrorsAreMisses].
+// Puts rejected while the breaker is open are not reported in any case.
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// ErrOpen is reported by [Cache.Put] while the breaker is open. It wraps
+// [gocache.ErrBackendUnavailable].
+var ErrOpen = fmt.Errorf("circuit breaker is open: %w", gocache.ErrBackendUnavailable)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// Threshold is the number of consecutive failures that trips the breaker.
+	// If zero, it defaults to 5.
+	Threshold int
+
+	// Cooldown is how long the breaker stays open after it trips, before it
+	// probes the backend for recovery. If zero, it defaults to 30s.
+	Cooldown time.Duration
+
+	// If positive, Timeout is the time limit for each operation on the
+	// backend. An operation that times out counts as a failure.
+	Timeout time.Duration
+
+	// Clock, if non-nil, is used to time the cool-down period. If nil, it
+	// defaults to [gocache.SystemClock].
+	Clock gocache.Clock
+}
+
+func (o *Options) threshold() int {
+	if o == nil || o.Threshold <= 0 {
+		return 5
+	}
+	return o.Threshold
+}
+
+func (o *Options) cooldown() time.Duration {
+	if o == nil || o.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return o.Cooldown
+}
+
+func (o *Options) clock() gocache.Clock {
+	if o == nil || o.Clock == nil {
+		return gocache.SystemClock
+	}
+	return o.Clock
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.Timeout
+}
+
+// Cache implements a circuit breaker around a [Backend].
+type Cache struct {
+	base      Backend
+	threshold int
+	cooldown  time.Duration
+	timeout   time.Duration
+	clock     gocache.Clock
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // when the breaker is open, the end of the cool-down
+	probing   bool      // a probe is in progress
+}
+
+// New constructs a new Cache that stops calling base while it is failing.
+func New(base Backend, opts *Options) *Cache {
+	return &Cache{
+		base:      base,
+		threshold: opts.threshold(),
+		cooldown:  opts.cooldown(),
+		timeout:   opts.timeout(),
+		clock:     opts.clock(),
+	}
+}
+
+// Open reports whether the breaker is currently open.
+func (c *Cache) Open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures >= c.threshold
+}
+
+// Get implements the corresponding method of the gocache service interface.
+// While the breaker is open, Get reports a cache miss.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	probe, ok := c.allow()
+	if !ok {
+		gocache.SetMissReason(ctx, "circuit-open")
+		return "", "", nil // cache miss
+	}
+	octx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	outputID, diskPath, err = c.base.Get(octx, actionID)
+	c.report(ctx, probe, err)
+	return outputID, diskPath, err
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// While the breaker is open, Put reports [ErrOpen].
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	probe, ok := c.allow()
+	if !ok {
+		return "", ErrOpen
+	}
+	octx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	diskPath, err = c.base.Put(octx, obj)
+	c.report(ctx, probe, err)
+	return diskPath, err
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+func (c *Cache) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return ctx, func() {}
+}
+
+// allow reports whether an operation may be passed to the backend, and if so,
+// whether the operation is a probe for recovery.
+func (c *Cache) allow() (probe, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.threshold {
+		return false, true // closed
+	} else if c.probing || c.clock.Now().Before(c.openUntil) {
+		return false, false // open
+	}
+	c.probing = true
+	return true, true
+}
+
+// report records the result of an operation on the backend.
+func (c *Cache) report(ctx context.Context, probe bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if probe {
+		c.probing = false
+	}
+	if err == nil {
+		if c.failures >= c.threshold {
+			gocache.Logf(ctx, "backend recovered; closing circuit breaker")
+		}
+		c.failures = 0
+		return
+	} else if ctx.Err() != nil {
+		return // the caller gave up; this says nothing about the backend
+	}
+
+	c.failures++
+	if c.failures >= c.threshold {
+		if !probe {
+			gocache.Logf(ctx, "backend failed %d times (last: %v); opening circuit breaker for %v",
+				c.failures, err, c.cooldown)
+		}
+		c.openUntil = c.clock.Now().Add(c.cooldown)
+	}
+}
@@ -0,0 +1,132 @@
+package breaker_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/breaker"
+	"github.com/creachadair/gocache/cachetest"
+)
+
+// fakeBackend is a fake backend whose operations fail while fail is true.
+type fakeBackend struct {
+	fail  bool
+	calls int
+}
+
+var errDown = errors.New("backend is down")
+
+func (f *fakeBackend) Get(ctx context.Context, actionID string) (string, string, error) {
+	f.calls++
+	if f.fail {
+		return "", "", errDown
+	}
+	return "0b1ec7", "/path/to/object", nil
+}
+
+func (f *fakeBackend) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	f.calls++
+	if f.fail {
+		return "", errDown
+	}
+	return "/path/to/object", nil
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	base := &fakeBackend{fail: true}
+	clock := cachetest.NewClock(time.Now())
+	c := breaker.New(base, &breaker.Options{Threshold: 2, Cooldown: time.Minute, Clock: clock})
+	obj := gocache.Object{ActionID: "a1b2c3", OutputID: "0b1ec7", Size: 5, Body: strings.NewReader("xyzzy")}
+
+	// Failures below the threshold are reported to the caller.
+	for i := range 2 {
+		if _, _, err := c.Get(ctx, "a1b2c3"); !errors.Is(err, errDown) {
+			t.Errorf("Get %d: got %v, want %v", i+1, err, errDown)
+		}
+	}
+	if !c.Open() {
+		t.Fatal("Breaker did not open after 2 failures")
+	}
+
+	// While the breaker is open, the backend is not called.
+	if oid, _, err := c.Get(ctx, "a1b2c3"); err != nil || oid != "" {
+		t.Errorf("Get (open): got %q, %v; want miss", oid, err)
+	}
+	if _, err := c.Put(ctx, obj); !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("Put (open): got %v, want %v", err, breaker.ErrOpen)
+	} else if !errors.Is(err, gocache.ErrBackendUnavailable) {
+		t.Errorf("Put (open): got %v, want %v", err, gocache.ErrBackendUnavailable)
+	}
+	if base.calls != 2 {
+		t.Errorf("Backend got %d calls, want 2", base.calls)
+	}
+
+	// After the cool-down, a failed probe reopens the breaker.
+	clock.Advance(time.Minute)
+	if _, _, err := c.Get(ctx, "a1b2c3"); !errors.Is(err, errDown) {
+		t.Errorf("Get (probe): got %v, want %v", err, errDown)
+	}
+	if _, _, err := c.Get(ctx, "a1b2c3"); err != nil {
+		t.Errorf("Get (reopened): got %v, want miss", err)
+	}
+	if base.calls != 3 {
+		t.Errorf("Backend got %d calls, want 3", base.calls)
+	}
+
+	// After the cool-down, a successful probe closes the breaker.
+	base.fail = false
+	if oid, _, err := c.Get(ctx, "a1b2c3"); err != nil || oid != "" {
+		t.Errorf("Get (reopened): got %q, %v; want miss", oid, err)
+	}
+	clock.Advance(time.Minute)
+	if oid, _, err := c.Get(ctx, "a1b2c3"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Get (probe): got %q, %v; want 0b1ec7, nil", oid, err)
+	}
+	if c.Open() {
+		t.Error("Breaker did not close after a successful probe")
+	}
+	if _, err := c.Put(ctx, obj); err != nil {
+		t.Errorf("Put (closed): unexpected error: %v", err)
+	}
+}
+
+// slowBackend is a fake backend whose operations block until their context
+// ends.
+type slowBackend struct{}
+
+func (slowBackend) Get(ctx context.Context, actionID string) (string, string, error) {
+	<-ctx.Done()
+	return "", "", ctx.Err()
+}
+
+func (slowBackend) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := context.Background()
+	c := breaker.New(slowBackend{}, &breaker.Options{Threshold: 1, Timeout: 5 * time.Millisecond})
+	if _, _, err := c.Get(ctx, "a1b2c3"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !c.Open() {
+		t.Error("Breaker did not open after a timeout")
+	}
+
+	// A failure caused by the caller giving up does not count.
+	c = breaker.New(slowBackend{}, &breaker.Options{Threshold: 1})
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.Get(cctx, "a1b2c3"); err == nil {
+		t.Error("Get: unexpectedly succeeded")
+	}
+	if c.Open() {
+		t.Error("Breaker opened after the caller's context ended")
+	}
+}
@@ -0,0 +1,259 @@
+// Package cachebench measures the throughput of a cache server by driving a
+// synthetic workload through the cache protocol.
+//
+// [Run] connects a [cacheclient.Client] to a [gocache.Server], and issues
+// requests from several workers at once, in the pattern of a build: each
+// worker gets the result for an action, and on a miss stores a new object for
+// it. On a hit, the worker reads the object from disk, as the go command does.
+// Actions are chosen at random from a fixed set, so that the hit rate rises
+// as the run proceeds.
+//
+// The same workload can be run against any backend, so the results give a
+// standard yardstick to compare backends and their settings.
+package cachebench
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/taskgroup"
+)
+
+// Options are optional settings for [Run]. A nil *Options is ready for use
+// and provides default values as described.
+type Options struct {
+	// The number of gets to issue. If zero, it defaults to 10000.
+	Requests int
+
+	// The number of workers issuing requests at once. If zero, it defaults
+	// to runtime.NumCPU.
+	Concurrency int
+
+	// The number of distinct actions. If zero, it defaults to 1000.
+	Actions int
+
+	// The size in bytes of each object stored, at least 8. If zero, it
+	// defaults to 16KiB.
+	ObjectSize int
+
+	// The seed for the random choice of actions. Runs with the same seed
+	// and settings issue the same requests, though not in the same order.
+	Seed uint64
+}
+
+func (o *Options) requests() int {
+	if o == nil || o.Requests <= 0 {
+		return 10000
+	}
+	return o.Requests
+}
+
+func (o *Options) concurrency() int {
+	if o == nil || o.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.Concurrency
+}
+
+func (o *Options) actions() int {
+	if o == nil || o.Actions <= 0 {
+		return 1000
+	}
+	return o.Actions
+}
+
+func (o *Options) objectSize() int {
+	if o == nil || o.ObjectSize <= 0 {
+		return 16 << 10
+	}
+	return max(o.ObjectSize, 8)
+}
+
+func (o *Options) seed() uint64 {
+	if o == nil {
+		return 0
+	}
+	return o.Seed
+}
+
+// Result reports the outcome of a run. In JSON, durations are encoded as
+// integer nanoseconds.
+type Result struct {
+	Gets      int   `json:"gets"`      // get requests issued
+	Hits      int   `json:"hits"`      // gets that hit
+	Puts      int   `json:"puts"`      // put requests issued
+	BytesRead int64 `json:"bytesRead"` // bytes read from the objects of hits
+	BytesPut  int64 `json:"bytesPut"`  // bytes sent in puts
+
+	Elapsed    time.Duration `json:"elapsed"`    // the wall-clock time of the run
+	GetLatency Latency       `json:"getLatency"` // latencies of get requests
+	PutLatency Latency       `json:"putLatency"` // latencies of put requests
+}
+
+// Latency summarizes the latencies of a kind of request.
+type Latency struct {
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// RequestsPerSecond reports the rate of get and put requests in r.
+func (r Result) RequestsPerSecond() float64 {
+	return float64(r.Gets+r.Puts) / r.Elapsed.Seconds()
+}
+
+// MBPerSecond reports the rate of object bytes read and written in r, in
+// units of 10^6 bytes.
+func (r Result) MBPerSecond() float64 {
+	return float64(r.BytesRead+r.BytesPut) / 1e6 / r.Elapsed.Seconds()
+}
+
+// String returns a human-readable summary of r.
+func (r Result) String() string {
+	hitPct := 100 * float64(r.Hits) / float64(max(r.Gets, 1))
+	return fmt.Sprintf("%d gets (%.1f%% hits), %d puts in %v: %.0f req/s, %.1f MB/s\n"+
+		"get latency: p50 %v, p95 %v, p99 %v, max %v\n"+
+		"put latency: p50 %v, p95 %v, p99 %v, max %v",
+		r.Gets, hitPct, r.Puts, r.Elapsed.Round(time.Millisecond), r.RequestsPerSecond(), r.MBPerSecond(),
+		r.GetLatency.P50, r.GetLatency.P95, r.GetLatency.P99, r.GetLatency.Max,
+		r.PutLatency.P50, r.PutLatency.P95, r.PutLatency.P99, r.PutLatency.Max)
+}
+
+// Run runs a workload against s, and reports the results. The server is
+// started by Run, and must not already be running.
+func Run(ctx context.Context, s *gocache.Server, opts *Options) (Result, error) {
+	c, err := cacheclient.Serve(ctx, s, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	canPut := slices.Contains(c.Commands(), "put")
+
+	var mu sync.Mutex
+	var res Result
+	var getTimes, putTimes []time.Duration
+	record := func(w *worker) {
+		mu.Lock()
+		defer mu.Unlock()
+		res.Gets += w.gets
+		res.Hits += w.hits
+		res.Puts += w.puts
+		res.BytesRead += w.bytesRead
+		res.BytesPut += w.bytesPut
+		getTimes = append(getTimes, w.getTimes...)
+		putTimes = append(putTimes, w.putTimes...)
+	}
+
+	// Divide the requests among the workers.
+	nw, nreq := opts.concurrency(), opts.requests()
+	g := taskgroup.New(nil)
+	start := time.Now()
+	for i := range nw {
+		w := &worker{
+			c:      c,
+			rng:    rand.New(rand.NewPCG(opts.seed(), uint64(i))),
+			canPut: canPut,
+			size:   opts.objectSize(),
+		}
+		n := nreq / nw
+		if i < nreq%nw {
+			n++
+		}
+		g.Go(func() error {
+			defer record(w)
+			return w.run(ctx, n, opts.actions())
+		})
+	}
+	err = g.Wait()
+	res.Elapsed = time.Since(start)
+	if cerr := c.Close(ctx); err == nil {
+		err = cerr
+	}
+	res.GetLatency = summarize(getTimes)
+	res.PutLatency = summarize(putTimes)
+	return res, err
+}
+
+// A worker issues requests for [Run], and records their results.
+type worker struct {
+	c      *cacheclient.Client
+	rng    *rand.Rand
+	canPut bool
+	size   int
+
+	gets, hits, puts    int
+	bytesRead, bytesPut int64
+	getTimes, putTimes  []time.Duration
+}
+
+// run issues n gets for actions chosen from nactions, and puts for the
+// actions that miss.
+func (w *worker) run(ctx context.Context, n, nactions int) error {
+	body := make([]byte, w.size)
+	for range n {
+		action := w.rng.IntN(nactions)
+		actionID := sha256.Sum256(binary.BigEndian.AppendUint64([]byte("action"), uint64(action)))
+
+		start := time.Now()
+		rsp, err := w.c.Get(ctx, actionID[:])
+		if err != nil {
+			return err
+		} else if rsp.Err != "" {
+			return fmt.Errorf("get: %s", rsp.Err)
+		}
+		w.gets++
+		if !rsp.Miss {
+			// Read the object, as the go command does.
+			data, err := os.ReadFile(rsp.DiskPath)
+			w.getTimes = append(w.getTimes, time.Since(start))
+			if err != nil {
+				return fmt.Errorf("read object: %w", err)
+			}
+			w.hits++
+			w.bytesRead += int64(len(data))
+			continue
+		}
+		w.getTimes = append(w.getTimes, time.Since(start))
+		if !w.canPut {
+			continue
+		}
+
+		// The contents of each object are determined by its action, so that
+		// concurrent puts for the same action agree.
+		binary.BigEndian.PutUint64(body, uint64(action))
+		outputID := sha256.Sum256(body)
+		start = time.Now()
+		rsp, err = w.c.Put(ctx, actionID[:], outputID[:], body)
+		w.putTimes = append(w.putTimes, time.Since(start))
+		if err != nil {
+			return err
+		} else if rsp.Err != "" {
+			return fmt.Errorf("put: %s", rsp.Err)
+		}
+		w.puts++
+		w.bytesPut += int64(len(body))
+	}
+	return nil
+}
+
+// summarize returns the latency percentiles of ds, which it sorts.
+func summarize(ds []time.Duration) Latency {
+	if len(ds) == 0 {
+		return Latency{}
+	}
+	slices.Sort(ds)
+	at := func(q float64) time.Duration {
+		return ds[min(int(q*float64(len(ds))), len(ds)-1)]
+	}
+	return Latency{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: ds[len(ds)-1]}
+}
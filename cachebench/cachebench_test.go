@@ -0,0 +1,90 @@
+package cachebench_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachebench"
+	"github.com/creachadair/gocache/cachetest"
+)
+
+func newServer(t testing.TB, hotCache int) *gocache.Server {
+	t.Helper()
+	s, _ := cachetest.NewServer(t)
+	s.HotCacheSize = hotCache
+	return s
+}
+
+func TestRun(t *testing.T) {
+	s := newServer(t, 0)
+	res, err := cachebench.Run(context.Background(), s, &cachebench.Options{
+		Requests:    500,
+		Concurrency: 4,
+		Actions:     50,
+		ObjectSize:  100,
+	})
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	t.Logf("Result:\n%v", res)
+
+	// Every get either hits or leads to a put, and there are more requests
+	// than actions, so some gets must hit.
+	if res.Gets != 500 {
+		t.Errorf("Gets: got %d, want 500", res.Gets)
+	}
+	if res.Hits+res.Puts != res.Gets {
+		t.Errorf("Hits + Puts: got %d + %d, want %d", res.Hits, res.Puts, res.Gets)
+	}
+	if res.Puts < 50 || res.Hits == 0 {
+		t.Errorf("Got %d puts, %d hits; want at least 50 puts and some hits", res.Puts, res.Hits)
+	}
+	if res.BytesPut != int64(100*res.Puts) || res.BytesRead != int64(100*res.Hits) {
+		t.Errorf("Got %d bytes put, %d read; want %d, %d", res.BytesPut, res.BytesRead, 100*res.Puts, 100*res.Hits)
+	}
+	if res.GetLatency.Max < res.GetLatency.P50 || res.GetLatency.P50 <= 0 {
+		t.Errorf("Invalid get latency: %+v", res.GetLatency)
+	}
+
+	// A read-only server is measured without puts.
+	s = newServer(t, 0)
+	s.ReadOnly = true
+	res, err = cachebench.Run(context.Background(), s, &cachebench.Options{Requests: 100, Actions: 10})
+	if err != nil {
+		t.Fatalf("Run (read-only): unexpected error: %v", err)
+	}
+	if res.Puts != 0 || res.Hits != 0 {
+		t.Errorf("Read-only: got %d puts, %d hits; want 0, 0", res.Puts, res.Hits)
+	}
+}
+
+func benchmarkServer(b *testing.B, newServer func(testing.TB) *gocache.Server) {
+	for _, tc := range []struct {
+		name string
+		size int
+	}{{"1KiB", 1 << 10}, {"64KiB", 64 << 10}} {
+		b.Run(tc.name, func(b *testing.B) {
+			res, err := cachebench.Run(context.Background(), newServer(b), &cachebench.Options{
+				Requests:   b.N,
+				Actions:    max(b.N/10, 1),
+				ObjectSize: tc.size,
+			})
+			if err != nil {
+				b.Fatalf("Run: %v", err)
+			}
+			b.ReportMetric(res.RequestsPerSecond(), "req/s")
+			b.ReportMetric(res.MBPerSecond(), "MB/s")
+			b.ReportMetric(float64(res.GetLatency.P95.Microseconds()), "get-p95-µs")
+			b.ReportMetric(float64(res.PutLatency.P95.Microseconds()), "put-p95-µs")
+		})
+	}
+}
+
+func BenchmarkCacheDir(b *testing.B) {
+	benchmarkServer(b, func(tb testing.TB) *gocache.Server { return newServer(tb, 0) })
+}
+
+func BenchmarkHotCache(b *testing.B) {
+	benchmarkServer(b, func(tb testing.TB) *gocache.Server { return newServer(tb, 1000) })
+}
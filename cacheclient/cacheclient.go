@@ -0,0 +1,263 @@
+// Package cacheclient implements the client side of the Go toolchain cache
+// process protocol, as used by the go command to talk to a GOCACHEPROG.
+//
+// A [Client] sends requests to a cache server and matches its responses to
+// them, so that several requests can be in flight at once, as they are from
+// the go command. This is useful to test and measure a server without a
+// toolchain that supports GOCACHEPROG. Use [Serve] to run a
+// [gocache.Server] in the same process, connected to a new Client.
+package cacheclient
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// ErrClosed is reported for requests that cannot be completed because the
+// connection to the server was closed.
+var ErrClosed = errors.New("client is closed")
+
+// A Response is the response of the server to a request.
+type Response struct {
+	ID  int64
+	Err string `json:",omitempty"` // if non-empty, the error reported by the server
+
+	// KnownCommands is set only in the initial message from the server.
+	KnownCommands []string `json:",omitempty"`
+
+	// For "get" requests.
+	Miss     bool       `json:",omitempty"`
+	OutputID []byte     `json:",omitempty"`
+	Size     int64      `json:",omitempty"`
+	Time     *time.Time `json:",omitempty"`
+
+	// For "get" hits and "put" requests, the path of the object.
+	DiskPath string `json:",omitempty"`
+}
+
+// request is a request to the server.
+type request struct {
+	ID       int64
+	Command  string
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	ObjectID []byte `json:",omitempty"` // the name of OutputID before Go 1.24
+	BodySize int64  `json:",omitempty"`
+}
+
+// Options are optional settings for a [Client]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// If true, the output ID of a put is sent in the "ObjectID" field, as by
+	// Go 1.23 and earlier, instead of "OutputID".
+	OldOutputID bool
+}
+
+func (o *Options) oldOutputID() bool { return o != nil && o.OldOutputID }
+
+// Client is a client for a cache server. Its methods are safe for concurrent
+// use.
+type Client struct {
+	oldOutputID bool
+	commands    []string
+	closer      io.Closer // if non-nil, closed by Close after the close request
+
+	wmu sync.Mutex // lock to write requests
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan *Response
+	err     error // set when the connection fails or is closed
+
+	done chan struct{} // closed when the reader exits
+	wait func() error  // if non-nil, waits for the server to exit
+}
+
+// New constructs a Client that reads responses from r and writes requests to
+// w. It reads the initial message from the server before returning. If w is
+// also an [io.Closer], it is closed by [Client.Close].
+func New(r io.Reader, w io.Writer, opts *Options) (*Client, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var init Response
+	if err := dec.Decode(&init); err != nil {
+		return nil, fmt.Errorf("read server init: %w", err)
+	} else if init.ID != 0 {
+		return nil, fmt.Errorf("server init has ID %d, want 0", init.ID)
+	}
+	c := &Client{
+		oldOutputID: opts.oldOutputID(),
+		commands:    init.KnownCommands,
+		w:           bufio.NewWriter(w),
+		pending:     make(map[int64]chan *Response),
+		done:        make(chan struct{}),
+	}
+	if wc, ok := w.(io.Closer); ok {
+		c.closer = wc
+	}
+	go c.read(dec)
+	return c, nil
+}
+
+// Serve starts s in a new goroutine, and returns a Client connected to it.
+// The server runs until the Client is closed, and [Client.Close] reports the
+// error from its Run method.
+func Serve(ctx context.Context, s *gocache.Server, opts *Options) (*Client, error) {
+	reqR, reqW := io.Pipe()
+	rspR, rspW := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := s.Run(ctx, reqR, rspW)
+		reqR.CloseWithError(ErrClosed) // unblock requests to a stopped server
+		rspW.CloseWithError(cmp.Or(err, io.EOF))
+		errc <- err
+	}()
+	c, err := New(rspR, reqW, opts)
+	if err != nil {
+		reqW.Close()
+		return nil, errors.Join(err, <-errc)
+	}
+	c.wait = func() error { return <-errc }
+	return c, nil
+}
+
+// Commands reports the commands the server advertised in its initial message.
+func (c *Client) Commands() []string { return slices.Clone(c.commands) }
+
+// Get sends a "get" request for the specified action ID.
+func (c *Client) Get(ctx context.Context, actionID []byte) (*Response, error) {
+	return c.call(ctx, &request{Command: "get", ActionID: actionID}, nil)
+}
+
+// Put sends a "put" request to store body as the object for the specified
+// action and output IDs.
+func (c *Client) Put(ctx context.Context, actionID, outputID, body []byte) (*Response, error) {
+	req := &request{Command: "put", ActionID: actionID, BodySize: int64(len(body))}
+	if c.oldOutputID {
+		req.ObjectID = outputID
+	} else {
+		req.OutputID = outputID
+	}
+	return c.call(ctx, req, body)
+}
+
+// Close sends a "close" request, if the server supports it, and closes the
+// connection to the server. If the server was started by [Serve], Close
+// waits for it to exit and reports the error from its Run method.
+func (c *Client) Close(ctx context.Context) error {
+	var err error
+	if slices.Contains(c.commands, "close") {
+		_, err = c.call(ctx, &request{Command: "close"}, nil)
+	}
+	if c.closer != nil {
+		c.closer.Close()
+	}
+	if c.wait != nil {
+		<-c.done
+		err = cmp.Or(c.wait(), err)
+	}
+	c.fail(ErrClosed)
+	return err
+}
+
+// call sends req with the specified body, and waits for the response.
+func (c *Client) call(ctx context.Context, req *request, body []byte) (*Response, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	ch := make(chan *Response, 1)
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	if err := c.send(req, body); err != nil {
+		c.fail(fmt.Errorf("send request: %w", err))
+	}
+	select {
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	case rsp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		return rsp, nil
+	}
+}
+
+// send writes req and its body to the server, in the same format as the go
+// command: The request is a JSON object on one line, followed by the body as
+// a base64-encoded JSON string on another.
+func (c *Client) send(req *request, body []byte) error {
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(msg)
+	c.w.WriteByte('\n')
+	if len(body) != 0 {
+		c.w.WriteByte('"')
+		enc := base64.NewEncoder(base64.StdEncoding, c.w)
+		enc.Write(body)
+		enc.Close()
+		c.w.WriteString("\"\n")
+	}
+	return c.w.Flush()
+}
+
+// read reads responses from dec and delivers them to the pending requests,
+// until the server closes its output or sends an invalid response.
+func (c *Client) read(dec *json.Decoder) {
+	defer close(c.done)
+	for {
+		var rsp Response
+		if err := dec.Decode(&rsp); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[rsp.ID]
+		delete(c.pending, rsp.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- &rsp
+		}
+	}
+}
+
+// fail records err as the reason the client has failed, if one is not
+// already recorded, and fails all pending requests.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,76 @@
+package cacheclient_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/gocache/cachetest"
+	gocmp "github.com/google/go-cmp/cmp"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	for _, old := range []bool{false, true} {
+		s, _ := cachetest.NewServer(t)
+		c, err := cacheclient.Serve(ctx, s, &cacheclient.Options{OldOutputID: old})
+		if err != nil {
+			t.Fatalf("Serve: unexpected error: %v", err)
+		}
+		if diff := gocmp.Diff(c.Commands(), []string{"get", "put", "close"}); diff != "" {
+			t.Errorf("Commands (-got, +want):\n%s", diff)
+		}
+
+		// A get before the put is a miss.
+		if rsp, err := c.Get(ctx, []byte{1}); err != nil || !rsp.Miss {
+			t.Errorf("Get: got %+v, %v; want miss", rsp, err)
+		}
+
+		// A put returns the path of the object, and a later get finds it.
+		const content = "hello, world"
+		rsp, err := c.Put(ctx, []byte{1}, []byte{2}, []byte(content))
+		if err != nil || rsp.Err != "" {
+			t.Fatalf("Put: got %+v, %v; want success", rsp, err)
+		}
+		if data, err := os.ReadFile(rsp.DiskPath); err != nil || string(data) != content {
+			t.Errorf("Read object: got %q, %v; want %q", data, err, content)
+		}
+		rsp, err = c.Get(ctx, []byte{1})
+		if err != nil || rsp.Miss || string(rsp.OutputID) != "\x02" || rsp.Size != int64(len(content)) {
+			t.Errorf("Get: got %+v, %v; want hit", rsp, err)
+		}
+
+		if err := c.Close(ctx); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+		if _, err := c.Get(ctx, []byte{1}); !errors.Is(err, cacheclient.ErrClosed) {
+			t.Errorf("Get after close: got %v, want %v", err, cacheclient.ErrClosed)
+		}
+
+		want := "OutputID"
+		if old {
+			want = "ObjectID"
+		}
+		if got := s.ClientInfo().OutputIDField; got != want {
+			t.Errorf("OutputIDField: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerError(t *testing.T) {
+	ctx := context.Background()
+	s, _ := cachetest.NewServer(t)
+	s.ReadOnly = true
+	c, err := cacheclient.Serve(ctx, s, nil)
+	if err != nil {
+		t.Fatalf("Serve: unexpected error: %v", err)
+	}
+	defer c.Close(ctx)
+
+	// Errors from the server are reported in the response.
+	if rsp, err := c.Put(ctx, []byte{1}, []byte{2}, []byte("data")); err != nil || rsp.Err == "" {
+		t.Errorf("Put: got %+v, %v; want an error response", rsp, err)
+	}
+}
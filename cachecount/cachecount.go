@@ -0,0 +1,94 @@
+// Package cachecount implements a wrapper for a cache backend that counts the
+// requests passed through it.
+//
+// A [Cache] passes gets and puts to an underlying backend unchanged, and
+// counts them and their results. Use it to add metrics to a backend that has
+// none of its own, or to see how many requests reach one layer of a stack of
+// wrappers, for example how many gets get past a coalescing or fallback layer
+// to a remote backend.
+package cachecount
+
+import (
+	"context"
+	"expvar"
+	"os"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Cache counts the requests passed through it to a [Backend].
+type Cache struct {
+	base Backend
+	name string
+
+	gets      expvar.Int
+	getHits   expvar.Int
+	hitBytes  expvar.Int
+	getErrors expvar.Int
+	puts      expvar.Int
+	putBytes  expvar.Int
+	putErrors expvar.Int
+}
+
+// New constructs a new Cache that passes requests to base. Its metrics are
+// named with the given prefix, so that the counts for several layers can share
+// a map. If name == "", it defaults to "count".
+func New(base Backend, name string) *Cache {
+	if name == "" {
+		name = "count"
+	}
+	return &Cache{base: base, name: name}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	c.gets.Add(1)
+	outputID, diskPath, err := c.base.Get(ctx, actionID)
+	if err != nil {
+		c.getErrors.Add(1)
+	} else if outputID != "" {
+		c.getHits.Add(1)
+		if fi, err := os.Stat(diskPath); err == nil {
+			c.hitBytes.Add(fi.Size())
+		}
+	}
+	return outputID, diskPath, err
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	c.puts.Add(1)
+	diskPath, err := c.base.Put(ctx, obj)
+	if err != nil {
+		c.putErrors.Add(1)
+	} else {
+		c.putBytes.Add(obj.Size)
+	}
+	return diskPath, err
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the request counts for c to m, named with the prefix given
+// to [New]. It has the signature of the SetMetrics field of a
+// [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set(c.name+"_gets", &c.gets)
+	m.Set(c.name+"_get_hits", &c.getHits)
+	m.Set(c.name+"_get_hit_bytes", &c.hitBytes)
+	m.Set(c.name+"_get_errors", &c.getErrors)
+	m.Set(c.name+"_puts", &c.puts)
+	m.Set(c.name+"_put_bytes", &c.putBytes)
+	m.Set(c.name+"_put_errors", &c.putErrors)
+}
@@ -0,0 +1,79 @@
+package cachecount_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachecount"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// failBackend is a backend whose requests fail.
+type failBackend struct{}
+
+func (failBackend) Get(context.Context, string) (string, string, error) {
+	return "", "", errors.New("get failed")
+}
+
+func (failBackend) Put(context.Context, gocache.Object) (string, error) {
+	return "", errors.New("put failed")
+}
+
+func checkMetrics(t *testing.T, c *cachecount.Cache, want map[string]string) {
+	t.Helper()
+	m := new(expvar.Map)
+	c.SetMetrics(context.Background(), m)
+	for name, w := range want {
+		if v := m.Get(name); v == nil || v.String() != w {
+			t.Errorf("Metric %s: got %v, want %s", name, v, w)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	c := cachecount.New(d, "")
+
+	const content = "hello"
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2",
+		OutputID: "c3d4",
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if oid, _, err := c.Get(ctx, "a1b2"); err != nil || oid != "c3d4" {
+		t.Errorf("Get a1b2: got %q, %v; want c3d4, nil", oid, err)
+	}
+	if oid, _, err := c.Get(ctx, "e5f6"); err != nil || oid != "" {
+		t.Errorf("Get e5f6: got %q, %v; want a miss", oid, err)
+	}
+	checkMetrics(t, c, map[string]string{
+		"count_gets": "2", "count_get_hits": "1", "count_get_hit_bytes": "5", "count_get_errors": "0",
+		"count_puts": "1", "count_put_bytes": "5", "count_put_errors": "0",
+	})
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	c := cachecount.New(failBackend{}, "remote")
+	if _, _, err := c.Get(ctx, "a1b2"); err == nil {
+		t.Error("Get: got nil, want error")
+	}
+	if _, err := c.Put(ctx, gocache.Object{ActionID: "a1b2", OutputID: "c3d4"}); err == nil {
+		t.Error("Put: got nil, want error")
+	}
+	checkMetrics(t, c, map[string]string{
+		"remote_gets": "1", "remote_get_hits": "0", "remote_get_errors": "1",
+		"remote_puts": "1", "remote_put_bytes": "0", "remote_put_errors": "1",
+	})
+}
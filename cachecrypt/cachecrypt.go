@@ -0,0 +1,279 @@
+// Package cachecrypt implements a wrapper for a cache backend that encrypts
+// cached objects at rest.
+//
+// A [Cache] encrypts each object with AES-256-GCM before passing it to the
+// underlying backend for storage, and decrypts objects fetched from the
+// backend into a local directory before reporting them to the toolchain.
+// Optionally, it can also conceal action and output IDs from the backend, by
+// replacing them with keyed hashes.
+//
+// # Object Format
+//
+// Each object stored in the backend has the format:
+//
+//	nonce || seal(len(outputID) || outputID || body)
+//
+// where nonce is a random 12-byte GCM nonce, seal is AES-256-GCM encryption,
+// len is a single byte, and outputID is the original hex output ID. The
+// output ID is included so that it can be recovered (and checked) when the
+// backend does not store it in plaintext.
+//
+// The action and output IDs given to the backend are authenticated as the
+// additional data of the seal, so an object that the backend reports for a
+// different action, or under a different output ID, cannot be opened and is
+// treated as a miss.
+//
+// # Limitations
+//
+// Objects are encrypted and decrypted in memory, so a Cache must be able to
+// hold a complete object and its ciphertext at once.
+//
+// The decrypted objects in the local directory are not pruned by the Cache.
+// It is safe for the caller to remove them at any time the cache is not
+// running.
+package cachecrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/gocache"
+)
+
+// MinKeyLen is the minimum length in bytes of a key accepted by [New].
+const MinKeyLen = 16
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// If true, action and output IDs are replaced by keyed hashes before they
+	// are passed to the backend, so that the backend does not see the IDs
+	// assigned by the toolchain.
+	HideIDs bool
+}
+
+func (o *Options) hideIDs() bool { return o != nil && o.HideIDs }
+
+// Cache implements an encrypting wrapper around a [Backend].
+type Cache struct {
+	base  Backend
+	dir   string
+	aead  cipher.AEAD
+	idKey []byte // if nil, IDs are passed through unmodified
+}
+
+// New constructs a new Cache that encrypts objects with key before storing
+// them in base. Decrypted objects are written under dir, which is created if
+// it does not exist. The key must be at least [MinKeyLen] bytes long.
+func New(base Backend, dir string, key []byte, opts *Options) (*Cache, error) {
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("key is too short (%d < %d bytes)", len(key), MinKeyLen)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	blk, err := aes.NewCipher(deriveKey(key, "gocache/cachecrypt object"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{base: base, dir: dir, aead: aead}
+	if opts.hideIDs() {
+		c.idKey = deriveKey(key, "gocache/cachecrypt id")
+	}
+	return c, nil
+}
+
+// KeyFromEnv returns the key stored in the named environment variable.
+// It reports an error if the variable is unset or empty.
+func KeyFromEnv(name string) ([]byte, error) {
+	key := strings.TrimSpace(os.Getenv(name))
+	if key == "" {
+		return nil, fmt.Errorf("no key found in $%s", name)
+	}
+	return []byte(key), nil
+}
+
+// KeyFromFile returns the key stored in the specified file. Leading and
+// trailing whitespace is removed. It reports an error if the file is empty.
+func KeyFromFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no key found in %q", path)
+	}
+	return key, nil
+}
+
+// Get implements the corresponding method of the gocache service interface.
+//
+// If an object fetched from the backend cannot be decrypted, or does not
+// match the output ID reported by the backend, Get reports a cache miss.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	mappedID := c.mapID("action", actionID)
+	storedID, storedPath, err := c.base.Get(ctx, mappedID)
+	if err != nil || storedPath == "" {
+		return "", "", err
+	}
+	data, err := os.ReadFile(storedPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil // cache miss
+	} else if err != nil {
+		return "", "", err
+	}
+	outputID, body, err := c.open(additionalData(mappedID, storedID), data)
+	if err != nil {
+		gocache.Logf(ctx, "decrypt action %s: %v (treating as miss)", actionID, err)
+		return "", "", nil
+	} else if c.mapID("output", outputID) != storedID {
+		gocache.Logf(ctx, "decrypt action %s: output ID mismatch (treating as miss)", actionID)
+		return "", "", nil
+	}
+
+	diskPath, err = c.writeLocal(outputID, body)
+	if err != nil {
+		return "", "", err
+	}
+	return outputID, diskPath, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	if len(obj.OutputID) > 255 {
+		return "", errors.New("output ID is too long")
+	}
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", err
+	} else if int64(len(body)) != obj.Size {
+		return "", fmt.Errorf("object size is %d bytes, want %d", len(body), obj.Size)
+	}
+
+	diskPath, err = c.writeLocal(obj.OutputID, body)
+	if err != nil {
+		return "", err
+	}
+	mappedAction, mappedOutput := c.mapID("action", obj.ActionID), c.mapID("output", obj.OutputID)
+	data, err := c.seal(additionalData(mappedAction, mappedOutput), obj.OutputID, body)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.base.Put(ctx, gocache.Object{
+		ActionID: mappedAction,
+		OutputID: mappedOutput,
+		Size:     int64(len(data)),
+		Body:     bytes.NewReader(data),
+		ModTime:  obj.ModTime,
+	}); err != nil {
+		return "", err
+	}
+	return diskPath, nil
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// seal returns the encrypted storage format for the given object, with ad as
+// the additional authenticated data.
+func (c *Cache) seal(ad []byte, outputID string, body []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	plain := make([]byte, 0, 1+len(outputID)+len(body))
+	plain = append(plain, byte(len(outputID)))
+	plain = append(plain, outputID...)
+	plain = append(plain, body...)
+
+	buf := make([]byte, ns, ns+len(plain)+c.aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(buf, buf, plain, ad), nil
+}
+
+// open decrypts data in the format written by seal, with the same additional
+// data ad.
+func (c *Cache) open(ad, data []byte) (outputID string, body []byte, _ error) {
+	ns := c.aead.NonceSize()
+	if len(data) < ns {
+		return "", nil, errors.New("invalid object: too short")
+	}
+	plain, err := c.aead.Open(nil, data[:ns], data[ns:], ad)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(plain) == 0 || int(plain[0]) > len(plain)-1 {
+		return "", nil, errors.New("invalid object: malformed header")
+	}
+	n := int(plain[0])
+	return string(plain[1 : 1+n]), plain[1+n:], nil
+}
+
+// additionalData returns the additional data sealed with an object stored in
+// the backend under the given action and output IDs. The IDs are hex or keyed
+// hashes, so they cannot contain the separator.
+func additionalData(actionID, outputID string) []byte {
+	return []byte(actionID + ":" + outputID)
+}
+
+// mapID returns the ID to use in the backend for the given ID of the
+// specified kind.
+func (c *Cache) mapID(kind, id string) string {
+	if c.idKey == nil {
+		return id
+	}
+	h := hmac.New(sha256.New, c.idKey)
+	io.WriteString(h, kind+":"+id)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeLocal writes the decrypted body of the specified object to the local
+// directory, if it is not already present, and returns its path.
+func (c *Cache) writeLocal(outputID string, body []byte) (string, error) {
+	if len(outputID) < 2 {
+		return "", fmt.Errorf("invalid output ID %q", outputID)
+	}
+	path := filepath.Join(c.dir, outputID[:2], outputID)
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode().IsRegular() && fi.Size() == int64(len(body)) {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, atomicfile.WriteData(path, body, 0644)
+}
+
+// deriveKey derives a 32-byte subkey from key for the specified purpose.
+func deriveKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, purpose)
+	return h.Sum(nil)
+}
@@ -0,0 +1,155 @@
+package cachecrypt_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachecrypt"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+func TestCache(t *testing.T) {
+	const (
+		actionID = "a1b2c3d4"
+		outputID = "0b1ec7ed"
+		content  = "the quick brown fox jumps over the lazy dog"
+	)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, hide := range []bool{false, true} {
+		name := map[bool]string{false: "PlainIDs", true: "HideIDs"}[hide]
+		t.Run(name, func(t *testing.T) {
+			storeDir := t.TempDir()
+			base, err := cachedir.New(storeDir)
+			if err != nil {
+				t.Fatalf("cachedir.New: unexpected error: %v", err)
+			}
+			opts := &cachecrypt.Options{HideIDs: hide}
+			c, err := cachecrypt.New(base, t.TempDir(), key, opts)
+			if err != nil {
+				t.Fatalf("New: unexpected error: %v", err)
+			}
+			ctx := context.Background()
+
+			diskPath, err := c.Put(ctx, gocache.Object{
+				ActionID: actionID,
+				OutputID: outputID,
+				Size:     int64(len(content)),
+				Body:     strings.NewReader(content),
+			})
+			if err != nil {
+				t.Fatalf("Put: unexpected error: %v", err)
+			}
+			if got, err := os.ReadFile(diskPath); err != nil {
+				t.Errorf("Read put object: %v", err)
+			} else if string(got) != content {
+				t.Errorf("Put object: got %q, want %q", got, content)
+			}
+
+			// Verify that nothing in the backend store contains the plaintext,
+			// and that IDs are hidden if requested.
+			if err := filepath.WalkDir(storeDir, func(path string, de fs.DirEntry, err error) error {
+				if err != nil || !de.Type().IsRegular() {
+					return err
+				}
+				if hide && (strings.Contains(path, actionID) || strings.Contains(path, outputID)) {
+					t.Errorf("Stored path %q contains an unhidden ID", path)
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				if bytes.Contains(data, []byte(content)) {
+					t.Errorf("Stored file %q contains plaintext", path)
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("Scan store: %v", err)
+			}
+
+			// Fetching the object should recover the original ID and content.
+			gotID, gotPath, err := c.Get(ctx, actionID)
+			if err != nil {
+				t.Fatalf("Get: unexpected error: %v", err)
+			} else if gotID != outputID {
+				t.Errorf("Get: got output ID %q, want %q", gotID, outputID)
+			}
+			if got, err := os.ReadFile(gotPath); err != nil {
+				t.Errorf("Read get object: %v", err)
+			} else if string(got) != content {
+				t.Errorf("Get object: got %q, want %q", got, content)
+			}
+
+			// A cache with a different key should not be able to read the object.
+			other, err := cachecrypt.New(base, t.TempDir(), []byte("fedcba9876543210fedcba9876543210"), opts)
+			if err != nil {
+				t.Fatalf("New: unexpected error: %v", err)
+			}
+			if id, path, err := other.Get(ctx, actionID); id != "" || path != "" || err != nil {
+				t.Errorf(`Get with wrong key: got %q, %q, %v; want "", "", nil`, id, path, err)
+			}
+		})
+	}
+}
+
+func TestMovedObject(t *testing.T) {
+	const content = "the quick brown fox jumps over the lazy dog"
+	base, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+	c, err := cachecrypt.New(base, t.TempDir(), []byte("0123456789abcdef0123456789abcdef"), nil)
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2",
+		OutputID: "0b1ec7ed",
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// Store the sealed object in the backend for another action. The seal
+	// covers the action ID, so the cache should not report it.
+	_, path, err := base.Get(ctx, "a1b2")
+	if err != nil {
+		t.Fatalf("Get stored object: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read stored object: %v", err)
+	}
+	if _, err := base.Put(ctx, gocache.Object{
+		ActionID: "c3d4",
+		OutputID: "0b1ec7ed",
+		Size:     int64(len(data)),
+		Body:     bytes.NewReader(data),
+	}); err != nil {
+		t.Fatalf("Put moved object: %v", err)
+	}
+	if id, path, err := c.Get(ctx, "c3d4"); id != "" || path != "" || err != nil {
+		t.Errorf(`Get moved object: got %q, %q, %v; want "", "", nil`, id, path, err)
+	}
+	if id, _, err := c.Get(ctx, "a1b2"); id != "0b1ec7ed" || err != nil {
+		t.Errorf("Get original object: got %q, %v; want 0b1ec7ed, nil", id, err)
+	}
+}
+
+func TestShortKey(t *testing.T) {
+	base, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+	if c, err := cachecrypt.New(base, t.TempDir(), []byte("short"), nil); err == nil {
+		t.Errorf("New: got %v, want error", c)
+	}
+}
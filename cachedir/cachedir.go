@@ -9,16 +9,85 @@
 //
 //	01/01234567
 //
+// The number of levels of partitioning and the number of digits per level can
+// be set via [Options]. For example, with two levels of two digits each,
+// "01234567" is stored as:
+//
+//	01/23/01234567
+//
+// When a non-default layout is used, entries stored in the default layout are
+// moved to the new layout when they are first accessed.
+//
+// If a fast directory is set in [Options], small objects are stored in an
+// "output" subdirectory of the fast directory instead, using the same layout.
+// Objects found in the wrong directory for their size, e.g., because the size
+// limit changed, are moved when they are first accessed.
+//
 // Each action file contains a single line of text giving the current object ID
 // for that action, and the size of the object in bytes, separated by a space:
 //
 //	0123abcd 25
 //
 // The modification timestamp of the action file is updated whenever the action
-// is written, i.e., when a new object ID is sent for that action.
+// is written, i.e., when a new object ID is sent for that action. If a touch
+// interval is set in [Options], it is also updated when the action is read,
+// if it was last updated longer ago than that interval.
 //
 // Object files contain only the literal contents of the object.
 //
+// # Concurrency
+//
+// Several processes may share a cache directory, for example when several
+// builds run at once on a developer machine. Action and object files are
+// written to a temporary file and renamed into place, so readers never see a
+// partial file, and concurrent writes of the same entry leave one complete
+// version.
+//
+// Pruning uses a lock file named "prune.lock" in the cache directory, so that
+// only one process prunes the cache at a time. Another process that wants to
+// prune while the lock is held skips pruning. A lock left behind by a process
+// that crashed is broken after an hour.
+//
+// Pruning removes objects that are not referenced by any remaining action.
+// To avoid removing an object that a concurrent Put has just written or
+// reused, Put holds a shared advisory lock on a file named "write.lock" in
+// the cache directory, and pruning holds an exclusive lock on it. Puts by
+// other processes therefore wait while the cache is pruned. Advisory locks
+// are supported only on Unix systems, and only with the local filesystem
+// (see [FS]); otherwise a concurrent Put may rarely lose its object, which is
+// then reported as a cache miss.
+//
+// Pruning may still remove an object after Get has reported its path, but
+// before the toolchain has read it. To prevent this, use the SessionDir or
+// PinObjects options.
+//
+// # Totals
+//
+// A Dir keeps running totals of the numbers of actions and objects in the
+// cache, and the size of the objects, so that [Dir.Totals] can report them
+// without scanning the cache. They are stored in a subdirectory named
+// "totals": A file named "base" holds the totals as of the last time they
+// were reconciled, and each process that writes to the cache appends the
+// changes it makes to a "delta-*" file of its own. Pruning reconciles the
+// totals with the contents of the cache, and Totals folds the delta files
+// into the base file. If the base file is missing, Totals rebuilds it by
+// scanning the cache.
+//
+// Changes made to the cache by other means, e.g., removing files by hand, are
+// not reflected in the totals until the cache is next pruned. Without
+// advisory locks (see above), the totals may drift slightly when processes
+// write and prune the cache concurrently.
+//
+// # Windows
+//
+// On Windows, a file cannot be renamed over or removed while another process
+// has it open without delete sharing, which antivirus scanners, indexers, and
+// the go command itself commonly do. Renames and removals that fail for this
+// reason are retried for a short time before the error is reported. Paths are
+// made absolute when the Dir is created, so that the os package can use
+// extended-length paths for caches deeper than the traditional 260-character
+// limit.
+//
 // # Important Note
 //
 // The cache directory and its contents must be readable by the user running
@@ -29,38 +98,383 @@
 package cachedir
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/creachadair/atomicfile"
 	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/snapshot"
 	"github.com/creachadair/mds/mapset"
 )
 
 // Dir implements a file cache using a local directory.
 type Dir struct {
-	path string
+	path    string
+	session string // if non-empty, the session directory
+	scratch string // if non-empty, the scratch directory
+	shared  bool   // shared filesystem mode
+	sync    Durability
+	hooks   Hooks
+	policy  PrunePolicy
+	depth   int // number of shard directory levels
+	width   int // number of ID digits per shard level
+	workers int // number of concurrent prune workers
+	touch   time.Duration
+	fast    string        // if non-empty, the directory for small objects
+	fastMax int64         // the maximum size of an object stored in fast
+	clock   gocache.Clock // if nil, use the system clock
+	fsys    FS            // the filesystem holding the cache
+	local   bool          // fsys is the local filesystem
+
+	pinMu   sync.Mutex
+	pinFile File               // if non-nil, the pin file for this Dir
+	pinned  mapset.Set[string] // output IDs recorded in pinFile
+
+	totMu   sync.Mutex
+	totFile File // if non-nil, the totals delta file for this Dir
+}
+
+// Options are optional settings for a [Dir]. A nil *Options is ready for use
+// and provides default values as described.
+type Options struct {
+	// If non-empty, Get places each object it reports into a new subdirectory
+	// of SessionDir unique to this Dir, and returns that path instead of the
+	// path of the object in the cache. This prevents concurrent pruning from
+	// removing objects the toolchain has not yet read.
+	//
+	// Objects are cloned (where the filesystem supports it), hard-linked, or
+	// copied, in that order of preference. The session subdirectory is removed
+	// by the function returned by [Dir.Cleanup].
+	SessionDir string
+
+	// If non-empty, Get places a copy of each object it reports in
+	// ScratchDir, and returns that path instead of the path of the object in
+	// the cache. This allows the cache to be stored on slow storage, while
+	// builds read objects from fast local storage, such as a tmpfs. Copies
+	// are made as for SessionDir, and are reused by later calls to Get, even
+	// by other processes. [Dir.PruneEntries] removes the copies of objects
+	// that it prunes from the cache.
+	ScratchDir string
+
+	// If true, the cache directory is assumed to be on a filesystem shared
+	// with other hosts, such as NFS. See also [IsNetworkFS]. In this mode, the
+	// Dir syncs each file to stable storage before it makes the file visible.
+	// It also checks the size of each object after writing it.
+	//
+	// SharedFS does not change how the Dir locks the cache (see "Concurrency"
+	// in the package docs). The prune lock file is created exclusively, which
+	// NFSv3 and later do atomically, so it also keeps other hosts from
+	// pruning. The write lock is an advisory lock. Linux NFS clients pass it
+	// to the server, but other systems may hold it only on the local host. In
+	// that case, a Put on another host may rarely lose its object to pruning,
+	// and the object is then reported as a cache miss.
+	SharedFS bool
+
+	// Durability specifies how files are written to stable storage. If
+	// SharedFS is true, files are always synced, as for DurabilitySync.
+	// The default is DurabilityNone.
+	Durability Durability
+
+	// Hooks are optional callbacks invoked when the contents of the cache
+	// change.
+	Hooks Hooks
+
+	// If non-nil, PrunePolicy is used by [Dir.PruneEntries] to choose which
+	// actions to remove, instead of removing all the expired actions.
+	PrunePolicy PrunePolicy
+
+	// ShardDepth is the number of levels of subdirectories used to partition
+	// cache entries by ID prefix. If zero, it defaults to 1.
+	ShardDepth int
+
+	// ShardWidth is the number of ID digits used for each level of shard
+	// subdirectories. If zero, it defaults to 2.
+	ShardWidth int
+
+	// If non-empty, objects no larger than FastMaxSize are stored under
+	// FastDir instead of the cache directory. This allows a small, fast
+	// device to hold the many small objects a build reads, while larger
+	// objects go to bigger, slower storage. Actions are always stored in the
+	// cache directory.
+	FastDir string
+
+	// FastMaxSize is the maximum size in bytes of an object stored in
+	// FastDir. If zero, it defaults to 1MiB.
+	FastMaxSize int64
+
+	// If positive, Get updates the modification time of each action it reads,
+	// if the action was last modified longer ago than TouchInterval. This
+	// makes pruning by age evict the least recently used actions rather than
+	// the least recently written. If zero, actions are touched only when
+	// written.
+	TouchInterval time.Duration
+
+	// PruneConcurrency is the maximum number of entries [Dir.PruneEntries]
+	// will process concurrently. If zero, it defaults to [runtime.NumCPU].
+	PruneConcurrency int
+
+	// If true, Get pins each object it reports, so that [Dir.PruneEntries]
+	// does not remove it until the pins are released by the function
+	// returned by [Dir.Cleanup]. Pins are recorded in files in the cache
+	// directory, so they are honored by other processes sharing the cache.
+	// Unlike SessionDir, this does not require a copy of each object.
+	//
+	// The pins of a process that exits without cleaning up are discarded
+	// once they have not been updated for a day.
+	PinObjects bool
+
+	// Clock, if non-nil, is used instead of the system clock to find the ages
+	// of entries, pins, and prune locks, and to time pruning. Actions written
+	// by Put are stamped with its time, so that tests can expire entries by
+	// advancing the clock rather than sleeping or setting file times.
+	Clock gocache.Clock
+
+	// FS is the filesystem in which the cache is stored. If nil, it defaults
+	// to [OSFS]. See [FS] for the features that require the local filesystem.
+	FS FS
+}
+
+func (o *Options) sessionDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.SessionDir
+}
+
+func (o *Options) scratchDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.ScratchDir
+}
+
+func (o *Options) sharedFS() bool { return o != nil && o.SharedFS }
+
+func (o *Options) durability() Durability {
+	if o == nil {
+		return DurabilityNone
+	} else if o.SharedFS {
+		return max(o.Durability, DurabilitySync)
+	}
+	return o.Durability
+}
+
+func (o *Options) hooks() Hooks {
+	if o == nil {
+		return Hooks{}
+	}
+	return o.Hooks
+}
+
+func (o *Options) prunePolicy() PrunePolicy {
+	if o == nil {
+		return nil
+	}
+	return o.PrunePolicy
+}
+
+func (o *Options) shardDepth() int {
+	if o == nil || o.ShardDepth <= 0 {
+		return 1
+	}
+	return o.ShardDepth
+}
+
+func (o *Options) shardWidth() int {
+	if o == nil || o.ShardWidth <= 0 {
+		return 2
+	}
+	return o.ShardWidth
+}
+
+func (o *Options) fastDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.FastDir
+}
+
+func (o *Options) fastMaxSize() int64 {
+	if o == nil || o.FastMaxSize <= 0 {
+		return 1 << 20
+	}
+	return o.FastMaxSize
+}
+
+func (o *Options) touchInterval() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.TouchInterval
+}
+
+func (o *Options) pinObjects() bool { return o != nil && o.PinObjects }
+
+func (o *Options) clock() gocache.Clock {
+	if o == nil {
+		return nil
+	}
+	return o.Clock
+}
+
+func (o *Options) fileSystem() FS {
+	if o == nil || o.FS == nil {
+		return OSFS
+	}
+	return o.FS
+}
+
+func (o *Options) pruneConcurrency() int {
+	if o == nil || o.PruneConcurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.PruneConcurrency
+}
+
+// Durability specifies how a [Dir] ensures that the files it writes survive
+// a crash or power loss. Stronger settings make writes slower.
+type Durability int
+
+const (
+	// DurabilityNone leaves it to the operating system to write files to
+	// stable storage. After a power loss, recently written objects may be
+	// empty or incomplete; Get treats these as misses.
+	DurabilityNone Durability = iota
+
+	// DurabilitySync syncs each file to stable storage before renaming it
+	// into place, so that a file that is visible is also complete.
+	DurabilitySync
+
+	// DurabilitySyncDir syncs each file as for DurabilitySync, and also syncs
+	// the directory containing it after the rename, so that the new
+	// directory entry is also on stable storage.
+	DurabilitySyncDir
+)
+
+// Hooks are optional callbacks invoked by a [Dir] when the contents of the
+// cache change. A nil hook is skipped. Hooks are called synchronously, and
+// may be called concurrently from multiple goroutines.
+type Hooks struct {
+	// ObjectStored is called after each successful Put, with the action ID,
+	// and the output ID and size in bytes of the object stored for it.
+	ObjectStored func(actionID, outputID string, size int64)
+
+	// ObjectEvicted is called after an object is removed from the cache by
+	// pruning, with its output ID and size in bytes.
+	ObjectEvicted func(outputID string, size int64)
+
+	// ActionExpired is called after an action is removed from the cache by
+	// pruning, with its action ID and the output ID it referred to.
+	ActionExpired func(actionID, outputID string)
 }
 
 // New constructs a new file cache using the specified directory.  If path does
 // not exist, it is created.
-func New(path string) (*Dir, error) {
-	if err := os.MkdirAll(path, 0755); err != nil {
+func New(path string) (*Dir, error) { return NewWithOptions(path, nil) }
+
+// NewWithOptions constructs a new file cache using the specified directory and
+// options, as [New]. A nil *Options provides default values.
+func NewWithOptions(path string, opts *Options) (*Dir, error) {
+	depth, width := opts.shardDepth(), opts.shardWidth()
+	if depth > 4 || width > 4 {
+		return nil, fmt.Errorf("invalid shard layout (depth %d, width %d)", depth, width)
+	}
+	fsys := opts.fileSystem()
+	_, local := fsys.(osFS)
+	abs := filepath.Abs
+	if !local {
+		abs = func(path string) (string, error) { return filepath.Clean(path), nil }
+	}
+	path, err := abs(path)
+	if err != nil {
 		return nil, err
 	}
-	return &Dir{path: path}, nil
+	if err := fsys.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	d := &Dir{
+		path:    path,
+		shared:  opts.sharedFS(),
+		sync:    opts.durability(),
+		hooks:   opts.hooks(),
+		policy:  opts.prunePolicy(),
+		depth:   depth,
+		width:   width,
+		workers: opts.pruneConcurrency(),
+		touch:   opts.touchInterval(),
+		clock:   opts.clock(),
+		fsys:    fsys,
+		local:   local,
+	}
+	if fd := opts.fastDir(); fd != "" {
+		fd, err := abs(fd)
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.MkdirAll(fd, 0755); err != nil {
+			return nil, err
+		}
+		d.fast, d.fastMax = fd, opts.fastMaxSize()
+	}
+	if sd := opts.scratchDir(); sd != "" {
+		sd, err := abs(sd)
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.MkdirAll(sd, 0755); err != nil {
+			return nil, err
+		}
+		d.scratch = sd
+	}
+	if sd := opts.sessionDir(); sd != "" {
+		if err := fsys.MkdirAll(sd, 0755); err != nil {
+			return nil, err
+		}
+		session, err := fsys.MkdirTemp(sd, "session-*")
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.Chmod(session, 0755); err != nil {
+			fsys.Remove(session)
+			return nil, err
+		}
+		d.session = session
+	}
+	if opts.pinObjects() {
+		pd := filepath.Join(path, "pins")
+		if err := fsys.MkdirAll(pd, 0755); err != nil {
+			return nil, err
+		}
+		f, err := fsys.CreateTemp(pd, "pin-*")
+		if err != nil {
+			return nil, err
+		}
+		d.pinFile = f
+	}
+	return d, nil
 }
 
 // Get implements the corresponding method of the gocache service interface.
 func (d *Dir) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
 	outputID, sz, err := d.readAction(actionID)
+	if errors.Is(err, os.ErrNotExist) && d.migrate("action", actionID) {
+		outputID, sz, err = d.readAction(actionID)
+	}
 	if errors.Is(err, os.ErrNotExist) {
 		return "", "", nil // cache miss
 	} else if err != nil {
@@ -69,31 +483,210 @@ func (d *Dir) Get(ctx context.Context, actionID string) (outputID, diskPath stri
 
 	// Verify that the output for this action is present and matches the
 	// expected size, or else treat it as a miss.
-	diskPath = d.outputPath(outputID)
-	if fi, err := os.Stat(diskPath); err != nil || fi.Size() != sz {
+	diskPath, fi, err := d.findOutput(outputID, sz)
+	if err != nil {
+		return "", "", nil // cache miss
+	} else if fi.Size() != sz {
+		gocache.SetMissReason(ctx, gocache.MissSizeMismatch)
 		return "", "", nil // cache miss
 	}
+	if err := d.Touch(actionID, outputID); err != nil {
+		return "", "", err
+	}
+	if d.scratch != "" {
+		diskPath, err = d.placeCopy(d.scratch, outputID, diskPath, sz)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if d.session != "" {
+		diskPath, err = d.placeCopy(d.session, outputID, diskPath, sz)
+		if err != nil {
+			return "", "", err
+		}
+	}
 	return outputID, diskPath, nil
 }
 
+// Touch records an access to the result for actionID, with the given output
+// ID, as Get does for a hit, but without reading the result: the action's
+// access time is updated, and the object is pinned, if those are enabled.
+// It is for a caller that answers gets from its own copy of recent results,
+// such as the HotCacheSize cache of a [gocache.Server].
+func (d *Dir) Touch(actionID, outputID string) error {
+	if d.touch > 0 {
+		d.touchAction(actionID)
+	}
+	if d.pinFile != nil {
+		return d.pin(outputID)
+	}
+	return nil
+}
+
+// Lookup reports the output ID, object path, and size of the result stored
+// in d for actionID, as Get does, but without recording the access: the
+// action is not touched or pinned, and the object is not copied. If d does
+// not have a complete result for the action, Lookup returns "", "", 0, nil.
+// This is for tools that inspect or publish the cache, so that they do not
+// keep results alive.
+func (d *Dir) Lookup(actionID string) (outputID, diskPath string, size int64, _ error) {
+	outputID, size, err := d.readAction(actionID)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", 0, nil
+	} else if err != nil {
+		return "", "", 0, err
+	}
+	diskPath, fi, err := d.statOutput(outputID)
+	if err != nil || fi.Size() != size {
+		return "", "", 0, nil
+	}
+	return outputID, diskPath, size, nil
+}
+
 // Put implements the corresponding method of the gocache service interface.
 func (d *Dir) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
-	path, size, err := d.writeObject(obj)
+	unlock, err := d.lockWrites(false)
+	if err != nil {
+		return "", fmt.Errorf("lock cache: %w", err)
+	}
+	defer unlock()
+
+	path, size, otot, err := d.writeObject(obj)
+	if err != nil {
+		return "", err
+	}
+	atot, err := d.writeAction(obj.ActionID, obj.OutputID, size)
 	if err != nil {
 		return "", err
 	}
-	return path, d.writeAction(obj.ActionID, obj.OutputID, size)
+	d.recordTotals(otot.add(atot))
+	if f := d.hooks.ObjectStored; f != nil {
+		f(obj.ActionID, obj.OutputID, size)
+	}
+	return path, nil
+}
+
+// Snapshot writes the contents of d to w in the format defined by package
+// [snapshot]. Actions whose objects are missing or incomplete are skipped.
+func (d *Dir) Snapshot(w io.Writer) error {
+	var actions []ScanEntry
+	for e, err := range d.scan(context.Background(), "action") {
+		if err != nil {
+			return err
+		} else if e.ID != "" {
+			actions = append(actions, e)
+		}
+	}
+	slices.SortFunc(actions, func(a, b ScanEntry) int { return cmp.Compare(a.ID, b.ID) })
+
+	sw, err := snapshot.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, e := range actions {
+		outputID, size, err := d.readActionFile(e.ID, e.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed since it was listed
+		} else if err != nil {
+			return err
+		}
+		path, fi, err := d.findOutput(outputID, size)
+		if err != nil || fi.Size() != size {
+			continue
+		}
+		if err := d.snapshotEntry(sw, snapshot.Entry{
+			ActionID: e.ID,
+			OutputID: outputID,
+			Size:     size,
+			ModTime:  e.ModTime.UTC(),
+		}, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dir) snapshotEntry(sw *snapshot.Writer, e snapshot.Entry, path string) error {
+	f, err := d.fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sw.Add(e, f)
+}
+
+// Restore adds the contents of the snapshot read from r to d. Existing
+// entries for the same actions are replaced. Restored actions keep the
+// modification times recorded in the snapshot, so they expire as they would
+// have in the original cache.
+//
+// If an object does not match its output ID (see [snapshot.Reader.Next]),
+// Restore stops and reports [snapshot.ErrDigestMismatch]. The object is not
+// stored, but the entries restored before it are kept.
+func (d *Dir) Restore(r io.Reader) error { return d.restore(r, false) }
+
+// RestoreMissing is as [Dir.Restore], but adds only the entries for actions
+// that d does not already have, e.g., to warm up a cache from an archive
+// without replacing newer results.
+func (d *Dir) RestoreMissing(r io.Reader) error { return d.restore(r, true) }
+
+func (d *Dir) restore(r io.Reader, missingOnly bool) error {
+	sr, err := snapshot.NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		e, body, err := sr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if missingOnly {
+			if outputID, sz, err := d.readAction(e.ActionID); err == nil {
+				if _, fi, err := d.findOutput(outputID, sz); err == nil && fi.Size() == sz {
+					continue // already present
+				}
+			}
+		}
+		if _, err := d.Put(context.Background(), gocache.Object{
+			ActionID: e.ActionID,
+			OutputID: e.OutputID,
+			Size:     e.Size,
+			Body:     body,
+			ModTime:  e.ModTime,
+		}); err != nil {
+			return fmt.Errorf("restore %s: %w", e.ActionID, err)
+		}
+		if !e.ModTime.IsZero() {
+			d.fsys.Chtimes(d.actionPath(e.ActionID), time.Time{} /* atime: ignore */, e.ModTime) // best-effort
+		}
+	}
 }
 
 // Cleanup returns a function implementing the Close method of the gocache
 // service interface.  The function prunes from the cache any actions that have
-// not been modified within the specified age before present.
-// If age ≤ 0, Cleanup returns nil.
+// not been modified within the specified age before present, and removes the
+// session directory, if there is one.
+// If age ≤ 0 and d has no session directory, Cleanup returns nil.
 func (d *Dir) Cleanup(age time.Duration) func(context.Context) error {
-	if age <= 0 {
+	if age <= 0 && d.session == "" && d.pinFile == nil {
 		return nil
 	}
 	return func(ctx context.Context) error {
+		if d.session != "" {
+			if err := d.fsys.RemoveAll(d.session); err != nil {
+				gocache.Logf(ctx, "remove session directory: %v (ignored)", err)
+			}
+		}
+		if d.pinFile != nil {
+			if err := d.unpin(); err != nil {
+				gocache.Logf(ctx, "remove pin file: %v (ignored)", err)
+			}
+		}
+		if age <= 0 {
+			return nil
+		}
 		gocache.Logf(ctx, "begin cache cleanup (age: %v)", age)
 		stats, err := d.PruneEntries(ctx, age)
 		if err != nil {
@@ -104,6 +697,56 @@ func (d *Dir) Cleanup(age time.Duration) func(context.Context) error {
 	}
 }
 
+// Usage reports how the objects in a Dir are shared among its actions.
+type Usage struct {
+	Actions     int   // the number of actions cached
+	Objects     int   // the number of distinct objects referenced by actions
+	ActionBytes int64 // the total size of the object of each action
+	ObjectBytes int64 // the total size of the distinct objects
+}
+
+// DedupRatio reports the ratio of ActionBytes to ObjectBytes, that is, how
+// many times larger the cache would be if actions did not share objects. It
+// returns 1 if the cache has no objects.
+func (u Usage) DedupRatio() float64 {
+	if u.ObjectBytes == 0 {
+		return 1
+	}
+	return float64(u.ActionBytes) / float64(u.ObjectBytes)
+}
+
+// Usage reports how the objects in d are shared among its actions. Sizes are
+// as recorded by the actions; the object files are not checked.
+func (d *Dir) Usage(ctx context.Context) (Usage, error) {
+	var mu sync.Mutex
+	var u Usage
+	objects := make(map[string]int64) // output ID → size
+	if err := d.forEach(ctx, "action", func(e ScanEntry) error {
+		if e.ID == "" {
+			return nil // a temporary file
+		}
+		outputID, size, err := d.readActionFile(e.ID, e.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // removed since it was listed
+		} else if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		u.Actions++
+		u.ActionBytes += size
+		objects[outputID] = size
+		return nil
+	}); err != nil {
+		return Usage{}, err
+	}
+	for _, size := range objects {
+		u.Objects++
+		u.ObjectBytes += size
+	}
+	return u, nil
+}
+
 // Stats report statistics about the contents of a Dir after pruning.
 type Stats struct {
 	Actions       int           // the number of actions cached
@@ -117,74 +760,398 @@ type Stats struct {
 // PruneEntries prunes the contents of the cache to remove actions that have
 // not been modified in longer than the specified age, along with any objects
 // that are not referenced by any action after pruning is complete.
+//
+// If d has a [PrunePolicy], the policy chooses which actions to remove, and
+// the age is used only to mark the entries presented to the policy as
+// expired. Actions whose objects are missing are always removed.
+//
+// Entries are examined and removed concurrently, as limited by the
+// PruneConcurrency option. If ctx ends before pruning is complete,
+// PruneEntries stops early and reports the context's error along with the
+// stats so far.
+//
+// If another process holds the prune lock, PruneEntries does nothing and
+// returns zero stats without error. See "Concurrency" in the package docs.
 func (d *Dir) PruneEntries(ctx context.Context, age time.Duration) (s Stats, _ error) {
-	start := time.Now()
-	defer func() { s.Elapsed = time.Since(start) }()
+	start := d.now()
+	defer func() { s.Elapsed = d.now().Sub(start) }()
+
+	unlock, err := d.lockPrune()
+	if errors.Is(err, errLocked) {
+		gocache.Logf(ctx, "prune lock is held by another process; skipping")
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	defer unlock()
+
+	// Exclude concurrent puts, which could otherwise store an object after
+	// the mark phase has decided it is unreferenced.
+	unlockWrites, err := d.lockWrites(true)
+	if err != nil {
+		return s, fmt.Errorf("lock cache: %w", err)
+	}
+	defer unlockWrites()
+
+	// The totals are recorded again when pruning is complete. Until then,
+	// e.g., if pruning fails, they are rebuilt if needed.
+	d.invalidateTotals(ctx)
+	var keptBytes int64 // the total size of objects not pruned
+
+	// Keep track of the objects that are being retained, starting with those
+	// pinned by running processes.
+	keepObject := d.readPins(ctx) // objects pinned or referenced by kept actions
+
+	// If there is a prune policy, collect the candidates for it to choose.
+	var cands []Entry
+	candPaths := make(map[string]string) // action ID → path
 
-	// Keep track of the objects that are being retained.
-	var keepObject mapset.Set[string] // objects referenced by kept actions
+	// Entries are processed concurrently, so updates to the stats and the
+	// bookkeeping above must hold mu.
+	var mu sync.Mutex
 
 	// Mark: Delete expired actions and collect object IDs.
-	root := filepath.Join(d.path, "action")
-	if err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		} else if !de.Type().IsRegular() {
-			return nil // skip directories and other stuff
-		}
-		id := d.idFromPath("action", path)
+	if err := d.forEach(ctx, "action", func(e ScanEntry) error {
+		id, path := e.ID, e.Path
 		if id == "" {
-			return nil // not ours
+			return nil // a temporary file
 		}
 
-		objID, _, err := d.readActionFile(id, path)
+		objID, size, err := d.readActionFile(id, path)
 		if err != nil {
 			return err
 		}
+		mu.Lock()
 		s.Actions++
+		mu.Unlock()
 
 		// Check whether the object specified by the action is still available.
 		// If not, prune the action as invalid.
-		if _, err := os.Stat(d.outputPath(objID)); err != nil {
-			s.ActionsPruned++
+		if !d.hasOutput(objID) {
 			gocache.Logf(ctx, "rm action %v (invalid, obj=%v)", id, objID)
-			return os.Remove(path)
+			return d.pruneAction(&mu, &s, id, objID, path)
 		}
 
 		// If the action has not been modified within the age limit, expire it.
-		fi, _ := de.Info()
-		if old := start.Sub(fi.ModTime()); old > age {
-			s.ActionsPruned++
+		old := start.Sub(e.ModTime)
+		if d.policy != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			cands = append(cands, Entry{
+				ActionID: id,
+				OutputID: objID,
+				Size:     size,
+				ModTime:  e.ModTime,
+				Expired:  old > age,
+			})
+			candPaths[id] = path
+			return nil
+		}
+		if old > age {
 			gocache.Logf(ctx, "rm action %v (expired %v)", id, old.Round(time.Minute))
-			return os.Remove(path)
+			return d.pruneAction(&mu, &s, id, objID, path)
 		}
 
 		// Mark this action's object as in-use.
+		mu.Lock()
+		defer mu.Unlock()
 		keepObject.Add(objID)
 		return nil
 	}); err != nil {
 		return s, err
 	}
 
+	// Apply the prune policy, if there is one.
+	if d.policy != nil && len(cands) != 0 {
+		slices.SortFunc(cands, func(a, b Entry) int { return cmp.Compare(a.ActionID, b.ActionID) })
+		evict, err := d.policy(ctx, cands)
+		if err != nil {
+			return s, fmt.Errorf("prune policy: %w", err)
+		}
+		evictSet := mapset.New(evict...)
+		for _, e := range cands {
+			if !evictSet.Has(e.ActionID) {
+				keepObject.Add(e.OutputID)
+				continue
+			} else if err := ctx.Err(); err != nil {
+				return s, err
+			}
+			gocache.Logf(ctx, "rm action %v (policy)", e.ActionID)
+			if err := d.pruneAction(&mu, &s, e.ActionID, e.OutputID, candPaths[e.ActionID]); err != nil {
+				return s, err
+			}
+		}
+	}
+
 	// Sweep: Delete objects not referenced by unexpired actions.
-	root = filepath.Join(d.path, "output")
-	if err := filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+	if err := d.forEach(ctx, "output", func(e ScanEntry) error {
+		id := filepath.Base(e.Path) // temporary files are swept too
+		mu.Lock()
+		s.Objects++
+		keep := keepObject.Has(id)
+		if keep {
+			keptBytes += e.Size
+		}
+		mu.Unlock()
+		if keep {
+			return nil
+		}
+
+		gocache.Logf(ctx, "rm orphan object %v (%d bytes)", id, e.Size)
+		if err := d.removeFile(e.Path); err != nil {
+			gocache.Logf(ctx, "rm object: %v (ignored)", err)
+			mu.Lock()
+			keptBytes += e.Size
+			mu.Unlock()
+			return nil
+		}
+		mu.Lock()
+		s.ObjectsPruned++
+		s.BytesPruned += e.Size
+		mu.Unlock()
+		if f := d.hooks.ObjectEvicted; f != nil {
+			f(id, e.Size)
+		}
+		return nil
+	}); err != nil {
+		return s, err
+	}
+	if d.scratch != "" {
+		d.sweepScratch(ctx, keepObject)
+	}
+	if err := d.writeTotals(Totals{
+		Actions:     s.Actions - s.ActionsPruned,
+		Objects:     s.Objects - s.ObjectsPruned,
+		ObjectBytes: keptBytes,
+	}); err != nil {
+		gocache.Logf(ctx, "write totals: %v (ignored)", err)
+	}
+	return s, nil
+}
+
+// pinMaxAge is the age after which a pin file is considered stale, e.g.,
+// because the process that wrote it crashed.
+const pinMaxAge = 24 * time.Hour
+
+// pin records that the object with the given output ID is in use by d.
+func (d *Dir) pin(outputID string) error {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.pinned.Has(outputID) {
+		return nil
+	}
+	if _, err := fmt.Fprintln(d.pinFile, outputID); err != nil {
+		return fmt.Errorf("pin object: %w", err)
+	}
+	d.pinned.Add(outputID)
+	return nil
+}
+
+// unpin removes the pin file for d, releasing all its pins.
+func (d *Dir) unpin() error {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	d.pinFile.Close()
+	d.pinned.Clear()
+	return d.fsys.Remove(d.pinFile.Name())
+}
+
+// readPins returns the set of object IDs pinned by all the pin files in d.
+// Stale pin files are removed.
+func (d *Dir) readPins(ctx context.Context) mapset.Set[string] {
+	var out mapset.Set[string]
+	pd := filepath.Join(d.path, "pins")
+	des, err := d.fsys.ReadDir(pd)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			gocache.Logf(ctx, "read pins: %v (ignored)", err)
+		}
+		return out
+	}
+	for _, de := range des {
+		path := filepath.Join(pd, de.Name())
+		if fi, err := de.Info(); err != nil || !fi.Mode().IsRegular() {
+			continue
+		} else if d.now().Sub(fi.ModTime()) > pinMaxAge {
+			gocache.Logf(ctx, "rm stale pin file %q", de.Name())
+			d.fsys.Remove(path)
+			continue
+		}
+		data, err := readFile(d.fsys, path)
 		if err != nil {
+			continue // e.g., released concurrently
+		}
+		for _, id := range strings.Fields(string(data)) {
+			out.Add(id)
+		}
+	}
+	return out
+}
+
+// sweepScratch removes the copies of objects in the scratch directory, other
+// than those in keep.
+func (d *Dir) sweepScratch(ctx context.Context, keep mapset.Set[string]) {
+	des, err := d.fsys.ReadDir(d.scratch)
+	if err != nil {
+		gocache.Logf(ctx, "read scratch directory: %v (ignored)", err)
+		return
+	}
+	for _, de := range des {
+		id := de.Name()
+		if !de.Type().IsRegular() || strings.Contains(id, ".") || keep.Has(id) {
+			continue // not a complete copy, or still in use
+		}
+		if err := d.fsys.Remove(filepath.Join(d.scratch, id)); err != nil {
+			gocache.Logf(ctx, "rm scratch copy: %v (ignored)", err)
+		}
+	}
+}
+
+// CheckOptions are optional settings for [Dir.Check]. A nil *CheckOptions
+// is ready for use and provides default values as described.
+type CheckOptions struct {
+	// If true, repair the problems found by removing the files involved.
+	Repair bool
+
+	// If true, verify that the contents of each object match its output ID.
+	// The go command uses the SHA-256 digest of an object's contents as its
+	// output ID; objects whose IDs are not SHA-256 digests are not checked.
+	// This reads every object, so it is much slower than the other checks.
+	//
+	// Do not use this for a cache whose objects are transformed before they
+	// are stored, e.g., by package cachecrypt.
+	Digests bool
+}
+
+func (o *CheckOptions) repair() bool  { return o != nil && o.Repair }
+func (o *CheckOptions) digests() bool { return o != nil && o.Digests }
+
+// CheckStats report the problems found by [Dir.Check].
+type CheckStats struct {
+	Actions    int // the number of actions examined
+	Objects    int // the number of objects examined
+	BadActions int // actions that are unreadable, or whose object is missing or the wrong size
+	BadObjects int // objects whose contents do not match their ID (with Digests)
+	Orphans    int // objects not referenced by any action, and not pinned
+	TempFiles  int // temporary files left by incomplete writes
+	Repaired   int // the number of problems repaired
+}
+
+// OK reports whether s records no problems.
+func (s CheckStats) OK() bool { return s.BadActions+s.BadObjects+s.Orphans+s.TempFiles == 0 }
+
+// Check verifies the consistency of the cache, and reports the problems it
+// finds. If the Repair option is set, it also repairs them: Invalid actions
+// and objects, orphaned objects, and temporary files are removed.
+//
+// Entries are written so that an interrupted Put leaves at most an orphaned
+// object or a temporary file, which PruneEntries would also remove, so Check
+// is not needed for correctness. It allows recovery to be run explicitly,
+// e.g., after a crash or when the cache was modified by other tools.
+//
+// Check holds the same locks as PruneEntries; it reports an error if another
+// process is pruning the cache.
+func (d *Dir) Check(ctx context.Context, opts *CheckOptions) (s CheckStats, _ error) {
+	unlock, err := d.lockPrune()
+	if errors.Is(err, errLocked) {
+		return s, errors.New("the cache is being pruned by another process")
+	} else if err != nil {
+		return s, err
+	}
+	defer unlock()
+	unlockWrites, err := d.lockWrites(true)
+	if err != nil {
+		return s, fmt.Errorf("lock cache: %w", err)
+	}
+	defer unlockWrites()
+
+	// Repairs are not recorded in the totals, so rebuild them if needed.
+	defer func() {
+		if s.Repaired != 0 {
+			d.invalidateTotals(ctx)
+		}
+	}()
+
+	var mu sync.Mutex
+	repair := opts.repair()
+	fix := func(path string, count *int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*count++
+		if !repair {
+			return nil
+		} else if err := d.removeFile(path); err != nil {
 			return err
-		} else if !de.Type().IsRegular() {
-			return nil // skip directories and other stuff
 		}
-		s.Objects++
+		s.Repaired++
+		return nil
+	}
 
-		if id := d.idFromPath("output", path); id != "" && !keepObject.Has(id) {
-			s.ObjectsPruned++
-			fi, _ := de.Info()
-			s.BytesPruned += fi.Size()
-			gocache.Logf(ctx, "rm orphan object %v (%d bytes)", id, fi.Size())
-			if err := os.Remove(path); err != nil {
-				gocache.Logf(ctx, "rm object: %v (ignored)", err)
+	keepObject := d.readPins(ctx)
+	var badObject mapset.Set[string]  // objects whose contents do not match
+	verified := make(map[string]bool) // object ID → digest matches
+	if err := d.forEach(ctx, "action", func(e ScanEntry) error {
+		id, path := e.ID, e.Path
+		if id == "" {
+			gocache.Logf(ctx, "temporary action file %q", path)
+			return fix(path, &s.TempFiles)
+		}
+		mu.Lock()
+		s.Actions++
+		mu.Unlock()
+
+		objID, size, err := d.readActionFile(id, path)
+		if err != nil {
+			gocache.Logf(ctx, "action %s: %v", id, err)
+			return fix(path, &s.BadActions)
+		}
+		objPath, fi, err := d.statOutput(objID)
+		if err != nil || fi.Size() != size {
+			gocache.Logf(ctx, "action %s: object %s is missing or the wrong size", id, objID)
+			return fix(path, &s.BadActions)
+		}
+		if opts.digests() {
+			mu.Lock()
+			ok, seen := verified[objID]
+			mu.Unlock()
+			if !seen {
+				ok = d.verifyOutput(objID, objPath)
+				mu.Lock()
+				verified[objID] = ok
+				if !ok {
+					badObject.Add(objID)
+				}
+				mu.Unlock()
+			}
+			if !ok {
+				gocache.Logf(ctx, "action %s: object %s does not match its digest", id, objID)
+				return fix(path, &s.BadActions)
 			}
 		}
+		mu.Lock()
+		defer mu.Unlock()
+		keepObject.Add(objID)
+		return nil
+	}); err != nil {
+		return s, err
+	}
+
+	if err := d.forEach(ctx, "output", func(e ScanEntry) error {
+		id, path := e.ID, e.Path
+		if id == "" {
+			gocache.Logf(ctx, "temporary object file %q", path)
+			return fix(path, &s.TempFiles)
+		}
+		mu.Lock()
+		s.Objects++
+		keep, bad := keepObject.Has(id), badObject.Has(id)
+		mu.Unlock()
+		if bad {
+			return fix(path, &s.BadObjects)
+		} else if !keep {
+			gocache.Logf(ctx, "orphan object %s", id)
+			return fix(path, &s.Orphans)
+		}
 		return nil
 	}); err != nil {
 		return s, err
@@ -192,22 +1159,214 @@ func (d *Dir) PruneEntries(ctx context.Context, age time.Duration) (s Stats, _ e
 	return s, nil
 }
 
-func (d *Dir) idFromPath(kind, path string) string {
-	// Expected path format: <dir>/<kind>/<xx>/<id>
-	tail, _ := filepath.Rel(d.path, path)         // remove <dir>/
-	tail, ok := strings.CutPrefix(tail, kind+"/") // remove <kind>/
-	if !ok {
-		return ""
+// Actions calls f with the ID of each action stored in d. Calls to f may run
+// concurrently, up to the PruneConcurrency limit. Actions stops early and
+// reports an error if ctx ends or if any call to f fails.
+func (d *Dir) Actions(ctx context.Context, f func(actionID string) error) error {
+	return d.forEach(ctx, "action", func(e ScanEntry) error {
+		if e.ID == "" {
+			return nil // a temporary file
+		}
+		return f(e.ID)
+	})
+}
+
+// pruneAction removes the action file at path for the given action ID and its
+// output ID, counts it in s while holding mu, and calls the ActionExpired hook
+// if it succeeds.
+func (d *Dir) pruneAction(mu *sync.Mutex, s *Stats, id, outputID, path string) error {
+	if err := d.removeFile(path); err != nil {
+		return err
+	}
+	mu.Lock()
+	s.ActionsPruned++
+	mu.Unlock()
+	if f := d.hooks.ActionExpired; f != nil {
+		f(id, outputID)
+	}
+	return nil
+}
+
+// lockWrites acquires the lock on writes to d, as described in "Concurrency"
+// in the package docs, and returns a function that releases it. Advisory
+// locks are used only with the local filesystem.
+func (d *Dir) lockWrites(exclusive bool) (func(), error) {
+	if !d.local {
+		return func() {}, nil
 	}
-	return filepath.Base(tail)
+	return lockFile(filepath.Join(d.path, "write.lock"), exclusive)
 }
 
-func (d *Dir) actionPath(id string) string {
-	return filepath.Join(d.path, "action", id[:2], id)
+// pruneLockAge is the age after which a prune lock file is considered stale,
+// e.g., because the process holding it crashed.
+const pruneLockAge = time.Hour
+
+var errLocked = errors.New("lock is held")
+
+// lockPrune acquires the prune lock for d, and returns a function that
+// releases it.  It reports errLocked if another process holds the lock.
+func (d *Dir) lockPrune() (func(), error) {
+	path := filepath.Join(d.path, "prune.lock")
+	for try := 0; ; try++ {
+		f, err := d.fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintln(f, os.Getpid())
+			f.Close()
+			return func() { d.fsys.Remove(path) }, nil
+		} else if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		// Break a stale lock (once).
+		fi, err := d.fsys.Stat(path)
+		if try > 0 || err != nil || d.now().Sub(fi.ModTime()) < pruneLockAge {
+			return nil, errLocked
+		}
+		d.fsys.Remove(path)
+	}
 }
 
-func (d *Dir) outputPath(id string) string {
-	return filepath.Join(d.path, "output", id[:2], id)
+func (d *Dir) actionPath(id string) string { return d.shardPath("action", id) }
+
+func (d *Dir) outputPath(id string) string { return d.shardPath("output", id) }
+
+// fastPath returns the path of the object with the given ID in the fast
+// directory. It must not be called unless d has a fast directory.
+func (d *Dir) fastPath(id string) string { return d.shardPathIn(d.fast, "output", id) }
+
+// objectPath returns the path where an object with the given ID and size
+// should be stored.
+func (d *Dir) objectPath(id string, size int64) string {
+	if d.fast != "" && size <= d.fastMax {
+		return d.fastPath(id)
+	}
+	return d.outputPath(id)
+}
+
+// shardPath returns the path of the file for the given kind and ID in the
+// current layout.
+func (d *Dir) shardPath(kind, id string) string { return d.shardPathIn(d.path, kind, id) }
+
+// shardPathIn returns the path of the file for the given kind and ID in the
+// current layout, under the specified root directory.
+func (d *Dir) shardPathIn(root, kind, id string) string {
+	parts := []string{root, kind}
+	for i := 0; i < d.depth; i++ {
+		lo := i * d.width
+		if lo+d.width > len(id) {
+			break
+		}
+		parts = append(parts, id[lo:lo+d.width])
+	}
+	return filepath.Join(append(parts, id)...)
+}
+
+// legacyPath returns the path of the file for the given kind and ID in the
+// default layout.
+func (d *Dir) legacyPath(kind, id string) string {
+	return filepath.Join(d.path, kind, id[:2], id)
+}
+
+// isLegacy reports whether d uses the default layout.
+func (d *Dir) isLegacy() bool { return d.depth == 1 && d.width == 2 }
+
+// migrate moves the file for the given kind and ID from the default layout to
+// the current layout, if d does not use the default layout and the file
+// exists. It reports whether a file was moved.
+func (d *Dir) migrate(kind, id string) bool {
+	if d.isLegacy() || len(id) < 2 {
+		return false
+	}
+	path, err := d.makePath(id, func(id string) string { return d.shardPath(kind, id) })
+	if err != nil {
+		return false
+	}
+	return d.fsys.Rename(d.legacyPath(kind, id), path) == nil
+}
+
+// findOutput locates the object with the given ID and expected size, and
+// returns its path and file info. If the object is stored in the default
+// layout, or in the other directory of a split cache, it is first moved to
+// where it belongs.
+func (d *Dir) findOutput(id string, size int64) (string, fs.FileInfo, error) {
+	path := d.objectPath(id, size)
+	fi, err := d.fsys.Stat(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return path, fi, err
+	}
+	moved := d.migrate("output", id)
+	if d.fast != "" {
+		if main := d.outputPath(id); path != main {
+			moved = d.moveFile(main, path) == nil
+		} else if !moved {
+			moved = d.moveFile(d.fastPath(id), path) == nil
+		}
+	}
+	if !moved {
+		return path, nil, err
+	}
+	fi, err = d.fsys.Stat(path)
+	return path, fi, err
+}
+
+// hasOutput reports whether the object with the given ID is present in
+// either the current or the default layout, or in the fast directory.
+func (d *Dir) hasOutput(id string) bool {
+	_, _, err := d.statOutput(id)
+	return err == nil
+}
+
+// verifyOutput reports whether the contents of the object file at path match
+// its ID, if the ID is a SHA-256 digest. It reports true for other IDs.
+func (d *Dir) verifyOutput(id, path string) bool {
+	want, err := hex.DecodeString(id)
+	if err != nil || len(want) != sha256.Size {
+		return true // not a digest
+	}
+	f, err := d.fsys.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), want)
+}
+
+// statOutput returns the path and file info for the object with the given
+// ID, from wherever [Dir.hasOutput] would find it. Unlike [Dir.findOutput],
+// it does not move the object.
+func (d *Dir) statOutput(id string) (string, fs.FileInfo, error) {
+	path := d.outputPath(id)
+	fi, err := d.fsys.Stat(path)
+	if err == nil {
+		return path, fi, nil
+	} else if d.fast != "" {
+		if fi, err := d.fsys.Stat(d.fastPath(id)); err == nil {
+			return d.fastPath(id), fi, nil
+		}
+	}
+	if d.isLegacy() || len(id) < 2 {
+		return "", nil, err
+	}
+	path = d.legacyPath("output", id)
+	fi, err = d.fsys.Stat(path)
+	return path, fi, err
+}
+
+// touchAction updates the modification time of the action file for id, if it
+// was last modified longer ago than the touch interval.
+func (d *Dir) touchAction(id string) {
+	path := d.actionPath(id)
+	fi, err := d.fsys.Stat(path)
+	if err != nil {
+		return
+	}
+	if now := d.now(); now.Sub(fi.ModTime()) >= d.touch {
+		d.fsys.Chtimes(path, time.Time{} /* atime: ignore */, now) // best-effort
+	}
 }
 
 func (d *Dir) readAction(id string) (outputID string, size int64, _ error) {
@@ -215,50 +1374,245 @@ func (d *Dir) readAction(id string) (outputID string, size int64, _ error) {
 }
 
 func (d *Dir) readActionFile(id, path string) (outputID string, size int64, _ error) {
-	data, err := os.ReadFile(path)
+	data, err := readFile(d.fsys, path)
 	if err != nil {
 		return "", 0, err
 	}
 	fs := strings.Fields(string(data))
 	if len(fs) != 2 {
-		return "", 0, fmt.Errorf("invalid action file for %s", id)
+		return "", 0, fmt.Errorf("invalid action file for %s: %w", id, gocache.ErrCorruptObject)
 	}
 	size, err = strconv.ParseInt(fs[1], 10, 64)
 	return fs[0], size, err
 }
 
-func (d *Dir) writeAction(id, outputID string, size int64) error {
-	path, err := makePath(id, d.actionPath)
+// writeAction writes the action file for id, and reports the resulting change
+// to the totals of d.
+func (d *Dir) writeAction(id, outputID string, size int64) (Totals, error) {
+	path, err := d.makePath(id, d.actionPath)
 	if err != nil {
-		return err
+		return Totals{}, err
 	}
-	return atomicfile.Tx(path, 0644, func(f *atomicfile.File) error {
-		_, err := fmt.Fprintf(f, "%s %d\n", outputID, size)
-		return err
-	})
+	var t Totals
+	if _, err := d.fsys.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		t.Actions++
+	}
+	line := fmt.Sprintf("%s %d\n", outputID, size)
+	if _, err := d.writeFile(path, strings.NewReader(line)); err != nil {
+		return Totals{}, err
+	}
+	if d.clock != nil {
+		d.fsys.Chtimes(path, time.Time{} /* atime: ignore */, d.clock.Now()) // best-effort
+	}
+	return t, nil
+}
+
+// now reports the current time, from the clock of d if it has one.
+func (d *Dir) now() time.Time {
+	if d.clock != nil {
+		return d.clock.Now()
+	}
+	return time.Now()
 }
 
-func (d *Dir) writeObject(obj gocache.Object) (string, int64, error) {
-	path, err := makePath(obj.OutputID, d.outputPath)
+// writeObject writes the file for obj, unless it is already present, and
+// reports its path and size, and the resulting change to the totals of d.
+func (d *Dir) writeObject(obj gocache.Object) (string, int64, Totals, error) {
+	path, err := d.makePath(obj.OutputID, func(id string) string { return d.objectPath(id, obj.Size) })
 	if err != nil {
-		return "", 0, err
+		return "", 0, Totals{}, err
 	}
 
 	// If the specified object is already present and has the expected size,
 	// skip writing the object.
-	fi, err := os.Stat(path)
-	if err == nil && fi.Mode().IsRegular() && fi.Size() == obj.Size {
-		return path, fi.Size(), nil
+	fi, err := d.fsys.Stat(path)
+	exists := err == nil && fi.Mode().IsRegular()
+	if exists && fi.Size() == obj.Size {
+		return path, fi.Size(), Totals{}, nil
+	}
+
+	sz, err := d.writeFile(path, obj.Body)
+	if err != nil {
+		return "", 0, Totals{}, err
+	}
+	t := Totals{Objects: 1, ObjectBytes: sz}
+	if exists {
+		t = Totals{ObjectBytes: sz - fi.Size()} // replaced an incomplete copy
+	}
+	if d.fast != "" {
+		if size, ok := d.removeOther(obj.OutputID, path); ok {
+			t = t.add(Totals{Objects: -1, ObjectBytes: -size})
+		}
+	}
+	if !obj.ModTime.IsZero() {
+		d.fsys.Chtimes(path, time.Time{} /* atime: ignore */, obj.ModTime) // best-effort
+	}
+
+	// In shared mode, verify that the object landed with the expected size.
+	if d.shared {
+		fi, err := d.fsys.Stat(path)
+		if err != nil {
+			return "", 0, Totals{}, err
+		} else if fi.Size() != sz {
+			return "", 0, Totals{}, fmt.Errorf("verify object %s: got %d bytes, want %d", obj.OutputID, fi.Size(), sz)
+		}
+	}
+	return path, sz, t, nil
+}
+
+// writeFile atomically replaces the contents of path with the data from r, and
+// reports the number of bytes written.
+func (d *Dir) writeFile(path string, r io.Reader) (int64, error) {
+	nw, err := d.writeAtomic(path, r, d.sync >= DurabilitySync)
+	if err == nil && d.sync >= DurabilitySyncDir {
+		err = d.syncDir(filepath.Dir(path))
+	}
+	return nw, err
+}
+
+// syncDir syncs the directory at path to stable storage.
+func (d *Dir) syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil // directories cannot be synced, and do not need to be
 	}
+	f, err := d.fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
 
-	sz, err := atomicfile.WriteAll(path, obj.Body, 0644)
-	if err == nil && !obj.ModTime.IsZero() {
-		os.Chtimes(path, time.Time{} /* atime: ignore */, obj.ModTime) // best-effort
+// writeAtomic atomically replaces the contents of path with the data from r,
+// by writing a temporary file and renaming it into place, and reports the
+// number of bytes written. If sync is true, the data are synced to stable
+// storage before the rename.
+func (d *Dir) writeAtomic(path string, r io.Reader, sync bool) (int64, error) {
+	dir, name := filepath.Split(path)
+	f, err := d.fsys.CreateTemp(filepath.Clean(dir), name+"-*.aftmp")
+	if err != nil {
+		return 0, err
+	}
+	nw, err := io.Copy(f, r)
+	if err == nil {
+		err = d.fsys.Chmod(f.Name(), 0644)
+	}
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = d.renameFile(f.Name(), path)
+	}
+	if err != nil {
+		d.fsys.Remove(f.Name()) // best-effort
+	}
+	return nw, err
+}
+
+// placeCopy places a copy of the object at path into dir, if one is not
+// already present, and returns the path of the copy.
+func (d *Dir) placeCopy(dir, id, path string, size int64) (string, error) {
+	target := filepath.Join(dir, id)
+	if fi, err := d.fsys.Stat(target); err == nil && fi.Size() == size {
+		return target, nil
+	}
+
+	// Build the copy under a temporary name and rename it into place, so that
+	// concurrent requests for the same object do not see a partial file.
+	tmp := fmt.Sprintf("%s.%x", target, rand.Uint64())
+	if !d.local || (cloneFile(path, tmp) != nil && os.Link(path, tmp) != nil) {
+		if _, err := d.copyFile(path, tmp); err != nil {
+			return "", err
+		}
+	}
+	if err := d.renameFile(tmp, target); err != nil {
+		d.fsys.Remove(tmp)
+		return "", err
+	}
+	return target, nil
+}
+
+// removeOther removes any copy of the object with the given ID from the other
+// directory of a split cache than path, so that only one copy is retained.
+// It reports the size of the copy, and whether one was removed.
+func (d *Dir) removeOther(id, path string) (int64, bool) {
+	other := d.outputPath(id)
+	if other == path {
+		other = d.fastPath(id)
+	}
+	fi, err := d.fsys.Stat(other)
+	if err != nil || d.fsys.Remove(other) != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// moveFile moves the file at src to dst, creating the parent directory of dst
+// if necessary. If src and dst are on different filesystems, the file is
+// copied and the original removed.
+func (d *Dir) moveFile(src, dst string) error {
+	if _, err := d.fsys.Stat(src); err != nil {
+		return err
+	} else if err := d.fsys.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := d.renameFile(src, dst); err == nil {
+		return nil
+	}
+	if _, err := d.copyFile(src, dst); err != nil {
+		return err
+	}
+	return d.removeFile(src)
+}
+
+// retryDelays are the delays between attempts of a filesystem operation that
+// fails transiently (see isTransient), about a second in total.
+var retryDelays = []time.Duration{
+	1 * time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond,
+}
+
+// retryTransient calls f until it succeeds, fails with an error that is not
+// transient, or the retry delays are exhausted.
+func retryTransient(f func() error) error {
+	err := f()
+	for _, d := range retryDelays {
+		if err == nil || !isTransient(err) {
+			break
+		}
+		time.Sleep(d)
+		err = f()
+	}
+	return err
+}
+
+// renameFile renames src to dst, replacing dst if it exists, and retrying if
+// the rename fails transiently.
+func (d *Dir) renameFile(src, dst string) error {
+	return retryTransient(func() error { return d.fsys.Rename(src, dst) })
+}
+
+// removeFile removes the file at path, retrying if the removal fails
+// transiently.
+func (d *Dir) removeFile(path string) error {
+	return retryTransient(func() error { return d.fsys.Remove(path) })
+}
+
+// copyFile copies the contents of the file at src to a new file at dst.
+func (d *Dir) copyFile(src, dst string) (int64, error) {
+	in, err := d.fsys.Open(src)
+	if err != nil {
+		return 0, err
 	}
-	return path, sz, err
+	defer in.Close()
+	return d.writeAtomic(dst, in, false)
 }
 
-func makePath(id string, f func(string) string) (string, error) {
+func (d *Dir) makePath(id string, f func(string) string) (string, error) {
 	path := f(id)
-	return path, os.MkdirAll(filepath.Dir(path), 0755)
+	return path, d.fsys.MkdirAll(filepath.Dir(path), 0755)
 }
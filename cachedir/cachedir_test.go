@@ -2,14 +2,26 @@ package cachedir_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/cachetest"
+	"github.com/creachadair/gocache/snapshot"
+	gocmp "github.com/google/go-cmp/cmp"
 )
 
 func TestDir(t *testing.T) {
@@ -71,3 +83,1512 @@ func TestDir(t *testing.T) {
 
 	checkMiss("good-action")
 }
+
+func TestRelativePath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	d, err := cachedir.New("cache")
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	path, err := d.Put(context.Background(), gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if !filepath.IsAbs(path) {
+		t.Errorf("Put: got path %q, want an absolute path", path)
+	}
+}
+
+func TestSessionDir(t *testing.T) {
+	dir := t.TempDir()
+	sessionDir := t.TempDir()
+
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{SessionDir: sessionDir})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	cachePath, err := d.Put(ctx, gocache.Object{
+		ActionID: "some-action",
+		OutputID: "some-object",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// Get should report a path in the session directory, not the cache.
+	obj, diskPath, err := d.Get(ctx, "some-action")
+	if err != nil || obj != "some-object" {
+		t.Fatalf("Get: got %q, %q, %v; want some-object, <path>, nil", obj, diskPath, err)
+	}
+	if !strings.HasPrefix(diskPath, sessionDir+string(filepath.Separator)) {
+		t.Errorf("Get: path %q is not in session directory %q", diskPath, sessionDir)
+	}
+
+	// Removing the object from the cache should not affect the session copy.
+	if err := os.Remove(cachePath); err != nil {
+		t.Fatalf("Remove object file: %v", err)
+	}
+	if data, err := os.ReadFile(diskPath); err != nil {
+		t.Errorf("Read session object: %v", err)
+	} else if got := string(data); got != "xyzzy" {
+		t.Errorf("Session object: got %q, want xyzzy", got)
+	}
+
+	// Cleanup should remove the session directory even without pruning.
+	cleanup := d.Cleanup(0)
+	if cleanup == nil {
+		t.Fatal("Cleanup(0) returned nil with a session directory")
+	}
+	if err := cleanup(ctx); err != nil {
+		t.Errorf("Cleanup: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(diskPath)); !os.IsNotExist(err) {
+		t.Errorf("Session directory still exists after cleanup: %v", err)
+	}
+}
+
+func TestScratchDir(t *testing.T) {
+	scratchDir := t.TempDir()
+	d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{ScratchDir: scratchDir})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := d.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// Get should report a path in the scratch directory, and reuse it.
+	want := filepath.Join(scratchDir, "0b1ec7")
+	for range 2 {
+		if _, path, err := d.Get(ctx, "a1b2c3"); err != nil || path != want {
+			t.Fatalf("Get: got %q, %v; want %q, nil", path, err, want)
+		}
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != "xyzzy" {
+		t.Errorf("Scratch copy: got %q, %v; want xyzzy", data, err)
+	}
+
+	// Pruning should keep the copies of objects that remain in the cache...
+	if _, err := d.PruneEntries(ctx, time.Hour); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("Scratch copy was removed: %v", err)
+	}
+
+	// ...and remove the copies of objects that were pruned.
+	if _, err := d.PruneEntries(ctx, -1); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(want); !os.IsNotExist(err) {
+		t.Errorf("Scratch copy still exists after pruning: %v", err)
+	}
+}
+
+func TestPinObjects(t *testing.T) {
+	dir := t.TempDir()
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{PinObjects: true})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	path, err := d.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if _, _, err := d.Get(ctx, "a1b2c3"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+
+	// Another process pruning the cache removes the expired action, but not
+	// the object pinned by d.
+	other, err := cachedir.New(dir)
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	if s, err := other.PruneEntries(ctx, -1); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	} else if s.ActionsPruned != 1 || s.ObjectsPruned != 0 {
+		t.Errorf("PruneEntries: got %+v, want 1 action and 0 objects pruned", s)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Pinned object was removed: %v", err)
+	}
+
+	// Once d releases its pins, the object can be pruned.
+	if err := d.Cleanup(0)(ctx); err != nil {
+		t.Fatalf("Cleanup: unexpected error: %v", err)
+	}
+	if s, err := other.PruneEntries(ctx, -1); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	} else if s.ObjectsPruned != 1 {
+		t.Errorf("PruneEntries: got %+v, want 1 object pruned", s)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Object still exists after unpinning: %v", err)
+	}
+}
+
+func TestSharedFS(t *testing.T) {
+	dir := t.TempDir()
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{SharedFS: true})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := d.Put(ctx, gocache.Object{
+		ActionID: "some-action",
+		OutputID: "some-object",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if obj, _, err := d.Get(ctx, "some-action"); err != nil || obj != "some-object" {
+		t.Errorf("Get: got %q, %v; want some-object, nil", obj, err)
+	}
+
+	// While another process holds the prune lock, pruning should do nothing.
+	lockPath := filepath.Join(dir, "prune.lock")
+	if err := os.WriteFile(lockPath, []byte("12345\n"), 0644); err != nil {
+		t.Fatalf("Create lock: %v", err)
+	}
+	if st, err := d.PruneEntries(ctx, -1); err != nil {
+		t.Errorf("PruneEntries: unexpected error: %v", err)
+	} else if st.ActionsPruned != 0 {
+		t.Errorf("PruneEntries with lock held: pruned %d actions, want 0", st.ActionsPruned)
+	}
+
+	// Once the lock is released, pruning should proceed and release the lock.
+	if err := os.Remove(lockPath); err != nil {
+		t.Fatalf("Remove lock: %v", err)
+	}
+	if st, err := d.PruneEntries(ctx, -1); err != nil {
+		t.Errorf("PruneEntries: unexpected error: %v", err)
+	} else if st.ActionsPruned != 1 {
+		t.Errorf("PruneEntries: pruned %d actions, want 1", st.ActionsPruned)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("Prune lock still present after pruning: %v", err)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	for _, dur := range []cachedir.Durability{
+		cachedir.DurabilityNone, cachedir.DurabilitySync, cachedir.DurabilitySyncDir,
+	} {
+		t.Run(fmt.Sprint(dur), func(t *testing.T) {
+			d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{Durability: dur})
+			if err != nil {
+				t.Fatalf("New: unexpected error: %v", err)
+			}
+			ctx := context.Background()
+			if _, err := d.Put(ctx, gocache.Object{
+				ActionID: "a1b2c3",
+				OutputID: "0b1ec7",
+				Size:     5,
+				Body:     strings.NewReader("xyzzy"),
+			}); err != nil {
+				t.Fatalf("Put: unexpected error: %v", err)
+			}
+			obj, path, err := d.Get(ctx, "a1b2c3")
+			if err != nil || obj != "0b1ec7" {
+				t.Fatalf("Get: got %q, %v; want 0b1ec7, nil", obj, err)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != "xyzzy" {
+				t.Errorf("Object: got %q, %v; want xyzzy", data, err)
+			}
+		})
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var stored, evicted, expired []string
+	d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{
+		Hooks: cachedir.Hooks{
+			ObjectStored: func(actionID, outputID string, size int64) {
+				stored = append(stored, fmt.Sprintf("%s:%s:%d", actionID, outputID, size))
+			},
+			ObjectEvicted: func(outputID string, size int64) {
+				evicted = append(evicted, fmt.Sprintf("%s:%d", outputID, size))
+			},
+			ActionExpired: func(actionID, outputID string) {
+				expired = append(expired, fmt.Sprintf("%s:%s", actionID, outputID))
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := d.Put(ctx, gocache.Object{
+		ActionID: "some-action",
+		OutputID: "some-object",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if _, err := d.PruneEntries(ctx, -1); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	}
+
+	if diff := gocmp.Diff(stored, []string{"some-action:some-object:5"}); diff != "" {
+		t.Errorf("ObjectStored (-got, +want):\n%s", diff)
+	}
+	if diff := gocmp.Diff(evicted, []string{"some-object:5"}); diff != "" {
+		t.Errorf("ObjectEvicted (-got, +want):\n%s", diff)
+	}
+	if diff := gocmp.Diff(expired, []string{"some-action:some-object"}); diff != "" {
+		t.Errorf("ActionExpired (-got, +want):\n%s", diff)
+	}
+}
+
+func TestPrunePolicy(t *testing.T) {
+	putAll := func(t *testing.T, d *cachedir.Dir, ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			if _, err := d.Put(context.Background(), gocache.Object{
+				ActionID: "action-" + id,
+				OutputID: "object-" + id,
+				Size:     int64(len(id)),
+				Body:     strings.NewReader(id),
+			}); err != nil {
+				t.Fatalf("Put %q: unexpected error: %v", id, err)
+			}
+		}
+	}
+	checkPrune := func(t *testing.T, d *cachedir.Dir, want []string) {
+		t.Helper()
+		st, err := d.PruneEntries(context.Background(), time.Hour)
+		if err != nil {
+			t.Fatalf("PruneEntries: unexpected error: %v", err)
+		}
+		if st.ActionsPruned != len(want) || st.ObjectsPruned != len(want) {
+			t.Errorf("PruneEntries: got %+v, want %d actions and objects pruned", st, len(want))
+		}
+		for _, id := range want {
+			if obj, _, err := d.Get(context.Background(), "action-"+id); obj != "" || err != nil {
+				t.Errorf("Get %q after prune: got %q, %v; want miss", id, obj, err)
+			}
+		}
+	}
+
+	t.Run("Func", func(t *testing.T) {
+		var got []string
+		d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{
+			PrunePolicy: func(_ context.Context, es []cachedir.Entry) ([]string, error) {
+				var evict []string
+				for _, e := range es {
+					got = append(got, e.ActionID)
+					if e.Expired {
+						t.Errorf("Entry %q is expired, but should not be", e.ActionID)
+					}
+					if e.Size == 3 {
+						evict = append(evict, e.ActionID)
+					}
+				}
+				return evict, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		putAll(t, d, "a", "bbb", "cc")
+		checkPrune(t, d, []string{"bbb"})
+		if len(got) != 3 {
+			t.Errorf("Policy saw %d entries, want 3", len(got))
+		}
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		sh, err := exec.LookPath("sh")
+		if err != nil {
+			t.Skipf("No shell available: %v", err)
+		}
+		d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{
+			PrunePolicy: cachedir.CommandPolicy(sh, "-c", `cat >/dev/null; echo '{"evict":["action-cc"]}'`),
+		})
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		putAll(t, d, "a", "bbb", "cc")
+		checkPrune(t, d, []string{"cc"})
+	})
+}
+
+func TestPruneConcurrent(t *testing.T) {
+	const numEntries = 200
+
+	dir := t.TempDir()
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{PruneConcurrency: 8})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	// Store a bunch of entries, and backdate every other action so that it
+	// will be expired by pruning.
+	old := time.Now().Add(-2 * time.Hour)
+	for i := range numEntries {
+		id := fmt.Sprintf("%04x", i)
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: id,
+			Size:     int64(len(id)),
+			Body:     strings.NewReader(id),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+		if i%2 == 0 {
+			if err := os.Chtimes(filepath.Join(dir, "action", id[:2], id), old, old); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+		}
+	}
+
+	// Pruning with a context that has already ended should stop early.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.PruneEntries(cctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("PruneEntries: got %v, want %v", err, context.Canceled)
+	}
+
+	st, err := d.PruneEntries(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	}
+	const half = numEntries / 2
+	if st.Actions != numEntries || st.ActionsPruned != half || st.Objects != numEntries || st.ObjectsPruned != half {
+		t.Errorf("PruneEntries: got %+v, want %d actions and objects with %d pruned", st, numEntries, half)
+	}
+	if st.BytesPruned != 4*half {
+		t.Errorf("PruneEntries: pruned %d bytes, want %d", st.BytesPruned, 4*half)
+	}
+}
+
+func TestPruneWhilePutting(t *testing.T) {
+	const numEntries = 200
+
+	// Simulate two processes sharing a cache directory: One stores new
+	// entries while the other repeatedly prunes. Pruning must not remove the
+	// objects of entries stored concurrently.
+	dir := t.TempDir()
+	w, err := cachedir.New(dir)
+	if err != nil {
+		t.Fatalf("New writer: unexpected error: %v", err)
+	}
+	p, err := cachedir.New(dir)
+	if err != nil {
+		t.Fatalf("New pruner: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := p.PruneEntries(ctx, time.Hour); err != nil {
+				t.Errorf("PruneEntries: unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+	for i := range numEntries {
+		id := fmt.Sprintf("%04x", i)
+		if _, err := w.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: id,
+			Size:     int64(len(id)),
+			Body:     strings.NewReader(id),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := range numEntries {
+		id := fmt.Sprintf("%04x", i)
+		if obj, _, err := w.Get(ctx, id); err != nil || obj != id {
+			t.Errorf("Get %q: got %q, %v; want %q, nil", id, obj, err, id)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	d, err := cachedir.New(dir)
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, id := range []string{"a1b2c3", "d4e5f6"} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b" + id,
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+	if s, err := d.Check(ctx, nil); err != nil || !s.OK() {
+		t.Fatalf("Check: got %+v, %v; want OK", s, err)
+	}
+
+	// Simulate a lost object, an orphaned object, and incomplete writes.
+	if err := os.Remove(filepath.Join(dir, "output/0b/0bd4e5f6")); err != nil {
+		t.Fatalf("Remove object: %v", err)
+	}
+	for _, path := range []string{"output/0c/0c0c0c", "output/0b/0b1ec7-123.aftmp", "action/a1/a1b2c3-456.aftmp"} {
+		p := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(p, []byte("junk"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	want := cachedir.CheckStats{Actions: 2, Objects: 2, BadActions: 1, Orphans: 1, TempFiles: 2}
+	s, err := d.Check(ctx, nil)
+	if err != nil {
+		t.Fatalf("Check: unexpected error: %v", err)
+	} else if s != want {
+		t.Errorf("Check: got %+v, want %+v", s, want)
+	}
+
+	want.Repaired = 4
+	if s, err := d.Check(ctx, &cachedir.CheckOptions{Repair: true}); err != nil {
+		t.Fatalf("Check repair: unexpected error: %v", err)
+	} else if s != want {
+		t.Errorf("Check repair: got %+v, want %+v", s, want)
+	}
+	if s, err := d.Check(ctx, nil); err != nil || !s.OK() {
+		t.Errorf("Check after repair: got %+v, %v; want OK", s, err)
+	}
+	if obj, _, err := d.Get(ctx, "a1b2c3"); err != nil || obj != "0ba1b2c3" {
+		t.Errorf("Get after repair: got %q, %v; want 0ba1b2c3, nil", obj, err)
+	}
+}
+
+func TestCheckDigests(t *testing.T) {
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	sum := sha256.Sum256([]byte("xyzzy"))
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("ab", sha256.Size)
+	for i, id := range []string{good, bad, "0b1ec7"} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: fmt.Sprintf("a%d", i),
+			OutputID: id,
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+
+	// Without digests, all the entries look fine.
+	if s, err := d.Check(ctx, nil); err != nil || !s.OK() {
+		t.Errorf("Check: got %+v, %v; want OK", s, err)
+	}
+
+	// With digests, the object whose contents do not match is found. The
+	// object whose ID is not a digest is not checked.
+	want := cachedir.CheckStats{Actions: 3, Objects: 3, BadActions: 1, BadObjects: 1, Repaired: 2}
+	if s, err := d.Check(ctx, &cachedir.CheckOptions{Digests: true, Repair: true}); err != nil {
+		t.Fatalf("Check: unexpected error: %v", err)
+	} else if s != want {
+		t.Errorf("Check: got %+v, want %+v", s, want)
+	}
+	if obj, _, err := d.Get(ctx, "a1"); err != nil || obj != "" {
+		t.Errorf("Get a1 after repair: got %q, %v; want miss", obj, err)
+	}
+}
+
+func TestTouchInterval(t *testing.T) {
+	dir := t.TempDir()
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{TouchInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := d.Put(ctx, gocache.Object{
+		ActionID: "abc123",
+		OutputID: "def456",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	actionPath := filepath.Join(dir, "action", "ab", "abc123")
+	getModTime := func(t *testing.T) time.Time {
+		t.Helper()
+		if _, path, err := d.Get(ctx, "abc123"); err != nil || path == "" {
+			t.Fatalf("Get: got %q, %v; want hit", path, err)
+		}
+		fi, err := os.Stat(actionPath)
+		if err != nil {
+			t.Fatalf("Stat action: %v", err)
+		}
+		return fi.ModTime()
+	}
+
+	// An action modified within the interval is not touched.
+	recent := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(actionPath, recent, recent); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got := getModTime(t); !got.Equal(recent) {
+		t.Errorf("Action mtime: got %v, want %v", got, recent)
+	}
+
+	// An action modified longer ago than the interval is touched by Get, but
+	// not by Lookup.
+	old := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(actionPath, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if oid, path, size, err := d.Lookup("abc123"); err != nil || oid != "def456" || path == "" || size != 5 {
+		t.Errorf("Lookup: got %q, %q, %d, %v; want def456, path, 5", oid, path, size, err)
+	}
+	if fi, err := os.Stat(actionPath); err != nil {
+		t.Fatalf("Stat action: %v", err)
+	} else if !fi.ModTime().Equal(old) {
+		t.Errorf("Lookup touched the action: mtime %v, want %v", fi.ModTime(), old)
+	}
+	if oid, _, _, err := d.Lookup("bad123"); err != nil || oid != "" {
+		t.Errorf("Lookup missing: got %q, %v; want miss", oid, err)
+	}
+	if got := getModTime(t); time.Since(got) > time.Minute {
+		t.Errorf("Action mtime: got %v, want recent", got)
+	}
+
+	// Touch updates the action as Get does.
+	if err := os.Chtimes(actionPath, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if err := d.Touch("abc123", "def456"); err != nil {
+		t.Errorf("Touch: unexpected error: %v", err)
+	}
+	if fi, err := os.Stat(actionPath); err != nil {
+		t.Fatalf("Stat action: %v", err)
+	} else if time.Since(fi.ModTime()) > time.Minute {
+		t.Errorf("Touch: action mtime %v, want recent", fi.ModTime())
+	}
+
+	// A touched action survives pruning by age.
+	if st, err := d.PruneEntries(ctx, time.Hour); err != nil {
+		t.Errorf("PruneEntries: unexpected error: %v", err)
+	} else if st.ActionsPruned != 0 {
+		t.Errorf("PruneEntries: got %+v, want none pruned", st)
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := cachetest.NewClock(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{TouchInterval: time.Hour, Clock: clock})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, id := range []string{"a1b2c3", "d4e5f6"} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b1ec7" + id,
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %s: unexpected error: %v", id, err)
+		}
+	}
+	prune := func(want int) {
+		t.Helper()
+		st, err := d.PruneEntries(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("PruneEntries: unexpected error: %v", err)
+		} else if st.ActionsPruned != want || st.Elapsed != 0 {
+			t.Errorf("PruneEntries: got %+v, want %d actions pruned in no time", st, want)
+		}
+	}
+
+	// Actions are stamped with the time of the clock, so they are not yet
+	// old enough to prune...
+	prune(0)
+
+	// ...until the clock passes the age limit. An action read after that is
+	// touched, and survives.
+	clock.Advance(2 * time.Hour)
+	if _, path, err := d.Get(ctx, "a1b2c3"); err != nil || path == "" {
+		t.Fatalf("Get: got %q, %v; want hit", path, err)
+	}
+	prune(1)
+	if oid, _, err := d.Get(ctx, "a1b2c3"); err != nil || oid == "" {
+		t.Errorf("Get a1b2c3: got %q, %v; want hit", oid, err)
+	}
+	if oid, _, err := d.Get(ctx, "d4e5f6"); err != nil || oid != "" {
+		t.Errorf("Get d4e5f6: got %q, %v; want miss", oid, err)
+	}
+}
+
+func TestFastDir(t *testing.T) {
+	dir, fast := t.TempDir(), t.TempDir()
+	ctx := context.Background()
+
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{FastDir: fast, FastMaxSize: 8})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	put := func(actionID, outputID, content string) {
+		t.Helper()
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", actionID, err)
+		}
+	}
+	checkGet := func(actionID, wantDir string) {
+		t.Helper()
+		_, path, err := d.Get(ctx, actionID)
+		if err != nil || path == "" {
+			t.Fatalf("Get %q: got %q, %v; want hit", actionID, path, err)
+		}
+		if !strings.HasPrefix(path, wantDir) {
+			t.Errorf("Get %q: path %q is not under %q", actionID, path, wantDir)
+		}
+	}
+	put("aa01", "bb01", "small")
+	put("aa02", "bb02", "this object is large")
+
+	checkGet("aa01", fast)
+	checkGet("aa02", dir)
+
+	// Raising the size limit should move the larger object when it is read.
+	d, err = cachedir.NewWithOptions(dir, &cachedir.Options{FastDir: fast, FastMaxSize: 64})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	checkGet("aa02", fast)
+	if _, err := os.Stat(filepath.Join(dir, "output", "bb", "bb02")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat old object: got %v, want %v", err, os.ErrNotExist)
+	}
+
+	// Pruning should sweep both directories.
+	if st, err := d.PruneEntries(ctx, -1); err != nil {
+		t.Errorf("PruneEntries: unexpected error: %v", err)
+	} else if st.ActionsPruned != 2 || st.ObjectsPruned != 2 {
+		t.Errorf("PruneEntries: got %+v, want 2 actions and 2 objects pruned", st)
+	}
+}
+
+func TestSharding(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Populate a cache with the default layout.
+	d1, err := cachedir.New(dir)
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	if _, err := d1.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3d4",
+		OutputID: "0b1ec7ed",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// Reopen the same directory with a two-level layout.
+	d2, err := cachedir.NewWithOptions(dir, &cachedir.Options{ShardDepth: 2})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	// The existing entry should be found, and moved to the new layout.
+	obj, diskPath, err := d2.Get(ctx, "a1b2c3d4")
+	if err != nil || obj != "0b1ec7ed" {
+		t.Fatalf("Get: got %q, %q, %v; want 0b1ec7ed, <path>, nil", obj, diskPath, err)
+	}
+	if want := filepath.Join(dir, "output", "0b", "1e", "0b1ec7ed"); diskPath != want {
+		t.Errorf("Get: path is %q, want %q", diskPath, want)
+	}
+	for _, path := range []string{
+		filepath.Join(dir, "action", "a1", "b2", "a1b2c3d4"),
+		filepath.Join(dir, "output", "0b", "1e", "0b1ec7ed"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Migrated entry: %v", err)
+		}
+	}
+	for _, path := range []string{
+		filepath.Join(dir, "action", "a1", "a1b2c3d4"),
+		filepath.Join(dir, "output", "0b", "0b1ec7ed"),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Legacy entry %q still exists: %v", path, err)
+		}
+	}
+
+	// Pruning should see the entry in the new layout.
+	if st, err := d2.PruneEntries(ctx, time.Hour); err != nil {
+		t.Errorf("PruneEntries: unexpected error: %v", err)
+	} else if st.Actions != 1 || st.ActionsPruned != 0 || st.Objects != 1 {
+		t.Errorf("PruneEntries: got %+v, want 1 action and 1 object, none pruned", st)
+	}
+}
+
+func TestActions(t *testing.T) {
+	d, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{ShardDepth: 2})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	want := []string{"a1b2c3d4", "a1b2ffff", "c0ffee00"}
+	for _, id := range want {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b1ec7ed",
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+
+	var mu sync.Mutex
+	var got []string
+	if err := d.Actions(ctx, func(id string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, id)
+		return nil
+	}); err != nil {
+		t.Fatalf("Actions: unexpected error: %v", err)
+	}
+	slices.Sort(got)
+	if diff := gocmp.Diff(got, want); diff != "" {
+		t.Errorf("Actions (-got, +want):\n%s", diff)
+	}
+
+	// An error from the callback stops the walk.
+	errStop := errors.New("stop")
+	if err := d.Actions(ctx, func(string) error { return errStop }); !errors.Is(err, errStop) {
+		t.Errorf("Actions: got %v, want %v", err, errStop)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir, fast := t.TempDir(), t.TempDir()
+	d, err := cachedir.NewWithOptions(dir, &cachedir.Options{FastDir: fast, FastMaxSize: 8, PruneConcurrency: 2})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	// An empty cache has no entries.
+	for e, err := range d.Scan(ctx) {
+		t.Errorf("Scan empty: got %+v, %v; want nothing", e, err)
+	}
+
+	for _, tc := range []struct{ action, output, body string }{
+		{"a1b2c3", "0b1ec7", "xyzzy"},
+		{"d4e5f6", "0b1ec8", "a larger object"},
+	} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: tc.action,
+			OutputID: tc.output,
+			Size:     int64(len(tc.body)),
+			Body:     strings.NewReader(tc.body),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", tc.action, err)
+		}
+	}
+	tmp := filepath.Join(dir, "output", "0b", "0b1ec9-123.aftmp")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Write temp file: %v", err)
+	}
+
+	type entry struct {
+		Kind, ID, Path string
+		Size           int64
+	}
+	var got []entry
+	for e, err := range d.Scan(ctx) {
+		if err != nil {
+			t.Fatalf("Scan: unexpected error: %v", err)
+		} else if e.ModTime.IsZero() {
+			t.Errorf("Scan: entry %q has no modification time", e.Path)
+		}
+		got = append(got, entry{e.Kind, e.ID, e.Path, e.Size})
+	}
+	slices.SortFunc(got, func(a, b entry) int { return strings.Compare(a.Path, b.Path) })
+	want := []entry{
+		{"action", "a1b2c3", filepath.Join(dir, "action", "a1", "a1b2c3"), 9},
+		{"action", "d4e5f6", filepath.Join(dir, "action", "d4", "d4e5f6"), 10},
+		{"output", "", tmp, 7},
+		{"output", "0b1ec8", filepath.Join(dir, "output", "0b", "0b1ec8"), 15},
+		{"output", "0b1ec7", filepath.Join(fast, "output", "0b", "0b1ec7"), 5},
+	}
+	slices.SortFunc(want, func(a, b entry) int { return strings.Compare(a.Path, b.Path) })
+	if diff := gocmp.Diff(got, want); diff != "" {
+		t.Errorf("Scan (-got, +want):\n%s", diff)
+	}
+
+	// Stopping early is safe.
+	for range d.Scan(ctx) {
+		break
+	}
+
+	// A cancelled scan reports the error of the context.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	var serr error
+	for _, err := range d.Scan(cctx) {
+		serr = err
+	}
+	if !errors.Is(serr, context.Canceled) {
+		t.Errorf("Scan: got error %v, want %v", serr, context.Canceled)
+	}
+
+	// A scan cancelled partway through stops reporting entries, and reports
+	// the error of the context.
+	for i := range 50 {
+		id := fmt.Sprintf("%02x", i)
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: "ac" + id,
+			OutputID: id + "00",
+			Size:     5,
+			Body:     strings.NewReader("hello"),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+	cctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	var seen, after int
+	serr = nil
+	for _, err := range d.Scan(cctx) {
+		if err != nil {
+			serr = err
+			continue
+		}
+		seen++
+		if cctx.Err() != nil {
+			after++
+		}
+		if seen == 3 {
+			cancel()
+		}
+	}
+	if after != 0 {
+		t.Errorf("Scan: got %d entries after cancellation, want 0", after)
+	}
+	if !errors.Is(serr, context.Canceled) {
+		t.Errorf("Scan: got error %v, want %v", serr, context.Canceled)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	src, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	for _, id := range []string{"a1b2c3d4", "c0ffee00"} {
+		if _, err := src.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b1ec7" + id[:2],
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", id, err)
+		}
+	}
+
+	var buf strings.Builder
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: unexpected error: %v", err)
+	}
+
+	// Restore into a cache with a different layout.
+	dst, err := cachedir.NewWithOptions(t.TempDir(), &cachedir.Options{ShardDepth: 2})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	if err := dst.Restore(strings.NewReader(buf.String())); err != nil {
+		t.Fatalf("Restore: unexpected error: %v", err)
+	}
+	for _, id := range []string{"a1b2c3d4", "c0ffee00"} {
+		obj, path, err := dst.Get(ctx, id)
+		if err != nil || obj != "0b1ec7"+id[:2] {
+			t.Errorf("Get %q: got %q, %v; want 0b1ec7%s, nil", id, obj, err, id[:2])
+			continue
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "xyzzy" {
+			t.Errorf("Object %q: got %q, %v; want xyzzy", id, data, err)
+		}
+	}
+
+	// A snapshot of the restored cache should match the original.
+	var buf2 strings.Builder
+	if err := dst.Snapshot(&buf2); err != nil {
+		t.Fatalf("Snapshot: unexpected error: %v", err)
+	}
+	if diff := gocmp.Diff(buf2.String(), buf.String()); diff != "" {
+		t.Errorf("Snapshot of restored cache (-got, +want):\n%s", diff)
+	}
+
+	// RestoreMissing keeps existing results, while Restore replaces them.
+	if _, err := dst.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3d4",
+		OutputID: "0b1ec7ff",
+		Size:     5,
+		Body:     strings.NewReader("plugh"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		restore func(io.Reader) error
+		want    string
+	}{
+		{dst.RestoreMissing, "0b1ec7ff"},
+		{dst.Restore, "0b1ec7a1"},
+	} {
+		if err := tc.restore(strings.NewReader(buf.String())); err != nil {
+			t.Fatalf("Restore: unexpected error: %v", err)
+		}
+		if obj, _, err := dst.Get(ctx, "a1b2c3d4"); err != nil || obj != tc.want {
+			t.Errorf("Get after restore: got %q, %v; want %q, nil", obj, err, tc.want)
+		}
+	}
+}
+
+func TestRestoreMismatch(t *testing.T) {
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	const outputID = "0000000000000000000000000000000000000000000000000000000000000000"
+	snap := `{"format":"gocache-snapshot","version":1}` + "\n" +
+		`{"actionID":"a1b2c3d4","outputID":"` + outputID + `","size":5}` + "\nxyzzy"
+
+	// An object that does not match its digest fails the restore, and is not
+	// stored.
+	if err := d.Restore(strings.NewReader(snap)); !errors.Is(err, snapshot.ErrDigestMismatch) {
+		t.Errorf("Restore: got %v, want %v", err, snapshot.ErrDigestMismatch)
+	}
+	if obj, _, err := d.Get(context.Background(), "a1b2c3d4"); err != nil || obj != "" {
+		t.Errorf("Get after restore: got %q, %v; want miss", obj, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct{ action, output, body string }{
+		{"a1b2c3", "0b1ec7", "xyzzy"},
+		{"d4e5f6", "0b1ec7", "xyzzy"}, // shares an object
+		{"f7f8f9", "0b1ec8", "plugh!"},
+	} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: tc.action,
+			OutputID: tc.output,
+			Size:     int64(len(tc.body)),
+			Body:     strings.NewReader(tc.body),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", tc.action, err)
+		}
+	}
+
+	u, err := d.Usage(ctx)
+	if err != nil {
+		t.Fatalf("Usage: unexpected error: %v", err)
+	}
+	want := cachedir.Usage{Actions: 3, Objects: 2, ActionBytes: 16, ObjectBytes: 11}
+	if diff := gocmp.Diff(u, want); diff != "" {
+		t.Errorf("Usage (-got, +want):\n%s", diff)
+	}
+	if got, want := u.DedupRatio(), 16.0/11; got != want {
+		t.Errorf("DedupRatio: got %v, want %v", got, want)
+	}
+}
+
+func TestTotals(t *testing.T) {
+	dir := t.TempDir()
+	clock := cachetest.NewClock(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	newDir := func() *cachedir.Dir {
+		t.Helper()
+		d, err := cachedir.NewWithOptions(dir, &cachedir.Options{Clock: clock})
+		if err != nil {
+			t.Fatalf("New: unexpected error: %v", err)
+		}
+		return d
+	}
+	d1, d2 := newDir(), newDir() // as if in separate processes
+	ctx := context.Background()
+	put := func(d *cachedir.Dir, action, output, body string) {
+		t.Helper()
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: action,
+			OutputID: output,
+			Size:     int64(len(body)),
+			Body:     strings.NewReader(body),
+		}); err != nil {
+			t.Fatalf("Put %q: unexpected error: %v", action, err)
+		}
+	}
+	check := func(want cachedir.Totals) {
+		t.Helper()
+		got, err := d1.Totals(ctx)
+		if err != nil {
+			t.Fatalf("Totals: unexpected error: %v", err)
+		} else if got != want {
+			t.Errorf("Totals: got %+v, want %+v", got, want)
+		}
+	}
+
+	// The totals of an empty cache are built by a scan.
+	check(cachedir.Totals{})
+
+	put(d1, "a1b2c3", "0b1ec7", "xyzzy")
+	put(d2, "d4e5f6", "0b1ec7", "xyzzy") // shares an object
+	put(d2, "f7f8f9", "0b1ec8", "plugh!")
+	check(cachedir.Totals{Actions: 3, Objects: 2, ObjectBytes: 11})
+
+	// Replacing an action does not add to the count of actions. The totals
+	// were folded into the base file by the last check, so this also checks
+	// that the writers start new delta files.
+	put(d1, "a1b2c3", "0b1ec9", "fee fie foe")
+	put(d2, "0c1d2e", "0b1ec9", "fee fie foe")
+	check(cachedir.Totals{Actions: 4, Objects: 3, ObjectBytes: 22})
+	if des, err := os.ReadDir(filepath.Join(dir, "totals")); err != nil || len(des) != 1 {
+		t.Errorf("Totals directory: got %v, %v; want only the base file", des, err)
+	}
+
+	// Changes made behind the back of the Dir are not seen, since the totals
+	// do not scan the cache...
+	stray := filepath.Join(dir, "output", "0b", "0b1eca")
+	if err := os.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatalf("Write stray object: %v", err)
+	}
+	check(cachedir.Totals{Actions: 4, Objects: 3, ObjectBytes: 22})
+
+	// ...until they are rebuilt.
+	if err := os.Remove(filepath.Join(dir, "totals", "base")); err != nil {
+		t.Fatalf("Remove totals: %v", err)
+	}
+	check(cachedir.Totals{Actions: 4, Objects: 4, ObjectBytes: 27})
+
+	// Pruning reconciles the totals with what remains.
+	clock.Advance(2 * time.Hour)
+	put(d2, "0c1d2e", "0b1ec9", "fee fie foe") // refresh this action
+	if _, err := d1.PruneEntries(ctx, time.Hour); err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	}
+	check(cachedir.Totals{Actions: 1, Objects: 1, ObjectBytes: 11})
+}
+
+func TestFS(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "cache")
+	mfs := newMemFS()
+	clock := cachetest.NewClock(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	d, err := cachedir.NewWithOptions(root, &cachedir.Options{
+		FS:         mfs,
+		Clock:      clock,
+		SessionDir: filepath.Join(root, "session"),
+		Durability: cachedir.DurabilitySyncDir,
+	})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, id := range []string{"a1b2c3", "d4e5f6"} {
+		if _, err := d.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b1ec7" + id,
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %s: unexpected error: %v", id, err)
+		}
+	}
+
+	// Nothing is stored on the local filesystem.
+	if _, err := os.Stat(root); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat %q: got %v, want %v", root, err, os.ErrNotExist)
+	}
+
+	// The session copy is made in the FS.
+	oid, path, err := d.Get(ctx, "a1b2c3")
+	if err != nil || oid != "0b1ec7a1b2c3" {
+		t.Fatalf("Get: got %q, %q, %v; want hit", oid, path, err)
+	}
+	if got, ok := mfs.contents(path); !ok || got != "xyzzy" {
+		t.Errorf("Object %q: got %q, %v; want %q", path, got, ok, "xyzzy")
+	}
+
+	if u, err := d.Usage(ctx); err != nil {
+		t.Errorf("Usage: unexpected error: %v", err)
+	} else if u.Actions != 2 || u.ObjectBytes != 10 {
+		t.Errorf("Usage: got %+v, want 2 actions and 10 object bytes", u)
+	}
+	if st, err := d.Check(ctx, &cachedir.CheckOptions{Digests: true}); err != nil || !st.OK() {
+		t.Errorf("Check: got %+v, %v; want OK", st, err)
+	}
+
+	// A cache in memory can be snapshotted and restored, as on disk.
+	var snap strings.Builder
+	if err := d.Snapshot(&snap); err != nil {
+		t.Fatalf("Snapshot: unexpected error: %v", err)
+	}
+	d2, err := cachedir.NewWithOptions(root, &cachedir.Options{FS: newMemFS()})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	if err := d2.Restore(strings.NewReader(snap.String())); err != nil {
+		t.Fatalf("Restore: unexpected error: %v", err)
+	}
+	if oid, _, err := d2.Get(ctx, "d4e5f6"); err != nil || oid != "0b1ec7d4e5f6" {
+		t.Errorf("Get after restore: got %q, %v; want 0b1ec7d4e5f6", oid, err)
+	}
+
+	// Pruning removes expired actions and their objects from the FS.
+	d.Cleanup(0)(ctx)
+	clock.Advance(2 * time.Hour)
+	st, err := d.PruneEntries(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("PruneEntries: unexpected error: %v", err)
+	} else if st.ActionsPruned != 2 || st.ObjectsPruned != 2 || st.BytesPruned != 10 {
+		t.Errorf("PruneEntries: got %+v, want 2 actions and 2 objects (10 bytes) pruned", st)
+	}
+	if diff := gocmp.Diff(mfs.files(), []string{filepath.Join(root, "totals", "base")}); diff != "" {
+		t.Errorf("Files after pruning (-got, +want):\n%s", diff)
+	}
+}
+
+// memFS is an in-memory implementation of [cachedir.FS] for testing.
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // path → node
+	seq   int                 // for temporary names
+}
+
+type memNode struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{nodes: map[string]*memNode{
+		string(filepath.Separator): {mode: fs.ModeDir | 0755},
+	}}
+}
+
+// contents returns the contents of the file at path, and whether it exists.
+func (m *memFS) contents(path string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[filepath.Clean(path)]
+	if !ok || n.mode.IsDir() {
+		return "", false
+	}
+	return string(n.data), true
+}
+
+// files returns the sorted paths of the files in m, other than lock files.
+func (m *memFS) files() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for path, n := range m.nodes {
+		if !n.mode.IsDir() && !strings.HasSuffix(path, ".lock") {
+			out = append(out, path)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (m *memFS) pathError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// create adds an empty file at path, and must be called with m.mu held.
+func (m *memFS) create(path string, excl bool, perm fs.FileMode) (*memNode, error) {
+	if n, ok := m.nodes[path]; ok {
+		if excl {
+			return nil, m.pathError("open", path, fs.ErrExist)
+		} else if n.mode.IsDir() {
+			return nil, m.pathError("open", path, errors.New("is a directory"))
+		}
+		return n, nil
+	}
+	if p, ok := m.nodes[filepath.Dir(path)]; !ok || !p.mode.IsDir() {
+		return nil, m.pathError("open", path, fs.ErrNotExist)
+	}
+	n := &memNode{mode: perm, modTime: time.Now()}
+	m.nodes[path] = n
+	return n, nil
+}
+
+func (m *memFS) tempName(dir, pattern string) string {
+	m.seq++
+	pre, suf, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return filepath.Join(dir, fmt.Sprintf("%s%d", pattern, m.seq))
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", pre, m.seq, suf))
+}
+
+func (m *memFS) Open(name string) (cachedir.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, m.pathError("open", name, fs.ErrNotExist)
+	}
+	return &memFile{fs: m, name: name, r: strings.NewReader(string(n.data))}, nil
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (cachedir.File, error) {
+	if flag&os.O_CREATE == 0 {
+		return m.Open(name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, err := m.create(name, flag&os.O_EXCL != 0, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{fs: m, node: n, name: name, r: strings.NewReader(string(n.data))}, nil
+}
+
+func (m *memFS) CreateTemp(dir, pattern string) (cachedir.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := m.tempName(filepath.Clean(dir), pattern)
+	n, err := m.create(name, true, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{fs: m, node: n, name: name, r: strings.NewReader("")}, nil
+}
+
+func (m *memFS) MkdirTemp(dir, pattern string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := m.tempName(filepath.Clean(dir), pattern)
+	n, err := m.create(name, true, 0700)
+	if err != nil {
+		return "", err
+	}
+	n.mode |= fs.ModeDir
+	return name, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if n, ok := m.nodes[p]; ok {
+			if !n.mode.IsDir() {
+				return m.pathError("mkdir", p, errors.New("not a directory"))
+			}
+			break
+		}
+		m.nodes[p] = &memNode{mode: fs.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, m.pathError("stat", name, fs.ErrNotExist)
+	}
+	return memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if n, ok := m.nodes[name]; !ok || !n.mode.IsDir() {
+		return nil, m.pathError("readdir", name, fs.ErrNotExist)
+	}
+	var out []fs.DirEntry
+	for path, n := range m.nodes {
+		if path != name && filepath.Dir(path) == name {
+			out = append(out, fs.FileInfoToDirEntry(memInfo{
+				name: filepath.Base(path), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime,
+			}))
+		}
+	}
+	slices.SortFunc(out, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return out, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := m.nodes[oldpath]
+	if !ok {
+		return m.pathError("rename", oldpath, fs.ErrNotExist)
+	} else if n.mode.IsDir() {
+		return m.pathError("rename", oldpath, errors.New("is a directory"))
+	} else if p, ok := m.nodes[filepath.Dir(newpath)]; !ok || !p.mode.IsDir() {
+		return m.pathError("rename", newpath, fs.ErrNotExist)
+	}
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = n
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.nodes[name]; !ok {
+		return m.pathError("remove", name, fs.ErrNotExist)
+	}
+	for path := range m.nodes {
+		if filepath.Dir(path) == name && path != name {
+			return m.pathError("remove", name, errors.New("directory not empty"))
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	for p := range m.nodes {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(m.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return m.pathError("chmod", name, fs.ErrNotExist)
+	}
+	n.mode = n.mode.Type() | mode.Perm()
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return m.pathError("chtimes", name, fs.ErrNotExist)
+	} else if !mtime.IsZero() {
+		n.modTime = mtime
+	}
+	return nil
+}
+
+// memFile is an open file in a memFS. Writes are appended to the node.
+type memFile struct {
+	fs   *memFS
+	node *memNode // nil if read-only
+	name string
+	r    *strings.Reader
+}
+
+func (f *memFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.node == nil {
+		return 0, f.fs.pathError("write", f.name, fs.ErrPermission)
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Name() string { return f.name }
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return fi.size }
+func (fi memInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi memInfo) ModTime() time.Time { return fi.modTime }
+func (fi memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memInfo) Sys() any           { return nil }
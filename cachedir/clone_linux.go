@@ -0,0 +1,33 @@
+package cachedir
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the Linux FICLONE ioctl request, _IOW(0x94, 9, int).
+const ficlone = 0x40049409
+
+// cloneFile creates dst as a copy-on-write clone of src, if the filesystem
+// supports it. If cloning fails, dst is not created.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	cerr := out.Close()
+	if errno != 0 {
+		os.Remove(dst)
+		return errno
+	} else if cerr != nil {
+		os.Remove(dst)
+		return cerr
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package cachedir
+
+import "errors"
+
+// cloneFile reports an error, as cloning is not supported on this platform.
+func cloneFile(src, dst string) error { return errors.New("clone not supported") }
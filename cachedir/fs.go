@@ -0,0 +1,119 @@
+package cachedir
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FS is the filesystem in which a [Dir] stores its files. Paths are in the
+// syntax of the host, as for package os. The default, [OSFS], uses the local
+// filesystem.
+//
+// Other implementations allow a Dir to be used over an in-memory filesystem in
+// tests, or over a filesystem library such as afero or billy by a thin
+// adapter. Note that the paths reported by Get and Put are paths in the FS, so
+// the go command can read them only if the FS stores its files on local disk.
+//
+// Some features depend on the local filesystem, and are used only with
+// [OSFS]: Advisory locks (see "Concurrency" in the package docs), and cloning
+// and hard-linking objects for the SessionDir and ScratchDir options, which
+// fall back to copying with other implementations.
+type FS interface {
+	// Open opens the named file for reading.
+	Open(name string) (File, error)
+
+	// OpenFile opens the named file with the given flags, as [os.OpenFile].
+	// Only the flags O_RDONLY, O_WRONLY, O_CREATE, and O_EXCL are used.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+
+	// CreateTemp creates a new file in dir, open for writing, with a name
+	// formed from pattern as [os.CreateTemp].
+	CreateTemp(dir, pattern string) (File, error)
+
+	// MkdirTemp creates a new directory in dir, with a name formed from
+	// pattern as [os.MkdirTemp], and returns its path.
+	MkdirTemp(dir, pattern string) (string, error)
+
+	// MkdirAll creates the directory at path and any missing parents.
+	MkdirAll(path string, perm fs.FileMode) error
+
+	// Stat returns file info for the named file.
+	Stat(name string) (fs.FileInfo, error)
+
+	// ReadDir returns the entries of the named directory, sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+
+	// Rename renames oldpath to newpath, replacing newpath if it exists.
+	Rename(oldpath, newpath string) error
+
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+
+	// RemoveAll removes path and anything it contains.
+	RemoveAll(path string) error
+
+	// Chmod changes the permissions of the named file.
+	Chmod(name string, mode fs.FileMode) error
+
+	// Chtimes changes the access and modification times of the named file.
+	// A zero time leaves the corresponding time unchanged.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is an open file in an [FS].
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	// Name returns the path of the file, as passed to the FS.
+	Name() string
+
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+}
+
+// OSFS is an [FS] that uses the local filesystem through package os.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) { return os.Open(name) }
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) CreateTemp(dir, pattern string) (File, error) { return os.CreateTemp(dir, pattern) }
+
+func (osFS) MkdirTemp(dir, pattern string) (string, error) { return os.MkdirTemp(dir, pattern) }
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) RemoveAll(path string) error { return os.RemoveAll(path) }
+
+func (osFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// readFile returns the contents of the named file in fsys.
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
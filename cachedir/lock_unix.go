@@ -0,0 +1,34 @@
+//go:build unix
+
+package cachedir
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an advisory lock on the file at path, creating the file if
+// necessary, and returns a function that releases the lock. The lock is
+// exclusive if exclusive is true, and otherwise shared. It blocks until the
+// lock is available.
+func lockFile(path string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil // closing the file releases the lock
+}
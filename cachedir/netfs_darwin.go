@@ -0,0 +1,24 @@
+package cachedir
+
+import "syscall"
+
+// Filesystem type names reported by statfs(2) for network filesystems.
+var networkFSTypes = map[string]bool{
+	"nfs": true, "smbfs": true, "afpfs": true, "webdav": true,
+}
+
+// IsNetworkFS reports whether path is on a network filesystem.
+func IsNetworkFS(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return networkFSTypes[string(name)], nil
+}
@@ -0,0 +1,26 @@
+package cachedir
+
+import "syscall"
+
+// Filesystem type identifiers from statfs(2) for network and cluster
+// filesystems.
+var networkFSTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x5346414f: true, // AFS
+	0x00c36400: true, // Ceph
+	0x01021997: true, // 9P
+	0x0bd00bd0: true, // Lustre
+	0x47504653: true, // GPFS
+}
+
+// IsNetworkFS reports whether path is on a network filesystem.
+func IsNetworkFS(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return networkFSTypes[uint32(st.Type)], nil
+}
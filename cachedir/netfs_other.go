@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package cachedir
+
+// IsNetworkFS reports whether path is on a network filesystem.
+// On this platform it always reports false.
+func IsNetworkFS(path string) (bool, error) { return false, nil }
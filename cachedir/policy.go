@@ -0,0 +1,61 @@
+package cachedir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// An Entry describes a cached action presented to a [PrunePolicy].
+type Entry struct {
+	ActionID string    `json:"actionID"`
+	OutputID string    `json:"outputID"`
+	Size     int64     `json:"size"`    // object size in bytes
+	ModTime  time.Time `json:"modTime"` // when the action was last written
+	Expired  bool      `json:"expired"` // whether the action is older than the prune age
+}
+
+// A PrunePolicy chooses which of the given cache entries to remove during
+// pruning, and returns the action IDs of the entries to remove. Objects no
+// longer referenced by any remaining action are removed after the policy is
+// applied. If the policy reports an error, pruning stops without removing
+// any of the candidate actions.
+type PrunePolicy func(ctx context.Context, entries []Entry) (evict []string, _ error)
+
+// CommandPolicy returns a [PrunePolicy] that runs the specified program to
+// choose which entries to remove.
+//
+// The program receives a JSON array of [Entry] values on stdin, and must write
+// a JSON object to stdout listing the action IDs to remove:
+//
+//	{"evict": ["actionID", ...]}
+//
+// The program's stderr is passed through to the stderr of the caller. If the
+// program exits with an error, pruning fails.
+func CommandPolicy(name string, args ...string) PrunePolicy {
+	return func(ctx context.Context, entries []Entry) ([]string, error) {
+		input, err := json.Marshal(entries)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("run %q: %w", name, err)
+		}
+		var result struct {
+			Evict []string `json:"evict"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			return nil, fmt.Errorf("decode output of %q: %w", name, err)
+		}
+		return result.Evict, nil
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package cachedir
+
+// isTransient reports whether err is a filesystem error that may succeed if
+// the operation is retried shortly. On this platform it always reports false.
+func isTransient(err error) bool { return false }
@@ -0,0 +1,26 @@
+//go:build windows
+
+package cachedir
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Windows error codes reported when another process has a file open in a way
+// that prevents it from being renamed, replaced, or removed. These persist
+// only while the other process, often an antivirus scanner, indexer, or the
+// go command itself, has the file open.
+const (
+	errAccessDenied     = syscall.Errno(5)  // ERROR_ACCESS_DENIED
+	errSharingViolation = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+	errLockViolation    = syscall.Errno(33) // ERROR_LOCK_VIOLATION
+)
+
+// isTransient reports whether err is a filesystem error that may succeed if
+// the operation is retried shortly.
+func isTransient(err error) bool {
+	return errors.Is(err, errSharingViolation) ||
+		errors.Is(err, errLockViolation) ||
+		errors.Is(err, errAccessDenied)
+}
@@ -0,0 +1,172 @@
+package cachedir
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"iter"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// A ScanEntry is a file in the cache, as reported by [Dir.Scan].
+type ScanEntry struct {
+	Kind    string    // "action" or "output"
+	ID      string    // the action or output ID, or "" for a temporary file
+	Path    string    // the path of the file
+	Size    int64     // the size of the file in bytes
+	ModTime time.Time // the modification time of the file
+}
+
+// Scan returns an iterator over the action and object files stored in d,
+// including those in the fast directory, if there is one. Temporary files
+// left by incomplete writes are reported with an empty ID.
+//
+// Directories are read concurrently, up to the PruneConcurrency limit, and
+// the entries of each are reported together, so entries are not reported in
+// any particular order. If ctx ends or a directory cannot be read, the
+// iterator reports the error and stops.
+//
+// PruneEntries, Check, Usage, and Snapshot all enumerate the cache with Scan.
+func (d *Dir) Scan(ctx context.Context) iter.Seq2[ScanEntry, error] {
+	return d.scan(ctx, "action", "output")
+}
+
+// scan is as [Dir.Scan], but reports only files of the given kinds.
+func (d *Dir) scan(ctx context.Context, kinds ...string) iter.Seq2[ScanEntry, error] {
+	return func(yield func(ScanEntry, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		batches := make(chan []ScanEntry, d.workers)
+		sem := make(chan struct{}, d.workers) // limits concurrent directory reads
+		g := taskgroup.New(cancel)
+
+		var visit func(kind, dir string, root bool) taskgroup.Task
+		visit = func(kind, dir string, root bool) taskgroup.Task {
+			return func() error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				batch, subdirs, err := d.readBatch(kind, dir)
+				<-sem
+				if root && errors.Is(err, fs.ErrNotExist) {
+					return nil // nothing of this kind has been stored
+				} else if err != nil {
+					return err
+				}
+				for _, sub := range subdirs {
+					g.Go(visit(kind, sub, false))
+				}
+				if len(batch) == 0 {
+					return nil
+				}
+				select {
+				case batches <- batch:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		for _, kind := range kinds {
+			roots := []string{d.path}
+			if kind == "output" && d.fast != "" {
+				roots = append(roots, d.fast)
+			}
+			for _, root := range roots {
+				g.Go(visit(kind, filepath.Join(root, kind), true))
+			}
+		}
+		done := make(chan error, 1)
+		go func() { done <- g.Wait(); close(batches) }()
+
+		for batch := range batches {
+			for _, e := range batch {
+				if ctx.Err() != nil {
+					break // reported below
+				} else if !yield(e, nil) {
+					cancel()
+					for range batches {
+						// Wait for the readers to stop.
+					}
+					return
+				}
+			}
+		}
+		err := <-done
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			yield(ScanEntry{}, err)
+		}
+	}
+}
+
+// readBatch reads the directory at dir, and returns entries for the regular
+// files it contains, and the paths of its subdirectories. Files that are
+// removed while the directory is being read are skipped.
+func (d *Dir) readBatch(kind, dir string) ([]ScanEntry, []string, error) {
+	des, err := d.fsys.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var batch []ScanEntry
+	var subdirs []string
+	for _, de := range des {
+		path := filepath.Join(dir, de.Name())
+		if de.IsDir() {
+			subdirs = append(subdirs, path)
+			continue
+		} else if !de.Type().IsRegular() {
+			continue // skip other stuff
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue // e.g., removed concurrently
+		}
+		id := de.Name()
+		if strings.Contains(id, ".") {
+			id = "" // a temporary file from an incomplete write
+		}
+		batch = append(batch, ScanEntry{
+			Kind:    kind,
+			ID:      id,
+			Path:    path,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	return batch, subdirs, nil
+}
+
+// forEach calls f for each entry of the given kind reported by [Dir.Scan],
+// running up to d.workers calls concurrently. It stops early and reports an
+// error if ctx ends or if any call to f fails.
+func (d *Dir) forEach(ctx context.Context, kind string, f func(ScanEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g, run := taskgroup.New(cancel).Limit(d.workers)
+	var serr error
+	for e, err := range d.scan(ctx, kind) {
+		if err != nil {
+			serr = err
+			break
+		}
+		run(func() error { return f(e) })
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return serr
+}
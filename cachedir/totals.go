@@ -0,0 +1,223 @@
+package cachedir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/gocache"
+)
+
+// Totals are running totals of the files stored in a [Dir]. Unlike [Usage],
+// they count every object file, including objects no longer referenced by
+// any action, until they are pruned.
+type Totals struct {
+	Actions     int   // the number of action files
+	Objects     int   // the number of object files
+	ObjectBytes int64 // the total size of the object files
+}
+
+func (t Totals) add(u Totals) Totals {
+	return Totals{
+		Actions:     t.Actions + u.Actions,
+		Objects:     t.Objects + u.Objects,
+		ObjectBytes: t.ObjectBytes + u.ObjectBytes,
+	}
+}
+
+func (t Totals) String() string {
+	return fmt.Sprintf("%d %d %d\n", t.Actions, t.Objects, t.ObjectBytes)
+}
+
+// Totals reports the running totals of the files stored in d. The totals are
+// maintained by Put and PruneEntries, so Totals does not scan the cache, as
+// Usage does, unless the totals are missing, e.g., because the cache was
+// written by an older version, or a prune did not finish. See "Totals" in
+// the package docs.
+func (d *Dir) Totals(ctx context.Context) (Totals, error) {
+	t, deltas, err := d.readTotals()
+	if err != nil {
+		gocache.Logf(ctx, "read totals: %v; rebuilding", err)
+		return d.rebuildTotals(ctx)
+	} else if deltas == 0 {
+		return t, nil
+	}
+
+	// Fold the changes recorded by writers into the base file, so that delta
+	// files do not pile up when the cache is not pruned. This is best-effort,
+	// e.g., the cache may be read-only.
+	unlock, err := d.lockWrites(true)
+	if err != nil {
+		gocache.Logf(ctx, "lock cache: %v (ignored)", err)
+		return t, nil
+	}
+	defer unlock()
+	if t, _, err = d.readTotals(); err != nil {
+		return d.rebuildTotalsLocked(ctx)
+	} else if err := d.writeTotals(t); err != nil {
+		gocache.Logf(ctx, "write totals: %v (ignored)", err)
+	}
+	return t, nil
+}
+
+func (d *Dir) totalsPath() string { return filepath.Join(d.path, "totals", "base") }
+
+// readTotals returns the totals recorded in the totals base file of d, plus
+// the changes recorded in the delta files of processes that have written to
+// the cache since, and the number of delta files.
+func (d *Dir) readTotals() (Totals, int, error) {
+	data, err := readFile(d.fsys, d.totalsPath())
+	if err != nil {
+		return Totals{}, 0, err
+	}
+	t, ok := parseTotals(string(data))
+	if !ok || strings.Count(string(data), "\n") != 1 {
+		return Totals{}, 0, fmt.Errorf("invalid totals file: %w", gocache.ErrCorruptObject)
+	}
+	td := filepath.Dir(d.totalsPath())
+	des, err := d.fsys.ReadDir(td)
+	if err != nil {
+		return Totals{}, 0, err
+	}
+	var deltas int
+	for _, de := range des {
+		if !strings.HasPrefix(de.Name(), "delta-") {
+			continue
+		}
+		deltas++
+		data, err := readFile(d.fsys, filepath.Join(td, de.Name()))
+		if err != nil {
+			continue // e.g., reconciled concurrently
+		}
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if u, ok := parseTotals(line); ok {
+				t = t.add(u)
+			}
+		}
+	}
+	return t, deltas, nil
+}
+
+// parseTotals parses a line of a totals file. It reports false if the line
+// is not complete, e.g., because it was only partly written.
+func parseTotals(line string) (Totals, bool) {
+	fields, ok := strings.CutSuffix(line, "\n")
+	if !ok {
+		return Totals{}, false
+	}
+	fs := strings.Fields(fields)
+	if len(fs) != 3 {
+		return Totals{}, false
+	}
+	a, aerr := strconv.Atoi(fs[0])
+	o, oerr := strconv.Atoi(fs[1])
+	b, berr := strconv.ParseInt(fs[2], 10, 64)
+	if aerr != nil || oerr != nil || berr != nil {
+		return Totals{}, false
+	}
+	return Totals{Actions: a, Objects: o, ObjectBytes: b}, true
+}
+
+// rebuildTotals computes the totals of d by scanning the cache, and records
+// them. It holds the write lock, so that the scan is not confused by puts or
+// pruning in other processes.
+func (d *Dir) rebuildTotals(ctx context.Context) (Totals, error) {
+	unlock, err := d.lockWrites(true)
+	if err != nil {
+		return Totals{}, fmt.Errorf("lock cache: %w", err)
+	}
+	defer unlock()
+
+	// Another process may have rebuilt the totals while we waited.
+	if t, _, err := d.readTotals(); err == nil {
+		return t, nil
+	}
+	return d.rebuildTotalsLocked(ctx)
+}
+
+// rebuildTotalsLocked is as rebuildTotals, but the caller must hold the write
+// lock exclusively.
+func (d *Dir) rebuildTotalsLocked(ctx context.Context) (Totals, error) {
+	var t Totals
+	for e, err := range d.Scan(ctx) {
+		if err != nil {
+			return Totals{}, err
+		} else if e.ID == "" {
+			continue // a temporary file
+		} else if e.Kind == "action" {
+			t.Actions++
+		} else {
+			t.Objects++
+			t.ObjectBytes += e.Size
+		}
+	}
+	if err := d.writeTotals(t); err != nil {
+		gocache.Logf(ctx, "write totals: %v (ignored)", err)
+	}
+	return t, nil
+}
+
+// writeTotals records t as the totals of d, and removes the delta files,
+// whose changes t is assumed to include. The caller must hold the write lock
+// exclusively.
+func (d *Dir) writeTotals(t Totals) error {
+	path := d.totalsPath()
+	td := filepath.Dir(path)
+	if err := d.fsys.MkdirAll(td, 0755); err != nil {
+		return err
+	} else if _, err := d.writeFile(path, strings.NewReader(t.String())); err != nil {
+		return err
+	}
+	des, _ := d.fsys.ReadDir(td)
+	for _, de := range des {
+		if strings.HasPrefix(de.Name(), "delta-") {
+			d.fsys.Remove(filepath.Join(td, de.Name())) // best-effort
+		}
+	}
+	return nil
+}
+
+// invalidateTotals removes the totals base file of d, so that the totals are
+// rebuilt when next requested, e.g., because the contents of the cache have
+// changed in ways that were not recorded.
+func (d *Dir) invalidateTotals(ctx context.Context) {
+	if err := d.fsys.Remove(d.totalsPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		gocache.Logf(ctx, "remove totals: %v (ignored)", err)
+	}
+}
+
+// recordTotals records the change t to the totals of d in the delta file of
+// d, creating it if necessary. The caller must hold the write lock. Errors
+// are ignored, as the totals are rebuilt if they are missing.
+func (d *Dir) recordTotals(t Totals) {
+	if t == (Totals{}) {
+		return
+	}
+	d.totMu.Lock()
+	defer d.totMu.Unlock()
+
+	// If the delta file has been removed, the totals were rebuilt or
+	// reconciled by pruning, and include all the changes recorded so far.
+	if d.totFile != nil {
+		if _, err := d.fsys.Stat(d.totFile.Name()); err != nil {
+			d.totFile.Close()
+			d.totFile = nil
+		}
+	}
+	if d.totFile == nil {
+		td := filepath.Dir(d.totalsPath())
+		if err := d.fsys.MkdirAll(td, 0755); err != nil {
+			return
+		}
+		f, err := d.fsys.CreateTemp(td, "delta-*")
+		if err != nil {
+			return
+		}
+		d.totFile = f
+	}
+	d.totFile.Write([]byte(t.String()))
+}
@@ -0,0 +1,73 @@
+// Package cachens implements a wrapper for a cache backend that isolates
+// actions into a namespace.
+//
+// A [Cache] replaces each action ID with a hash of the ID and a namespace
+// string before passing it to the underlying backend. Caches with different
+// namespaces can thus share the same backend storage without seeing each
+// other's actions. A namespace may be any string, for example a project name,
+// a target platform ("linux/amd64"), a toolchain version, or a combination.
+//
+// Output IDs are not modified, since they identify object contents rather
+// than the actions that produced them, so identical objects may be shared
+// across namespaces.
+package cachens
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Cache implements a namespace wrapper around a [Backend].
+type Cache struct {
+	base      Backend
+	namespace string
+}
+
+// New constructs a new Cache that maps action IDs into the specified
+// namespace before passing them to base. If namespace == "", action IDs are
+// passed through unmodified.
+func New(base Backend, namespace string) *Cache {
+	return &Cache{base: base, namespace: namespace}
+}
+
+// Namespace reports the namespace of c.
+func (c *Cache) Namespace() string { return c.namespace }
+
+// ActionID returns the action ID used in the backend for the given ID.
+func (c *Cache) ActionID(id string) string {
+	if c.namespace == "" {
+		return id
+	}
+	h := sha256.New()
+	h.Write([]byte(c.namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get implements the corresponding method of the gocache service interface.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	return c.base.Get(ctx, c.ActionID(actionID))
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	obj.ActionID = c.ActionID(obj.ActionID)
+	return c.base.Put(ctx, obj)
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
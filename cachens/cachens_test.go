@@ -0,0 +1,70 @@
+package cachens_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/cachens"
+)
+
+func TestCache(t *testing.T) {
+	base, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	nsA := cachens.New(base, "linux/amd64")
+	nsB := cachens.New(base, "darwin/arm64")
+	none := cachens.New(base, "")
+
+	if _, err := nsA.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+
+	// The action should be visible in its own namespace...
+	if obj, path, err := nsA.Get(ctx, "a1b2c3"); err != nil || obj != "0b1ec7" || path == "" {
+		t.Errorf("Get A: got %q, %q, %v; want 0b1ec7, <path>, nil", obj, path, err)
+	}
+
+	// ...but not in others, nor in the underlying backend.
+	for _, c := range []*cachens.Cache{nsB, none} {
+		if obj, path, err := c.Get(ctx, "a1b2c3"); err != nil || obj != "" || path != "" {
+			t.Errorf("Get %q: got %q, %q, %v; want miss", c.Namespace(), obj, path, err)
+		}
+	}
+	if got := none.ActionID("a1b2c3"); got != "a1b2c3" {
+		t.Errorf("ActionID without namespace: got %q, want unchanged", got)
+	}
+}
+
+// closer is a backend that records whether it was closed.
+type closer struct {
+	cachens.Backend
+	closed bool
+}
+
+func (c *closer) Close(context.Context) error { c.closed = true; return nil }
+
+func TestClose(t *testing.T) {
+	base, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+	b := &closer{Backend: base}
+	var s gocache.Server
+	s.SetCache(cachens.New(b, "test"))
+	if err := s.Close(context.Background()); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if !b.closed {
+		t.Error("Close did not close the underlying backend")
+	}
+}
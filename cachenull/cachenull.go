@@ -0,0 +1,109 @@
+// Package cachenull implements a cache backend that stores nothing.
+//
+// A [Cache] reports a miss for every get, and accepts every put without
+// storing it, but counts them both. Use it to measure builds without a cache
+// under the same server and settings as with one, or in place of a backend
+// that cannot be used.
+//
+// Since the client may read back the object for a put from the path Put
+// returns, the contents of each object are kept in a temporary file until the
+// Cache is closed.
+package cachenull
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/creachadair/gocache"
+)
+
+// MissNull is the reason recorded for the misses reported by [Cache.Get].
+const MissNull = "null"
+
+// Cache is a cache backend that stores nothing. The zero value is ready for
+// use.
+type Cache struct {
+	gets     expvar.Int
+	puts     expvar.Int
+	putBytes expvar.Int
+
+	mu  sync.Mutex
+	dir string // temporary directory for objects, or "" if not yet created
+}
+
+// New constructs a new, empty Cache.
+func New() *Cache { return new(Cache) }
+
+// Get implements the corresponding method of the gocache service interface.
+// It reports a miss for every action.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	c.gets.Add(1)
+	gocache.SetMissReason(ctx, MissNull)
+	return "", "", nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// It writes the contents of obj to a temporary file, which is removed when c
+// is closed, and returns its path.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	dir, err := c.tempDir()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "object-*")
+	if err != nil {
+		return "", err
+	}
+	nw, err := io.Copy(f, obj.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	c.puts.Add(1)
+	c.putBytes.Add(nw)
+	return f.Name(), nil
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It removes the objects written by Put. The counts are not reset, and c may
+// be used again after it is closed.
+func (c *Cache) Close(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(c.dir)
+	c.dir = ""
+	return err
+}
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the request counts for c to m. It has the signature of the
+// SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("null_gets", &c.gets)
+	m.Set("null_puts", &c.puts)
+	m.Set("null_put_bytes", &c.putBytes)
+}
+
+// tempDir returns the temporary directory for objects, creating it if needed.
+func (c *Cache) tempDir() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dir == "" {
+		dir, err := os.MkdirTemp("", "cachenull-*")
+		if err != nil {
+			return "", err
+		}
+		c.dir = dir
+	}
+	return c.dir, nil
+}
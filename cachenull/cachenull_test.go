@@ -0,0 +1,74 @@
+package cachenull_test
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/gocache/cachenull"
+	"github.com/creachadair/gocache/cachetest"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := cachenull.New()
+
+	const content = "hello, world"
+	path, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2",
+		OutputID: "c3d4",
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != content {
+		t.Errorf("Read %q: got %q, %v; want %q", path, data, err, content)
+	}
+	if oid, dp, err := c.Get(ctx, "a1b2"); err != nil || oid != "" || dp != "" {
+		t.Errorf("Get: got %q, %q, %v; want a miss", oid, dp, err)
+	}
+
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	for name, want := range map[string]string{"null_gets": "1", "null_puts": "1", "null_put_bytes": "12"} {
+		if got := m.Get(name).String(); got != want {
+			t.Errorf("Metric %s: got %s, want %s", name, got, want)
+		}
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Object %q was not removed: %v", path, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	c := cachenull.New()
+	s := &gocache.Server{Get: c.Get, Put: c.Put, Close: c.Close}
+	cli, err := cacheclient.Serve(ctx, s, nil)
+	if err != nil {
+		t.Fatalf("Serve: unexpected error: %v", err)
+	}
+	err = cachetest.Run(ctx, cli, strings.NewReader("put a 10\nget a miss\nget b miss"))
+	if err != nil {
+		t.Errorf("Run: unexpected error: %v", err)
+	}
+	if err := cli.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+
+	// Misses are recorded with the null reason.
+	reasons := s.Metrics().Get("server").(*expvar.Map).Get("get_miss_reasons").(*expvar.Map)
+	if got := reasons.Get(cachenull.MissNull); got == nil || got.String() != "2" {
+		t.Errorf("Misses for %q: got %v, want 2", cachenull.MissNull, got)
+	}
+}
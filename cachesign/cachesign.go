@@ -0,0 +1,327 @@
+// Package cachesign implements a wrapper for a cache backend that signs
+// cached results, so that results written without the key are not used.
+//
+// A [Cache] attaches an HMAC-SHA256 tag to the output ID of each result it
+// stores, computed over the action ID, the output ID, and the size of the
+// object. When a result is read, the tag is checked before the result is
+// reported to the toolchain. A result whose tag is missing or invalid is
+// reported as a cache miss. This protects against cache poisoning where more
+// parties can write to the underlying storage than hold the key, for example
+// a shared directory or bucket.
+//
+// The go command uses the SHA-256 digest of an object as its output ID. When
+// an output ID has the length of a SHA-256 digest, Get also checks that the
+// contents of the object match it, so that the object cannot be replaced
+// without the key either. Other objects are checked only for size.
+//
+// # Signatures
+//
+// For environments where the parties that read the cache should not be able
+// to add to it, [NewEd25519] constructs a Cache that uses Ed25519 signatures
+// instead of HMAC tags. Writers sign results with a private key, and readers
+// check them against a set of trusted public keys. In this mode, output IDs
+// must be SHA-256 digests, so that every object is checked against its
+// signed output ID.
+//
+// # Limitations
+//
+// Since the tag is part of the output ID stored in the backend, identical
+// objects for different actions are stored separately, and the backend does
+// not see the output IDs assigned by the toolchain.
+//
+// Objects are checked when they are fetched, not copied, so an object that is
+// modified in the backend after [Cache.Get] reports it is not detected. See
+// [Cache.Get] for details.
+package cachesign
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/creachadair/gocache"
+)
+
+// MinKeyLen is the minimum length in bytes of a key accepted by [New].
+const MinKeyLen = 16
+
+// hmacTagLen is the length in bytes of the HMAC tag attached to each output
+// ID.
+const hmacTagLen = 16
+
+// ErrNoSigningKey is reported by [Cache.Put] for a Cache that can check
+// signatures but has no private key to sign with.
+var ErrNoSigningKey = errors.New("no signing key")
+
+// MissBadSignature is the miss reason recorded for a result whose tag is
+// missing or invalid.
+const MissBadSignature = "bad-signature"
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Cache implements a signing wrapper around a [Backend].
+type Cache struct {
+	base   Backend
+	signer signer
+
+	numBad expvar.Int // results rejected by Get
+}
+
+// A signer computes and checks the tags attached to output IDs.
+type signer interface {
+	// tagLen reports the length in bytes of a tag.
+	tagLen() int
+
+	// sign returns the tag for msg, or reports ErrNoSigningKey.
+	sign(msg []byte) ([]byte, error)
+
+	// verify reports whether tag is valid for msg.
+	verify(msg, tag []byte) bool
+
+	// digestsOnly reports whether output IDs must be SHA-256 digests.
+	digestsOnly() bool
+}
+
+// New constructs a new Cache that signs results stored in base with key.
+// The key must be at least [MinKeyLen] bytes long. Keys can be loaded with
+// [github.com/creachadair/gocache/cachecrypt.KeyFromEnv] or
+// [github.com/creachadair/gocache/cachecrypt.KeyFromFile].
+func New(base Backend, key []byte) (*Cache, error) {
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("key is too short (%d < %d bytes)", len(key), MinKeyLen)
+	}
+	return &Cache{base: base, signer: hmacSigner(key)}, nil
+}
+
+// NewEd25519 constructs a new Cache that signs results stored in base with
+// key, and accepts results signed by key or any of the trusted keys. If key
+// is nil, the Cache checks results but does not store them: Put reports
+// [ErrNoSigningKey].
+func NewEd25519(base Backend, key ed25519.PrivateKey, trusted []ed25519.PublicKey) (*Cache, error) {
+	if key != nil {
+		if len(key) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid Ed25519 private key")
+		}
+		trusted = append(trusted[:len(trusted):len(trusted)], key.Public().(ed25519.PublicKey))
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("no trusted keys")
+	}
+	for _, pub := range trusted {
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+	}
+	return &Cache{base: base, signer: edSigner{key: key, trusted: trusted}}, nil
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM file in PKCS #8
+// form, as written by "openssl genpkey -algorithm ed25519".
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %q is %T, not Ed25519", path, k)
+	}
+	return key, nil
+}
+
+// LoadPublicKeys reads one or more Ed25519 public keys from a PEM file in
+// PKIX form, as written by "openssl pkey -pubout".
+func LoadPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	ders, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for _, der := range ders {
+		k, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		key, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key in %q is %T, not Ed25519", path, k)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// readPEM returns the contents of the PEM blocks of the given type in the
+// file at path. It reports an error if there are none.
+func readPEM(path, blockType string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		} else if b.Type == blockType {
+			out = append(out, b.Bytes)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no %s found in %q", blockType, path)
+	}
+	return out, nil
+}
+
+// Get implements the corresponding method of the gocache service interface.
+//
+// If the result fetched from the backend does not have a valid tag, or its
+// object does not match, Get reports a cache miss.
+//
+// Get checks the object in place and reports the path of the backend's own
+// file, so the check holds only until the file changes: a party that can
+// write to the backend storage can replace the object after Get checks it
+// and before the toolchain reads it. The tag also covers only the size of an
+// object whose output ID is not a SHA-256 digest, so such an object can be
+// replaced by another of the same size at any time. Where writers without
+// the key can modify objects, use [NewEd25519], which requires digests, and
+// a backend whose files they cannot modify once stored.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	storedID, diskPath, err := c.base.Get(ctx, actionID)
+	if err != nil || storedID == "" {
+		return "", "", err
+	}
+	miss := func(msg string) (string, string, error) {
+		c.numBad.Add(1)
+		gocache.Logf(ctx, "check action %s: %s (treating as miss)", actionID, msg)
+		gocache.SetMissReason(ctx, MissBadSignature)
+		return "", "", nil
+	}
+	n := 2 * c.signer.tagLen()
+	if len(storedID) <= n {
+		return miss("output ID is not signed")
+	}
+	outputID = storedID[:len(storedID)-n]
+	tag, err := hex.DecodeString(storedID[len(storedID)-n:])
+	if err != nil {
+		return miss("output ID is not signed")
+	} else if c.signer.digestsOnly() && len(outputID) != 2*sha256.Size {
+		return miss("output ID is not a digest")
+	}
+
+	f, err := os.Open(diskPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil // cache miss
+	} else if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	} else if !c.signer.verify(message(actionID, outputID, fi.Size()), tag) {
+		return miss("invalid signature")
+	}
+	if len(outputID) == 2*sha256.Size {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", "", err
+		} else if hex.EncodeToString(h.Sum(nil)) != outputID {
+			return miss("object does not match output ID")
+		}
+	}
+	return outputID, diskPath, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	if c.signer.digestsOnly() && len(obj.OutputID) != 2*sha256.Size {
+		return "", fmt.Errorf("output ID %q is not a SHA-256 digest", obj.OutputID)
+	}
+	tag, err := c.signer.sign(message(obj.ActionID, obj.OutputID, obj.Size))
+	if err != nil {
+		return "", err
+	}
+	obj.OutputID += hex.EncodeToString(tag)
+	return c.base.Put(ctx, obj)
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the signature statistics for c to m. It has the signature
+// of the SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("cachesign_rejected", &c.numBad)
+}
+
+// message returns the message signed for the specified result.
+func message(actionID, outputID string, size int64) []byte {
+	msg := []byte("gocache/cachesign\x00" + actionID + "\x00" + outputID + "\x00")
+	return binary.BigEndian.AppendUint64(msg, uint64(size))
+}
+
+// hmacSigner is a signer that uses HMAC-SHA256 with a shared key.
+type hmacSigner []byte
+
+func (hmacSigner) tagLen() int       { return hmacTagLen }
+func (hmacSigner) digestsOnly() bool { return false }
+
+func (h hmacSigner) sign(msg []byte) ([]byte, error) {
+	m := hmac.New(sha256.New, h)
+	m.Write(msg)
+	return m.Sum(nil)[:hmacTagLen], nil
+}
+
+func (h hmacSigner) verify(msg, tag []byte) bool {
+	want, _ := h.sign(msg)
+	return hmac.Equal(tag, want)
+}
+
+// edSigner is a signer that uses Ed25519 signatures.
+type edSigner struct {
+	key     ed25519.PrivateKey // nil if the signer only verifies
+	trusted []ed25519.PublicKey
+}
+
+func (edSigner) tagLen() int       { return ed25519.SignatureSize }
+func (edSigner) digestsOnly() bool { return true }
+
+func (e edSigner) sign(msg []byte) ([]byte, error) {
+	if e.key == nil {
+		return nil, ErrNoSigningKey
+	}
+	return ed25519.Sign(e.key, msg), nil
+}
+
+func (e edSigner) verify(msg, tag []byte) bool {
+	for _, pub := range e.trusted {
+		if ed25519.Verify(pub, msg, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package cachesign_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/cachesign"
+)
+
+func TestCache(t *testing.T) {
+	const (
+		actionID = "a1b2c3d4"
+		content  = "the quick brown fox jumps over the lazy dog"
+	)
+	sum := sha256.Sum256([]byte(content))
+	outputID := hex.EncodeToString(sum[:])
+
+	ctx := context.Background()
+	base, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+	if _, err := cachesign.New(base, []byte("short")); err == nil {
+		t.Error("New with a short key: got nil, want error")
+	}
+	c, err := cachesign.New(base, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	other, err := cachesign.New(base, []byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	put := func(b cachesign.Backend, actionID, outputID, content string) {
+		t.Helper()
+		if _, err := b.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}); err != nil {
+			t.Fatalf("Put %s: unexpected error: %v", actionID, err)
+		}
+	}
+	wantMiss := func(actionID string) {
+		t.Helper()
+		if oid, _, err := c.Get(ctx, actionID); err != nil || oid != "" {
+			t.Errorf("Get %s: got %q, %v; want miss", actionID, oid, err)
+		}
+	}
+
+	// A signed result round-trips, and the backend sees the tag.
+	put(c, actionID, outputID, content)
+	oid, path, err := c.Get(ctx, actionID)
+	if err != nil || oid != outputID {
+		t.Fatalf("Get: got %q, %v; want %q", oid, err, outputID)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != content {
+		t.Errorf("Get object: got %q, %v; want %q", data, err, content)
+	}
+	if oid, _, err := base.Get(ctx, actionID); err != nil || oid == outputID || !strings.HasPrefix(oid, outputID) {
+		t.Errorf("Base Get: got %q, %v; want %q with a tag", oid, err, outputID)
+	}
+
+	// Results stored without the key, or with another key, are misses.
+	put(base, "b1", outputID, content)
+	wantMiss("b1")
+	put(other, "b2", outputID, content)
+	wantMiss("b2")
+
+	// A result whose object does not match its output ID is a miss.
+	put(c, "b3", outputID, strings.ToUpper(content))
+	wantMiss("b3")
+
+	// A signed result cannot be moved to another action.
+	storedID, _, err := base.Get(ctx, actionID)
+	if err != nil {
+		t.Fatalf("Base Get: unexpected error: %v", err)
+	}
+	put(base, "b4", storedID, content)
+	wantMiss("b4")
+
+	// Output IDs that are not digests are checked only for size.
+	put(c, "b5", "0b1ec7ed", "xyzzy")
+	if oid, _, err := c.Get(ctx, "b5"); err != nil || oid != "0b1ec7ed" {
+		t.Errorf("Get b5: got %q, %v; want 0b1ec7ed", oid, err)
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	base, err := cachedir.New(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("cachedir.New: unexpected error: %v", err)
+	}
+
+	// Write a signing key, and a file of trusted keys with its public key.
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	privPath, pubPath := filepath.Join(dir, "key.pem"), filepath.Join(dir, "trusted.pem")
+	writePEM(t, privPath, "PRIVATE KEY", must(x509.MarshalPKCS8PrivateKey(priv)))
+	writePEM(t, pubPath, "PUBLIC KEY", must(x509.MarshalPKIXPublicKey(pub)))
+
+	key, err := cachesign.LoadPrivateKey(privPath)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey: unexpected error: %v", err)
+	}
+	trusted, err := cachesign.LoadPublicKeys(pubPath)
+	if err != nil {
+		t.Fatalf("LoadPublicKeys: unexpected error: %v", err)
+	}
+	if _, err := cachesign.LoadPublicKeys(privPath); err == nil {
+		t.Error("LoadPublicKeys of a private key: got nil, want error")
+	}
+
+	writer, err := cachesign.NewEd25519(base, key, nil)
+	if err != nil {
+		t.Fatalf("NewEd25519 (writer): unexpected error: %v", err)
+	}
+	reader, err := cachesign.NewEd25519(base, nil, trusted)
+	if err != nil {
+		t.Fatalf("NewEd25519 (reader): unexpected error: %v", err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	other, err := cachesign.NewEd25519(base, otherKey, nil)
+	if err != nil {
+		t.Fatalf("NewEd25519 (other): unexpected error: %v", err)
+	}
+
+	const content = "the quick brown fox jumps over the lazy dog"
+	sum := sha256.Sum256([]byte(content))
+	outputID := hex.EncodeToString(sum[:])
+	newObj := func(actionID, outputID string) gocache.Object {
+		return gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(content)),
+			Body:     strings.NewReader(content),
+		}
+	}
+
+	// A result signed by the writer is accepted by the reader.
+	if _, err := writer.Put(ctx, newObj("a1", outputID)); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if oid, _, err := reader.Get(ctx, "a1"); err != nil || oid != outputID {
+		t.Errorf("Get a1: got %q, %v; want %q", oid, err, outputID)
+	}
+
+	// The reader cannot store results, and output IDs must be digests.
+	if _, err := reader.Put(ctx, newObj("a2", outputID)); !errors.Is(err, cachesign.ErrNoSigningKey) {
+		t.Errorf("Put (reader): got %v, want %v", err, cachesign.ErrNoSigningKey)
+	}
+	if _, err := writer.Put(ctx, newObj("a3", "0b1ec7ed")); err == nil {
+		t.Error("Put with a non-digest output ID: got nil, want error")
+	}
+
+	// A result signed by an untrusted key is rejected, and counted.
+	if _, err := other.Put(ctx, newObj("a4", outputID)); err != nil {
+		t.Fatalf("Put (other): unexpected error: %v", err)
+	}
+	if oid, _, err := reader.Get(ctx, "a4"); err != nil || oid != "" {
+		t.Errorf("Get a4: got %q, %v; want miss", oid, err)
+	}
+	m := new(expvar.Map)
+	reader.SetMetrics(ctx, m)
+	if got := m.Get("cachesign_rejected").String(); got != "1" {
+		t.Errorf("cachesign_rejected: got %s, want 1", got)
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Write %s: %v", blockType, err)
+	}
+}
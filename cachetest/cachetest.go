@@ -0,0 +1,229 @@
+// Package cachetest runs scripted workloads against a cache server, and
+// checks that its responses are consistent with the requests, as the go
+// command expects.
+//
+// A script is a sequence of lines, each giving one command. Blank lines and
+// lines beginning with "#" are ignored. Actions are identified by names,
+// which the script maps to action IDs. The commands are:
+//
+//	put NAME SIZE [error]
+//	get NAME hit|miss|any
+//	concurrent N COMMAND...
+//
+// A put stores an object of SIZE bytes for the action, whose contents are
+// determined by the name and size, and whose output ID is the SHA-256 digest
+// of the contents, as for the go command. The server must report a path whose
+// contents match, or an error if "error" is given.
+//
+// A get for which "hit" is given must report the output ID and size of the
+// object last stored for the action, and a path with its contents. A get for
+// which "miss" is given must report a miss. With "any", either is accepted,
+// but a hit must still match the object last stored.
+//
+// The concurrent command runs N copies of the command that follows it at
+// once. Responses to concurrent puts for the same action may be in any order.
+//
+// The package also provides a [Clock] that is set by hand, for tests of
+// behavior that depends on the time, and [NewServer], which constructs a
+// server backed by a temporary cache directory.
+package cachetest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/taskgroup"
+)
+
+// DefaultScript is a script that checks the basic behavior expected of a
+// writable cache by the go command.
+const DefaultScript = `# A result is missing until it is stored.
+get a1 miss
+put a1 100
+get a1 hit
+
+# Objects may be empty or large.
+put empty 0
+get empty hit
+put big 1048576
+get big hit
+
+# A later put for an action replaces the earlier result.
+put a1 200
+get a1 hit
+
+# Concurrent requests for the same action.
+concurrent 8 get big hit
+concurrent 8 put c1 1000
+get c1 hit
+`
+
+// Run runs the script read from r using c, and reports an error describing
+// the first request whose response is not as expected. Run does not close c.
+func Run(ctx context.Context, c *cacheclient.Client, r io.Reader) error {
+	rs := &runner{c: c, stored: make(map[string]int)}
+	sc := bufio.NewScanner(r)
+	var line int
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := rs.run(ctx, strings.Fields(text)); err != nil {
+			return fmt.Errorf("line %d: %s: %w", line, text, err)
+		}
+	}
+	return sc.Err()
+}
+
+// RunFile runs the script in the named file, as [Run].
+func RunFile(ctx context.Context, c *cacheclient.Client, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Run(ctx, c, f)
+}
+
+type runner struct {
+	c *cacheclient.Client
+
+	mu     sync.Mutex
+	stored map[string]int // name → size of the object last stored
+}
+
+// run runs a single command.
+func (r *runner) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "put":
+		if len(args) < 3 || len(args) > 4 || (len(args) == 4 && args[3] != "error") {
+			return errors.New("usage: put NAME SIZE [error]")
+		}
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size %q", args[2])
+		}
+		return r.put(ctx, args[1], size, len(args) == 4)
+
+	case "get":
+		if len(args) != 3 || (args[2] != "hit" && args[2] != "miss" && args[2] != "any") {
+			return errors.New("usage: get NAME hit|miss|any")
+		}
+		return r.get(ctx, args[1], args[2])
+
+	case "concurrent":
+		if len(args) < 3 {
+			return errors.New("usage: concurrent N COMMAND...")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %q", args[1])
+		}
+		g := taskgroup.New(nil)
+		for range n {
+			g.Go(func() error { return r.run(ctx, args[2:]) })
+		}
+		return g.Wait()
+
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func (r *runner) put(ctx context.Context, name string, size int, wantErr bool) error {
+	body := Content(name, size)
+	outputID := sha256.Sum256(body)
+	rsp, err := r.c.Put(ctx, ActionID(name), outputID[:], body)
+	if err != nil {
+		return err
+	} else if wantErr {
+		if rsp.Err == "" {
+			return errors.New("put succeeded, want error")
+		}
+		return nil
+	} else if rsp.Err != "" {
+		return fmt.Errorf("put failed: %s", rsp.Err)
+	}
+	if err := checkFile(rsp.DiskPath, body); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stored[name] = size
+	return nil
+}
+
+func (r *runner) get(ctx context.Context, name, want string) error {
+	rsp, err := r.c.Get(ctx, ActionID(name))
+	if err != nil {
+		return err
+	} else if rsp.Err != "" {
+		return fmt.Errorf("get failed: %s", rsp.Err)
+	}
+	if rsp.Miss {
+		if want == "hit" {
+			return errors.New("got miss, want hit")
+		}
+		return nil
+	} else if want == "miss" {
+		return fmt.Errorf("got hit (%q), want miss", rsp.DiskPath)
+	}
+
+	r.mu.Lock()
+	size, ok := r.stored[name]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("got hit (%q) for an action the script has not stored", rsp.DiskPath)
+	}
+	body := Content(name, size)
+	outputID := sha256.Sum256(body)
+	if !bytes.Equal(rsp.OutputID, outputID[:]) {
+		return fmt.Errorf("got output ID %x, want %x", rsp.OutputID, outputID)
+	} else if rsp.Size != int64(size) {
+		return fmt.Errorf("got size %d, want %d", rsp.Size, size)
+	}
+	return checkFile(rsp.DiskPath, body)
+}
+
+// checkFile reports an error if the file at path does not contain want.
+func checkFile(path string, want []byte) error {
+	if path == "" {
+		return errors.New("no disk path in response")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read object: %w", err)
+	} else if !bytes.Equal(data, want) {
+		return fmt.Errorf("object %q has %d bytes, not the %d bytes stored", path, len(data), len(want))
+	}
+	return nil
+}
+
+// ActionID returns the action ID used by scripts for the given name.
+func ActionID(name string) []byte {
+	id := sha256.Sum256([]byte("cachetest action " + name))
+	return id[:]
+}
+
+// Content returns the contents of the object of the given size stored by
+// scripts for the given name.
+func Content(name string, size int) []byte {
+	seed := sha256.Sum256([]byte("cachetest content " + name + " " + strconv.Itoa(size)))
+	out := make([]byte, size)
+	for i := 0; i < size; i += len(seed) {
+		copy(out[i:], seed[:])
+	}
+	return out
+}
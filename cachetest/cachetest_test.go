@@ -0,0 +1,82 @@
+package cachetest_test
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/gocache/cachetest"
+)
+
+func runScript(t *testing.T, s *gocache.Server, script string) error {
+	t.Helper()
+	ctx := context.Background()
+	c, err := cacheclient.Serve(ctx, s, nil)
+	if err != nil {
+		t.Fatalf("Serve: unexpected error: %v", err)
+	}
+	defer func() {
+		if err := c.Close(ctx); err != nil {
+			t.Errorf("Close: unexpected error: %v", err)
+		}
+	}()
+	return cachetest.Run(ctx, c, strings.NewReader(script))
+}
+
+func TestDefaultScript(t *testing.T) {
+	s, _ := cachetest.NewServer(t)
+	if err := runScript(t, s, cachetest.DefaultScript); err != nil {
+		t.Errorf("Run: unexpected error: %v", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name, script, want string
+	}{
+		{"UnexpectedHit", "put a 10\nget a miss", "got hit"},
+		{"UnexpectedMiss", "get a hit", "got miss"},
+		{"UnknownHit", "put a 10\nconcurrent 2 get b any\nget a hit\nget a miss", "line 4"},
+		{"PutSucceeds", "put a 10 error", "want error"},
+		{"BadCommand", "frob a", "unknown command"},
+		{"BadUsage", "get a", "usage"},
+		{"BadSize", "put a -1", "invalid size"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := cachetest.NewServer(t)
+			err := runScript(t, s, tc.script)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Run: got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrongObject(t *testing.T) {
+	// A backend that reports the wrong object for an action is caught.
+	s, d := cachetest.NewServer(t)
+	s.Get = func(ctx context.Context, actionID string) (string, string, error) {
+		oid, _, err := d.Get(ctx, actionID)
+		if err != nil || oid == "" {
+			return oid, "", err
+		}
+		_, path, err := d.Get(ctx, hex.EncodeToString(cachetest.ActionID("other")))
+		return oid, path, err
+	}
+	err := runScript(t, s, "put other 20\nput a 10\nget a hit")
+	if err == nil || !strings.Contains(err.Error(), "got size 20, want 10") {
+		t.Errorf("Run: got %v, want a content mismatch", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, _ := cachetest.NewServer(t)
+	s.ReadOnly = true
+	if err := runScript(t, s, "put a 10 error\nget a miss"); err != nil {
+		t.Errorf("Run: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package cachetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// Clock is a [gocache.Clock] whose time changes only when it is set, for tests
+// of behavior that depends on the time, such as expiry and pruning. It is safe
+// for concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a new Clock set to now.
+func NewClock(now time.Time) *Clock { return &Clock{now: now} }
+
+// Now implements [gocache.Clock].
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set sets the time of c to now.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the time of c forward by d, and returns the new time.
+func (c *Clock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+var _ gocache.Clock = (*Clock)(nil)
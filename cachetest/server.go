@@ -0,0 +1,26 @@
+package cachetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// NewServer returns a server for tests, backed by a new cache directory
+// under t.TempDir, and the directory. The server supports the get, put, and
+// close commands; closing it does nothing. NewServer fails t if the directory
+// cannot be created.
+func NewServer(t testing.TB) (*gocache.Server, *cachedir.Dir) {
+	t.Helper()
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	return &gocache.Server{
+		Get:   d.Get,
+		Put:   d.Put,
+		Close: func(context.Context) error { return nil },
+	}, d
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache/cachebench"
+)
+
+var benchFlags = struct {
+	Requests    int    `flag:"n,default=*,Number of get requests to issue"`
+	Concurrency int    `flag:"workers,default=*,Number of concurrent client workers"`
+	Actions     int    `flag:"actions,default=*,Number of distinct actions"`
+	ObjectSize  int    `flag:"size,default=*,Size in bytes of each object stored"`
+	Seed        uint64 `flag:"seed,Seed for the random choice of actions"`
+	JSON        bool   `flag:"json,Write results as JSON"`
+}{
+	Requests:    10000,
+	Concurrency: runtime.NumCPU(),
+	Actions:     1000,
+	ObjectSize:  16 << 10,
+}
+
+// runBench implements the "bench" subcommand.
+func runBench(env *command.Env) error {
+	if flags.CacheDir == "" {
+		// Do not add the synthetic objects to the default cache.
+		dir, err := os.MkdirTemp("", "diskcache-bench-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		flags.CacheDir = dir
+	}
+	s, err := newServer(env.Parent)
+	if err != nil {
+		return err
+	}
+	res, err := cachebench.Run(context.Background(), s, &cachebench.Options{
+		Requests:    benchFlags.Requests,
+		Concurrency: benchFlags.Concurrency,
+		Actions:     benchFlags.Actions,
+		ObjectSize:  benchFlags.ObjectSize,
+		Seed:        benchFlags.Seed,
+	})
+	if err != nil {
+		return fmt.Errorf("bench: %w", err)
+	}
+	if benchFlags.JSON {
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			cachebench.Result
+			RequestsPerSecond float64 `json:"requestsPerSecond"`
+			MBPerSecond       float64 `json:"mbPerSecond"`
+		}{res, res.RequestsPerSecond(), res.MBPerSecond()})
+	}
+	fmt.Println(res)
+	if flags.Verbose || flags.Metrics {
+		fmt.Fprintln(os.Stderr, s.Metrics())
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfig reads settings from the config file at path, and applies them
+// to the flags in fs that were not set on the command line.
+//
+// The config file uses a subset of TOML: Each non-blank line is a comment
+// starting with "#", or a setting of the form
+//
+//	name = value
+//
+// where name is the name of a flag, and value is a TOML string, number, or
+// boolean. Durations are given as strings, e.g., x = "24h". Tables, arrays,
+// and other TOML or YAML syntax are not supported, so the file holds only
+// settings that have a flag.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	isSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := parseConfigLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, ln, err)
+		}
+		fl := fs.Lookup(name)
+		if fl == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, ln, name)
+		} else if seen[name] {
+			return fmt.Errorf("%s:%d: duplicate setting %q", path, ln, name)
+		}
+		seen[name] = true
+		if isSet[name] {
+			continue // the command line takes precedence
+		}
+		if err := fl.Value.Set(value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s: %w", path, ln, name, err)
+		}
+	}
+	return sc.Err()
+}
+
+// parseConfigLine parses a "name = value" line from a config file.
+func parseConfigLine(line string) (name, value string, _ error) {
+	name, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid line %q", line)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t\"'[]") {
+		return "", "", fmt.Errorf("invalid setting name %q", name)
+	}
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid string for %s: %s", name, value)
+		}
+		return name, s, nil
+	case strings.HasPrefix(value, "'"):
+		s, ok := strings.CutSuffix(value[1:], "'")
+		if !ok || strings.Contains(s, "'") {
+			return "", "", fmt.Errorf("invalid string for %s: %s", name, value)
+		}
+		return name, s, nil
+	}
+
+	// An unquoted value may be followed by a comment.
+	if i := strings.Index(value, "#"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	if value == "" {
+		return "", "", fmt.Errorf("missing value for %s", name)
+	}
+	return name, strings.ReplaceAll(value, "_", ""), nil // TOML allows 1_000
+}
+
+// envPrefix is the prefix of environment variables that set flags.
+const envPrefix = "GOCACHEPROG_"
+
+// envNames maps flag names to environment variable names (without the
+// prefix) for flags whose names do not map directly.
+var envNames = map[string]string{
+	"cache-dir": "DIR",
+	"c":         "CONCURRENCY",
+	"x":         "MAX_AGE",
+	"m":         "METRICS",
+	"v":         "VERBOSE",
+}
+
+// envName returns the name of the environment variable for the named flag,
+// for example GOCACHEPROG_HOT_CACHE for hot-cache.
+func envName(flagName string) string {
+	if s, ok := envNames[flagName]; ok {
+		return envPrefix + s
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadEnv applies the values of GOCACHEPROG_* environment variables to the
+// flags in fs that were not set on the command line.
+func loadEnv(fs *flag.FlagSet) error {
+	isSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { isSet[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || isSet[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid %s: %w", name, serr)
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// startDebug starts an HTTP server at addr, which must be a loopback address,
+// with debugging endpoints for s:
+//
+//	/debug/pprof/    -- profiles, as for net/http/pprof
+//	/debug/vars      -- expvar, including the server metrics as "gocache"
+//	/debug/requests  -- the requests in progress, and how long they have run
+//
+// It returns the address the server listens on, and a function that stops
+// the server.
+func startDebug(addr string, s *gocache.Server) (net.Addr, func(), error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, nil, errors.New("the address must be on the loopback interface")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	expvar.Publish("gocache", s.Metrics())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/requests", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeRequests(w, s.ActiveRequests(), time.Now())
+	})
+	hs := &http.Server{Handler: mux}
+	go hs.Serve(ln)
+	return ln.Addr(), func() { hs.Close() }, nil
+}
+
+// writeRequests writes a table of the requests in rs to w, with the time each
+// has been in progress as of now.
+func writeRequests(w io.Writer, rs []gocache.ActiveRequest, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMAND\tELAPSED\tSIZE\tACTION")
+	for _, r := range rs {
+		fmt.Fprintf(tw, "%d\t%s\t%v\t%d\t%s\n",
+			r.ID, r.Command, now.Sub(r.Start).Round(time.Millisecond), r.Size, r.ActionID)
+	}
+	tw.Flush()
+}
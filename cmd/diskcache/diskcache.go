@@ -4,66 +4,1026 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/user"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
 	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachecount"
+	"github.com/creachadair/gocache/cachecrypt"
 	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/cachens"
+	"github.com/creachadair/gocache/cachesign"
+	"github.com/creachadair/gocache/fallback"
+	"github.com/creachadair/gocache/migrate"
+	"github.com/creachadair/gocache/remote"
+	"github.com/creachadair/gocache/writeback"
+	"github.com/creachadair/mds/shell"
 	"github.com/creachadair/mds/value"
 )
 
-var flags = struct {
-	CacheDir    string        `flag:"cache-dir,Cache directory (required)"`
-	Concurrency int           `flag:"c,default=*,Maximum number of concurrent requests"`
-	MaxAge      time.Duration `flag:"x,Age after which cache entries expire"`
-	Metrics     bool          `flag:"m,Print cache metrics to stderr on exit"`
-	Verbose     bool          `flag:"v,Enable verbose logging"`
-	DebugLog    bool          `flag:"debug,Enable detailed debug logs (noisy)"`
-}{
-	Concurrency: runtime.NumCPU(),
+// settings are the settings of the main command, from its flags, the
+// environment, and the --config file.
+type settings struct {
+	Config        string        `flag:"config,Read settings from this config file (optional)"`
+	CacheDir      string        `flag:"cache-dir,Cache directory (default: per-user cache directory)"`
+	PerUser       bool          `flag:"per-user,Use a subdirectory of --cache-dir for the current user"`
+	SharedDir     string        `flag:"shared-dir,Cache directory to read results from, but not write to (optional)"`
+	Concurrency   int           `flag:"c,default=*,Maximum number of concurrent requests"`
+	MaxGets       int           `flag:"max-gets,Maximum number of concurrent get requests (0 means only -c applies)"`
+	MaxPuts       int           `flag:"max-puts,Maximum number of concurrent put requests (0 means only -c applies)"`
+	MaxPutBytes   int64         `flag:"max-put-bytes,Maximum total size in bytes of pending put requests (0 means no limit)"`
+	ReqTimeout    time.Duration `flag:"request-timeout,Time limit for each get and put request (0 means no limit)"`
+	StrictIDs     bool          `flag:"strict-ids,Reject action and output IDs that are not SHA-256 digests"`
+	MaxAge        time.Duration `flag:"x,Age after which cache entries expire"`
+	TouchInterval time.Duration `flag:"touch-interval,default=*,Minimum interval between access time updates (0 to disable)"`
+	PruneCmd      string        `flag:"prune-command,Program to choose which entries to prune (optional)"`
+	FastDir       string        `flag:"fast-dir,Directory for small objects, e.g., on a faster device (optional)"`
+	FastMaxSize   int64         `flag:"fast-max-size,Maximum object size in bytes to store in --fast-dir (default 1MiB)"`
+	SessionDir    string        `flag:"session-dir,Directory for per-session copies of cached objects (optional)"`
+	ScratchDir    string        `flag:"scratch-dir,Directory for copies of cached objects read by builds, e.g., on tmpfs (optional)"`
+	Pin           bool          `flag:"pin,Protect objects read by the build from pruning until it exits"`
+	WarmFrom      string        `flag:"warm-from,Snapshot file or HTTP(S) URL to add to the cache on startup (optional)"`
+	WarmSHA256    string        `flag:"warm-from-sha256,Expected SHA-256 digest of the --warm-from snapshot (optional)"`
+	Remote        string        `flag:"remote,URL of a cache server to use behind the local cache (optional)"`
+	RemoteToken   string        `flag:"remote-token,Source of the bearer token for --remote (env:NAME or file:PATH)"`
+	RemoteCA      string        `flag:"remote-ca,PEM file of CA certificates to verify the --remote server (optional)"`
+	RemoteCert    string        `flag:"remote-cert,PEM file of the client certificate for --remote (optional)"`
+	RemoteKey     string        `flag:"remote-key,PEM file of the client key for --remote (optional)"`
+	RemoteMinHit  float64       `flag:"remote-min-hit-rate,Stop fetching from --remote if the fraction of fetches that hit is lower (optional)"`
+	RemoteMinLook int           `flag:"remote-min-lookups,Minimum fetches from --remote before checking --remote-min-hit-rate (default 100)"`
+	SignKey       string        `flag:"sign-key,Source of a key to sign and check cached results (env:NAME or file:PATH)"`
+	Ed25519Key    string        `flag:"ed25519-key,PEM file of an Ed25519 private key to sign cached results (optional)"`
+	TrustedKeys   string        `flag:"trusted-keys,PEM file of Ed25519 public keys whose signed results are used (optional)"`
+	WriteBehind   bool          `flag:"write-behind,Acknowledge puts before storing them, and store them in the background"`
+	Namespace     string        `flag:"namespace,Isolate cached actions in this namespace (optional)"`
+	ShardDepth    int           `flag:"shard-depth,Number of levels of cache subdirectories (default 1)"`
+	SharedFS      string        `flag:"shared-fs,default=auto,Shared filesystem mode (auto, on, off)"`
+	Durability    string        `flag:"durability,default=none,Write durability (none, sync, sync-dir)"`
+	MigrateFrom   string        `flag:"migrate-from,Cache directory to migrate from as results are used (optional)"`
+	MigrateDepth  int           `flag:"migrate-from-shard-depth,Number of levels of subdirectories in --migrate-from (default 1)"`
+	ReadOnly      bool          `flag:"read-only,Use the cache without adding to, pruning, or updating it"`
+	FallbackNull  bool          `flag:"fallback-null,If the cache cannot be opened, serve it as empty and store nothing, instead of failing"`
+	HotCache      int           `flag:"hot-cache,Number of recent results to cache in memory (0 to disable)"`
+	MaxBodySize   int64         `flag:"max-body-size,Maximum object size in bytes to store (0 means no limit)"`
+	DropOversize  bool          `flag:"drop-oversize,Silently drop objects over --max-body-size instead of failing"`
+	CachePercent  int           `flag:"cache-percent,default=*,Percentage of actions to use the cache for (1 to 100)"`
+	Record        string        `flag:"record,Record the session to this file (optional)"`
+	RecordElide   bool          `flag:"record-elide,Record only the digests of object bodies"`
+	RecordBodyDir string        `flag:"record-body-dir,Store recorded object bodies in this directory (optional)"`
+	DumpWire      string        `flag:"dump-wire,Write a trace of protocol messages, without object contents, to this file (optional)"`
+	ErrorsMiss    string        `flag:"errors-are-misses,Comma-separated commands whose errors are not reported to the toolchain (get, put)"`
+	Summary       bool          `flag:"summary,Log a summary of hits, latencies, and time saved on exit"`
+	MinHitRate    float64       `flag:"min-hit-rate,Warn on exit if the fraction of gets that hit is lower (optional)"`
+	MaxErrorRate  float64       `flag:"max-error-rate,Warn on exit if the fraction of requests that fail is higher (optional)"`
+	AlarmMinReqs  int           `flag:"alarm-min-requests,Minimum requests before checking --min-hit-rate and --max-error-rate (default 100)"`
+	Metrics       bool          `flag:"m,Print cache metrics to stderr on exit"`
+	Verbose       bool          `flag:"v,Enable verbose logging"`
+	LogFormat     string        `flag:"log-format,default=std,Log format (std, tagged)"`
+	DebugLog      bool          `flag:"debug,Enable detailed debug logs (noisy)"`
+	DebugAddr     string        `flag:"debug-addr,Serve profiles, metrics, and requests in progress over HTTP at this loopback address (optional)"`
 }
 
+// defaultSettings returns the settings of the main command when no flags are
+// set.
+func defaultSettings() settings {
+	return settings{
+		Concurrency:   runtime.NumCPU(),
+		TouchInterval: time.Hour,
+		CachePercent:  100,
+	}
+}
+
+var flags = defaultSettings()
+
 func main() {
 	root := &command.C{
-		Name:     command.ProgramName(),
-		Usage:    "--cache-dir d [options]\nhelp",
-		Help:     `Serve a GOCACHEPROG plugin on stdin/stdout.`,
-		SetFlags: command.Flags(flax.MustBind, &flags),
-		Run: command.Adapt(func(env *command.Env) error {
-			if flags.CacheDir == "" {
-				return env.Usagef("You must provide a --cache-dir")
-			}
+		Name:  command.ProgramName(),
+		Usage: "[--cache-dir d] [options]\nhelp",
+		Help: `Serve a GOCACHEPROG plugin on stdin/stdout.
 
-			dir, err := cachedir.New(flags.CacheDir)
-			if err != nil {
-				return fmt.Errorf("create cache dir: %w", err)
-			}
-			s := &gocache.Server{
-				Get:         dir.Get,
-				Put:         dir.Put,
-				Close:       dir.Cleanup(flags.MaxAge),
-				MaxRequests: flags.Concurrency,
-				Logf:        value.Cond(flags.Verbose, log.Printf, nil),
-				LogRequests: flags.DebugLog,
-			}
+If --cache-dir is not set, the cache is stored in a "gocacheprog"
+subdirectory of the user's default cache directory for the platform
+(for example, $XDG_CACHE_HOME or $HOME/.cache on Linux, and
+$HOME/Library/Caches on macOS).
+
+On build hosts where several users share a cache directory, --per-user
+stores each user's cache in a separate subdirectory named for the user's
+ID. If the shared directory does not exist, it is created so that any
+user can add a subdirectory, but only its owner can remove it. Each
+user's subdirectory is created so that only its owner can access it,
+and an existing subdirectory is not used unless the same holds for it.
+
+With --shared-dir, results missing from the cache are also read from the
+given cache directory, which is not written. Combined with --per-user, this
+lets users share a cache populated by a trusted process, such as a CI job
+that runs with --cache-dir set to the shared directory, while the results
+of their own builds are kept private.
+
+With --config, settings are read from the given file, one per line, in
+the form "name = value" where name is a flag name and value is a TOML
+string, number, or boolean. Lines starting with "#" are comments. Flags
+set on the command line take precedence over values from the file:
+
+   # diskcache config
+   cache-dir = "/var/cache/gocacheprog"
+   x = "720h"
+   hot-cache = 1000
+   summary = true
+
+This is a flat subset of TOML, not full TOML or YAML: tables, arrays,
+and nested sections are not supported, and each setting names a flag of
+this command. Backend settings are given by their flags in the same way,
+for example remote = "https://cache.example.com" and remote-token =
+"file:/etc/gocache/token".
+
+Each flag can also be set by an environment variable named for the flag,
+for example GOCACHEPROG_HOT_CACHE for --hot-cache, and GOCACHEPROG_DIR,
+GOCACHEPROG_CONCURRENCY, GOCACHEPROG_MAX_AGE, GOCACHEPROG_METRICS, and
+GOCACHEPROG_VERBOSE for --cache-dir, -c, -x, -m, and -v. This is useful
+when GOCACHEPROG is set by tools that do not allow flags to be added.
+Flags set on the command line take precedence over the environment, and
+the environment takes precedence over --config.
+
+With --record, the requests and responses of the session are written to
+the specified file, for use with the replay command.
+
+With --dump-wire, each message exchanged with the go command is written to
+the given file as it was sent, with the contents of objects left out. This
+helps diagnose protocol mismatches between the server and a toolchain,
+without the size and sensitivity of a full --record log.
+
+With --debug-addr, an HTTP server at the given loopback address (for
+example, localhost:6060) serves profiles at /debug/pprof/, metrics at
+/debug/vars, and the requests in progress, with how long each has run, at
+/debug/requests. If the address is in use, the cache runs without it.
+
+With --log-format=tagged, each log message is written as a single line
+tagged with the program name, so that logs can be told apart from the
+output of the go command on the same terminal or CI log. When stderr is a
+terminal, the tag is dimmed, unless NO_COLOR is set.
+
+With --pin, each object read by the build is pinned until the server
+exits, so that pruning by this or any other diskcache process sharing the
+cache does not remove files the go command has yet to read. Pins are
+recorded in the "pins" subdirectory of the cache, and are not used with
+--read-only.
+
+With --warm-from, a snapshot written by the export command is added to
+the cache before the server starts, for actions the cache does not already
+have. The snapshot may be a file or an HTTP(S) URL, and may be compressed
+with gzip. This is useful to bootstrap the cache on a fresh CI runner. If
+--warm-from-sha256 is also set, the snapshot is verified before it is used,
+and it is not fetched again once it has been added. In any case, an object
+whose output ID is a SHA-256 digest is checked against it as it is read, and
+the warm-up fails if one does not match.
 
-			if err := s.Run(context.Background(), os.Stdin, os.Stdout); err != nil {
-				log.Printf("Server exited with error: %v", err)
+With --remote, results missing from the local cache are fetched from a
+cache server at the given URL, such as one run by the serve command, and
+new results are sent to the server as well as stored locally. If the server
+does not accept a result, the error is logged, and the result is still
+stored locally. Combine this with --write-behind so that builds do not wait
+for uploads. If the server requires a token, set --remote-token to
+"env:NAME" to read it from an environment variable, or to "file:PATH" to
+read it from a file, which is read again when it changes. For an HTTPS
+server, --remote-ca sets the CA certificates to trust, and --remote-cert
+and --remote-key set a client certificate. A result fetched from the server
+is not stored locally if its contents do not match its output ID, or if it
+is larger than --max-body-size.
+
+With --remote-min-hit-rate, once --remote-min-lookups fetches have been
+made from the server, if the fraction that hit is lower, the server is not
+asked for results for the rest of the session, and a message is logged. New
+results are still sent to the server. This limits the cost of a cold server
+cache.
+
+With --sign-key, each result stored is signed with the key, and results
+without a valid signature are treated as misses. Use this when the storage
+for the cache, such as a shared directory or server, can be written by
+parties that should not be trusted to add results. The key is read from an
+environment variable with "env:NAME", or from a file with "file:PATH".
+
+For stricter setups, --ed25519-key and --trusted-keys use Ed25519
+signatures instead, so that readers need only public keys. Results stored
+are signed with the private key given by --ed25519-key, and only results
+signed by that key or a key in --trusted-keys are used. Builds that should
+only read the cache can set --trusted-keys alone, with --read-only or
+--errors-are-misses=put, since they cannot store results.
+
+With --write-behind, each put is acknowledged once the object has been
+written to a temporary spool directory, and the object is stored in the
+cache in the background. The server waits for pending puts to be stored
+before it exits.
+
+With --cache-percent less than 100, the server uses the cache for only
+that percentage of actions, chosen by action ID, and treats the rest as
+misses that are not stored. Since the choice is stable, the same actions are
+cached across builds. This is useful to limit the size of a cache, or to
+measure the benefit of caching. To skip objects over a size threshold,
+use --max-body-size with --drop-oversize.
+
+With --read-only, the server reads from the cache but does not store new
+results, prune old ones, or update access times. Use this for builds that
+should use a shared cache populated by other builds, but not add to it.
+
+With --summary, the server logs a summary of its requests on exit, with an
+estimate of the build time saved by its hits. The estimate is the number of
+hits times the mean time from a miss to the put of its result, which is how
+long the go command took to compute it. It is a total over all actions, so
+it overstates the time saved for a build that runs actions in parallel.
+The summary is followed by the number of hits served by each tier of the
+cache, and their size: the server's --hot-cache, the cache directory, the
+--shared-dir, and the --remote server.
+
+With --min-hit-rate or --max-error-rate, a warning is logged on exit if the
+hit rate or error rate is outside the expected range, so that a broken cache
+configuration is noticed in CI logs. The warnings are followed by a summary,
+as for --summary, which counts the alarms.
+
+With --fallback-null, if the cache cannot be opened, for example because
+the cache directory is not writable or a --warm-from snapshot cannot be
+read, the server logs a warning and serves as an empty cache that stores
+nothing, so that builds continue without the cache. Invalid flags are
+still reported as errors.`,
+		SetFlags: command.Flags(flax.MustBind, &flags),
+		Init: func(env *command.Env) error {
+			if err := loadEnv(&env.Command.Flags); err != nil {
+				return err
 			}
-			if flags.Verbose || flags.Metrics {
-				fmt.Fprintln(os.Stderr, s.Metrics())
+			if flags.Config != "" {
+				path, err := filepath.Abs(flags.Config)
+				if err != nil {
+					return err
+				}
+				flags.Config = path
+				if err := loadConfig(&env.Command.Flags, path); err != nil {
+					return fmt.Errorf("load config: %w", err)
+				}
+			}
+			if err := setupLogging(flags.LogFormat); err != nil {
+				return env.Usagef("Invalid --log-format: %v", err)
 			}
 			return nil
-		}),
+		},
+		Run: command.Adapt(runPlugin),
 		Commands: []*command.C{
+			{
+				Name:  "env",
+				Usage: "[-w] [-f]",
+				Help: `Print settings to use this program as the GOCACHEPROG.
+
+By default, this prints an export command for a POSIX shell.  With -w it
+prints an equivalent "go env -w" command instead. Any flags set for the
+cache server are included in the settings.
+
+This command also checks that the go command in $PATH supports
+GOCACHEPROG, and reports an error if not.`,
+				SetFlags: command.Flags(flax.MustBind, &envFlags),
+				Run:      command.Adapt(runEnv),
+			},
+			{
+				Name:  "replay",
+				Usage: "[--body-dir d] <log-file>",
+				Help: `Replay a session recorded with --record through a cache server.
+
+The requests from the log are sent to a server configured by the flags
+of the main command, and its responses are written to stdout. Object
+bodies recorded with --record-body-dir are read from --body-dir, if
+it is set; otherwise, bodies that were not recorded are replaced with
+zeroes.`,
+				SetFlags: command.Flags(flax.MustBind, &replayFlags),
+				Run:      command.Adapt(runReplay),
+			},
+			{
+				Name:  "migrate",
+				Usage: "[--target-shard-depth n] <target-dir>",
+				Help: `Copy the contents of the cache into another cache directory.
+
+The cache configured by the flags of the main command is copied into the
+target directory, which is created if necessary. Entries already in the
+target are replaced. Use this to populate a new cache, for example with a
+different layout, without starting from a cold cache.
+
+To migrate gradually instead, run the server with --migrate-from set to the
+old cache directory. Results are then read from the old cache, and written
+to both caches. Each result read from the old cache is also copied to the
+new one, if it is not already there. With -m, the metrics on exit report
+the progress of the migration.`,
+				SetFlags: command.Flags(flax.MustBind, &migrateFlags),
+				Run:      command.Adapt(runMigrate),
+			},
+			{
+				Name: "sync",
+				Help: `Upload the contents of the cache to a --remote server.
+
+The cache and the server are configured by the flags of the main command.
+An index of the cache, listing each action and its output ID, is first
+sent to the server, which reports the actions it does not have. Only the
+objects for those actions are uploaded, up to -c at a time.
+The cache is read without updating its access times, so a sync does not
+keep results from being pruned.
+
+Use this to publish a cache built without --remote, such as one built by
+a CI job, or one whose uploads failed while the server was unavailable.`,
+				Run: command.Adapt(runSync),
+			},
+			{
+				Name:  "export",
+				Usage: "<snapshot-file>",
+				Help: `Write a snapshot of the contents of the cache to a file.
+
+The cache is configured by the flags of the main command. If the file
+name is "-", the snapshot is written to stdout. Use the import command
+to restore the snapshot into a cache.`,
+				Run: command.Adapt(runExport),
+			},
+			{
+				Name:  "import",
+				Usage: "<snapshot-file>",
+				Help: `Add the contents of a snapshot file to the cache.
+
+The cache is configured by the flags of the main command. If the file
+name is "-", the snapshot is read from stdin. The snapshot may be
+compressed with gzip. Entries already in the cache for the same actions
+are replaced.`,
+				Run: command.Adapt(runImport),
+			},
+			{
+				Name:  "stats",
+				Usage: "[--json] [--full]",
+				Help: `Print statistics about the contents of the cache.
+
+The cache is configured by the flags of the main command. By default, the
+statistics report the numbers of actions and objects, and the total size
+of the objects, from running totals kept by the cache, so the cache is
+not scanned. Objects no longer used by any action are counted until the
+cache is pruned.
+
+With --full, the cache is scanned, and the statistics report the number
+of actions and of distinct objects used by them, and their sizes. The
+dedup ratio is the total size of the objects of all actions, divided by
+the total size of the distinct objects.`,
+				SetFlags: command.Flags(flax.MustBind, &statsFlags),
+				Run:      command.Adapt(runStats),
+			},
+			{
+				Name:  "bench",
+				Usage: "[-n requests] [--workers n] [--actions n] [--size bytes]",
+				Help: `Measure the throughput of the cache with a synthetic workload.
+
+The cache is configured by the flags of the main command, so any backend
+settings can be compared. If --cache-dir is not set, a temporary directory
+is used instead of the default cache, and removed afterward.
+
+Each worker gets the result for an action chosen at random from --actions,
+reads the object on a hit, and stores a new object of --size bytes on a
+miss, as a build does. This reports the rate of requests and bytes, and
+the latencies of gets and puts. With --json, latencies are reported in
+nanoseconds.`,
+				SetFlags: command.Flags(flax.MustBind, &benchFlags),
+				Run:      command.Adapt(runBench),
+			},
+			{
+				Name:  "fsck",
+				Usage: "[--repair]",
+				Help: `Check the consistency of the cache.
+
+The cache is configured by the flags of the main command. This reports
+actions that are unreadable or whose objects are missing or the wrong
+size, objects not used by any action, and temporary files left behind by
+interrupted writes. With --repair, these are removed.
+
+A put interrupted by a crash leaves at most an orphaned object or a
+temporary file, which pruning also removes, so this is not needed for
+correctness. It reports an error if problems are found and not repaired.`,
+				SetFlags: command.Flags(flax.MustBind, &checkFlags),
+				Run:      command.Adapt(runFsck),
+			},
+			{
+				Name:  "verify",
+				Usage: "[--repair]",
+				Help: `Verify the contents of the cache.
+
+This performs the same checks as the fsck command, and also verifies that
+the contents of each object match its output ID, which the go command sets
+to the SHA-256 digest of the contents. Every object is read, so this is
+slower than fsck. Use it to validate a cache directory copied from another
+machine. With --repair, the problems found are removed.`,
+				SetFlags: command.Flags(flax.MustBind, &checkFlags),
+				Run:      command.Adapt(runVerify),
+			},
+			{
+				Name:  "check",
+				Usage: "[--timeout d]",
+				Help: `Check that the cache is usable.
+
+The cache is configured by the flags of the main command. This stores a
+small probe object in the cache, through any --remote, --shared-dir, or
+signing settings, and reads it back. With --read-only, it only checks that
+the cache can be read. With --remote, it also checks that the server can
+be reached with the given credentials.
+
+It prints "ok" and exits with status 0 if the cache is usable, and reports
+an error otherwise. Use this in CI to decide whether to build with the
+cache, for example:
+
+  if diskcache check; then export GOCACHEPROG=diskcache; fi`,
+				SetFlags: command.Flags(flax.MustBind, &healthFlags),
+				Run:      command.Adapt(runHealthCheck),
+			},
+			{
+				Name:  "serve",
+				Usage: "[--addr host:port] [--token src] [--tls-cert f --tls-key f] [--idle-timeout d] [--control path]\nunits\n--control path control stats|prune|reload|subscribe",
+				Help: `Serve the cache over HTTP, for use with --remote.
+
+The cache is configured by the flags of the main command. With --read-only,
+clients may read from the cache but not add to it. With -x, the cache is
+pruned periodically while the server runs, and again when it exits.
+
+With --token, clients must send the token given by the source, in the
+same form as --remote-token. With --tls-cert and --tls-key, the server uses
+HTTPS, and with --tls-client-ca, clients must also present a certificate
+signed by one of the given CA certificates. Without these, any client that
+can reach the server can read and write the cache. In either case, an
+object whose output ID is a SHA-256 digest, as the go command uses, is
+rejected unless its contents match the digest.
+
+With --idle-timeout, the server exits once no requests have arrived for the
+given time. If it was started by systemd socket activation, the server uses
+the socket passed by systemd instead of --addr, so that systemd starts it
+again on demand. The "units" subcommand prints systemd user units for this.
+
+The server performs maintenance on request. On Unix systems, SIGUSR1 logs
+statistics about the cache, SIGUSR2 prunes the cache (if -x is set), and
+SIGHUP reloads the --config file. Settings removed from the file revert to
+their defaults, and settings of the cache directory itself, such as
+--cache-dir, take effect only on restart. With --control, the same
+commands ("stats", "prune", and "reload") are accepted on a Unix socket at
+the given path, on all platforms. The "control" subcommand sends one.
+
+The "subscribe" command, accepted only on the control socket, streams the
+events of the server as lines of JSON until the subscriber disconnects.
+Each event has a "kind": "hit" or "miss" for a get, "put" for a stored
+object, "evict" for an object removed by pruning, and "error" for a
+request that failed, with the error in "error". Events are dropped if the
+subscriber does not keep up.
+
+For use as a liveness probe, GET /healthz reports 200 if the cache directory
+is usable, and 503 otherwise. It does not require the --token.`,
+				SetFlags: command.Flags(flax.MustBind, &serveFlags),
+				Run:      command.Adapt(runServe),
+				Commands: []*command.C{{
+					Name: "units",
+					Help: `Print systemd user units to start the server on demand.
+
+The units listen on --addr, and run the server with --idle-timeout (by
+default 15m) and the --cache-dir given, if any. Add other flags to the
+ExecStart line as needed. To install them, save the units to the files
+named in their comments, and run:
+
+  systemctl --user enable --now diskcache.socket`,
+					Run: command.Adapt(runServeUnits),
+				}, {
+					Name:  "control",
+					Usage: "stats|prune|reload|subscribe",
+					Help: `Send a maintenance command to a running server.
+
+The command is sent to the socket given by --control, and the result is
+printed. For "subscribe", events are printed as they arrive, until the
+server exits or the command is interrupted. See "help serve" for the
+commands.`,
+					Run: command.Adapt(runServeControl),
+				}},
+			},
+			{
+				Name:  "remote",
+				Usage: "--url url",
+				Help: `Serve a GOCACHEPROG plugin backed by a remote cache.
+
+This is the main command with --remote set to --url, for use as, e.g.:
+
+  GOCACHEPROG="diskcache remote --url https://cache.example.com"
+
+The local cache directory is a read-through tier in front of the remote
+cache: results missing from it are fetched from the remote cache and kept,
+and new results are stored in both. Other flags of the main command, such
+as --remote-token, are set before the subcommand name.
+
+The scheme of the URL selects the backend. Only "http" and "https" are
+supported, for a server run with "diskcache serve". Other schemes, such as
+"s3", "gs", and "redis", are reported as errors.`,
+				SetFlags: command.Flags(flax.MustBind, &remoteFlags),
+				Run:      command.Adapt(runRemote),
+			},
 			command.HelpCommand(nil),
-			command.VersionCommand(),
+			versionCommand(),
 		},
 	}
 	command.RunOrFail(root.NewEnv(nil), os.Args[1:])
 }
+
+// runPlugin implements the main command, serving the cache as a GOCACHEPROG
+// plugin on stdin and stdout.
+func runPlugin(env *command.Env) error {
+	s, err := newServer(env)
+	var uerr command.UsageError
+	if err != nil && flags.FallbackNull && !errors.As(err, &uerr) {
+		s = newNullServer(err)
+	} else if err != nil {
+		return err
+	}
+
+	in, out := io.Reader(os.Stdin), io.Writer(os.Stdout)
+	if flags.Record != "" {
+		rec, err := newRecorder()
+		if err != nil {
+			return fmt.Errorf("record session: %w", err)
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				log.Printf("WARNING: Recording session: %v", err)
+			}
+		}()
+		in, out = rec.Input(in), rec.Output(out)
+	}
+	if flags.DumpWire != "" {
+		f, err := os.Create(flags.DumpWire)
+		if err != nil {
+			return fmt.Errorf("dump wire: %w", err)
+		}
+		defer f.Close()
+		s.DumpWire(f)
+	}
+	if flags.DebugAddr != "" {
+		// The cache is still usable without the debug server, e.g.,
+		// if another cache program has the address.
+		addr, stop, err := startDebug(flags.DebugAddr, s)
+		if err != nil {
+			log.Printf("WARNING: Debug server: %v", err)
+		} else {
+			defer stop()
+			if flags.Verbose {
+				log.Printf("Debug server at http://%s/debug/", addr)
+			}
+		}
+	}
+
+	if err := s.Run(context.Background(), in, out); err != nil {
+		log.Printf("Server exited with error: %v", err)
+	}
+	if flags.Summary {
+		log.Print(tierSummary(s.Metrics()))
+	}
+	if flags.Verbose || flags.Metrics {
+		fmt.Fprintln(os.Stderr, s.Metrics())
+	}
+	return nil
+}
+
+// newServer constructs a cache server from the settings in flags.
+func newServer(env *command.Env) (*gocache.Server, error) {
+	var errorsMiss []string
+	if flags.ErrorsMiss != "" {
+		for _, cmd := range strings.Split(flags.ErrorsMiss, ",") {
+			if cmd != "get" && cmd != "put" {
+				return nil, env.Usagef("Invalid --errors-are-misses command: %q", cmd)
+			}
+			errorsMiss = append(errorsMiss, cmd)
+		}
+	}
+	if flags.MinHitRate < 0 || flags.MinHitRate > 1 {
+		return nil, env.Usagef("Invalid --min-hit-rate: %v (must be between 0 and 1)", flags.MinHitRate)
+	}
+	if flags.MaxErrorRate < 0 || flags.MaxErrorRate > 1 {
+		return nil, env.Usagef("Invalid --max-error-rate: %v (must be between 0 and 1)", flags.MaxErrorRate)
+	}
+	if flags.CachePercent < 1 || flags.CachePercent > 100 {
+		return nil, env.Usagef("Invalid --cache-percent: %d (must be between 1 and 100)", flags.CachePercent)
+	}
+	if flags.ReadOnly && flags.MigrateFrom != "" {
+		return nil, env.Usagef("You may not use --migrate-from with --read-only")
+	}
+	if flags.RemoteMinHit < 0 || flags.RemoteMinHit > 1 {
+		return nil, env.Usagef("Invalid --remote-min-hit-rate: %v (must be between 0 and 1)", flags.RemoteMinHit)
+	}
+	if flags.ReadOnly && flags.Remote != "" {
+		return nil, env.Usagef("You may not use --remote with --read-only")
+	}
+	if flags.Remote != "" {
+		if err := checkRemoteURL(flags.Remote); err != nil {
+			return nil, env.Usagef("Invalid --remote: %v", err)
+		}
+	}
+	if flags.ReadOnly && flags.WarmFrom != "" {
+		return nil, env.Usagef("You may not use --warm-from with --read-only")
+	}
+	dir, err := newCacheDir(env, true)
+	if err != nil {
+		return nil, err
+	}
+	if flags.WarmFrom != "" {
+		if err := warmCache(dir); err != nil {
+			return nil, fmt.Errorf("warm cache: %w", err)
+		}
+	}
+	var base cachens.Backend = dir
+	var setMetrics func(context.Context, *expvar.Map)
+	if flags.MigrateFrom != "" {
+		old, err := cachedir.NewWithOptions(flags.MigrateFrom, &cachedir.Options{ShardDepth: flags.MigrateDepth})
+		if err != nil {
+			return nil, fmt.Errorf("open --migrate-from dir: %w", err)
+		}
+		mig := migrate.New(old, dir, &migrate.Options{Backfill: true})
+		base, setMetrics = mig, mig.SetMetrics
+	}
+
+	// Count the requests served by each tier of the cache, for the summary.
+	local := cachecount.New(base, "local")
+	base, setMetrics = local, chainMetrics(setMetrics, local.SetMetrics)
+	if flags.SharedDir != "" {
+		sd, err := cachedir.NewWithOptions(flags.SharedDir, &cachedir.Options{ShardDepth: flags.ShardDepth})
+		if err != nil {
+			return nil, fmt.Errorf("open --shared-dir: %w", err)
+		}
+		shared := cachecount.New(sd, "shared")
+		fb := fallback.New(base, shared)
+		setMetrics = chainMetrics(setMetrics, shared.SetMetrics)
+		base, setMetrics = fb, chainMetrics(setMetrics, fb.SetMetrics)
+	}
+	if flags.Remote != "" {
+		opts, err := remoteOptions()
+		if err != nil {
+			return nil, err
+		}
+		rc := remote.NewClient(flags.Remote, base, opts)
+		base, setMetrics = rc, chainMetrics(setMetrics, rc.SetMetrics)
+	}
+	if sc, err := newSigner(base); err != nil {
+		return nil, err
+	} else if sc != nil {
+		base = sc
+		setMetrics = chainMetrics(setMetrics, sc.SetMetrics)
+	}
+	if flags.WriteBehind && !flags.ReadOnly {
+		wb, err := writeback.New(base, nil)
+		if err != nil {
+			return nil, err
+		}
+		base, setMetrics = wb, chainMetrics(setMetrics, wb.SetMetrics)
+	}
+	ns := cachens.New(base, flags.Namespace)
+
+	// Each wrapper closes the backend it wraps, so closing the namespace
+	// closes them all, from the outermost in. The cache directory is cleaned
+	// up last, after any pending puts have been stored.
+	cleanup := dir.Cleanup(value.Cond(flags.ReadOnly, 0, flags.MaxAge))
+	closeFunc := func(ctx context.Context) error {
+		err := ns.Close(ctx)
+		if cleanup != nil {
+			err = errors.Join(err, cleanup(ctx))
+		}
+		return err
+	}
+
+	// Results served from the hot cache do not reach the cache directory, so
+	// report them to it, to update access times and pins.
+	touch := func(_ context.Context, actionID, outputID string) error {
+		return dir.Touch(ns.ActionID(actionID), outputID)
+	}
+
+	// Alarm warnings are reported with the summary, so enable it if any
+	// alarm thresholds are set.
+	alarms := flags.MinHitRate > 0 || flags.MaxErrorRate > 0
+	return &gocache.Server{
+		Get:              ns.Get,
+		Put:              ns.Put,
+		Close:            closeFunc,
+		SetMetrics:       setMetrics,
+		MaxRequests:      flags.Concurrency,
+		MaxGetRequests:   flags.MaxGets,
+		MaxPutRequests:   flags.MaxPuts,
+		MaxPutBytes:      flags.MaxPutBytes,
+		RequestTimeout:   flags.ReqTimeout,
+		StrictIDs:        flags.StrictIDs,
+		ReadOnly:         flags.ReadOnly,
+		HotCacheSize:     flags.HotCache,
+		Touch:            touch,
+		MaxBodySize:      flags.MaxBodySize,
+		DropOversize:     flags.DropOversize,
+		Policy:           percentPolicy(flags.CachePercent),
+		ErrorsAreMisses:  errorsMiss,
+		Logf:             value.Cond(flags.Verbose, log.Printf, nil),
+		SummaryLogf:      value.Cond(flags.Summary || alarms, log.Printf, nil),
+		MinHitRate:       flags.MinHitRate,
+		MaxErrorRate:     flags.MaxErrorRate,
+		AlarmMinRequests: flags.AlarmMinReqs,
+		LogRequests:      flags.DebugLog,
+	}, nil
+}
+
+// newNullServer returns a server that reports err and then serves as a null
+// cache, for --fallback-null.
+func newNullServer(err error) *gocache.Server {
+	return &gocache.Server{
+		Init:           func(context.Context) error { return err },
+		FallbackToNull: true,
+		ReadOnly:       flags.ReadOnly,
+		Logf:           value.Cond(flags.Verbose, log.Printf, nil),
+		SummaryLogf:    log.Printf,
+	}
+}
+
+// newCacheDir opens the cache directory specified by the settings in flags.
+// If serving is true, the directory is for use by the server, rather than a
+// subcommand.
+func newCacheDir(env *command.Env, serving bool) (*cachedir.Dir, error) {
+	if flags.CacheDir == "" {
+		path, err := defaultCacheDir()
+		if err != nil {
+			return nil, env.Usagef("You must provide a --cache-dir: %v", err)
+		}
+		flags.CacheDir = path
+	}
+	if flags.PerUser {
+		path, err := perUserDir(flags.CacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("per-user cache dir: %w", err)
+		}
+		flags.CacheDir = path
+	}
+
+	shared, err := sharedFSMode(flags.SharedFS, flags.CacheDir)
+	if err != nil {
+		return nil, env.Usagef("Invalid --shared-fs: %v", err)
+	}
+	durability, err := durabilityMode(flags.Durability)
+	if err != nil {
+		return nil, env.Usagef("Invalid --durability: %v", err)
+	}
+	var policy cachedir.PrunePolicy
+	if flags.PruneCmd != "" {
+		args, ok := shell.Split(flags.PruneCmd)
+		if !ok || len(args) == 0 {
+			return nil, env.Usagef("Invalid --prune-command: %q", flags.PruneCmd)
+		}
+		policy = cachedir.CommandPolicy(args[0], args[1:]...)
+	}
+	dir, err := cachedir.NewWithOptions(flags.CacheDir, &cachedir.Options{
+		SessionDir:    flags.SessionDir,
+		ScratchDir:    flags.ScratchDir,
+		SharedFS:      shared,
+		Durability:    durability,
+		PrunePolicy:   policy,
+		ShardDepth:    flags.ShardDepth,
+		TouchInterval: value.Cond(flags.ReadOnly, 0, flags.TouchInterval),
+		FastDir:       flags.FastDir,
+		FastMaxSize:   flags.FastMaxSize,
+		PinObjects:    serving && flags.Pin && !flags.ReadOnly,
+		Hooks: cachedir.Hooks{
+			// Report evictions to subscribers of the serve command. Other
+			// commands have no subscribers, so this does nothing for them.
+			ObjectEvicted: serveEvents.evicted,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	if err := checkCacheDir(flags.CacheDir); err != nil {
+		return nil, fmt.Errorf("check cache dir: %w", err)
+	}
+	return dir, nil
+}
+
+// defaultCacheDir returns the default cache directory path, a subdirectory of
+// the user's per-platform cache directory (see [os.UserCacheDir]).
+func defaultCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "gocacheprog"), nil
+}
+
+// perUserDir returns a subdirectory of root for the current user, named for
+// the user's ID, creating it if necessary with access only for the user. If
+// root does not exist, it is created with permissions that allow all users to
+// create their own subdirectories, like a temporary directory.
+//
+// Since any user may create entries in root, another user could create the
+// subdirectory first, to read or alter the results stored there. An existing
+// subdirectory is therefore used only if it is a directory (not a symbolic
+// link) owned by the user, with no permissions for other users.
+func perUserDir(root string) (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(root); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(root, 0777|fs.ModeSticky); err != nil {
+			return "", err
+		}
+		log.Printf("Created shared cache directory %q, writable by all users", root)
+	} else if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(root, u.Uid)
+	if err := os.Mkdir(path, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	} else if fi.Mode()&fs.ModeSymlink != 0 {
+		return "", fmt.Errorf("%s is a symbolic link", path)
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	} else if err := checkPrivate(fi); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return path, nil
+}
+
+// sharedFSMode reports whether to enable shared filesystem mode for the cache
+// directory at path, given the mode setting from the command line.
+func sharedFSMode(mode, path string) (bool, error) {
+	switch mode {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	case "auto":
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return false, err
+		}
+		ok, err := cachedir.IsNetworkFS(path)
+		if err != nil {
+			log.Printf("WARNING: Unable to check filesystem type: %v", err)
+			return false, nil
+		}
+		if ok && flags.Verbose {
+			log.Printf("Cache directory is on a network filesystem; enabling shared mode")
+		}
+		return ok, nil
+	default:
+		return false, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// durabilityMode returns the durability setting for the given mode.
+func durabilityMode(mode string) (cachedir.Durability, error) {
+	switch mode {
+	case "none":
+		return cachedir.DurabilityNone, nil
+	case "sync":
+		return cachedir.DurabilitySync, nil
+	case "sync-dir":
+		return cachedir.DurabilitySyncDir, nil
+	default:
+		return 0, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// checkCacheDir reports an error if path is not a directory the current user
+// can both read and write.
+func checkCacheDir(path string) error {
+	if _, err := os.ReadDir(path); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(path, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("directory is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// percentPolicy returns a cache policy that uses the cache for the given
+// percentage of actions, or nil if percent ≥ 100. Action IDs are digests, so
+// the leading bits of the ID choose a stable and evenly-distributed subset.
+func percentPolicy(percent int) func(context.Context, gocache.Object) gocache.Decision {
+	if percent >= 100 {
+		return nil
+	}
+	return func(_ context.Context, obj gocache.Object) gocache.Decision {
+		if len(obj.ActionID) < 4 {
+			return gocache.Use
+		}
+		v, err := strconv.ParseUint(obj.ActionID[:4], 16, 16)
+		if err != nil || int(v%100) < percent {
+			return gocache.Use
+		}
+		return gocache.Skip
+	}
+}
+
+// newSigner returns a cache that signs results stored in base, as specified
+// by the settings in flags, or nil if signing is not enabled.
+func newSigner(base cachesign.Backend) (*cachesign.Cache, error) {
+	if flags.SignKey != "" {
+		if flags.Ed25519Key != "" || flags.TrustedKeys != "" {
+			return nil, errors.New("you may not use --sign-key with --ed25519-key or --trusted-keys")
+		}
+		key, err := loadKey(flags.SignKey)
+		if err != nil {
+			return nil, fmt.Errorf("--sign-key: %w", err)
+		}
+		return cachesign.New(base, key)
+	}
+	if flags.Ed25519Key == "" && flags.TrustedKeys == "" {
+		return nil, nil
+	}
+	var key ed25519.PrivateKey
+	var trusted []ed25519.PublicKey
+	if flags.Ed25519Key != "" {
+		var err error
+		key, err = cachesign.LoadPrivateKey(flags.Ed25519Key)
+		if err != nil {
+			return nil, fmt.Errorf("--ed25519-key: %w", err)
+		}
+	}
+	if flags.TrustedKeys != "" {
+		var err error
+		trusted, err = cachesign.LoadPublicKeys(flags.TrustedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("--trusted-keys: %w", err)
+		}
+	}
+	return cachesign.NewEd25519(base, key, trusted)
+}
+
+// tierSummary returns a one-line report of the hits served by each tier of
+// the cache, from the metrics of a server constructed by newServer: the
+// server's hot cache, the local cache directory, the --shared-dir, and the
+// --remote server. Tiers that are not in use are omitted.
+func tierSummary(m *expvar.Map) string {
+	get := func(m *expvar.Map, name string) expvar.Var {
+		if m == nil {
+			return nil
+		}
+		return m.Get(name)
+	}
+	sm, _ := get(m, "server").(*expvar.Map)
+	hm, _ := get(m, "host").(*expvar.Map)
+	tiers := []struct{ name, hits, bytes string }{
+		{"hot", "get_hot_hits", "get_hot_hit_bytes"},
+		{"local", "local_get_hits", "local_get_hit_bytes"},
+		{"shared", "shared_get_hits", "shared_get_hit_bytes"},
+		{"remote", "remote_hits", "remote_hit_bytes"},
+	}
+	var parts []string
+	for i, t := range tiers {
+		tm := value.Cond(i == 0, sm, hm)
+		hits, _ := get(tm, t.hits).(*expvar.Int)
+		bytes, _ := get(tm, t.bytes).(*expvar.Int)
+		if hits == nil || bytes == nil {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %d (%d bytes)", t.name, hits.Value(), bytes.Value()))
+	}
+	return "cache tiers: hits " + strings.Join(parts, ", ")
+}
+
+// chainMetrics returns a SetMetrics function that calls prev, if it is not
+// nil, and then next.
+func chainMetrics(prev, next func(context.Context, *expvar.Map)) func(context.Context, *expvar.Map) {
+	if prev == nil {
+		return next
+	}
+	return func(ctx context.Context, m *expvar.Map) {
+		prev(ctx, m)
+		next(ctx, m)
+	}
+}
+
+// loadKey loads a key from the given source, which has the form "env:NAME"
+// or "file:PATH".
+func loadKey(spec string) ([]byte, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	switch {
+	case !ok || arg == "":
+		return nil, errors.New("key source must be env:NAME or file:PATH")
+	case kind == "env":
+		return cachecrypt.KeyFromEnv(arg)
+	case kind == "file":
+		return cachecrypt.KeyFromFile(arg)
+	default:
+		return nil, fmt.Errorf("unknown key source %q", kind)
+	}
+}
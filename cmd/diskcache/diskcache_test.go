@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/flax"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/remote"
+)
+
+func TestPerUserDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Directory ownership is not checked on Windows")
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("Current user: %v", err)
+	}
+	root := filepath.Join(t.TempDir(), "shared")
+	want := filepath.Join(root, u.Uid)
+
+	// A missing root is created for all users, and the subdirectory for the
+	// current user only.
+	path, err := perUserDir(root)
+	if err != nil || path != want {
+		t.Fatalf("perUserDir: got %q, %v; want %q", path, err, want)
+	}
+	checkMode := func(path string, want fs.FileMode) {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		} else if got := fi.Mode() & (fs.ModePerm | fs.ModeSticky); got != want {
+			t.Errorf("Mode of %q: got %v, want %v", path, got, want)
+		}
+	}
+	checkMode(root, 0777|fs.ModeSticky)
+	checkMode(path, 0700)
+
+	// An existing private subdirectory is reused.
+	if path, err := perUserDir(root); err != nil || path != want {
+		t.Errorf("perUserDir (existing): got %q, %v; want %q", path, err, want)
+	}
+
+	// Another user may create the subdirectory before the current user does.
+	// It must not be used if others can access it, if it is owned by another
+	// user, or if it is not a directory.
+	mustFail := func(what string) {
+		t.Helper()
+		if path, err := perUserDir(root); err == nil {
+			t.Errorf("perUserDir (%s): got %q, want error", what, path)
+		} else {
+			t.Logf("perUserDir (%s): got expected error: %v", what, err)
+		}
+	}
+	if err := os.Chmod(want, 0777); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	mustFail("mode 0777")
+
+	if err := os.Remove(want); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	other := t.TempDir()
+	if err := os.Symlink(other, want); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	mustFail("symlink")
+
+	if err := os.Remove(want); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		t.Log("Not running as root; skipped foreign owner check")
+		return
+	}
+	if err := os.Mkdir(want, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.Chown(want, os.Getuid()+1, -1); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+	mustFail("foreign owner")
+}
+
+func TestReload(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	writeConfig := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(config, []byte(text), 0600); err != nil {
+			t.Fatalf("Write config: %v", err)
+		}
+	}
+	writeConfig("x = \"24h\"\nread-only = true\ntouch-interval = \"10m\"\n")
+
+	// Set up the settings as at startup: a flag from the command line, then
+	// the config file.
+	cfg := defaultSettings()
+	fs := flag.NewFlagSet("diskcache", flag.ContinueOnError)
+	flax.MustBind(fs, &cfg)
+	if err := fs.Parse([]string{"--config", config, "--touch-interval", "5m"}); err != nil {
+		t.Fatalf("Parse flags: %v", err)
+	}
+	if err := loadConfig(fs, config); err != nil {
+		t.Fatalf("Load config: %v", err)
+	}
+	if !cfg.ReadOnly || cfg.MaxAge != 24*time.Hour || cfg.TouchInterval != 5*time.Minute {
+		t.Fatalf("Startup settings: got %+v", cfg)
+	}
+
+	dir, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	m := &maintainer{flags: fs, dir: dir, cfg: &cfg}
+	m.state.Store(m.newState(&cfg))
+	if m.state.Load().prune != nil {
+		t.Error("Startup: pruning is enabled for a read-only cache")
+	}
+
+	// Removing a setting from the file reverts it to its default on reload,
+	// and settings from the command line still take precedence.
+	writeConfig("x = \"24h\"\ntouch-interval = \"10m\"\n")
+	if _, err := m.run(context.Background(), "reload"); err != nil {
+		t.Fatalf("Reload: unexpected error: %v", err)
+	}
+	if m.cfg.ReadOnly {
+		t.Error("Reload: read-only is still set after it was removed")
+	}
+	if m.cfg.MaxAge != 24*time.Hour {
+		t.Errorf("Reload: max age is %v, want 24h", m.cfg.MaxAge)
+	}
+	if m.cfg.TouchInterval != 5*time.Minute {
+		t.Errorf("Reload: touch interval is %v, want 5m from the command line", m.cfg.TouchInterval)
+	}
+	if m.state.Load().prune == nil {
+		t.Error("Reload: pruning is not enabled")
+	}
+
+	// The settings in use before the reload are not modified.
+	if !cfg.ReadOnly {
+		t.Error("Reload modified the previous settings")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	dir, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	cfg := defaultSettings()
+	m := &maintainer{dir: dir, cfg: &cfg}
+	m.state.Store(m.newState(&cfg))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sock := filepath.Join(t.TempDir(), "control")
+	stop, err := m.listenControl(ctx, sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer stop()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, "subscribe"); err != nil {
+		t.Fatalf("Send subscribe: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	if rsp, err := br.ReadString('\n'); err != nil || rsp != "ok: subscribed\n" {
+		t.Fatalf("Subscribe: got %q, %v; want ok", rsp, err)
+	}
+
+	// Each request to the server is reported to the subscriber.
+	do := func(method, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/v1/action/a1b2c3", strings.NewReader(body))
+		req.Header.Set(remote.OutputIDHeader, "0b1ec7")
+		m.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("GET", "")
+	do("PUT", "xyzzy")
+	do("GET", "")
+
+	dec := json.NewDecoder(br)
+	for _, want := range []string{"miss", "put", "hit"} {
+		var e serveEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Decode event: %v", err)
+		}
+		if e.Kind != want || e.ActionID != "a1b2c3" {
+			t.Errorf("Event: got %+v, want %s of a1b2c3", e, want)
+		}
+	}
+}
+
+func TestCheckRemoteURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://localhost:8086", true},
+		{"https://cache.example.com/", true},
+		{"https://", false},
+		{"s3://bucket/prefix", false},
+		{"gcs://bucket/prefix", false},
+		{"redis://localhost:6379", false},
+		{"ftp://cache.example.com", false},
+		{"cache.example.com", false},
+	}
+	for _, tc := range tests {
+		err := checkRemoteURL(tc.url)
+		if got := err == nil; got != tc.ok {
+			t.Errorf("checkRemoteURL(%q): got %v, want ok=%v", tc.url, err, tc.ok)
+		}
+	}
+}
+
+func TestTierSummary(t *testing.T) {
+	counter := func(v int64) *expvar.Int {
+		n := new(expvar.Int)
+		n.Set(v)
+		return n
+	}
+	sm, hm := new(expvar.Map), new(expvar.Map)
+	sm.Set("get_hot_hits", counter(3))
+	sm.Set("get_hot_hit_bytes", counter(30))
+	hm.Set("local_get_hits", counter(5))
+	hm.Set("local_get_hit_bytes", counter(500))
+	hm.Set("remote_hits", counter(1))
+	hm.Set("remote_hit_bytes", counter(100))
+	m := new(expvar.Map)
+	m.Set("server", sm)
+	m.Set("host", hm)
+
+	// There is no --shared-dir, so that tier is omitted.
+	const want = "cache tiers: hits hot 3 (30 bytes), local 5 (500 bytes), remote 1 (100 bytes)"
+	if got := tierSummary(m); got != want {
+		t.Errorf("tierSummary:\ngot  %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/version"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/mds/shell"
+)
+
+var envFlags struct {
+	GoEnv bool `flag:"w,Print a go env -w command instead of a shell export"`
+	Force bool `flag:"f,Print settings even if the toolchain does not support GOCACHEPROG"`
+}
+
+// runEnv implements the "env" subcommand.
+func runEnv(env *command.Env) error {
+	goVersion, err := checkToolchain()
+	if err != nil {
+		if !envFlags.Force {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+
+	prog, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate program: %w", err)
+	}
+
+	// Reproduce the flags explicitly set on the main command, so that the
+	// toolchain runs the cache with the same settings.
+	args := []string{prog}
+	env.Parent.Command.Flags.Visit(func(f *flag.Flag) {
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	val, err := joinQuoted(args)
+	if err != nil {
+		return err
+	}
+
+	if goVersion != "" {
+		fmt.Printf("# toolchain: %s\n", goVersion)
+	}
+	if envFlags.GoEnv {
+		fmt.Printf("go env -w GOCACHEPROG=%s\n", shell.Quote(val))
+	} else {
+		fmt.Printf("export GOCACHEPROG=%s\n", shell.Quote(val))
+	}
+	return nil
+}
+
+// checkToolchain reports the version of the go command found in $PATH, or an
+// error if it cannot be run or does not support GOCACHEPROG.
+func checkToolchain() (string, error) {
+	out, err := exec.Command("go", "env", "GOVERSION", "GOEXPERIMENT").Output()
+	if err != nil {
+		return "", fmt.Errorf("checking go toolchain: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	vf := strings.Fields(lines[0])
+	if len(vf) == 0 {
+		return "", errors.New("checking go toolchain: no version reported")
+	}
+	goVersion := vf[0]
+
+	// GOCACHEPROG is supported by default as of Go 1.24; earlier versions
+	// require the cacheprog experiment. Development versions do not have a
+	// comparable version string, so assume they are recent enough.
+	if !version.IsValid(goVersion) || version.Compare(goVersion, "go1.24") >= 0 {
+		return goVersion, nil
+	} else if len(lines) > 1 && slices.Contains(strings.Split(lines[1], ","), "cacheprog") {
+		return goVersion, nil
+	}
+	return goVersion, fmt.Errorf("toolchain %s does not support GOCACHEPROG (requires go1.24 or GOEXPERIMENT=cacheprog)", goVersion)
+}
+
+// joinQuoted joins args into a single string, quoting arguments as needed so
+// that the go command will split the result back into the same arguments.
+// The go command does not support escapes, so an argument cannot contain both
+// single and double quotation marks.
+func joinQuoted(args []string) (string, error) {
+	var sb strings.Builder
+	for i, arg := range args {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		hasSpace := strings.ContainsAny(arg, " \t\n\r")
+		hasSingle := strings.Contains(arg, "'")
+		hasDouble := strings.Contains(arg, `"`)
+		switch {
+		case hasSingle && hasDouble:
+			return "", fmt.Errorf("argument %q contains both quotation marks", arg)
+		case hasSingle:
+			sb.WriteString(`"` + arg + `"`)
+		case hasDouble || hasSpace:
+			sb.WriteString("'" + arg + "'")
+		default:
+			sb.WriteString(arg)
+		}
+	}
+	return sb.String(), nil
+}
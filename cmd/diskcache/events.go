@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// serveEvent is an event reported to subscribers of the serve command, as a
+// line of JSON on the control socket.
+type serveEvent struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"` // "hit", "miss", "put", "evict", or "error"
+	Command  string        `json:"command,omitempty"`
+	ActionID string        `json:"actionID,omitempty"`
+	OutputID string        `json:"outputID,omitempty"`
+	Size     int64         `json:"size,omitempty"`
+	Elapsed  time.Duration `json:"elapsed,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// subscriberBuffer is the number of events buffered for each subscriber.
+// Events are dropped for a subscriber that falls further behind, so that a
+// slow subscriber does not delay requests.
+const subscriberBuffer = 256
+
+// eventHub delivers events to subscribers. The zero value is ready for use,
+// and publishing to a hub with no subscribers does nothing.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan serveEvent]struct{}
+}
+
+// serveEvents receives the events of the cache served by the serve command.
+// It is shared by the cache directory hooks, which are set when the directory
+// is opened, and the maintainer, which serves subscriptions.
+var serveEvents eventHub
+
+// subscribe returns a channel that receives the events published to h, and a
+// function to end the subscription.
+func (h *eventHub) subscribe() (<-chan serveEvent, func()) {
+	ch := make(chan serveEvent, subscriberBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan serveEvent]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, ch)
+	}
+}
+
+// publish delivers e to the current subscribers of h, without waiting.
+func (h *eventHub) publish(e serveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// The subscriber is not keeping up; drop the event.
+		}
+	}
+}
+
+// request publishes an event for the end of a request to the server, in the
+// form of [remote.ServerOptions.OnEvent].
+func (h *eventHub) request(e gocache.Event) {
+	se := serveEvent{
+		Command:  e.Command,
+		ActionID: e.ActionID,
+		OutputID: e.OutputID,
+		Size:     e.Size,
+		Elapsed:  e.Elapsed,
+	}
+	switch {
+	case e.Err != nil:
+		se.Kind, se.Error = "error", e.Err.Error()
+	case e.Command == "put":
+		se.Kind = "put"
+	case e.Miss:
+		se.Kind = "miss"
+	default:
+		se.Kind = "hit"
+	}
+	h.publish(se)
+}
+
+// evicted publishes an event for an object removed by pruning, in the form of
+// [cachedir.Hooks.ObjectEvicted].
+func (h *eventHub) evicted(outputID string, size int64) {
+	h.publish(serveEvent{Kind: "evict", OutputID: outputID, Size: size})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+)
+
+var checkFlags struct {
+	Repair bool `flag:"repair,Remove invalid actions and objects, orphaned objects, and temporary files"`
+}
+
+// runFsck implements the "fsck" subcommand.
+func runFsck(env *command.Env) error { return runCheck(env, false) }
+
+// runVerify implements the "verify" subcommand.
+func runVerify(env *command.Env) error { return runCheck(env, true) }
+
+// runCheck checks the cache, and also checks object digests if digests is
+// true.
+func runCheck(env *command.Env, digests bool) error {
+	name := env.Command.Name
+	if checkFlags.Repair && flags.ReadOnly {
+		return env.Usagef("You may not use --repair with --read-only")
+	}
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	ctx := gocache.WithLogf(context.Background(), log.Printf)
+	s, err := dir.Check(ctx, &cachedir.CheckOptions{
+		Repair:  checkFlags.Repair,
+		Digests: digests,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	fmt.Printf("actions:      %d\n", s.Actions)
+	fmt.Printf("objects:      %d\n", s.Objects)
+	fmt.Printf("bad actions:  %d\n", s.BadActions)
+	if digests {
+		fmt.Printf("bad objects:  %d\n", s.BadObjects)
+	}
+	fmt.Printf("orphans:      %d\n", s.Orphans)
+	fmt.Printf("temp files:   %d\n", s.TempFiles)
+	if checkFlags.Repair {
+		fmt.Printf("repaired:     %d\n", s.Repaired)
+	} else if !s.OK() {
+		return fmt.Errorf("%s: %w", name, errProblems)
+	}
+	return nil
+}
+
+var errProblems = errors.New("problems found (use --repair to fix them)")
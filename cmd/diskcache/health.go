@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/remote"
+	"github.com/creachadair/mds/value"
+)
+
+var healthFlags = struct {
+	Timeout time.Duration `flag:"timeout,default=*,Time limit for the check"`
+}{
+	Timeout: 30 * time.Second,
+}
+
+// probeBody is the contents of the object stored by the check command. The
+// probe always uses the same action, so repeated checks do not add to the
+// size of the cache.
+const probeBody = "diskcache health check\n"
+
+// runHealthCheck implements the "check" subcommand.
+func runHealthCheck(env *command.Env) error {
+	s, err := newServer(env.Parent)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthFlags.Timeout)
+	defer cancel()
+	err = checkCache(ctx, s)
+	if s.Close != nil {
+		err = errors.Join(err, s.Close(context.WithoutCancel(ctx)))
+	}
+	if err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	}
+	fmt.Printf("ok: cache %q is %s\n", flags.CacheDir, value.Cond(flags.ReadOnly, "readable", "writable"))
+	return nil
+}
+
+// checkCache stores a probe object through the callbacks of s, and reads it
+// back. If the cache is read-only, it only checks that the probe can be read.
+// If --remote is set, it also checks that the server has the probe.
+func checkCache(ctx context.Context, s *gocache.Server) error {
+	actionSum := sha256.Sum256([]byte("diskcache check"))
+	outputSum := sha256.Sum256([]byte(probeBody))
+	actionID, outputID := hex.EncodeToString(actionSum[:]), hex.EncodeToString(outputSum[:])
+
+	if !flags.ReadOnly {
+		if _, err := s.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(probeBody)),
+			Body:     bytes.NewReader([]byte(probeBody)),
+		}); err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+	}
+	gotID, diskPath, err := s.Get(ctx, actionID)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	} else if gotID == "" {
+		if flags.ReadOnly {
+			return nil // the probe has not been stored, but the cache is readable
+		}
+		return errors.New("get: the probe was not found after it was stored")
+	} else if gotID != outputID {
+		return fmt.Errorf("get: got output ID %s, want %s", gotID, outputID)
+	}
+	data, err := os.ReadFile(diskPath)
+	if err != nil {
+		return fmt.Errorf("read object: %w", err)
+	} else if string(data) != probeBody {
+		return fmt.Errorf("read object: contents of %q do not match", diskPath)
+	}
+
+	if flags.Remote != "" {
+		opts, err := remoteOptions()
+		if err != nil {
+			return err
+		}
+		// The object is stored under the namespace, if any, so only check that
+		// the server is reachable.
+		if _, _, err := remote.NewClient(flags.Remote, nil, opts).Stat(ctx, actionID); err != nil {
+			return fmt.Errorf("remote: %w", err)
+		}
+	}
+	return nil
+}
+
+// handleHealth reports whether the cache directory of the serve command is
+// usable, for use as a liveness probe.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if flags.ReadOnly {
+		_, err = os.ReadDir(flags.CacheDir)
+	} else {
+		err = checkCacheDir(flags.CacheDir)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
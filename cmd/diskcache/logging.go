@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/creachadair/command"
+)
+
+// setupLogging configures the standard logger for the --log-format setting.
+func setupLogging(format string) error {
+	switch format {
+	case "std":
+		return nil
+	case "tagged":
+		tag := "[" + command.ProgramName() + "]"
+		if useColor(os.Stderr) {
+			tag = "\x1b[2m" + tag + "\x1b[0m"
+		}
+		log.SetFlags(0)
+		log.SetPrefix(tag + " ")
+		log.SetOutput(lineWriter{os.Stderr})
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// useColor reports whether to colorize output written to f: It must be a
+// terminal, and the user must not have set NO_COLOR (see https://no-color.org).
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// lineWriter is an [io.Writer] for log messages that joins the lines of a
+// multi-line message, so that each message is written as a single line and
+// does not break up the output of the go command on the same stream.
+type lineWriter struct{ w io.Writer }
+
+// Write implements the [io.Writer] interface. The standard logger calls Write
+// once per message.
+func (lw lineWriter) Write(data []byte) (int, error) {
+	msg := bytes.TrimRight(data, "\n")
+	if bytes.IndexByte(msg, '\n') < 0 {
+		return lw.w.Write(data)
+	}
+	line := append(bytes.ReplaceAll(msg, []byte("\n"), []byte(" | ")), '\n')
+	if _, err := lw.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
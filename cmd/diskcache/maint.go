@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/flax"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/remote"
+	"github.com/creachadair/mds/value"
+)
+
+// maintainer serves the cache for the serve command, and performs
+// maintenance on request, from a signal or the control socket.
+type maintainer struct {
+	flags *flag.FlagSet // the flags of the main command
+	dir   *cachedir.Dir
+	token remote.TokenSource
+
+	state    atomic.Pointer[serveState]
+	requests atomic.Int64
+
+	mu  sync.Mutex // serializes maintenance commands
+	cfg *settings  // the current settings, guarded by mu
+}
+
+// serveState is the state of the server that depends on settings that can be
+// reloaded from the config file.
+type serveState struct {
+	handler http.Handler
+	prune   func(context.Context) error // nil if pruning is disabled
+}
+
+func (m *maintainer) newState(cfg *settings) *serveState {
+	return &serveState{
+		handler: remote.NewServer(m.dir, &remote.ServerOptions{
+			ReadOnly: cfg.ReadOnly,
+			Token:    m.token,
+			Logf:     value.Cond(cfg.Verbose, log.Printf, nil),
+			OnEvent:  serveEvents.request,
+		}),
+		prune: m.dir.Cleanup(value.Cond(cfg.ReadOnly, 0, cfg.MaxAge)),
+	}
+}
+
+// ServeHTTP implements [http.Handler] using the current state of m.
+func (m *maintainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.requests.Add(1)
+	m.state.Load().handler.ServeHTTP(w, r)
+}
+
+// run performs the named maintenance command, and returns a description of
+// the result.
+func (m *maintainer) run(ctx context.Context, cmd string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch cmd {
+	case "stats":
+		t, err := m.dir.Totals(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("requests %d, actions %d, objects %d (%d bytes)",
+			m.requests.Load(), t.Actions, t.Objects, t.ObjectBytes), nil
+
+	case "prune":
+		prune := m.state.Load().prune
+		if prune == nil {
+			return "", errors.New("pruning is not enabled")
+		} else if err := prune(ctx); err != nil {
+			return "", err
+		}
+		return "pruned", nil
+
+	case "reload":
+		if m.cfg.Config == "" {
+			return "", errors.New("no config file")
+		}
+		cfg, err := reloadSettings(m.flags, m.cfg.Config)
+		if err != nil {
+			return "", err
+		}
+		// The cache directory is not reopened, so keep its path as resolved
+		// at startup.
+		cfg.CacheDir = m.cfg.CacheDir
+		m.cfg = cfg
+		m.state.Store(m.newState(cfg))
+		return fmt.Sprintf("reloaded %q", cfg.Config), nil
+
+	default:
+		return "", fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// reloadSettings returns new settings for the main command, starting from the
+// defaults, then applying the flags that are set in fs, and then the config
+// file at path. The flags set in fs were set on the command line or by the
+// environment, neither of which changes while the program runs, so they take
+// precedence over the file as they did at startup. Settings removed from the
+// file revert to their defaults.
+func reloadSettings(fs *flag.FlagSet, path string) (*settings, error) {
+	cfg := defaultSettings()
+	nfs := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	flax.MustBind(nfs, &cfg)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if serr := nfs.Set(f.Name, f.Value.String()); serr != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %w", f.Name, serr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if err := loadConfig(nfs, path); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// handleSignals runs the maintenance commands for the signals in
+// maintSignals as they arrive, until ctx ends.
+func (m *maintainer) handleSignals(ctx context.Context) {
+	if len(maintSignals) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	for sig := range maintSignals {
+		signal.Notify(ch, sig)
+	}
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			cmd := maintSignals[sig]
+			if msg, err := m.run(ctx, cmd); err != nil {
+				log.Printf("WARNING: %s (%v): %v", cmd, sig, err)
+			} else {
+				log.Printf("%s (%v): %s", cmd, sig, msg)
+			}
+		}
+	}
+}
+
+// listenControl accepts maintenance commands on a Unix socket at path, one
+// per line, until the returned function is called to close the socket. Each
+// command is answered with a line beginning "ok" or "error".
+func (m *maintainer) listenControl(ctx context.Context, path string) (func(), error) {
+	// Remove a socket left behind by an earlier server.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serveControl(ctx, conn)
+		}
+	}()
+	return func() { ln.Close() }, nil
+}
+
+func (m *maintainer) serveControl(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		cmd := strings.TrimSpace(sc.Text())
+		if cmd == "" {
+			continue
+		} else if cmd == "subscribe" {
+			m.subscribe(ctx, conn)
+			return
+		}
+		msg, err := m.run(ctx, cmd)
+		if err != nil {
+			log.Printf("WARNING: %s (control): %v", cmd, err)
+			fmt.Fprintf(conn, "error: %v\n", err)
+		} else {
+			log.Printf("%s (control): %s", cmd, msg)
+			fmt.Fprintf(conn, "ok: %s\n", msg)
+		}
+	}
+}
+
+// subscribe writes the events of the server to conn as JSON, one per line,
+// until conn is closed or ctx ends.
+func (m *maintainer) subscribe(ctx context.Context, conn net.Conn) {
+	events, cancel := serveEvents.subscribe()
+	defer cancel()
+	log.Printf("subscribe (control): started")
+	defer log.Printf("subscribe (control): ended")
+	if _, err := fmt.Fprintln(conn, "ok: subscribed"); err != nil {
+		return
+	}
+
+	// The subscriber sends nothing more, so a read ends when it disconnects.
+	closed := make(chan struct{})
+	go func() { defer close(closed); io.Copy(io.Discard, conn) }()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case e := <-events:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// runServeControl implements the "serve control" subcommand.
+func runServeControl(env *command.Env, cmd string) error {
+	if serveFlags.Control == "" {
+		return env.Usagef("You must provide the --control socket of the server")
+	}
+	conn, err := net.Dial("unix", serveFlags.Control)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	rsp, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	rsp = strings.TrimSpace(rsp)
+	if msg, ok := strings.CutPrefix(rsp, "error: "); ok {
+		return errors.New(msg)
+	} else if cmd == "subscribe" {
+		_, err := io.Copy(os.Stdout, br)
+		return err
+	}
+	fmt.Println(strings.TrimPrefix(rsp, "ok: "))
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// maintSignals maps signals to the maintenance commands they trigger in the
+// serve command. There are none on this platform; use the control socket.
+var maintSignals map[os.Signal]string
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// maintSignals maps signals to the maintenance commands they trigger in the
+// serve command.
+var maintSignals = map[os.Signal]string{
+	syscall.SIGUSR1: "stats",
+	syscall.SIGUSR2: "prune",
+	syscall.SIGHUP:  "reload",
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/migrate"
+)
+
+var migrateFlags struct {
+	ShardDepth int `flag:"target-shard-depth,Number of levels of subdirectories in the target (default 1)"`
+}
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(env *command.Env, target string) error {
+	src, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	srcPath, _ := filepath.Abs(flags.CacheDir)
+	if dstPath, _ := filepath.Abs(target); dstPath == srcPath {
+		return env.Usagef("The target must not be the same as --cache-dir")
+	}
+	dst, err := cachedir.NewWithOptions(target, &cachedir.Options{ShardDepth: migrateFlags.ShardDepth})
+	if err != nil {
+		return fmt.Errorf("create target dir: %w", err)
+	}
+
+	ctx := context.Background()
+	if flags.Verbose {
+		ctx = gocache.WithLogf(ctx, log.Printf)
+	}
+	var actions, copied atomic.Int64
+	if err := src.Actions(ctx, func(id string) error {
+		actions.Add(1)
+		ok, err := migrate.Copy(ctx, dst, src, id)
+		if ok {
+			copied.Add(1)
+		}
+		return err
+	}); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	fmt.Printf("copied %d of %d actions to %s\n", copied.Load(), actions.Load(), target)
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// checkPrivate does nothing and reports nil, as file ownership and permission
+// bits are not available on this platform.
+func checkPrivate(fi fs.FileInfo) error { return nil }
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// checkPrivate reports an error if the file described by fi is not owned by
+// the current user, or grants any permissions to other users.
+func checkPrivate(fi fs.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("cannot determine owner")
+	} else if uid := os.Getuid(); int(st.Uid) != uid {
+		return fmt.Errorf("owned by uid %d, not %d", st.Uid, uid)
+	} else if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("mode %04o grants access to other users", perm)
+	}
+	return nil
+}
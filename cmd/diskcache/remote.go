@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/creachadair/command"
+)
+
+var remoteFlags struct {
+	URL string `flag:"url,URL of the remote cache (required)"`
+}
+
+// runRemote implements the "remote" subcommand.
+func runRemote(env *command.Env) error {
+	if remoteFlags.URL == "" {
+		return env.Usagef("You must provide a --url")
+	} else if flags.Remote != "" {
+		return env.Usagef("You may not use --url with --remote")
+	} else if err := checkRemoteURL(remoteFlags.URL); err != nil {
+		return env.Usagef("Invalid --url: %v", err)
+	}
+	flags.Remote = remoteFlags.URL
+	return runPlugin(env.Parent)
+}
+
+// checkRemoteURL reports whether s is the URL of a remote cache that this
+// program can use. The scheme selects the backend; only the HTTP service of
+// package remote is bundled.
+func checkRemoteURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return errors.New("missing host")
+		}
+		return nil
+	case "s3", "gs", "gcs", "redis", "rediss":
+		return fmt.Errorf("no %s backend is bundled with this program; "+
+			`serve the cache with "diskcache serve" and use its http or https URL`, u.Scheme)
+	case "":
+		return errors.New("missing scheme")
+	default:
+		return fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache/record"
+)
+
+var replayFlags struct {
+	BodyDir string `flag:"body-dir,Directory of object bodies recorded with --record-body-dir"`
+}
+
+// runReplay implements the "replay" subcommand.
+func runReplay(env *command.Env, logFile string) error {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := newServer(env.Parent)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(record.Replay(pw, f, replayFlags.BodyDir)) }()
+	defer pr.Close() // unblock the replay if the server stops early
+
+	if err := s.Run(context.Background(), pr, os.Stdout); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	if flags.Verbose || flags.Metrics {
+		fmt.Fprintln(os.Stderr, s.Metrics())
+	}
+	return nil
+}
+
+// sessionRecorder is a [record.Recorder] that writes to a file.
+type sessionRecorder struct {
+	*record.Recorder
+	f *os.File
+}
+
+// newRecorder creates a recorder for the log file named by --record.
+func newRecorder() (*sessionRecorder, error) {
+	if flags.RecordBodyDir != "" {
+		if err := os.MkdirAll(flags.RecordBodyDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Create(flags.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionRecorder{
+		Recorder: record.New(f, &record.Options{
+			ElideBodies: flags.RecordElide,
+			BodyDir:     flags.RecordBodyDir,
+		}),
+		f: f,
+	}, nil
+}
+
+// Close closes the log file, and reports the first error that occurred while
+// recording the session, if any.
+func (r *sessionRecorder) Close() error {
+	err := r.Err()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/remote"
+	"github.com/creachadair/mds/shell"
+	"github.com/creachadair/mds/value"
+)
+
+var serveFlags = struct {
+	Addr     string        `flag:"addr,default=*,Address to listen on"`
+	Token    string        `flag:"token,Source of the bearer token clients must send (env:NAME or file:PATH)"`
+	TLSCert  string        `flag:"tls-cert,PEM file of the server certificate (optional)"`
+	TLSKey   string        `flag:"tls-key,PEM file of the server key (optional)"`
+	ClientCA string        `flag:"tls-client-ca,PEM file of CA certificates for client certificates (optional)"`
+	Idle     time.Duration `flag:"idle-timeout,Exit after this long with no requests (0 means never)"`
+	Control  string        `flag:"control,Path of a Unix socket to accept maintenance commands on (optional)"`
+}{
+	Addr: "localhost:8086",
+}
+
+// pruneInterval is how often the serve command prunes the cache, if --x is set.
+const pruneInterval = time.Hour
+
+// runServe implements the "serve" subcommand.
+func runServe(env *command.Env) error {
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	var token remote.TokenSource
+	if serveFlags.Token != "" {
+		src, err := remote.ParseTokenSource(serveFlags.Token)
+		if err != nil {
+			return env.Usagef("Invalid --token: %v", err)
+		}
+		if _, err := src(); err != nil {
+			return fmt.Errorf("read token: %w", err)
+		}
+		token = src
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	ln, activated, err := listen(serveFlags.Addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ctx = gocache.WithLogf(ctx, log.Printf)
+
+	cfg := flags
+	m := &maintainer{flags: &env.Parent.Command.Flags, dir: dir, token: token, cfg: &cfg}
+	m.state.Store(m.newState(&cfg))
+	var handler http.Handler = m
+	if serveFlags.Idle > 0 {
+		handler = newIdleHandler(handler, serveFlags.Idle, func() {
+			log.Printf("No requests for %v, exiting", serveFlags.Idle)
+			cancel()
+		})
+	}
+	// Health checks do not count as activity for --idle-timeout, and do not
+	// require a token.
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc("GET /healthz", handleHealth)
+	hs := &http.Server{
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	if serveFlags.Control != "" {
+		stop, err := m.listenControl(ctx, serveFlags.Control)
+		if err != nil {
+			return fmt.Errorf("control socket: %w", err)
+		}
+		defer stop()
+	}
+	go m.handleSignals(ctx)
+	go func() {
+		t := time.NewTicker(pruneInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if prune := m.state.Load().prune; prune != nil {
+					if err := prune(ctx); err != nil {
+						log.Printf("WARNING: Prune cache: %v", err)
+					}
+				}
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		hs.Shutdown(sctx)
+	}()
+
+	log.Printf("Serving cache %q at %s%s", flags.CacheDir, ln.Addr(),
+		value.Cond(activated, " (socket activated)", ""))
+	if tlsConfig != nil {
+		err = hs.ServeTLS(ln, "", "") // certificates are in tlsConfig
+	} else {
+		err = hs.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if prune := m.state.Load().prune; prune != nil {
+		return prune(context.WithoutCancel(ctx))
+	}
+	return nil
+}
+
+// listen returns a listener for the serve command. If the program was started
+// by systemd socket activation, it uses the first socket passed by systemd,
+// and reports true. Otherwise, it listens on addr.
+func listen(addr string) (net.Listener, bool, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	nfds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || nfds < 1 {
+		ln, err := net.Listen("tcp", addr)
+		return ln, false, err
+	}
+	// Do not pass the sockets on to subprocesses.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3 // see sd_listen_fds(3)
+	f := os.NewFile(firstFD, "systemd-socket")
+	defer f.Close() // the listener has its own copy
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("activated socket: %w", err)
+	}
+	return ln, true, nil
+}
+
+// idleHandler wraps an [http.Handler], and calls a function when no requests
+// have been in progress for a given time.
+type idleHandler struct {
+	http.Handler
+	timeout time.Duration
+
+	mu     sync.Mutex
+	active int
+	timer  *time.Timer
+}
+
+func newIdleHandler(h http.Handler, timeout time.Duration, onIdle func()) *idleHandler {
+	return &idleHandler{Handler: h, timeout: timeout, timer: time.AfterFunc(timeout, onIdle)}
+}
+
+func (h *idleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.active++
+	h.timer.Stop()
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.active--; h.active == 0 {
+			h.timer.Reset(h.timeout)
+		}
+	}()
+	h.Handler.ServeHTTP(w, r)
+}
+
+// runServeUnits implements the "serve units" subcommand.
+func runServeUnits(env *command.Env) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{exe}
+	if flags.CacheDir != "" {
+		args = append(args, "--cache-dir="+flags.CacheDir)
+	}
+	args = append(args, "serve", "--idle-timeout="+cmp.Or(serveFlags.Idle, 15*time.Minute).String())
+
+	// systemd requires a numeric address.
+	addr := serveFlags.Addr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "localhost" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	fmt.Printf(`# ~/.config/systemd/user/diskcache.socket
+[Unit]
+Description=Go build cache server socket
+
+[Socket]
+ListenStream=%[1]s
+
+[Install]
+WantedBy=sockets.target
+
+# ~/.config/systemd/user/diskcache.service
+[Unit]
+Description=Go build cache server
+Requires=diskcache.socket
+
+[Service]
+ExecStart=%[2]s
+`, addr, shell.Join(args))
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/command"
+)
+
+// runExport implements the "export" subcommand.
+func runExport(env *command.Env, path string) error {
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := dir.Snapshot(w); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		return w.Flush()
+	}
+	f, err := atomicfile.New(path, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Cancel()
+	w := bufio.NewWriter(f)
+	if err := dir.Snapshot(w); err != nil {
+		return fmt.Errorf("export: %w", err)
+	} else if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// runImport implements the "import" subcommand.
+func runImport(env *command.Env, path string) error {
+	if flags.ReadOnly {
+		return env.Usagef("You may not import with --read-only")
+	}
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	f := os.Stdin
+	if path != "-" {
+		f, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	if err := dir.Restore(r); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	return nil
+}
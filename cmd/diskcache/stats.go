@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/creachadair/command"
+)
+
+var statsFlags struct {
+	JSON bool `flag:"json,Write statistics as JSON"`
+	Full bool `flag:"full,Scan the cache to report how objects are shared"`
+}
+
+// runStats implements the "stats" subcommand.
+func runStats(env *command.Env) error {
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if !statsFlags.Full {
+		t, err := dir.Totals(ctx)
+		if err != nil {
+			return fmt.Errorf("stats: %w", err)
+		}
+		if statsFlags.JSON {
+			return json.NewEncoder(os.Stdout).Encode(struct {
+				Actions     int   `json:"actions"`
+				Objects     int   `json:"objects"`
+				ObjectBytes int64 `json:"objectBytes"`
+			}{t.Actions, t.Objects, t.ObjectBytes})
+		}
+		fmt.Printf("actions:      %d\n", t.Actions)
+		fmt.Printf("objects:      %d\n", t.Objects)
+		fmt.Printf("object bytes: %d\n", t.ObjectBytes)
+		return nil
+	}
+
+	u, err := dir.Usage(ctx)
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	if statsFlags.JSON {
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Actions     int     `json:"actions"`
+			Objects     int     `json:"objects"`
+			ActionBytes int64   `json:"actionBytes"`
+			ObjectBytes int64   `json:"objectBytes"`
+			DedupRatio  float64 `json:"dedupRatio"`
+		}{u.Actions, u.Objects, u.ActionBytes, u.ObjectBytes, u.DedupRatio()})
+	}
+	fmt.Printf("actions:      %d\n", u.Actions)
+	fmt.Printf("objects:      %d\n", u.Objects)
+	fmt.Printf("action bytes: %d\n", u.ActionBytes)
+	fmt.Printf("object bytes: %d\n", u.ObjectBytes)
+	fmt.Printf("dedup ratio:  %.2f\n", u.DedupRatio())
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/remote"
+	"github.com/creachadair/taskgroup"
+)
+
+// runSync implements the "sync" subcommand.
+func runSync(env *command.Env) error {
+	if flags.Remote == "" {
+		return env.Usagef("You must provide a --remote to sync to")
+	} else if err := checkRemoteURL(flags.Remote); err != nil {
+		return env.Usagef("Invalid --remote: %v", err)
+	}
+	dir, err := newCacheDir(env.Parent, false)
+	if err != nil {
+		return err
+	}
+	opts, err := remoteOptions()
+	if err != nil {
+		return err
+	}
+	rc := remote.NewClient(flags.Remote, dir, opts)
+
+	ctx := context.Background()
+	if flags.Verbose {
+		ctx = gocache.WithLogf(ctx, log.Printf)
+	}
+
+	// Build an index of the local cache, and ask the server which entries it
+	// is missing, so that only those are uploaded.
+	type entry struct {
+		outputID, path string
+		size           int64
+	}
+	var mu sync.Mutex
+	entries := make(map[string]entry)
+	index := make(map[string]string)
+	if err := dir.Actions(ctx, func(id string) error {
+		outputID, path, size, err := dir.Lookup(id)
+		if err != nil || outputID == "" {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		entries[id] = entry{outputID, path, size}
+		index[id] = outputID
+		return nil
+	}); err != nil {
+		return fmt.Errorf("list actions: %w", err)
+	}
+	missing, err := rc.Missing(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	var sent, bytes atomic.Int64
+	g, run := taskgroup.New(nil).Limit(flags.Concurrency)
+	for _, id := range missing {
+		e, ok := entries[id]
+		if !ok {
+			continue // not in the index; should not happen
+		}
+		run(func() error {
+			f, err := os.Open(e.path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := rc.Upload(ctx, gocache.Object{
+				ActionID: id,
+				OutputID: e.outputID,
+				Size:     e.size,
+				Body:     f,
+			}); err != nil {
+				return err
+			}
+			sent.Add(1)
+			bytes.Add(e.size)
+			return nil
+		})
+	}
+	err = g.Wait()
+	fmt.Printf("sent %d of %d actions (%d missing on the server, %d bytes)\n",
+		sent.Load(), len(entries), len(missing), bytes.Load())
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/creachadair/gocache/remote"
+)
+
+// remoteOptions returns client options for --remote from the settings in
+// flags.
+func remoteOptions() (*remote.ClientOptions, error) {
+	opts := &remote.ClientOptions{
+		MaxBodySize: flags.MaxBodySize,
+		MinHitRate:  flags.RemoteMinHit,
+		MinLookups:  flags.RemoteMinLook,
+	}
+	if flags.RemoteToken != "" {
+		src, err := remote.ParseTokenSource(flags.RemoteToken)
+		if err != nil {
+			return nil, fmt.Errorf("--remote-token: %w", err)
+		}
+		opts.Token = src
+	}
+	if flags.RemoteCA == "" && flags.RemoteCert == "" && flags.RemoteKey == "" {
+		return opts, nil
+	}
+	cfg := new(tls.Config)
+	if flags.RemoteCA != "" {
+		pool, err := loadCertPool(flags.RemoteCA)
+		if err != nil {
+			return nil, fmt.Errorf("--remote-ca: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if (flags.RemoteCert == "") != (flags.RemoteKey == "") {
+		return nil, errors.New("--remote-cert and --remote-key must be set together")
+	} else if flags.RemoteCert != "" {
+		cert, err := tls.LoadX509KeyPair(flags.RemoteCert, flags.RemoteKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	opts.HTTPClient = &http.Client{Transport: tr}
+	return opts, nil
+}
+
+// serverTLSConfig returns the TLS configuration for the serve command from
+// the settings in serveFlags, or nil if TLS is not enabled.
+func serverTLSConfig() (*tls.Config, error) {
+	if (serveFlags.TLSCert == "") != (serveFlags.TLSKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	} else if serveFlags.TLSCert == "" {
+		if serveFlags.ClientCA != "" {
+			return nil, errors.New("--tls-client-ca requires --tls-cert")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(serveFlags.TLSCert, serveFlags.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if serveFlags.ClientCA != "" {
+		pool, err := loadCertPool(serveFlags.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("--tls-client-ca: %w", err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// loadCertPool returns a pool of the PEM-encoded certificates in the file at
+// path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
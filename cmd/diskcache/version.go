@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+)
+
+// features lists the optional capabilities supported by this program.
+var features = []string{
+	"alarms",
+	"bench",
+	"cache-percent",
+	"check",
+	"config",
+	"control-socket",
+	"debug-server",
+	"default-cache-dir",
+	"dump-wire",
+	"durability",
+	"ed25519",
+	"env",
+	"env-vars",
+	"errors-are-misses",
+	"export",
+	"fallback-null",
+	"fast-dir",
+	"fsck",
+	"healthz",
+	"hot-cache",
+	"idle-timeout",
+	"import",
+	"log-format",
+	"maintenance-signals",
+	"max-body-size",
+	"migrate",
+	"migrate-from",
+	"namespace",
+	"per-user",
+	"pin",
+	"prune-command",
+	"read-only",
+	"record",
+	"remote",
+	"remote-bypass",
+	"remote-url",
+	"request-limits",
+	"request-timeout",
+	"scratch-dir",
+	"serve",
+	"session-dir",
+	"shard-depth",
+	"shared-dir",
+	"shared-fs",
+	"sign-key",
+	"socket-activation",
+	"stats",
+	"strict-ids",
+	"subscribe",
+	"summary",
+	"sync",
+	"tier-summary",
+	"totals",
+	"touch-interval",
+	"verify",
+	"warm-from",
+	"write-behind",
+}
+
+// versionInfo is the machine-readable output of the version command.
+type versionInfo struct {
+	command.VersionInfo
+	Protocol gocache.ProtocolInfo `json:"protocol"`
+	Features []string             `json:"features"`
+}
+
+// versionCommand returns a version command that extends the standard version
+// output with the protocol features supported by the program.
+func versionCommand() *command.C {
+	var doJSON bool
+	cmd := command.VersionCommand()
+	cmd.Help = `Print build version and protocol information for this program and exit.`
+	cmd.SetFlags = func(_ *command.Env, fs *flag.FlagSet) {
+		fs.BoolVar(&doJSON, "json", false, "Write version information as JSON")
+	}
+	cmd.Run = command.Adapt(func(env *command.Env) error {
+		vi := versionInfo{
+			VersionInfo: command.GetVersionInfo(),
+			Protocol:    gocache.Protocol(),
+			Features:    features,
+		}
+		if doJSON {
+			return json.NewEncoder(os.Stdout).Encode(vi)
+		}
+		fmt.Println(vi.VersionInfo)
+		fmt.Printf("protocol: commands %s, output ID fields %s, requires %s or later\n",
+			strings.Join(vi.Protocol.Commands, ","),
+			strings.Join(vi.Protocol.OutputIDFields, ","),
+			vi.Protocol.MinGoVersion)
+		fmt.Printf("features: %s\n", strings.Join(vi.Features, ","))
+		return nil
+	})
+	return cmd
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// warmCache adds the contents of the snapshot named by --warm-from to dir,
+// for actions that dir does not already have.
+//
+// If --warm-from-sha256 is set, the snapshot is verified before it is used,
+// and a marker is kept in the cache directory so that the same snapshot is
+// not fetched again.
+func warmCache(dir *cachedir.Dir) error {
+	src, want := flags.WarmFrom, strings.ToLower(flags.WarmSHA256)
+	var marker string
+	if want != "" {
+		if _, err := hex.DecodeString(want); err != nil || len(want) != 2*sha256.Size {
+			return fmt.Errorf("invalid --warm-from-sha256 %q", flags.WarmSHA256)
+		}
+		marker = filepath.Join(flags.CacheDir, "warm", want)
+		if _, err := os.Stat(marker); err == nil {
+			vlogf("cache was already warmed from %s", src)
+			return nil
+		}
+	}
+
+	// Fetch the snapshot to a temporary file if it is remote, or if it must be
+	// verified before use.
+	rc, err := openSource(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if isRemote(src) || want != "" {
+		f, err := os.CreateTemp("", "gocache-warm-*")
+		if err != nil {
+			return err
+		}
+		defer func() { f.Close(); os.Remove(f.Name()) }()
+
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), rc); err != nil {
+			return fmt.Errorf("fetch %s: %w", src, err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); want != "" && got != want {
+			return fmt.Errorf("snapshot %s has SHA-256 %s, want %s", src, got, want)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = f
+	}
+
+	r, err = maybeGunzip(r)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", src, err)
+	}
+	if err := dir.RestoreMissing(r); err != nil {
+		return fmt.Errorf("restore %s: %w", src, err)
+	}
+	vlogf("warmed cache from %s", src)
+	if marker != "" {
+		if err := os.MkdirAll(filepath.Dir(marker), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(marker, nil, 0644)
+	}
+	return nil
+}
+
+// isRemote reports whether src is an HTTP or HTTPS URL.
+func isRemote(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// openSource opens src, which is a file path, or an HTTP or HTTPS URL.
+func openSource(src string) (io.ReadCloser, error) {
+	if !isRemote(src) {
+		return os.Open(src)
+	}
+	rsp, err := http.Get(src)
+	if err != nil {
+		return nil, err
+	} else if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("fetch %s: %s", src, rsp.Status)
+	}
+	return rsp.Body, nil
+}
+
+// maybeGunzip returns a reader for the contents of r, which are decompressed
+// if they are in gzip format.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	} else if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// vlogf logs a message if verbose logging is enabled.
+func vlogf(msg string, args ...any) {
+	if flags.Verbose {
+		log.Printf(msg, args...)
+	}
+}
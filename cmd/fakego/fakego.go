@@ -0,0 +1,104 @@
+// Program fakego runs a GOCACHEPROG cache server the way the go command does,
+// sends it a scripted workload, and checks its responses. This allows a cache
+// server to be tested without a Go toolchain that supports GOCACHEPROG.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/flax"
+	"github.com/creachadair/gocache/cacheclient"
+	"github.com/creachadair/gocache/cachetest"
+	"github.com/creachadair/mds/shell"
+)
+
+var flags struct {
+	Script      string `flag:"script,Script file to run (default: a basic check of a writable cache)"`
+	OldOutputID bool   `flag:"old-output-id,Send output IDs as ObjectID, as Go 1.23 and earlier do"`
+	Verbose     bool   `flag:"v,Print the commands the server advertises"`
+}
+
+func main() {
+	root := &command.C{
+		Name:  command.ProgramName(),
+		Usage: "[options] [--] [command args...]",
+		Help: `Run a cache server and check its responses to a scripted workload.
+
+The server is started with the given command and arguments, or if none are
+given, with the command in $GOCACHEPROG. As with the go command, requests
+are written to its stdin, and responses read from its stdout.
+
+The script is read from --script. Without it, a default script checks the
+basic behavior of a writable cache, which must be empty to start with. See
+the documentation of the cachetest package for the script format.
+
+It prints "ok" and exits with status 0 if every response is as expected.`,
+		SetFlags: command.Flags(flax.MustBind, &flags),
+		Run: command.Adapt(func(env *command.Env, args ...string) error {
+			if len(args) == 0 {
+				prog := os.Getenv("GOCACHEPROG")
+				if prog == "" {
+					return env.Usagef("No command given, and GOCACHEPROG is not set")
+				}
+				var ok bool
+				args, ok = shell.Split(prog)
+				if !ok || len(args) == 0 {
+					return env.Usagef("Invalid GOCACHEPROG: %q", prog)
+				}
+			}
+			return run(context.Background(), args)
+		}),
+		Commands: []*command.C{
+			command.HelpCommand(nil),
+		},
+	}
+	command.RunOrFail(root.NewEnv(nil), os.Args[1:])
+}
+
+// run starts the server with args, and runs the script against it.
+func run(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start server: %w", err)
+	}
+
+	c, err := cacheclient.New(out, in, &cacheclient.Options{OldOutputID: flags.OldOutputID})
+	if err != nil {
+		in.Close()
+		return errors.Join(err, cmd.Wait())
+	}
+	if flags.Verbose {
+		fmt.Fprintf(os.Stderr, "server commands: %s\n", strings.Join(c.Commands(), ", "))
+	}
+	if flags.Script != "" {
+		err = cachetest.RunFile(ctx, c, flags.Script)
+	} else {
+		err = cachetest.Run(ctx, c, strings.NewReader(cachetest.DefaultScript))
+	}
+	if cerr := c.Close(ctx); err == nil {
+		err = cerr
+	}
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("server: %w", werr)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
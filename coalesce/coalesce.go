@@ -0,0 +1,106 @@
+// Package coalesce implements a wrapper for a cache backend that combines
+// concurrent lookups of the same action.
+//
+// When the go command runs several builds or test binaries in parallel, they
+// often look up the same actions at nearly the same time. A [Cache] passes
+// only the first of a set of concurrent gets for an action to the underlying
+// backend, and shares its result with the others. This saves work when the
+// backend is remote or otherwise slow to respond. Puts are passed through.
+//
+// The backend call is not canceled when the caller that started it gives up,
+// since other callers may be waiting for its result. Each caller stops waiting
+// when its own context ends. The reason for a miss, if any, is recorded only
+// for the caller that started the backend call.
+package coalesce
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Cache combines concurrent gets for the same action to a [Backend].
+type Cache struct {
+	base Backend
+
+	mu      sync.Mutex
+	pending map[string]*call // actionID → in-flight get
+
+	numCalls  expvar.Int // gets passed to the backend
+	numShared expvar.Int // gets that shared the result of another
+}
+
+// call is an in-flight get from the backend.
+type call struct {
+	done     chan struct{} // closed when the result is ready
+	outputID string
+	diskPath string
+	err      error
+}
+
+// New constructs a new Cache that combines concurrent gets to base.
+func New(base Backend) *Cache {
+	return &Cache{base: base, pending: make(map[string]*call)}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+// If a get for actionID is already in progress, Get waits for and reports its
+// result instead of calling the backend again.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	c.mu.Lock()
+	cl, ok := c.pending[actionID]
+	if !ok {
+		cl = &call{done: make(chan struct{})}
+		c.pending[actionID] = cl
+		c.numCalls.Add(1)
+		go c.run(context.WithoutCancel(ctx), actionID, cl)
+	} else {
+		c.numShared.Add(1)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", "", context.Cause(ctx)
+	case <-cl.done:
+		return cl.outputID, cl.diskPath, cl.err
+	}
+}
+
+// run calls the backend for actionID, and records the result in cl.
+func (c *Cache) run(ctx context.Context, actionID string, cl *call) {
+	cl.outputID, cl.diskPath, cl.err = c.base.Get(ctx, actionID)
+
+	c.mu.Lock()
+	delete(c.pending, actionID)
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// It passes the object to the backend unchanged.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	return c.base.Put(ctx, obj)
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the coalescing statistics for c to m. It has the signature
+// of the SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("coalesce_calls", &c.numCalls)
+	m.Set("coalesce_shared", &c.numShared)
+}
@@ -0,0 +1,122 @@
+package coalesce_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/coalesce"
+)
+
+// slowBackend is a fake backend whose gets block until released.
+type slowBackend struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *slowBackend) Get(ctx context.Context, actionID string) (string, string, error) {
+	s.calls.Add(1)
+	<-s.release
+	return "0b1ec7", "/path/to/" + actionID, nil
+}
+
+func (s *slowBackend) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	return "/path/to/" + obj.ActionID, nil
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	base := &slowBackend{release: make(chan struct{})}
+	c := coalesce.New(base)
+
+	// Start several concurrent gets for the same action, and one for another.
+	const numGets = 5
+	var wg sync.WaitGroup
+	got := make([]string, numGets+1)
+	for i := range numGets + 1 {
+		id := "a1b2c3"
+		if i == numGets {
+			id = "d4e5f6"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			oid, path, err := c.Get(ctx, id)
+			if err != nil || oid != "0b1ec7" {
+				t.Errorf("Get %d: got %q, %v; want 0b1ec7, nil", i, oid, err)
+			}
+			got[i] = path
+		}()
+	}
+
+	// Wait for the other gets to join the first before releasing them.
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	for m.Get("coalesce_shared").String() != "4" {
+		time.Sleep(time.Millisecond)
+	}
+	close(base.release)
+	wg.Wait()
+
+	if n := base.calls.Load(); n != 2 {
+		t.Errorf("Backend calls: got %d, want 2", n)
+	}
+	for i, path := range got[:numGets] {
+		if path != "/path/to/a1b2c3" {
+			t.Errorf("Get %d: got path %q, want /path/to/a1b2c3", i, path)
+		}
+	}
+
+	if s := m.Get("coalesce_calls").String(); s != "2" {
+		t.Errorf("coalesce_calls: got %s, want 2", s)
+	}
+	if s := m.Get("coalesce_shared").String(); s != "4" {
+		t.Errorf("coalesce_shared: got %s, want 4", s)
+	}
+
+	// Once the get is complete, a new get calls the backend again.
+	if _, _, err := c.Get(ctx, "a1b2c3"); err != nil {
+		t.Errorf("Get: unexpected error: %v", err)
+	}
+	if n := base.calls.Load(); n != 3 {
+		t.Errorf("Backend calls: got %d, want 3", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	base := &slowBackend{release: make(chan struct{})}
+	c := coalesce.New(base)
+
+	// A caller that gives up does not end the backend call for others.
+	cctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.Get(cctx, "a1b2c3")
+		errc <- err
+	}()
+	for base.calls.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("Get (canceled): got %v, want %v", err, context.Canceled)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, path, err := c.Get(context.Background(), "a1b2c3"); err != nil || path != "/path/to/a1b2c3" {
+			t.Errorf("Get: got %q, %v; want /path/to/a1b2c3, nil", path, err)
+		}
+	}()
+	close(base.release)
+	<-done
+	if n := base.calls.Load(); n > 2 {
+		t.Errorf("Backend calls: got %d, want at most 2", n)
+	}
+}
@@ -0,0 +1,78 @@
+// Package fallback implements a wrapper for a cache backend that reads results
+// missing from it from another backend, without writing to the other.
+//
+// A [Cache] serves gets from a primary backend and, on a miss, from a
+// fallback backend. Puts go only to the primary. This supports a layout where
+// a shared cache is populated by a trusted process, such as a CI job, and
+// each user also has a private cache for the results of their own builds:
+// users read from both, but write only to their own.
+//
+// Results read from the fallback are reported with their paths in the
+// fallback backend, and are not copied to the primary.
+package fallback
+
+import (
+	"context"
+	"errors"
+	"expvar"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage used by a [Cache]. It is satisfied
+// by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Cache reads from a fallback backend the results that are missing from a
+// primary backend.
+type Cache struct {
+	primary, fallback Backend
+
+	fallbackHits expvar.Int // gets served from the fallback
+}
+
+// New constructs a new Cache that reads from primary, then from fallback.
+// Only primary is written.
+func New(primary, fallback Backend) *Cache {
+	return &Cache{primary: primary, fallback: fallback}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+// Errors from the fallback are logged, and reported as misses.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	outputID, diskPath, err := c.primary.Get(ctx, actionID)
+	if err != nil || outputID != "" {
+		return outputID, diskPath, err
+	}
+	outputID, diskPath, err = c.fallback.Get(ctx, actionID)
+	if err != nil {
+		gocache.Logf(ctx, "fallback: get %s: %v (treating as miss)", actionID, err)
+		return "", "", nil
+	} else if outputID != "" {
+		c.fallbackHits.Add(1)
+	}
+	return outputID, diskPath, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// The object is written only to the primary backend.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	return c.primary.Put(ctx, obj)
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes both backends, if they have Close methods.
+func (c *Cache) Close(ctx context.Context) error {
+	return errors.Join(gocache.CloseBackend(ctx, c.primary), gocache.CloseBackend(ctx, c.fallback))
+}
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the fallback statistics for c to m. It has the signature of
+// the SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("fallback_hits", &c.fallbackHits)
+}
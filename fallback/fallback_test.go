@@ -0,0 +1,87 @@
+package fallback_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/fallback"
+)
+
+func newDir(t *testing.T) *cachedir.Dir {
+	t.Helper()
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	return d
+}
+
+func putString(t *testing.T, b fallback.Backend, actionID, outputID, content string) string {
+	t.Helper()
+	path, err := b.Put(context.Background(), gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     int64(len(content)),
+		Body:     strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatalf("Put %s: unexpected error: %v", actionID, err)
+	}
+	return path
+}
+
+// failBackend is a backend whose gets fail.
+type failBackend struct{ fallback.Backend }
+
+func (failBackend) Get(context.Context, string) (string, string, error) {
+	return "", "", errors.New("unavailable")
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	private, shared := newDir(t), newDir(t)
+	c := fallback.New(private, shared)
+
+	sharedPath := putString(t, shared, "a1", "01", "shared")
+	putString(t, shared, "a2", "02", "shared")
+	putString(t, c, "a2", "03", "private")
+
+	// A result only in the shared cache is read from there.
+	if oid, path, err := c.Get(ctx, "a1"); err != nil || oid != "01" || path != sharedPath {
+		t.Errorf("Get a1: got %q, %q, %v; want 01, %q", oid, path, err, sharedPath)
+	}
+
+	// A result in the private cache takes precedence.
+	if oid, _, err := c.Get(ctx, "a2"); err != nil || oid != "03" {
+		t.Errorf("Get a2: got %q, %v; want 03", oid, err)
+	}
+
+	// Puts are not written to the shared cache.
+	if oid, _, err := shared.Get(ctx, "a2"); err != nil || oid != "02" {
+		t.Errorf("Shared Get a2: got %q, %v; want 02", oid, err)
+	}
+	if oid, _, err := c.Get(ctx, "a3"); err != nil || oid != "" {
+		t.Errorf("Get a3: got %q, %v; want miss", oid, err)
+	}
+
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	if got := m.Get("fallback_hits").String(); got != "1" {
+		t.Errorf("fallback_hits: got %s, want 1", got)
+	}
+
+	// Errors from the fallback are misses.
+	c = fallback.New(private, failBackend{})
+	if oid, _, err := c.Get(ctx, "a1"); err != nil || oid != "" {
+		t.Errorf("Get a1 (failing fallback): got %q, %v; want miss", oid, err)
+	}
+	if data, err := os.ReadFile(sharedPath); err != nil || string(data) != "shared" {
+		t.Errorf("Read shared object: got %q, %v; want shared", data, err)
+	}
+}
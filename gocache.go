@@ -14,18 +14,25 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"math/bits"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/creachadair/mds/cache"
 	"github.com/creachadair/mds/value"
 	"github.com/creachadair/taskgroup"
 )
@@ -38,7 +45,8 @@ type Server struct {
 	// On success, Get must return the object ID for the specified action, and
 	// the path of a local file containing the object's contents.
 	//
-	// To report a cache miss, Get must return "", "", nil.
+	// To report a cache miss, Get must return "", "", nil. Get may call
+	// [SetMissReason] to record why the result was a miss.
 	//
 	// API: "get"
 	Get func(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
@@ -52,12 +60,45 @@ type Server struct {
 	// API: "put"
 	Put func(ctx context.Context, req Object) (diskPath string, _ error)
 
+	// GetRaw, if non-nil, is used instead of Get, for a backend that keys
+	// objects by the binary action ID rather than its hex encoding. It follows
+	// the same rules as Get, but returns the output ID in binary. To report a
+	// cache miss, GetRaw must return nil, "", nil. GetRaw must not retain or
+	// modify actionID after it returns, and the server may retain the output
+	// ID it returns.
+	//
+	// API: "get"
+	GetRaw func(ctx context.Context, actionID []byte) (outputID []byte, diskPath string, _ error)
+
+	// PutRaw, if non-nil, is used instead of Put, for a backend that keys
+	// objects by their binary IDs. It follows the same rules as Put. PutRaw
+	// must not retain or modify the IDs in req after it returns.
+	//
+	// API: "put"
+	PutRaw func(ctx context.Context, req RawObject) (diskPath string, _ error)
+
 	// Close is called once when the client closes its channel to the server.
 	// If nil, the server stops immediately without waiting.
 	//
 	// API: "close"
 	Close func(context.Context) error
 
+	// Init, if non-nil, is called once when Run starts, before the server
+	// sends its initial message to the client. It may set up the storage
+	// used by the other callbacks. If Init reports an error, Run returns it
+	// without serving the client, unless FallbackToNull is set.
+	Init func(context.Context) error
+
+	// FallbackToNull, if true, causes the server to serve the client as a
+	// null cache if Init reports an error, instead of failing. The error is
+	// logged with SummaryLogf, if it is set, or Logf. The server advertises
+	// "get" and "put" (unless ReadOnly is set), but does not call any of the
+	// other callbacks: Every get is a miss with reason MissUnavailable, and
+	// every put is acknowledged but not stored, as for DropOversize. The
+	// "null_mode" metric is 1 while the server is in this state. This keeps
+	// an outage of the cache storage from breaking builds.
+	FallbackToNull bool
+
 	// SetMetrics, if non-nil, is called once when the server starts up.  The
 	// function should populate the provided map with any metrics it wishes to
 	// expose via the service's Metrics method (under "host").
@@ -71,6 +112,120 @@ type Server struct {
 	// serviced concurrently by the server. If zero, it uses runtime.NumCPU.
 	MaxRequests int
 
+	// MaxGetRequests and MaxPutRequests, if positive, limit the number of get
+	// and put requests, respectively, that may be serviced concurrently, in
+	// addition to MaxRequests, so that, for example, slow puts cannot occupy
+	// all the MaxRequests slots. As for MaxRequests, when a request must wait
+	// for a slot, the server stops reading requests until one is free, so
+	// that the number of requests the server holds stays bounded.
+	MaxGetRequests int
+	MaxPutRequests int
+
+	// MaxPutBytes, if positive, is the maximum total size in bytes of the
+	// bodies of put requests held in memory by the server at once. When it is
+	// reached, the server stops reading requests until enough pending puts
+	// have completed. A single object larger than MaxPutBytes is admitted once
+	// no other puts are pending.
+	MaxPutBytes int64
+
+	// RequestTimeout, if positive, is the time limit for each get and put
+	// request. The context passed to the Policy, Get, and Put callbacks for
+	// the request has a deadline this far after the request is received.
+	RequestTimeout time.Duration
+
+	// ReadOnly, if true, causes the server to reject all put requests, even if
+	// Put is set, and not to advertise the "put" command to the client. This
+	// is for clients that should use a shared cache, but not add to it.
+	ReadOnly bool
+
+	// HotCacheSize, if positive, enables an in-memory cache of the results of
+	// up to this many recent get and put requests. A get for an action whose
+	// result is in this cache is answered without calling Get, provided its
+	// object file still exists with the expected size. Otherwise the result
+	// is evicted, and Get is called as usual.
+	HotCacheSize int
+
+	// Touch, if non-nil, is called for each get answered from the in-memory
+	// cache (see HotCacheSize), with the hex action and output IDs of the
+	// result, since Get is not called for those. It allows the backend to
+	// record the access, as its Get method would, e.g., to update access
+	// times or protect the object from pruning. If Touch reports an error,
+	// the result is evicted, and Get is called as usual.
+	Touch func(ctx context.Context, actionID, outputID string) error
+
+	// MaxBodySize, if positive, is the maximum size in bytes of an object the
+	// server will pass to Put. Larger objects are rejected with an error, or
+	// dropped if DropOversize is true.
+	MaxBodySize int64
+
+	// DropOversize, if true, causes the server to acknowledge puts larger
+	// than MaxBodySize as successful without storing them. The contents of a
+	// dropped object are kept in a temporary file until Run returns, since the
+	// client may read them back.
+	DropOversize bool
+
+	// Policy, if non-nil, is called for each get and put request before the
+	// corresponding callback, to decide whether to use the cache for the
+	// action. For a get, only the ActionID of the object is set. For a put,
+	// all the fields except Body are set. If Policy returns [Skip] for a get,
+	// the server reports a miss without calling Get. If it returns Skip for a
+	// put, the object is dropped as for DropOversize.
+	Policy func(context.Context, Object) Decision
+
+	// MaxRequestSize is the maximum number of bytes the server will read to
+	// decode a single request, not including the body of a put request. The
+	// body of a put may not be longer than the encoding of its declared size.
+	// A request that exceeds these limits terminates Run with an error.
+	// If zero, it defaults to 64KiB.
+	MaxRequestSize int64
+
+	// MaxIDLength is the maximum length in bytes of an action or output ID.
+	// Requests with longer IDs are rejected. If zero, it defaults to 64.
+	MaxIDLength int
+
+	// StrictIDs, if true, requires action and output IDs to be exactly the
+	// length of a SHA-256 digest, as the go command sends them, and requires
+	// the output IDs reported by Get to be the lowercase hex encoding of such
+	// a digest (or by GetRaw, such a digest). Requests that do not comply are
+	// rejected with an error and counted in the "invalid_ids" metric. Use this
+	// to notice a mismatch between the server and the toolchain or backend
+	// early. When StrictIDs is set, MaxIDLength is ignored.
+	StrictIDs bool
+
+	// ErrorsAreMisses lists the commands ("get", "put") for which errors
+	// reported by the corresponding callback are logged and counted, but not
+	// reported to the client. A failed get is reported as a cache miss. A
+	// failed put is reported as successful, and its contents are kept in a
+	// temporary file until Run returns, as for DropOversize. Some classes of
+	// error are handled this way regardless; see [ErrBackendUnavailable].
+	ErrorsAreMisses []string
+
+	// SummaryLogf, if non-nil, is called once when Run returns, with a
+	// one-line summary of the get and put requests handled by the server: The
+	// number of requests, hits, and bytes transferred, and the median and 95th
+	// percentile request latencies. Latencies are rounded up to a power of two
+	// microseconds.
+	SummaryLogf func(string, ...any)
+
+	// MinHitRate, if positive, is the lowest fraction of get requests that
+	// are expected to hit. If the hit rate is lower when Run returns, the
+	// server logs a warning. This helps notice a misconfigured cache.
+	MinHitRate float64
+
+	// MaxErrorRate, if positive, is the highest fraction of get and put
+	// requests that are expected to fail, including errors hidden from the
+	// client by ErrorsAreMisses. If the error rate is higher when Run
+	// returns, the server logs a warning.
+	MaxErrorRate float64
+
+	// AlarmMinRequests is the number of requests the server must handle
+	// before MinHitRate and MaxErrorRate are checked. If zero, it defaults to
+	// 100.
+	//
+	// Alarm warnings are logged with SummaryLogf, if it is set, or Logf. The
+	// summary logged by SummaryLogf includes the number of alarms.
+	AlarmMinRequests int
+
 	// LogRequests, if true, enables detailed (but noisy) debug logging of all
 	// requests received and handled by the server.
 	//
@@ -89,20 +244,118 @@ type Server struct {
 	//    O:<object-id>
 	//    S:<size>         -- for "put" requests, object size in bytes
 	//    M:<miss>         -- for "get" requests: 1=true, 0=false
+	//    MR:<reason>      -- for "get" misses, the reason for the miss
 	//    DP:"<diskpath>"
 	//
 	LogRequests bool
 
+	// OnEvent, if non-nil, is called when each request begins and ends, with
+	// a description of the request and its result. This is a structured
+	// alternative to LogRequests, for custom accounting or telemetry.
+	//
+	// OnEvent may be called concurrently for different requests, and the
+	// server waits for it to return, so it should not block.
+	OnEvent func(Event)
+
+	// Tag, if non-nil, is called for each get and put request to choose a
+	// tag for it, such as the package or kind of the action, and the server
+	// counts the requests and results for each tag in the "tags" metric. This
+	// shows which parts of a build benefit from the cache. The object passed
+	// to Tag is as for Policy. A callback may also set or replace the tag of
+	// its request with [SetTag]. Requests with an empty tag are not counted by
+	// tag. Tags should have few distinct values, since each has its own
+	// counters for the life of the server.
+	Tag func(context.Context, Object) string
+
+	// Clock, if non-nil, is used for the start times and latencies of
+	// requests. If nil, it defaults to [SystemClock]. The deadlines set by
+	// RequestTimeout always use the system clock.
+	Clock Clock
+
+	active atomic.Pointer[activeRequests] // for the current call to Run
+
 	// Metrics
-	getRequests expvar.Int
-	getHits     expvar.Int
-	getHitBytes expvar.Int
-	getMisses   expvar.Int
-	getErrors   expvar.Int
-	putRequests expvar.Int
-	putBytes    expvar.Int
-	putErrors   expvar.Int
-	hostMetrics expvar.Map
+	getRequests    expvar.Int
+	getHits        expvar.Int
+	getHitBytes    expvar.Int
+	getHotHits     expvar.Int
+	getHotBytes    expvar.Int
+	getMisses      expvar.Int
+	getErrors      expvar.Int
+	getMissReasons expvar.Map // counts by miss reason
+	putRequests    expvar.Int
+	putBytes       expvar.Int
+	putErrors      expvar.Int
+	putTooLarge    expvar.Int
+	putSkipped     expvar.Int
+	invalidIDs     expvar.Int
+	nullMode       expvar.Int // 1 if Init failed and the server is a null cache
+	tags           tagMetrics
+	hostMetrics    expvar.Map
+
+	hotOnce sync.Once
+	hot     *cache.Cache[string, hotEntry] // nil if disabled
+
+	scratchOnce sync.Once
+	scratchDir  string // temporary directory for dropped objects
+	scratchErr  error
+
+	// Latencies of get and put requests, in total and split into the time
+	// spent in the Get and Put callbacks and the time spent in the server.
+	getLatency         latencyHist
+	getBackendLatency  latencyHist
+	getOverheadLatency latencyHist
+	putLatency         latencyHist
+	putBackendLatency  latencyHist
+	putOverheadLatency latencyHist
+
+	// The time from a get miss to the put of the same action, during which
+	// the client computes the result. See TimeSaved.
+	missMu    sync.Mutex
+	missStart map[string]time.Time // action ID → start of the miss
+	missCost  latencyHist
+
+	cmu    sync.Mutex
+	client ClientInfo // observed client behavior
+
+	wire *wireDump // if non-nil, receives a trace of messages (see DumpWire)
+}
+
+// DumpWire causes s to write a trace of the messages it exchanges with the
+// client to w, for debugging protocol mismatches. It must be called before
+// Run. If w == nil, the trace is disabled.
+//
+// Each message is written on its own line, exactly as it was sent, prefixed
+// by "> " for a request from the client or "< " for a response to it. The
+// body of a put request is replaced by a note of its size, so that object
+// contents are not written to the trace. Errors writing to w are ignored,
+// and end the trace.
+func (s *Server) DumpWire(w io.Writer) {
+	if w == nil {
+		s.wire = nil
+	} else {
+		s.wire = &wireDump{w: w}
+	}
+}
+
+// An ActiveRequest describes a request in progress, for [Server.ActiveRequests].
+type ActiveRequest struct {
+	ID       int64     `json:"id"`
+	Command  string    `json:"command"`
+	ActionID string    `json:"actionID,omitempty"` // lower-case hexadecimal digits
+	Size     int64     `json:"size,omitempty"`     // for a put, the object size in bytes
+	Start    time.Time `json:"start"`              // when the server began to handle the request
+}
+
+// ActiveRequests returns a description of each request the server is
+// handling, in the order they started. A request is included once it has been
+// read from the client, even if it is still waiting for a concurrency limit.
+// It is safe to call concurrently with Run, to debug a server that is stuck.
+func (s *Server) ActiveRequests() []ActiveRequest {
+	if a := s.active.Load(); a != nil {
+		return a.list()
+	}
+	return nil
 }
 
 // Metrics returns a map of server metrics. The caller is responsible for
@@ -115,61 +368,138 @@ func (s *Server) Metrics() *expvar.Map {
 	sm.Set("get_requests", &s.getRequests)
 	sm.Set("get_hits", &s.getHits)
 	sm.Set("get_hit_bytes", &s.getHitBytes)
+	sm.Set("get_hot_hits", &s.getHotHits)
+	sm.Set("get_hot_hit_bytes", &s.getHotBytes)
 	sm.Set("get_misses", &s.getMisses)
 	sm.Set("get_errors", &s.getErrors)
+	sm.Set("get_miss_reasons", &s.getMissReasons)
 	sm.Set("put_requests", &s.putRequests)
 	sm.Set("put_bytes", &s.putBytes)
 	sm.Set("put_errors", &s.putErrors)
+	sm.Set("put_too_large", &s.putTooLarge)
+	sm.Set("put_skipped", &s.putSkipped)
+	sm.Set("invalid_ids", &s.invalidIDs)
+	sm.Set("null_mode", &s.nullMode)
+	sm.Set("tags", &s.tags.m)
+	sm.Set("get_latency", &s.getLatency)
+	sm.Set("get_backend_latency", &s.getBackendLatency)
+	sm.Set("get_overhead_latency", &s.getOverheadLatency)
+	sm.Set("put_latency", &s.putLatency)
+	sm.Set("put_backend_latency", &s.putBackendLatency)
+	sm.Set("put_overhead_latency", &s.putOverheadLatency)
+	sm.Set("miss_cost", &s.missCost)
 	m.Set("server", sm)
 
 	return m
 }
 
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (s *Server) since(t time.Time) time.Duration { return s.now().Sub(t) }
+
+// isNull reports whether s is serving as a null cache, because Init failed.
+// See [Server.FallbackToNull].
+func (s *Server) isNull() bool { return s.nullMode.Value() != 0 }
+
+// SetCache sets the Get, Put, and Close callbacks of s to the methods of c.
+func (s *Server) SetCache(c Cache) {
+	s.Get, s.Put, s.Close = c.Get, c.Put, c.Close
+}
+
 // Run starts the server reading requests from in and writing responses to
 // out. Each valid request is passed to the corresponding callback, if defined.
 // Run blocks running the server until ctx ends, reading in reports an error,
 // or decoding a client request fails.
 //
-// If in reports io.EOF, Run returns nil; otherwise it reports the error that
-// terminated the service.
+// If in reports io.EOF, Run waits for the requests in progress to finish, and
+// returns nil; otherwise it reports the error that terminated the service.
+// When Run stops because of an error, such as the client closing its end in
+// the middle of a request, the client will not read any further responses:
+// Run cancels the contexts of the requests in progress, with a cause that
+// wraps the error, and waits for them to finish.
 func (s *Server) Run(ctx context.Context, in io.Reader, out io.Writer) (xerr error) {
-	if s.SetMetrics != nil {
+	s.nullMode.Set(0)
+	if s.Init != nil {
+		if err := s.Init(ctx); err != nil {
+			if !s.FallbackToNull {
+				return fmt.Errorf("initialize: %w", err)
+			}
+			msg := fmt.Sprintf("WARNING: initialize: %v (serving as a null cache: all gets miss, and puts are not stored)", err)
+			if s.SummaryLogf != nil {
+				s.SummaryLogf("%s", msg)
+			} else {
+				s.logf("%s", msg)
+			}
+			s.nullMode.Set(1)
+		}
+	}
+	if s.SetMetrics != nil && !s.isNull() {
 		s.SetMetrics(ctx, &s.hostMetrics)
 	}
-	rd := bufio.NewReader(in)
+	budget := &budgetReader{r: in}
+	rd := bufio.NewReader(budget)
 	dec := json.NewDecoder(rd)
 
-	var emu sync.Mutex // lock to write to enc
+	// Write the initial message advertising available methods.
 	wr := bufio.NewWriter(out)
-	enc := json.NewEncoder(wr)
-	encode := func(v any) error {
-		emu.Lock()
-		defer emu.Unlock()
-		if err := enc.Encode(v); err != nil {
-			return err
-		}
-		return wr.Flush()
+	init := (&progResponse{ID: 0, KnownCommands: s.commands()}).appendJSON(nil)
+	if s.wire != nil {
+		s.wire.write("< ", init)
 	}
-
-	// Write the initial message advertising available methods.
-	if err := encode(&progResponse{ID: 0, KnownCommands: s.commands()}); err != nil {
+	if _, err := wr.Write(init); err != nil {
+		return fmt.Errorf("write server init: %w", err)
+	} else if err := wr.Flush(); err != nil {
 		return fmt.Errorf("write server init: %w", err)
 	}
+	rw := newResponseWriter(wr, s.wire, s.maxRequests())
 
 	s.logf("cache server started")
-	start := time.Now()
+	start := s.now()
 	defer func() {
 		s.logf("cache server exiting (%v elapsed, err=%v)",
-			time.Since(start).Round(100*time.Microsecond), xerr)
+			s.since(start).Round(100*time.Microsecond), xerr)
+		alarms := s.alarms()
+		for _, msg := range alarms {
+			if s.SummaryLogf != nil {
+				s.SummaryLogf("WARNING: %s", msg)
+			} else {
+				s.logf("WARNING: %s", msg)
+			}
+		}
+		if s.SummaryLogf != nil {
+			s.SummaryLogf("%s", s.summary(len(alarms)))
+		}
 	}()
 
-	g, run := taskgroup.New(nil).Limit(s.maxRequests())
-	defer g.Wait()
+	defer s.removeScratch()
+
+	g := taskgroup.New(nil)
+	active := newActiveRequests()
+	s.active.Store(active)
+	defer func() {
+		if xerr != nil {
+			// The client is gone or has broken the protocol, so it will not
+			// read the responses to requests still in progress.
+			active.cancelAll(fmt.Errorf("request abandoned: %w", xerr))
+		}
+		g.Wait()
+		if err := rw.close(); err != nil {
+			s.logf("write responses: %v", err)
+		}
+	}()
+	slots := newRequestSlots(s)
+	putBytes := newByteBudget(s.MaxPutBytes)
 
 	runCtx := WithLogf(ctx, s.logf)
 	for {
 		var req progRequest
-		if err := dec.Decode(&req); errors.Is(err, io.EOF) {
+		budget.left = s.maxRequestSize()
+		if err := s.decodeRequest(dec, &req); errors.Is(err, io.EOF) {
 			return nil
 		} else if err != nil {
 			return err
@@ -177,80 +507,191 @@ func (s *Server) Run(ctx context.Context, in io.Reader, out io.Writer) (xerr err
 
 		// A "put" request with a non-zero body size is followed immediately by
 		// the contents of the body as a JSON string (base64).
+		var bodyBytes int64
 		if req.Command == "put" && req.BodySize > 0 {
+			if req.BodySize > maxBodySize {
+				return fmt.Errorf("request %d: invalid body size %d", req.ID, req.BodySize)
+			}
+			// Wait for room in the budget before reading the body into memory.
+			bodyBytes = putBytes.acquire(req.BodySize)
+			// Allow for the base64 encoding, the quotation marks, and reading
+			// ahead into the next request.
+			budget.left = (req.BodySize+2)/3*4 + s.maxRequestSize()
+
 			var body []byte
 			if err := dec.Decode(&body); err != nil {
+				putBytes.release(bodyBytes)
 				return fmt.Errorf("request %d: decode body: %w", req.ID, err)
 			}
 			if int64(len(body)) != req.BodySize {
 				return fmt.Errorf("request %d body: got %d bytes, want %d", req.ID, len(body), req.BodySize)
 			}
-			s.putBytes.Add(req.BodySize)
+			if s.wire != nil {
+				s.wire.write("> ", fmt.Appendf(nil, "<%d-byte body redacted>\n", len(body)))
+			}
 			req.Body = bytes.NewReader(body)
 		}
+		s.observe(&req)
+
+		release := slots.admit(req.Command)
+		reqCtx, ar := active.start(runCtx, &req, s.now())
+		g.Go(func() error {
+			defer ar.done()
+			defer putBytes.release(bodyBytes)
+			defer release()
 
-		run(func() error {
-			rsp, err := s.handleRequest(runCtx, &req)
+			rsp, err := s.handleRequest(reqCtx, &req)
 			if err != nil {
 				s.logf("request %d failed: %v", req.ID, err)
 				rsp = &progResponse{ID: req.ID, Err: err.Error()}
 			} else {
 				rsp.ID = req.ID
 			}
-			return encode(rsp)
+			rw.send(rsp)
+			return nil
 		})
 	}
 }
 
 // handleRequest returns the response corresponding to req, or an error.
 func (s *Server) handleRequest(ctx context.Context, req *progRequest) (pr *progResponse, oerr error) {
-	start := time.Now()
+	start := s.now()
+	if s.RequestTimeout > 0 && req.Command != "close" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.RequestTimeout)
+		defer cancel()
+	}
+	rctx := &requestContext{Context: ctx, s: s, req: req}
 	switch req.Command {
 	case "get":
-		s.vlogf("bc B GET R:%d, A:%x", req.ID, req.ActionID)
+		if s.LogRequests {
+			s.vlogf("bc B GET R:%d, A:%x", req.ID, req.ActionID)
+		}
+		if s.OnEvent != nil {
+			s.OnEvent(Event{Command: "get", RequestID: req.ID, ActionID: hex.EncodeToString(req.ActionID)})
+		}
 		defer func() {
 			isMiss := pr != nil && pr.Miss
 			if isMiss {
 				s.getMisses.Add(1)
+				s.getMissReasons.Add(pr.missReason, 1)
+				s.startMiss(string(req.ActionID), start)
 			}
 			if oerr != nil {
 				s.getErrors.Add(1)
 			}
-			s.vlogf("bc E GET R:%d, A:%x, M:%v, err %v, %v elapsed, DP:%q",
-				req.ID, req.ActionID, value.Cond(isMiss, 1, 0), oerr, time.Since(start), value.At(pr).DiskPath)
+			s.tags.countGet(rctx.tag, pr, oerr)
+			elapsed := s.since(start)
+			s.getLatency.add(elapsed)
+			s.getOverheadLatency.add(elapsed - req.backendTime)
+			if s.LogRequests {
+				s.vlogf("bc E GET R:%d, A:%x, M:%v, MR:%s, err %v, %v elapsed, DP:%q",
+					req.ID, req.ActionID, value.Cond(isMiss, 1, 0), value.At(pr).missReason, oerr,
+					s.since(start), value.At(pr).DiskPath)
+			}
+			if s.OnEvent != nil {
+				s.OnEvent(Event{
+					End:        true,
+					Command:    "get",
+					RequestID:  req.ID,
+					ActionID:   hex.EncodeToString(req.ActionID),
+					OutputID:   hex.EncodeToString(value.At(pr).OutputID),
+					Size:       value.At(pr).Size,
+					Miss:       isMiss,
+					MissReason: value.At(pr).missReason,
+					DiskPath:   value.At(pr).DiskPath,
+					Tag:        rctx.tag,
+					Err:        oerr,
+					Elapsed:    elapsed,
+				})
+			}
 		}()
 		s.getRequests.Add(1)
-		if len(req.ActionID) == 0 {
+		if err := s.checkID("get", "ActionID", req.ActionID); err != nil {
 			// This should not be possible with a real toolchain, but defend
 			// against weird input from a human testing things.
-			return nil, errors.New("get: invalid ActionID")
+			return nil, err
+		}
+		if s.Tag != nil {
+			rctx.tag = s.Tag(rctx, Object{ActionID: hex.EncodeToString(req.ActionID)})
 		}
-		return s.handleGet(ctx, req)
+		return s.handleGet(rctx, req)
 	case "put":
 		outputID := req.outputID()
-		s.vlogf("bc B PUT R:%d, A:%x, O:%x, S:%d", req.ID, req.ActionID, outputID, req.BodySize)
+		if s.LogRequests {
+			s.vlogf("bc B PUT R:%d, A:%x, O:%x, S:%d", req.ID, req.ActionID, outputID, req.BodySize)
+		}
+		if s.OnEvent != nil {
+			s.OnEvent(Event{
+				Command:   "put",
+				RequestID: req.ID,
+				ActionID:  hex.EncodeToString(req.ActionID),
+				OutputID:  hex.EncodeToString(outputID),
+				Size:      req.BodySize,
+			})
+		}
 		defer func() {
 			if oerr != nil {
 				s.putErrors.Add(1)
+			} else {
+				s.endMiss(string(req.ActionID))
+			}
+			s.tags.countPut(rctx.tag, req.BodySize, oerr)
+			elapsed := s.since(start)
+			s.putLatency.add(elapsed)
+			s.putOverheadLatency.add(elapsed - req.backendTime)
+			if s.LogRequests {
+				s.vlogf("bc E PUT R:%d, err %v, %v elapsed, DP:%q",
+					req.ID, oerr, s.since(start), value.At(pr).DiskPath)
+			}
+			if s.OnEvent != nil {
+				s.OnEvent(Event{
+					End:       true,
+					Command:   "put",
+					RequestID: req.ID,
+					ActionID:  hex.EncodeToString(req.ActionID),
+					OutputID:  hex.EncodeToString(outputID),
+					Size:      req.BodySize,
+					DiskPath:  value.At(pr).DiskPath,
+					Tag:       rctx.tag,
+					Err:       oerr,
+					Elapsed:   elapsed,
+				})
 			}
-			s.vlogf("bc E PUT R:%d, err %v, %v elapsed, DP:%q",
-				req.ID, oerr, time.Since(start), value.At(pr).DiskPath)
 		}()
 		s.putRequests.Add(1)
-		if len(req.ActionID) == 0 || len(outputID) == 0 {
+		if err := cmp.Or(
+			s.checkID("put", "ActionID", req.ActionID),
+			s.checkID("put", "OutputID", outputID),
+		); err != nil {
 			// This should not be possible with a real toolchain, but defend
 			// against weird input from a human testing things.
-			return nil, errors.New("put: invalid ActionID/OutputID")
+			return nil, err
+		} else if req.BodySize < 0 {
+			return nil, errors.New("put: invalid BodySize")
+		}
+		if s.Tag != nil {
+			rctx.tag = s.Tag(rctx, Object{
+				ActionID: hex.EncodeToString(req.ActionID),
+				OutputID: hex.EncodeToString(outputID),
+				Size:     req.BodySize,
+			})
 		}
-		return s.handlePut(ctx, req)
+		return s.handlePut(rctx, req)
 
 	case "close":
-		if s.Close != nil {
+		if s.Close != nil && !s.isNull() {
 			s.vlogf("bc B CLOSE R:%d", req.ID)
+			if s.OnEvent != nil {
+				s.OnEvent(Event{Command: "close", RequestID: req.ID})
+			}
 			defer func() {
-				s.vlogf("bc E CLOSE R:%d, err %v, %v elapsed", req.ID, oerr, time.Since(start))
+				s.vlogf("bc E CLOSE R:%d, err %v, %v elapsed", req.ID, oerr, s.since(start))
+				if s.OnEvent != nil {
+					s.OnEvent(Event{End: true, Command: "close", RequestID: req.ID, Err: oerr, Elapsed: s.since(start)})
+				}
 			}()
-			return &progResponse{}, s.Close(ctx)
+			return &progResponse{}, s.Close(rctx)
 		}
 		return &progResponse{}, nil
 
@@ -260,24 +701,79 @@ func (s *Server) handleRequest(ctx context.Context, req *progRequest) (pr *progR
 }
 
 // handleGet handles "get" requests.
-func (s *Server) handleGet(ctx context.Context, req *progRequest) (pr *progResponse, oerr error) {
-	if s.Get == nil {
-		return &progResponse{Miss: true}, nil
+func (s *Server) handleGet(ctx *requestContext, req *progRequest) (pr *progResponse, oerr error) {
+	if s.isNull() {
+		return missResponse(MissUnavailable), nil
+	} else if s.Get == nil && s.GetRaw == nil {
+		return missResponse(MissNotFound), nil
+	}
+	if s.Policy != nil && s.Policy(ctx, Object{ActionID: hex.EncodeToString(req.ActionID)}) == Skip {
+		return missResponse(MissPolicy), nil
+	}
+	hot := s.hotCache()
+	if hot != nil {
+		if e, ok := hot.Get(string(req.ActionID)); ok {
+			// The object file may have been removed since the result was
+			// cached, e.g., by pruning in another process. If so, evict the
+			// entry and consult the backend.
+			if fi, err := os.Stat(e.diskPath); err == nil && fi.Mode().IsRegular() && fi.Size() == e.size &&
+				s.touch(ctx, req.ActionID, e.outputID) {
+				s.getHotHits.Add(1)
+				s.getHotBytes.Add(e.size)
+				s.getHits.Add(1)
+				s.getHitBytes.Add(e.size)
+				return e.response(), nil
+			}
+			hot.Remove(string(req.ActionID))
+		}
+	}
+	start := s.now()
+	var outputID []byte
+	var hexOutputID, diskPath string
+	var err error
+	if s.GetRaw != nil {
+		outputID, diskPath, err = s.GetRaw(ctx, req.ActionID)
+	} else {
+		hexOutputID, diskPath, err = s.Get(ctx, hex.EncodeToString(req.ActionID))
 	}
-	hexOutputID, diskPath, err := s.Get(ctx, fmt.Sprintf("%x", req.ActionID))
+	req.backendTime = s.since(start)
+	s.getBackendLatency.add(req.backendTime)
 	if err != nil {
-		return nil, fmt.Errorf("get %x: %w", req.ActionID, err)
-	} else if hexOutputID == "" && diskPath == "" {
-		return &progResponse{Miss: true}, nil
+		var reason string
+		switch {
+		case errors.Is(err, ErrCorruptObject):
+			reason = MissCorrupt
+		case errors.Is(err, ErrBackendUnavailable):
+			reason = value.Cond(errors.Is(err, context.DeadlineExceeded), MissTimeout, MissUnavailable)
+		case slices.Contains(s.ErrorsAreMisses, "get"):
+			reason = value.Cond(errors.Is(err, context.DeadlineExceeded), MissTimeout, MissError)
+		default:
+			return nil, fmt.Errorf("get %x: %w", req.ActionID, err)
+		}
+		s.getErrors.Add(1)
+		s.logf("get %x: %v (reporting a miss)", req.ActionID, err)
+		return missResponse(reason), nil
+	} else if len(outputID) == 0 && hexOutputID == "" && diskPath == "" {
+		return missResponse(cmp.Or(ctx.reason, MissNotFound)), nil
 	}
 
 	// Safety check: The output ID should be hex-encoded and non-empty.
-	if hexOutputID == "" {
-		return nil, errors.New("get: empty output ID")
+	if s.GetRaw == nil && hexOutputID != "" {
+		if s.StrictIDs && !isHexDigest(hexOutputID) {
+			s.invalidIDs.Add(1)
+			return nil, fmt.Errorf("get: invalid output ID %q from backend (strict)", hexOutputID)
+		}
+		outputID, err = hex.DecodeString(hexOutputID)
+		if err != nil {
+			return nil, fmt.Errorf("get: invalid object ID: %w", err)
+		}
 	}
-	outputID, err := hex.DecodeString(hexOutputID)
-	if err != nil {
-		return nil, fmt.Errorf("get: invalid object ID: %w", err)
+	if len(outputID) == 0 {
+		return nil, errors.New("get: empty output ID")
+	} else if s.StrictIDs && len(outputID) != sha256.Size {
+		s.invalidIDs.Add(1)
+		return nil, fmt.Errorf("get: invalid output ID %x from backend: got %d bytes, want %d (strict)",
+			outputID, len(outputID), sha256.Size)
 	}
 
 	// Safety check: The object file must exist and be a regular file.
@@ -286,7 +782,7 @@ func (s *Server) handleGet(ctx context.Context, req *progRequest) (pr *progRespo
 		// Treat a missing object as a normal cache miss, to allow for the
 		// possibility that the action record has gone out of sync due to
 		// cache pruning or a concurrent update to the same ID.
-		return &progResponse{Miss: true}, nil
+		return missResponse(MissNotFound), nil
 	} else if err != nil {
 		return nil, fmt.Errorf("get: verify path: %w", err)
 	} else if !fi.Mode().IsRegular() {
@@ -296,26 +792,90 @@ func (s *Server) handleGet(ctx context.Context, req *progRequest) (pr *progRespo
 	// Cache hit.
 	s.getHits.Add(1)
 	s.getHitBytes.Add(fi.Size())
-	added := fi.ModTime().UTC()
-	return &progResponse{Size: fi.Size(), Time: &added, DiskPath: diskPath, OutputID: outputID}, nil
+	e := hotEntry{outputID: outputID, diskPath: diskPath, size: fi.Size(), added: fi.ModTime().UTC()}
+	if hot != nil {
+		hot.Put(string(req.ActionID), e)
+	}
+	return e.response(), nil
 }
 
 // handlePut handles "put" requests.
-func (s *Server) handlePut(ctx context.Context, req *progRequest) (pr *progResponse, oerr error) {
+func (s *Server) handlePut(ctx *requestContext, req *progRequest) (pr *progResponse, oerr error) {
 	// If no body was provided, swap in an empty reader.
+	//
+	// Run reads the whole body into memory before it dispatches the request,
+	// so there is no need to drain what is left unread if the put fails.
 	body := cmp.Or(req.Body, io.Reader(strings.NewReader("")))
-	defer io.Copy(io.Discard, body)
-	if s.Put == nil {
-		return nil, errors.New("put: cache is read-only")
+	if s.ReadOnly || (s.Put == nil && s.PutRaw == nil && !s.isNull()) {
+		return nil, fmt.Errorf("put: %w", ErrReadOnly)
+	} else if s.isNull() {
+		diskPath, err := s.dropObject(body)
+		if err != nil {
+			return nil, fmt.Errorf("put %x: drop object: %w", req.ActionID, err)
+		}
+		return &progResponse{DiskPath: diskPath}, nil
 	}
-
-	diskPath, err := s.Put(ctx, Object{
-		ActionID: fmt.Sprintf("%x", req.ActionID),
-		OutputID: fmt.Sprintf("%x", req.outputID()),
+	if s.MaxBodySize > 0 && req.BodySize > s.MaxBodySize {
+		s.putTooLarge.Add(1)
+		if !s.DropOversize {
+			return nil, fmt.Errorf("put %x: %w (%d > %d bytes)",
+				req.ActionID, ErrTooLarge, req.BodySize, s.MaxBodySize)
+		}
+		diskPath, err := s.dropObject(body)
+		if err != nil {
+			return nil, fmt.Errorf("put %x: drop object: %w", req.ActionID, err)
+		}
+		s.vlogf("bc PUT R:%d dropped oversize object (%d bytes)", req.ID, req.BodySize)
+		return &progResponse{DiskPath: diskPath}, nil
+	}
+	if s.Policy != nil && s.Policy(ctx, Object{
+		ActionID: hex.EncodeToString(req.ActionID),
+		OutputID: hex.EncodeToString(req.outputID()),
 		Size:     req.BodySize,
-		Body:     body,
-	})
+	}) == Skip {
+		s.putSkipped.Add(1)
+		diskPath, err := s.dropObject(body)
+		if err != nil {
+			return nil, fmt.Errorf("put %x: drop object: %w", req.ActionID, err)
+		}
+		s.vlogf("bc PUT R:%d skipped by policy", req.ID)
+		return &progResponse{DiskPath: diskPath}, nil
+	}
+
+	start := s.now()
+	var diskPath string
+	var err error
+	if s.PutRaw != nil {
+		diskPath, err = s.PutRaw(ctx, RawObject{
+			ActionID: req.ActionID,
+			OutputID: req.outputID(),
+			Size:     req.BodySize,
+			Body:     body,
+		})
+	} else {
+		diskPath, err = s.Put(ctx, Object{
+			ActionID: hex.EncodeToString(req.ActionID),
+			OutputID: hex.EncodeToString(req.outputID()),
+			Size:     req.BodySize,
+			Body:     body,
+		})
+	}
+	req.backendTime = s.since(start)
+	s.putBackendLatency.add(req.backendTime)
 	if err != nil {
+		tooLarge := errors.Is(err, ErrTooLarge)
+		if tooLarge {
+			s.putTooLarge.Add(1)
+		}
+		hide := slices.Contains(s.ErrorsAreMisses, "put") ||
+			errors.Is(err, ErrBackendUnavailable) || (tooLarge && s.DropOversize)
+		if hide {
+			if diskPath, ok := s.recoverPut(body); ok {
+				s.putErrors.Add(1)
+				s.logf("put %x: %v (ignored)", req.ActionID, err)
+				return &progResponse{DiskPath: diskPath}, nil
+			}
+		}
 		return nil, fmt.Errorf("put %x: %w", req.ActionID, err)
 	}
 
@@ -330,9 +890,305 @@ func (s *Server) handlePut(ctx context.Context, req *progRequest) (pr *progRespo
 
 	// Write successful.
 	s.putBytes.Add(fi.Size())
+	if hot := s.hotCache(); hot != nil {
+		hot.Put(string(req.ActionID), hotEntry{
+			outputID: req.outputID(),
+			diskPath: diskPath,
+			size:     fi.Size(),
+			added:    fi.ModTime().UTC(),
+		})
+	}
 	return &progResponse{DiskPath: diskPath}, nil
 }
 
+func missResponse(reason string) *progResponse {
+	return &progResponse{Miss: true, missReason: reason}
+}
+
+// touch reports the access to a result in the in-memory cache to the Touch
+// callback, if it is set, and reports whether the result may be used.
+func (s *Server) touch(ctx context.Context, actionID, outputID []byte) bool {
+	if s.Touch == nil {
+		return true
+	}
+	err := s.Touch(ctx, hex.EncodeToString(actionID), hex.EncodeToString(outputID))
+	if err != nil {
+		s.logf("touch action %x: %v (evicting)", actionID, err)
+	}
+	return err == nil
+}
+
+// hotEntry is an entry in the in-memory cache of recent results.
+type hotEntry struct {
+	outputID []byte
+	diskPath string
+	size     int64
+	added    time.Time
+}
+
+func (e hotEntry) response() *progResponse {
+	return &progResponse{Size: e.size, Time: &e.added, DiskPath: e.diskPath, OutputID: e.outputID}
+}
+
+// hotCache returns the in-memory cache of recent results, or nil if it is
+// not enabled.
+func (s *Server) hotCache() *cache.Cache[string, hotEntry] {
+	s.hotOnce.Do(func() {
+		if s.HotCacheSize > 0 {
+			s.hot = cache.New(cache.LRU[string, hotEntry](int64(s.HotCacheSize)))
+		}
+	})
+	return s.hot
+}
+
+// dropObject writes the contents of body to a temporary file, and returns the
+// path of the file. The file is removed when Run returns.
+func (s *Server) dropObject(body io.Reader) (string, error) {
+	s.scratchOnce.Do(func() {
+		s.scratchDir, s.scratchErr = os.MkdirTemp("", "gocache-dropped-*")
+	})
+	if s.scratchErr != nil {
+		return "", s.scratchErr
+	}
+	f, err := os.CreateTemp(s.scratchDir, "object-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// recoverPut writes the contents of body to a temporary file as for
+// [Server.dropObject], and returns its path, so that an error from Put can be
+// hidden from the client. It reports false if this is not possible.
+func (s *Server) recoverPut(body io.Reader) (string, bool) {
+	rs, ok := body.(io.ReadSeeker)
+	if !ok {
+		return "", false
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", false
+	}
+	diskPath, err := s.dropObject(rs)
+	if err != nil {
+		s.logf("recover failed put: %v", err)
+		return "", false
+	}
+	return diskPath, true
+}
+
+// removeScratch removes the temporary directory for dropped objects, if one
+// was created.
+func (s *Server) removeScratch() {
+	if s.scratchDir != "" {
+		os.RemoveAll(s.scratchDir)
+	}
+}
+
+// alarms returns a description of each alarm threshold exceeded by the
+// requests handled by s.
+func (s *Server) alarms() []string {
+	gets, puts := s.getRequests.Value(), s.putRequests.Value()
+	if gets+puts < int64(s.alarmMinRequests()) {
+		return nil
+	}
+	var out []string
+	if gets > 0 && s.MinHitRate > 0 {
+		if rate := float64(s.getHits.Value()) / float64(gets); rate < s.MinHitRate {
+			out = append(out, fmt.Sprintf("cache hit rate %.1f%% is below the minimum %.1f%% (%d gets)",
+				100*rate, 100*s.MinHitRate, gets))
+		}
+	}
+	if s.MaxErrorRate > 0 {
+		errs := s.getErrors.Value() + s.putErrors.Value()
+		if rate := float64(errs) / float64(gets+puts); rate > s.MaxErrorRate {
+			out = append(out, fmt.Sprintf("cache error rate %.1f%% is above the maximum %.1f%% (%d errors in %d requests)",
+				100*rate, 100*s.MaxErrorRate, errs, gets+puts))
+		}
+	}
+	return out
+}
+
+// summary returns a one-line summary of the requests handled by s, given the
+// number of alarms reported.
+func (s *Server) summary(alarms int) string {
+	gets, hits := s.getRequests.Value(), s.getHits.Value()
+	var hitPct float64
+	if gets > 0 {
+		hitPct = 100 * float64(hits) / float64(gets)
+	}
+	saved, timed := s.TimeSaved()
+	return fmt.Sprintf("cache summary: "+
+		"gets %d, hits %d (%.1f%%), %d bytes served, p50 %v, p95 %v; "+
+		"puts %d, %d bytes written, p50 %v, p95 %v; "+
+		"est. %v saved (%d misses timed); alarms %d",
+		gets, hits, hitPct, s.getHitBytes.Value(),
+		s.getLatency.quantile(0.50), s.getLatency.quantile(0.95),
+		s.putRequests.Value(), s.putBytes.Value(),
+		s.putLatency.quantile(0.50), s.putLatency.quantile(0.95),
+		saved.Round(time.Millisecond), timed, alarms)
+}
+
+// maxTimedMisses is the most misses the server keeps track of while it waits
+// for the puts of their results, for TimeSaved.
+const maxTimedMisses = 10000
+
+// startMiss records that a get for actionID that began at start missed.
+func (s *Server) startMiss(actionID string, start time.Time) {
+	s.missMu.Lock()
+	defer s.missMu.Unlock()
+	if s.missStart == nil {
+		s.missStart = make(map[string]time.Time)
+	}
+	if len(s.missStart) < maxTimedMisses {
+		s.missStart[actionID] = start
+	}
+}
+
+// endMiss records that the result for actionID was put, and if a get for it
+// missed earlier, the time since then as the cost of the miss.
+func (s *Server) endMiss(actionID string) {
+	s.missMu.Lock()
+	start, ok := s.missStart[actionID]
+	delete(s.missStart, actionID)
+	s.missMu.Unlock()
+	if ok {
+		s.missCost.add(s.since(start))
+	}
+}
+
+// TimeSaved estimates how much time the hits served by s have saved the
+// client, compared to a cold cache, and reports the number of misses the
+// estimate is based on.
+//
+// The cost of a miss is measured as the time from the miss to the put of
+// the result for the same action, during which the client computes the
+// result. The estimate is the number of hits times the mean cost of a miss.
+// It is a total over all actions: when the client runs actions in parallel,
+// as the go command does, the elapsed time saved is less. If no misses have
+// been measured, TimeSaved returns 0, 0.
+func (s *Server) TimeSaved() (time.Duration, int64) {
+	n := s.missCost.count()
+	if n == 0 {
+		return 0, 0
+	}
+	mean := time.Duration(s.missCost.sumUS.Load()/n) * time.Microsecond
+	return time.Duration(s.getHits.Value()) * mean, n
+}
+
+// tagMetrics counts requests and their results by tag (see Server.Tag). Each
+// tag has a map of counters, named as the corresponding server metrics.
+type tagMetrics struct {
+	mu sync.Mutex // protects creating the counters for a tag
+	m  expvar.Map // tag → *expvar.Map
+}
+
+func (t *tagMetrics) counts(tag string) *expvar.Map {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.m.Get(tag).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map)
+		t.m.Set(tag, m)
+	}
+	return m
+}
+
+func (t *tagMetrics) countGet(tag string, pr *progResponse, err error) {
+	if tag == "" {
+		return
+	}
+	m := t.counts(tag)
+	m.Add("get_requests", 1)
+	switch {
+	case err != nil:
+		m.Add("get_errors", 1)
+	case pr.Miss:
+		m.Add("get_misses", 1)
+	default:
+		m.Add("get_hits", 1)
+		m.Add("get_hit_bytes", pr.Size)
+	}
+}
+
+func (t *tagMetrics) countPut(tag string, size int64, err error) {
+	if tag == "" {
+		return
+	}
+	m := t.counts(tag)
+	m.Add("put_requests", 1)
+	if err != nil {
+		m.Add("put_errors", 1)
+	} else {
+		m.Add("put_bytes", size)
+	}
+}
+
+// latencyHist is a histogram of request latencies. Bucket i counts latencies
+// greater than 2^(i-1) and at most 2^i microseconds. The histogram has a fixed
+// size, so memory use does not grow with the number of requests.
+type latencyHist struct {
+	counts [32]atomic.Int64
+	sumUS  atomic.Int64 // total of all latencies, in microseconds
+}
+
+func (h *latencyHist) add(d time.Duration) {
+	h.sumUS.Add(d.Microseconds())
+	var i int
+	if us := d.Microseconds(); us > 1 {
+		i = min(bits.Len64(uint64(us-1)), len(h.counts)-1)
+	}
+	h.counts[i].Add(1)
+}
+
+// count returns the number of latencies recorded in h.
+func (h *latencyHist) count() int64 {
+	var total int64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+	}
+	return total
+}
+
+// quantile returns the upper bound of the bucket containing the q quantile of
+// the latencies in h, or 0 if h is empty.
+func (h *latencyHist) quantile(q float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+	rank := max(int64(math.Ceil(q*float64(total))), 1)
+	var n int64
+	for i := range h.counts {
+		if n += h.counts[i].Load(); n >= rank {
+			return time.Duration(1<<i) * time.Microsecond
+		}
+	}
+	return time.Duration(1<<(len(h.counts)-1)) * time.Microsecond
+}
+
+// String implements the [expvar.Var] interface. It renders a JSON object
+// giving the number of latencies recorded, their mean, and the p50, p95,
+// p99, and maximum latencies, in microseconds. The quantiles are rounded up
+// to a power of two.
+func (h *latencyHist) String() string {
+	count := h.count()
+	var mean int64
+	if count > 0 {
+		mean = h.sumUS.Load() / count
+	}
+	us := func(q float64) int64 { return h.quantile(q).Microseconds() }
+	return fmt.Sprintf(`{"count":%d,"mean_us":%d,"p50_us":%d,"p95_us":%d,"p99_us":%d,"max_us":%d}`,
+		count, mean, us(0.50), us(0.95), us(0.99), us(1))
+}
+
 func (s *Server) logf(msg string, args ...any) {
 	if s.Logf != nil {
 		s.Logf(msg, args...)
@@ -352,20 +1208,482 @@ func (s *Server) maxRequests() int {
 	return runtime.NumCPU()
 }
 
+func (s *Server) alarmMinRequests() int {
+	if s.AlarmMinRequests > 0 {
+		return s.AlarmMinRequests
+	}
+	return 100
+}
+
+func (s *Server) maxRequestSize() int64 {
+	if s.MaxRequestSize > 0 {
+		return s.MaxRequestSize
+	}
+	return 64 << 10
+}
+
+func (s *Server) maxIDLength() int {
+	if s.MaxIDLength > 0 {
+		return s.MaxIDLength
+	}
+	return 64
+}
+
+// checkID reports an error for the named ID field of a cmd request, if id is
+// not valid for s. Invalid IDs are counted in the metrics.
+func (s *Server) checkID(cmd, field string, id []byte) error {
+	if s.StrictIDs {
+		if len(id) == sha256.Size {
+			return nil
+		}
+		s.invalidIDs.Add(1)
+		return fmt.Errorf("%s: invalid %s: got %d bytes, want %d (strict)", cmd, field, len(id), sha256.Size)
+	}
+	if len(id) == 0 || len(id) > s.maxIDLength() {
+		s.invalidIDs.Add(1)
+		return fmt.Errorf("%s: invalid %s", cmd, field)
+	}
+	return nil
+}
+
+// isHexDigest reports whether s is the lowercase hex encoding of a SHA-256
+// digest.
+func isHexDigest(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for i := range len(s) {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// activeRequests tracks the contexts of the requests in progress by their
+// IDs, so that they can be cancelled when the client abandons them.
+type activeRequests struct {
+	mu   sync.Mutex
+	reqs map[int64]*activeRequest
+}
+
+type activeRequest struct {
+	a      *activeRequests
+	id     int64
+	req    *progRequest
+	start  time.Time
+	cancel context.CancelCauseFunc
+}
+
+func newActiveRequests() *activeRequests {
+	return &activeRequests{reqs: make(map[int64]*activeRequest)}
+}
+
+// start returns a context for req, which the server began to handle at now.
+// The caller must call done on the result when the request is complete.
+func (a *activeRequests) start(ctx context.Context, req *progRequest, now time.Time) (context.Context, *activeRequest) {
+	rctx, cancel := context.WithCancelCause(ctx)
+	ar := &activeRequest{a: a, id: req.ID, req: req, start: now, cancel: cancel}
+	a.mu.Lock()
+	a.reqs[req.ID] = ar
+	a.mu.Unlock()
+	return rctx, ar
+}
+
+// done removes ar from the active requests, and releases its context.
+func (ar *activeRequest) done() {
+	ar.a.mu.Lock()
+	if ar.a.reqs[ar.id] == ar { // the client may reuse an ID
+		delete(ar.a.reqs, ar.id)
+	}
+	ar.a.mu.Unlock()
+	ar.cancel(nil)
+}
+
+// cancel cancels the context of the request with the given ID, if it is in
+// progress, with the given cause. It reports whether a request was found.
+func (a *activeRequests) cancel(id int64, cause error) bool {
+	a.mu.Lock()
+	ar, ok := a.reqs[id]
+	delete(a.reqs, id)
+	a.mu.Unlock()
+	if ok {
+		ar.cancel(cause)
+	}
+	return ok
+}
+
+// list returns a description of each request in progress, in order of their
+// start times.
+func (a *activeRequests) list() []ActiveRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]ActiveRequest, 0, len(a.reqs))
+	for _, ar := range a.reqs {
+		out = append(out, ActiveRequest{
+			ID:       ar.id,
+			Command:  ar.req.Command,
+			ActionID: hex.EncodeToString(ar.req.ActionID),
+			Size:     ar.req.BodySize,
+			Start:    ar.start,
+		})
+	}
+	slices.SortFunc(out, func(a, b ActiveRequest) int { return a.Start.Compare(b.Start) })
+	return out
+}
+
+// cancelAll cancels the contexts of all requests in progress.
+func (a *activeRequests) cancelAll(cause error) {
+	a.mu.Lock()
+	ids := slices.Collect(maps.Keys(a.reqs))
+	a.mu.Unlock()
+	for _, id := range ids {
+		a.cancel(id, cause)
+	}
+}
+
+// decodeRequest decodes the next request from dec into req, and adds it to
+// the wire trace if one is enabled.
+func (s *Server) decodeRequest(dec *json.Decoder, req *progRequest) error {
+	if s.wire == nil {
+		return dec.Decode(req)
+	}
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	s.wire.write("> ", append(raw, '\n'))
+	return json.Unmarshal(raw, req)
+}
+
+// wireDump writes a trace of protocol messages. See [Server.DumpWire].
+type wireDump struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error // the first write error, if any
+}
+
+// write writes msg to the trace with the given prefix. The message must end
+// with a newline.
+func (d *wireDump) write(prefix string, msg []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		_, d.err = d.w.Write(append([]byte(prefix), msg...))
+	}
+}
+
+// responseWriter writes responses to the client from a single goroutine, so
+// that the goroutines handling requests do not contend to write them. It
+// flushes the output whenever it has no more responses waiting.
+type responseWriter struct {
+	w    *bufio.Writer
+	wire *wireDump    // if non-nil, also receives the responses
+	ch   chan *[]byte // encoded responses
+	done chan struct{}
+	err  error // the first write error, if any
+}
+
+func newResponseWriter(w *bufio.Writer, wire *wireDump, size int) *responseWriter {
+	rw := &responseWriter{w: w, wire: wire, ch: make(chan *[]byte, size), done: make(chan struct{})}
+	go rw.run()
+	return rw
+}
+
+// bufPool holds buffers for encoded responses.
+var bufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// send encodes rsp and queues it to be written.
+func (rw *responseWriter) send(rsp *progResponse) {
+	buf := bufPool.Get().(*[]byte)
+	*buf = rsp.appendJSON((*buf)[:0])
+	rw.ch <- buf
+}
+
+func (rw *responseWriter) run() {
+	defer close(rw.done)
+	for buf := range rw.ch {
+		if rw.wire != nil {
+			rw.wire.write("< ", *buf)
+		}
+		if rw.err == nil {
+			_, rw.err = rw.w.Write(*buf)
+			if rw.err == nil && len(rw.ch) == 0 {
+				rw.err = rw.w.Flush()
+			}
+		}
+		if cap(*buf) <= 4<<10 {
+			bufPool.Put(buf) // don't keep unusually large buffers
+		}
+	}
+}
+
+// close waits for all queued responses to be written, and reports the first
+// error from writing them. No responses may be sent after close.
+func (rw *responseWriter) close() error {
+	close(rw.ch)
+	<-rw.done
+	return rw.err
+}
+
+// requestSlots limits the number of requests serviced concurrently by a
+// [Server], in total and for each command. A nil channel means no limit.
+type requestSlots struct {
+	total, get, put chan struct{}
+}
+
+func newRequestSlots(s *Server) *requestSlots {
+	limit := func(n int) chan struct{} {
+		if n > 0 {
+			return make(chan struct{}, n)
+		}
+		return nil
+	}
+	return &requestSlots{
+		total: limit(s.maxRequests()),
+		get:   limit(s.MaxGetRequests),
+		put:   limit(s.MaxPutRequests),
+	}
+}
+
+// admit is called by the reader for each request for the given command. It
+// blocks until a slot for the command, if it has a limit of its own, and a
+// total slot are free, so that the reader stops reading while the server is
+// busy. It returns a function that releases the slots.
+func (r *requestSlots) admit(command string) (release func()) {
+	var cmd chan struct{}
+	switch command {
+	case "get":
+		cmd = r.get
+	case "put":
+		cmd = r.put
+	}
+	if cmd == nil {
+		r.total <- struct{}{}
+		return func() { <-r.total }
+	}
+	cmd <- struct{}{}
+	r.total <- struct{}{}
+	return func() { <-r.total; <-cmd }
+}
+
+// byteBudget limits the total size of put bodies held by a [Server]. A nil
+// *byteBudget has no limit.
+type byteBudget struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	max  int64
+	used int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	b := &byteBudget{max: max}
+	b.cond.L = &b.mu
+	return b
+}
+
+// acquire blocks until n bytes are available in the budget, and reports the
+// number of bytes charged, which must be passed to release. A request for
+// more than the whole budget is charged the whole budget.
+func (b *byteBudget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	n = min(n, b.max)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// release returns n bytes to the budget.
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// maxBodySize is the largest body size the server will accept in a request,
+// regardless of other settings. It is far larger than any real object, but
+// ensures that size computations based on it cannot overflow.
+const maxBodySize = 1 << 48
+
+// errRequestTooLarge is reported by Run if a request exceeds the size limits.
+var errRequestTooLarge = errors.New("request is too large")
+
+// budgetReader is an [io.Reader] that reports errRequestTooLarge once it has
+// read as many bytes as the current budget allows. The caller sets the budget
+// before reading each message.
+type budgetReader struct {
+	r    io.Reader
+	left int64 // bytes remaining in the budget
+}
+
+// Read implements the [io.Reader] interface.
+func (b *budgetReader) Read(data []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, errRequestTooLarge
+	}
+	if int64(len(data)) > b.left {
+		data = data[:b.left]
+	}
+	nr, err := b.r.Read(data)
+	b.left -= int64(nr)
+	return nr, err
+}
+
 func (s *Server) commands() []string {
 	var out []string
-	if s.Get != nil {
+	if s.Get != nil || s.GetRaw != nil || s.isNull() {
 		out = append(out, "get")
 	}
-	if s.Put != nil {
+	if (s.Put != nil || s.PutRaw != nil || s.isNull()) && !s.ReadOnly {
 		out = append(out, "put")
 	}
-	if s.Close != nil {
+	if s.Close != nil && !s.isNull() {
 		out = append(out, "close")
 	}
 	return out
 }
 
+// ProtocolInfo describes the features of the cache protocol supported by the
+// [Server] implementation in this package.
+type ProtocolInfo struct {
+	// Commands lists all the commands the server can handle. A given Server
+	// advertises only those for which it has callbacks.
+	Commands []string `json:"commands"`
+
+	// OutputIDFields lists the request field names the server accepts for the
+	// output ID of a "put" request, in order of preference. The field was
+	// renamed from "ObjectID" to "OutputID" in Go 1.24.
+	OutputIDFields []string `json:"outputIDFields"`
+
+	// MinGoVersion is the earliest Go toolchain version the server is known
+	// to be compatible with.
+	MinGoVersion string `json:"minGoVersion"`
+}
+
+// An Event describes the beginning or end of a request handled by a [Server].
+// See [Server.OnEvent].
+type Event struct {
+	End       bool   // false when the request begins, true when it ends
+	Command   string // "get", "put", or "close"
+	RequestID int64  // the request ID assigned by the client
+
+	ActionID string // hex; empty for "close"
+	OutputID string // hex; for "put", or at the end of a "get" that hit
+	Size     int64  // object size in bytes; as for OutputID
+
+	// The remaining fields are set only when the request ends.
+
+	Miss       bool          // for "get", whether the result was a miss
+	MissReason string        // for a "get" miss, the reason (see SetMissReason)
+	DiskPath   string        // the path of the object file, on success
+	Tag        string        // the tag of the request, if any (see Server.Tag)
+	Err        error         // the error reported to the client, if any
+	Elapsed    time.Duration // the time taken to handle the request
+}
+
+// ClientInfo describes the behavior of a client observed by a [Server].
+type ClientInfo struct {
+	// Commands lists the known commands the client has sent, in order of
+	// first use.
+	Commands []string `json:"commands"`
+
+	// OutputIDField is the request field name the client uses for the output
+	// ID of a "put" request: "OutputID" for Go 1.24 and later, "ObjectID" for
+	// earlier versions. It is empty if the client has not sent a put.
+	OutputIDField string `json:"outputIDField,omitempty"`
+}
+
+// ClientInfo reports the behavior of the client observed by s so far. The
+// server accepts requests from all supported Go versions without further
+// configuration, but this may help diagnose problems with a particular
+// toolchain.
+func (s *Server) ClientInfo() ClientInfo {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	ci := s.client
+	ci.Commands = slices.Clone(ci.Commands)
+	return ci
+}
+
+// observe records the client behavior shown by req.
+func (s *Server) observe(req *progRequest) {
+	switch req.Command {
+	case "get", "put", "close":
+	default:
+		return // do not record unknown commands
+	}
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	if !slices.Contains(s.client.Commands, req.Command) {
+		s.client.Commands = append(s.client.Commands, req.Command)
+	}
+	if req.Command == "put" && s.client.OutputIDField == "" {
+		if len(req.OutputID) != 0 {
+			s.client.OutputIDField = "OutputID"
+		} else if len(req.OldOutputID) != 0 {
+			s.client.OutputIDField = "ObjectID"
+			s.logf("client uses the ObjectID field for puts (Go 1.23 or earlier)")
+		}
+	}
+}
+
+// Protocol reports the protocol features supported by this package.
+func Protocol() ProtocolInfo {
+	return ProtocolInfo{
+		Commands:       []string{"get", "put", "close"},
+		OutputIDFields: []string{"OutputID", "ObjectID"},
+		MinGoVersion:   "go1.23",
+	}
+}
+
+// Cache is the interface to a cache with the methods corresponding to the Get,
+// Put, and Close callbacks of a [Server]. The cache wrappers in this module
+// implement it, so that they can be combined and installed in a Server with
+// [Server.SetCache].
+type Cache interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj Object) (diskPath string, _ error)
+	Close(ctx context.Context) error
+}
+
+// CloseBackend calls the Close method of b, if it has one with the signature
+// of the Close callback of a [Server], and otherwise returns nil. A cache that
+// wraps another can use it to close what it wraps.
+func CloseBackend(ctx context.Context, b any) error {
+	if c, ok := b.(interface{ Close(context.Context) error }); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
+
+// A Clock reports the current time. A [Server] and the backends in this
+// module that depend on the time accept a Clock, so that tests can control the
+// passage of time without sleeping. See
+// [github.com/creachadair/gocache/cachetest.Clock] for a clock set by hand.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a [Clock] that reports the time of the system clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
 // An Object defines an object to be stored into the cache.
 type Object struct {
 	ActionID string    // non-empty; lower-case hexadecimal digits
@@ -375,6 +1693,16 @@ type Object struct {
 	ModTime  time.Time // if non-zero, set the object mod-time to this
 }
 
+// RawObject is the parameter to the PutRaw callback of a [Server]. It is the
+// same as [Object], except that the IDs are in binary.
+type RawObject struct {
+	ActionID []byte    // non-empty
+	OutputID []byte    // non-empty
+	Size     int64     // object size in bytes
+	Body     io.Reader // always non-nil
+	ModTime  time.Time // if non-zero, set the object mod-time to this
+}
+
 // Logf writes a log to the logger associated with ctx, if one is defined.
 // The context passed to the callbacks of a Server supports this.
 func Logf(ctx context.Context, msg string, args ...any) {
@@ -391,3 +1719,127 @@ func WithLogf(ctx context.Context, f func(string, ...any)) context.Context {
 }
 
 type logKey struct{}
+
+// Reasons for a cache miss, for use with [SetMissReason]. A Get function may
+// also report other reasons.
+const (
+	MissNotFound     = "not-found"      // no result is stored for the action
+	MissExpired      = "expired"        // a result was stored, but has expired
+	MissSizeMismatch = "size-mismatch"  // the stored object has the wrong size
+	MissTimeout      = "remote-timeout" // a remote backend did not respond in time
+	MissPolicy       = "policy"         // the server's Policy skipped the action
+	MissUnavailable  = "unavailable"    // Get reported ErrBackendUnavailable
+	MissCorrupt      = "corrupt"        // Get reported ErrCorruptObject
+	MissError        = "error"          // Get failed, and ErrorsAreMisses includes "get"
+)
+
+// Errors that callbacks may report, alone or wrapped, to classify a failure.
+// The server checks for them with [errors.Is], and handles them as described.
+var (
+	// ErrReadOnly reports that the cache does not accept writes. The server
+	// reports it for a put to a read-only Server.
+	ErrReadOnly = errors.New("cache is read-only")
+
+	// ErrTooLarge reports that an object is too large to store. The server
+	// reports it for a put larger than MaxBodySize. When Put reports it, the
+	// put is counted as too large, and if DropOversize is set, the object is
+	// dropped as if it exceeded MaxBodySize.
+	ErrTooLarge = errors.New("object too large")
+
+	// ErrBackendUnavailable reports that storage needed by the cache cannot
+	// be reached, for example because a remote server is down. When Get
+	// reports it, the server reports a miss with reason MissUnavailable.
+	// When Put reports it, the server reports success, as for a put listed
+	// in ErrorsAreMisses.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+
+	// ErrCorruptObject reports that a stored result is damaged and cannot be
+	// used. When Get reports it, the server reports a miss with reason
+	// MissCorrupt, so that the client rebuilds and replaces the result.
+	ErrCorruptObject = errors.New("corrupt object")
+)
+
+// A Decision is the result of a [Server] Policy.
+type Decision int
+
+const (
+	Use  Decision = iota // use the cache for the action
+	Skip                 // do not use the cache for the action
+)
+
+// SetMissReason records the reason for a cache miss reported by a Get
+// function. The server counts misses by reason in its metrics, and includes
+// the reason in debug logs. The context passed to the Get callback of a Server
+// supports this; for other contexts SetMissReason has no effect. A miss with
+// no recorded reason is counted as [MissNotFound].
+func SetMissReason(ctx context.Context, reason string) {
+	if rc, ok := ctx.Value(requestKey{}).(*requestContext); ok {
+		rc.reason = reason
+	}
+}
+
+// SetTag sets the tag of the request for which a [Server] called one of its
+// callbacks, replacing the tag chosen by the Tag function of the server, if
+// any. The server counts requests and their results by tag in its metrics.
+// For other contexts SetTag has no effect.
+func SetTag(ctx context.Context, tag string) {
+	if rc, ok := ctx.Value(requestKey{}).(*requestContext); ok {
+		rc.tag = tag
+	}
+}
+
+// RequestInfo describes the client request for which a [Server] called one
+// of its callbacks.
+type RequestInfo struct {
+	ID      int64  // the request ID assigned by the client
+	Command string // "get", "put", or "close"
+
+	// Client describes the behavior of the client observed by the server when
+	// the request was handled.
+	Client ClientInfo
+}
+
+// Request reports the client request for which ctx was passed to a callback.
+// The context passed to the callbacks of a Server supports this; for other
+// contexts Request returns false. The deadline of the request, if the server
+// has a RequestTimeout, is the deadline of ctx.
+func Request(ctx context.Context) (RequestInfo, bool) {
+	rc, ok := ctx.Value(requestKey{}).(*requestContext)
+	if !ok {
+		return RequestInfo{}, false
+	}
+	return RequestInfo{ID: rc.req.ID, Command: rc.req.Command, Client: rc.s.ClientInfo()}, true
+}
+
+// RequestID returns the client's ID for the request for which ctx was passed
+// to a callback, or 0 if ctx was not passed to a callback by a Server. The
+// client assigns IDs starting from 1, so they can be used to correlate the
+// logs of a backend with those of the server and the toolchain.
+func RequestID(ctx context.Context) int64 {
+	if rc, ok := ctx.Value(requestKey{}).(*requestContext); ok {
+		return rc.req.ID
+	}
+	return 0
+}
+
+// requestContext is the context passed to the callbacks for a request, which
+// describes the request and records the reason for a miss. These are stored
+// in the context itself rather than in separate values, to save allocations
+// per request.
+type requestContext struct {
+	context.Context
+	s      *Server
+	req    *progRequest
+	reason string
+	tag    string
+}
+
+// Value implements part of the [context.Context] interface.
+func (c *requestContext) Value(key any) any {
+	if key == (requestKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+type requestKey struct{}
@@ -1,16 +1,22 @@
 package gocache
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"expvar"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -19,6 +25,10 @@ import (
 	gocmp "github.com/google/go-cmp/cmp"
 )
 
+// allowUnexported allows go-cmp to compare responses, which have unexported
+// fields.
+var allowUnexported = gocmp.AllowUnexported(progResponse{})
+
 func TestServer(t *testing.T) {
 	const (
 		actionMiss  = "01"
@@ -84,6 +94,11 @@ func TestServer(t *testing.T) {
 		},
 		Logf:        log.New(&logBuf, "", log.LstdFlags).Printf,
 		LogRequests: true,
+
+		// The test client below does not read responses concurrently with
+		// sending requests, so allow enough concurrency that the server does
+		// not stall regardless of the number of CPUs.
+		MaxRequests: 8,
 	}
 	cr, sw := io.Pipe() // server to client
 	sr, cw := io.Pipe() // client to server
@@ -170,7 +185,7 @@ func TestServer(t *testing.T) {
 			if tc.wait || tc.want != nil {
 				rsp := recv()
 				if tc.want != nil {
-					if diff := gocmp.Diff(rsp, tc.want); diff != "" {
+					if diff := gocmp.Diff(rsp, tc.want, allowUnexported); diff != "" {
 						t.Errorf("Recv [%d] (-got, +want):\n%s", i+1, diff)
 					}
 				} else {
@@ -207,11 +222,11 @@ func TestServer(t *testing.T) {
 		2:   {ID: 2, Size: 5, Time: &objTime, DiskPath: objPath, OutputID: []byte("\x0b\x1e\xc7")},
 		3:   {ID: 3, Err: "get 99: erroneous condition"},
 		4:   {ID: 4, DiskPath: objPath},
-		5:   {ID: 5, Err: "put: invalid ActionID/OutputID"},
+		5:   {ID: 5, Err: "put: invalid ActionID"},
 		6:   {ID: 6, Err: "get: invalid ActionID"},
 		7:   {ID: 7, DiskPath: objPath},
 		999: {ID: 999}, // close response
-	}); diff != "" {
+	}, allowUnexported); diff != "" {
 		t.Errorf("Responses (-got, +want):\n%s", diff)
 	}
 
@@ -235,3 +250,1672 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxBodySize(t *testing.T) {
+	var didPut atomic.Bool
+	s := &Server{
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			didPut.Store(true)
+			return "", errors.New("unexpected put")
+		},
+		MaxBodySize: 3,
+	}
+	ctx := context.Background()
+	newReq := func() *progRequest {
+		return &progRequest{
+			ID:       1,
+			Command:  "put",
+			ActionID: []byte("\x01"),
+			OutputID: []byte("\x02"),
+			BodySize: 5,
+			Body:     strings.NewReader("xyzzy"),
+		}
+	}
+
+	// By default, an oversize put is rejected.
+	if rsp, err := s.handleRequest(ctx, newReq()); err == nil {
+		t.Errorf("Put oversize: got %+v, want error", rsp)
+	}
+
+	// With DropOversize, it is acknowledged but not stored.
+	s.DropOversize = true
+	rsp, err := s.handleRequest(ctx, newReq())
+	if err != nil {
+		t.Fatalf("Put oversize (drop): unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(rsp.DiskPath); err != nil {
+		t.Errorf("Read dropped object: %v", err)
+	} else if got := string(data); got != "xyzzy" {
+		t.Errorf("Dropped object: got %q, want xyzzy", got)
+	}
+	s.removeScratch()
+	if _, err := os.Stat(rsp.DiskPath); !os.IsNotExist(err) {
+		t.Errorf("Dropped object still present after cleanup: %v", err)
+	}
+
+	if didPut.Load() {
+		t.Error("Put was called for an oversize object")
+	}
+	if got := s.putTooLarge.Value(); got != 2 {
+		t.Errorf("put_too_large: got %d, want 2", got)
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+
+	var numGets atomic.Int32
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			numGets.Add(1)
+			if actionID == "01" {
+				return "0b1ec7", objPath, nil
+			}
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return objPath, nil
+		},
+		HotCacheSize: 4,
+	}
+	ctx := context.Background()
+	get := func(id byte) *progResponse {
+		t.Helper()
+		rsp, err := s.handleRequest(ctx, &progRequest{ID: 1, Command: "get", ActionID: []byte{id}})
+		if err != nil {
+			t.Fatalf("Get %x: unexpected error: %v", id, err)
+		}
+		return rsp
+	}
+
+	// Repeated gets for the same action should call Get only once.
+	first := get(1)
+	if diff := gocmp.Diff(get(1), first, allowUnexported); diff != "" {
+		t.Errorf("Hot get (-got, +want):\n%s", diff)
+	}
+	if n := numGets.Load(); n != 1 {
+		t.Errorf("Get called %d times, want 1", n)
+	}
+
+	// A put should populate the cache for its action.
+	if _, err := s.handleRequest(ctx, &progRequest{
+		ID: 2, Command: "put", ActionID: []byte{2}, OutputID: []byte{3},
+		BodySize: 5, Body: strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if rsp := get(2); rsp.Miss || rsp.DiskPath != objPath {
+		t.Errorf("Get after put: got %+v, want hit", rsp)
+	}
+	if n := numGets.Load(); n != 1 {
+		t.Errorf("Get called %d times, want 1", n)
+	}
+
+	// Misses are not cached.
+	get(9)
+	get(9)
+	if n := numGets.Load(); n != 3 {
+		t.Errorf("Get called %d times, want 3", n)
+	}
+	if got := s.getHotHits.Value(); got != 2 {
+		t.Errorf("get_hot_hits: got %d, want 2", got)
+	}
+
+	// If the object file behind a hot entry is removed, the entry is evicted,
+	// and Get is consulted again.
+	if err := os.Remove(objPath); err != nil {
+		t.Fatalf("Remove test object: %v", err)
+	}
+	if rsp := get(1); !rsp.Miss {
+		t.Errorf("Get after remove: got %+v, want miss", rsp)
+	}
+	if n := numGets.Load(); n != 4 {
+		t.Errorf("Get called %d times, want 4", n)
+	}
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+	if rsp := get(1); rsp.Miss || rsp.DiskPath != objPath {
+		t.Errorf("Get after restore: got %+v, want hit", rsp)
+	}
+	if n := numGets.Load(); n != 5 {
+		t.Errorf("Get called %d times, want 5", n)
+	}
+	if got := s.getHotHits.Value(); got != 2 {
+		t.Errorf("get_hot_hits: got %d, want 2", got)
+	}
+}
+
+func TestHotCacheTouch(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+
+	var numGets atomic.Int32
+	var touched []string
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			numGets.Add(1)
+			return "0b1ec7", objPath, nil
+		},
+		Touch: func(ctx context.Context, actionID, outputID string) error {
+			touched = append(touched, actionID+":"+outputID)
+			if actionID == "02" {
+				return errors.New("touch failed")
+			}
+			return nil
+		},
+		HotCacheSize: 4,
+	}
+	ctx := context.Background()
+	get := func(id byte) {
+		t.Helper()
+		rsp, err := s.handleRequest(ctx, &progRequest{ID: 1, Command: "get", ActionID: []byte{id}})
+		if err != nil || rsp.Miss {
+			t.Fatalf("Get %x: got %+v, %v; want hit", id, rsp, err)
+		}
+	}
+
+	// Gets answered by Get are not touched; hot hits are.
+	get(1)
+	get(1)
+	get(1)
+	if n := numGets.Load(); n != 1 {
+		t.Errorf("Get called %d times, want 1", n)
+	}
+
+	// If a touch fails, the entry is evicted, and Get is consulted again.
+	get(2)
+	get(2)
+	if n := numGets.Load(); n != 3 {
+		t.Errorf("Get called %d times, want 3", n)
+	}
+	want := []string{"01:0b1ec7", "01:0b1ec7", "02:0b1ec7"}
+	if diff := gocmp.Diff(touched, want); diff != "" {
+		t.Errorf("Touched (-got, +want):\n%s", diff)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+
+	var summary []string
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			if actionID == "01" {
+				return "0b1ec7", objPath, nil
+			}
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return objPath, nil
+		},
+		SummaryLogf: func(msg string, args ...any) {
+			summary = append(summary, fmt.Sprintf(msg, args...))
+		},
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"put","ActionID":"Ag==","OutputID":"Aw==","BodySize":5}
+"eHl6enk="
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if len(summary) != 1 {
+		t.Fatalf("Got %d summaries, want 1: %q", len(summary), summary)
+	}
+	for _, want := range []string{
+		"gets 2, hits 1 (50.0%), 5 bytes served",
+		"puts 1, 5 bytes written",
+		"alarms 0",
+	} {
+		if !strings.Contains(summary[0], want) {
+			t.Errorf("Summary %q does not contain %q", summary[0], want)
+		}
+	}
+}
+
+func TestTimeSaved(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+
+	// The client takes 2s to compute the result for action 02 after it
+	// misses, and 10s for action 03, which is not counted, since it did not
+	// miss first.
+	clock := &manualClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var summary []string
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			if actionID == "01" {
+				return "0b1ec7", objPath, nil
+			}
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			if obj.ActionID == "02" {
+				clock.advance(2 * time.Second)
+			} else {
+				clock.advance(10 * time.Second)
+			}
+			return objPath, nil
+		},
+		SummaryLogf: func(msg string, args ...any) {
+			summary = append(summary, fmt.Sprintf(msg, args...))
+		},
+		Clock:       clock,
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"put","ActionID":"Ag==","OutputID":"Aw==","BodySize":5}
+"eHl6enk="
+{"ID":4,"Command":"put","ActionID":"Aw==","OutputID":"Aw==","BodySize":5}
+"eHl6enk="
+{"ID":5,"Command":"get","ActionID":"AQ=="}
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	// Two hits, at 2s for each miss.
+	if saved, n := s.TimeSaved(); saved != 4*time.Second || n != 1 {
+		t.Errorf("TimeSaved: got %v, %d; want 4s, 1", saved, n)
+	}
+	if len(summary) != 1 || !strings.Contains(summary[0], "est. 4s saved (1 misses timed)") {
+		t.Errorf("Summary: got %q, want time saved", summary)
+	}
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			time.Sleep(delay)
+			return "", "", nil
+		},
+	}
+	for i := range 3 {
+		if _, err := s.handleRequest(context.Background(), &progRequest{
+			ID: int64(i + 1), Command: "get", ActionID: []byte{byte(i)},
+		}); err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+	}
+
+	type latency struct {
+		Count int64 `json:"count"`
+		Mean  int64 `json:"mean_us"`
+		P50   int64 `json:"p50_us"`
+		Max   int64 `json:"max_us"`
+	}
+	sm := s.Metrics().Get("server").(*expvar.Map)
+	get := func(name string) latency {
+		t.Helper()
+		var v latency
+		if err := json.Unmarshal([]byte(sm.Get(name).String()), &v); err != nil {
+			t.Fatalf("Decode %s: %v", name, err)
+		}
+		return v
+	}
+	total, backend, overhead := get("get_latency"), get("get_backend_latency"), get("get_overhead_latency")
+	for _, v := range []latency{total, backend, overhead} {
+		if v.Count != 3 {
+			t.Errorf("Latency %+v: got count %d, want 3", v, v.Count)
+		}
+	}
+	if min := delay.Microseconds(); backend.Mean < min || backend.P50 < min {
+		t.Errorf("Backend latency %+v: want at least %dµs", backend, min)
+	}
+	if overhead.Mean >= backend.Mean {
+		t.Errorf("Overhead latency %+v: want less than backend %+v", overhead, backend)
+	}
+	if get("put_latency").Count != 0 {
+		t.Errorf("Put latency: got %q, want count 0", sm.Get("put_latency"))
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	const input = `{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"get","ActionID":"Aw=="}
+`
+	tests := []struct {
+		name     string
+		minHit   float64
+		maxErr   float64
+		minReqs  int
+		wantWarn []string
+	}{
+		{"NoAlarms", 0, 0, 1, nil},
+		{"TooFewRequests", 0.9, 0.1, 0, nil}, // default minimum is 100
+		{"HitRate", 0.5, 0, 3, []string{"hit rate 33.3% is below the minimum 50.0%"}},
+		{"ErrorRate", 0, 0.5, 3, []string{"error rate 66.7% is above the maximum 50.0%"}},
+		{"Both", 0.5, 0.5, 3, []string{"hit rate", "error rate"}},
+		{"OK", 0.3, 0.7, 3, nil},
+	}
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs []string
+			s := &Server{
+				Get: func(ctx context.Context, actionID string) (string, string, error) {
+					switch actionID {
+					case "01":
+						return "0b1ec7", objPath, nil
+					case "02":
+						return "", "", errors.New("get failed")
+					}
+					return "", "", context.DeadlineExceeded
+				},
+				SummaryLogf: func(msg string, args ...any) {
+					logs = append(logs, fmt.Sprintf(msg, args...))
+				},
+				MinHitRate:       tc.minHit,
+				MaxErrorRate:     tc.maxErr,
+				AlarmMinRequests: tc.minReqs,
+				MaxRequests:      1,
+			}
+			if err := s.Run(context.Background(), strings.NewReader(input), io.Discard); err != nil {
+				t.Fatalf("Run: unexpected error: %v", err)
+			}
+			if len(logs) != len(tc.wantWarn)+1 {
+				t.Fatalf("Got %d logs, want %d: %q", len(logs), len(tc.wantWarn)+1, logs)
+			}
+			for i, want := range tc.wantWarn {
+				if !strings.HasPrefix(logs[i], "WARNING: ") || !strings.Contains(logs[i], want) {
+					t.Errorf("Log %d: got %q, want warning containing %q", i+1, logs[i], want)
+				}
+			}
+			if want := fmt.Sprintf("alarms %d", len(tc.wantWarn)); !strings.HasSuffix(logs[len(logs)-1], want) {
+				t.Errorf("Summary %q does not end with %q", logs[len(logs)-1], want)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var puts int
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			puts++
+			return "", errors.New("unexpected put")
+		},
+		Close:    func(context.Context) error { return nil },
+		ReadOnly: true,
+	}
+	if diff := gocmp.Diff(s.commands(), []string{"get", "close"}); diff != "" {
+		t.Errorf("Commands (-got, +want):\n%s", diff)
+	}
+	rsp, err := s.handleRequest(context.Background(), &progRequest{
+		ID: 1, Command: "put", ActionID: []byte("\x01"), OutputID: []byte("\x02"),
+		BodySize: 5, Body: strings.NewReader("xyzzy"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("Put: got %+v, %v; want read-only error", rsp, err)
+	}
+	if puts != 0 {
+		t.Errorf("Put callback was called %d times, want 0", puts)
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return "/path/to/" + obj.OutputID, nil
+		},
+		Close: func(context.Context) error { return nil },
+	}
+	if diff := gocmp.Diff(s.ClientInfo(), ClientInfo{}); diff != "" {
+		t.Errorf("Initial ClientInfo (-got, +want):\n%s", diff)
+	}
+
+	// A Go 1.23 client, which sends the output ID of a put as ObjectID.
+	in := strings.Join([]string{
+		`{"ID":1,"Command":"get","ActionID":"AQ=="}`,
+		`{"ID":2,"Command":"bogus"}`,
+		`{"ID":3,"Command":"put","ActionID":"AQ==","ObjectID":"Ag==","BodySize":1}`,
+		`"eA=="`,
+		`{"ID":4,"Command":"get","ActionID":"Aw=="}`,
+		`{"ID":5,"Command":"close"}`,
+	}, "\n")
+	if err := s.Run(context.Background(), strings.NewReader(in), io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if diff := gocmp.Diff(s.ClientInfo(), ClientInfo{
+		Commands:      []string{"get", "put", "close"},
+		OutputIDField: "ObjectID",
+	}); diff != "" {
+		t.Errorf("ClientInfo (-got, +want):\n%s", diff)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+	putErr := errors.New("put failed")
+
+	var got []Event
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			if actionID == "01" {
+				return "0b1ec7", objPath, nil
+			}
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return "", putErr
+		},
+		Close: func(context.Context) error { return nil },
+		OnEvent: func(e Event) {
+			if e.End && e.Elapsed <= 0 {
+				t.Errorf("Event %+v: missing elapsed time", e)
+			}
+			e.Elapsed = 0
+			got = append(got, e)
+		},
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"put","ActionID":"Ag==","OutputID":"Aw==","BodySize":5}
+"eHl6enk="
+{"ID":4,"Command":"close"}
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if diff := gocmp.Diff(got, []Event{
+		{Command: "get", RequestID: 1, ActionID: "01"},
+		{End: true, Command: "get", RequestID: 1, ActionID: "01", OutputID: "0b1ec7", Size: 5, DiskPath: objPath},
+		{Command: "get", RequestID: 2, ActionID: "02"},
+		{End: true, Command: "get", RequestID: 2, ActionID: "02", Miss: true, MissReason: MissNotFound},
+		{Command: "put", RequestID: 3, ActionID: "02", OutputID: "03", Size: 5},
+		{End: true, Command: "put", RequestID: 3, ActionID: "02", OutputID: "03", Size: 5, Err: putErr},
+		{Command: "close", RequestID: 4},
+		{End: true, Command: "close", RequestID: 4},
+	}, gocmp.Comparer(func(a, b error) bool { return errors.Is(a, b) })); diff != "" {
+		t.Errorf("Events (-got, +want):\n%s", diff)
+	}
+}
+
+func TestErrorsAreMisses(t *testing.T) {
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "", "", errors.New("get failed")
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return "", errors.New("put failed")
+		},
+	}
+	defer s.removeScratch()
+	ctx := context.Background()
+	get := func() (*progResponse, error) {
+		return s.handleRequest(ctx, &progRequest{ID: 1, Command: "get", ActionID: []byte("\x01")})
+	}
+	put := func() (*progResponse, error) {
+		return s.handleRequest(ctx, &progRequest{
+			ID: 2, Command: "put", ActionID: []byte("\x01"), OutputID: []byte("\x02"),
+			BodySize: 5, Body: strings.NewReader("xyzzy"),
+		})
+	}
+
+	// By default, errors are reported to the client.
+	if rsp, err := get(); err == nil {
+		t.Errorf("Get: got %+v, want error", rsp)
+	}
+	if rsp, err := put(); err == nil {
+		t.Errorf("Put: got %+v, want error", rsp)
+	}
+
+	// With ErrorsAreMisses, a failed get is a miss and a failed put succeeds.
+	s.ErrorsAreMisses = []string{"get", "put"}
+	if rsp, err := get(); err != nil || !rsp.Miss || rsp.missReason != MissError {
+		t.Errorf("Get: got %+v, %v; want miss (%s)", rsp, err, MissError)
+	}
+	if rsp, err := put(); err != nil {
+		t.Errorf("Put: unexpected error: %v", err)
+	} else if data, err := os.ReadFile(rsp.DiskPath); err != nil {
+		t.Errorf("Read put object: %v", err)
+	} else if string(data) != "xyzzy" {
+		t.Errorf("Put object: got %q, want %q", data, "xyzzy")
+	}
+
+	// Errors are still counted.
+	if got := s.getErrors.Value(); got != 2 {
+		t.Errorf("get_errors: got %d, want 2", got)
+	}
+	if got := s.putErrors.Value(); got != 2 {
+		t.Errorf("put_errors: got %d, want 2", got)
+	}
+}
+
+func TestMissReasons(t *testing.T) {
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			switch actionID {
+			case "01":
+				SetMissReason(ctx, MissExpired)
+			case "02":
+				return "", "", context.DeadlineExceeded
+			}
+			return "", "", nil
+		},
+		ErrorsAreMisses: []string{"get"},
+	}
+	ctx := context.Background()
+	for _, id := range []string{"\x01", "\x01", "\x02", "\x03"} {
+		if rsp, err := s.handleRequest(ctx, &progRequest{ID: 1, Command: "get", ActionID: []byte(id)}); err != nil || !rsp.Miss {
+			t.Errorf("Get %x: got %+v, %v; want miss", id, rsp, err)
+		}
+	}
+
+	got := make(map[string]string)
+	s.getMissReasons.Do(func(kv expvar.KeyValue) { got[kv.Key] = kv.Value.String() })
+	want := map[string]string{MissExpired: "2", MissTimeout: "1", MissNotFound: "1"}
+	if diff := gocmp.Diff(got, want); diff != "" {
+		t.Errorf("get_miss_reasons (-got, +want):\n%s", diff)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	var gets, puts atomic.Int32
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			gets.Add(1)
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			puts.Add(1)
+			return "", errors.New("unexpected put")
+		},
+		Policy: func(ctx context.Context, obj Object) Decision {
+			if obj.ActionID == "01" {
+				return Skip
+			}
+			return Use
+		},
+	}
+	defer s.removeScratch()
+	ctx := context.Background()
+
+	// A skipped get is a miss, and does not call Get.
+	if rsp, err := s.handleRequest(ctx, &progRequest{ID: 1, Command: "get", ActionID: []byte("\x01")}); err != nil || !rsp.Miss {
+		t.Errorf("Get skipped: got %+v, %v; want miss", rsp, err)
+	}
+	if rsp, err := s.handleRequest(ctx, &progRequest{ID: 2, Command: "get", ActionID: []byte("\x02")}); err != nil || !rsp.Miss {
+		t.Errorf("Get: got %+v, %v; want miss", rsp, err)
+	}
+	if got := gets.Load(); got != 1 {
+		t.Errorf("Get calls: got %d, want 1", got)
+	}
+
+	// A skipped put is acknowledged, but not stored.
+	rsp, err := s.handleRequest(ctx, &progRequest{
+		ID:       3,
+		Command:  "put",
+		ActionID: []byte("\x01"),
+		OutputID: []byte("\x02"),
+		BodySize: 5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put skipped: unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(rsp.DiskPath); err != nil {
+		t.Errorf("Read skipped object: %v", err)
+	} else if got := string(data); got != "xyzzy" {
+		t.Errorf("Skipped object: got %q, want xyzzy", got)
+	}
+	if got := puts.Load(); got != 0 {
+		t.Errorf("Put calls: got %d, want 0", got)
+	}
+	if got := s.putSkipped.Value(); got != 1 {
+		t.Errorf("put_skipped: got %d, want 1", got)
+	}
+	if got := s.getMissReasons.Get(MissPolicy); got == nil || got.String() != "1" {
+		t.Errorf("get_miss_reasons[%s]: got %v, want 1", MissPolicy, got)
+	}
+}
+
+func TestRequestInfo(t *testing.T) {
+	type seen struct {
+		Info        RequestInfo
+		ID          int64
+		HasDeadline bool
+	}
+	var got []seen
+	record := func(ctx context.Context) {
+		info, ok := Request(ctx)
+		if !ok {
+			t.Error("Request: no request info in callback context")
+		} else if !slices.Contains(info.Client.Commands, info.Command) {
+			t.Errorf("Request %d: client commands %q do not include %q", info.ID, info.Client.Commands, info.Command)
+		}
+		info.Client = ClientInfo{} // depends on how far the server has read
+		_, hasDeadline := ctx.Deadline()
+		got = append(got, seen{Info: info, ID: RequestID(ctx), HasDeadline: hasDeadline})
+	}
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			record(ctx)
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			record(ctx)
+			return "", errors.New("put failed")
+		},
+		Close: func(ctx context.Context) error {
+			record(ctx)
+			return nil
+		},
+		RequestTimeout: time.Minute,
+		MaxRequests:    1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"put","ActionID":"Ag==","OutputID":"Aw==","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"close"}
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if diff := gocmp.Diff(got, []seen{
+		{Info: RequestInfo{ID: 1, Command: "get"}, ID: 1, HasDeadline: true},
+		{Info: RequestInfo{ID: 2, Command: "put"}, ID: 2, HasDeadline: true},
+		{Info: RequestInfo{ID: 3, Command: "close"}, ID: 3},
+	}); diff != "" {
+		t.Errorf("Request info (-got, +want):\n%s", diff)
+	}
+
+	// Other contexts have no request info.
+	if info, ok := Request(context.Background()); ok {
+		t.Errorf("Request: got %+v, want none", info)
+	}
+	if id := RequestID(context.Background()); id != 0 {
+		t.Errorf("RequestID: got %d, want 0", id)
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	var active, maxActive atomic.Int32
+	var numGets atomic.Int32
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			numGets.Add(1)
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			n := active.Add(1)
+			defer active.Add(-1)
+			if n > maxActive.Load() {
+				maxActive.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+			return "", errors.New("put failed")
+		},
+		MaxRequests:    4,
+		MaxPutRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":0}
+{"ID":2,"Command":"put","ActionID":"Ag==","OutputID":"Ag==","BodySize":0}
+{"ID":3,"Command":"put","ActionID":"Aw==","OutputID":"Ag==","BodySize":0}
+{"ID":4,"Command":"get","ActionID":"BA=="}
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if got := maxActive.Load(); got != 1 {
+		t.Errorf("Concurrent puts: got %d, want 1", got)
+	}
+	if got := numGets.Load(); got != 1 {
+		t.Errorf("Gets: got %d, want 1", got)
+	}
+}
+
+func TestMaxPutBytes(t *testing.T) {
+	var active, maxActive atomic.Int32
+	var sizes []int64
+	var mu sync.Mutex
+	s := &Server{
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			n := active.Add(1)
+			defer active.Add(-1)
+			if n > maxActive.Load() {
+				maxActive.Store(n)
+			}
+			mu.Lock()
+			sizes = append(sizes, obj.Size)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			return "", errors.New("put failed")
+		},
+		MaxRequests: 8,
+		MaxPutBytes: 8,
+	}
+
+	// Two 5-byte objects do not fit in the budget together, and an object
+	// larger than the budget is admitted by itself.
+	in := strings.NewReader(`{"ID":1,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":5}
+"eHl6enk="
+{"ID":2,"Command":"put","ActionID":"Ag==","OutputID":"Ag==","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"put","ActionID":"Aw==","OutputID":"Ag==","BodySize":10}
+"eHl6enl4eXp6eQ=="
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if got := maxActive.Load(); got != 1 {
+		t.Errorf("Concurrent puts: got %d, want 1", got)
+	}
+	if diff := gocmp.Diff(sizes, []int64{5, 5, 10}); diff != "" {
+		t.Errorf("Put sizes (-got, +want):\n%s", diff)
+	}
+}
+
+func TestRequestAllocs(t *testing.T) {
+	objPath := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		t.Fatalf("Create test object: %v", err)
+	}
+	newServer := func(hotSize int) *Server {
+		return &Server{
+			Get: func(ctx context.Context, actionID string) (string, string, error) {
+				return "0b1ec7", objPath, nil
+			},
+			Put: func(ctx context.Context, obj Object) (string, error) {
+				return objPath, nil
+			},
+			HotCacheSize: hotSize,
+		}
+	}
+	ctx := context.Background()
+	getReq := &progRequest{ID: 1, Command: "get", ActionID: []byte("\x01")}
+	putReq := &progRequest{ID: 2, Command: "put", ActionID: []byte("\x01"), OutputID: []byte("\x02"), BodySize: 5}
+	body := strings.NewReader("xyzzy")
+
+	// These ceilings are not exact, but guard against regressions in the
+	// per-request overhead of the server, which matters for long-running
+	// servers handling many requests.
+	tests := []struct {
+		name string
+		s    *Server
+		req  *progRequest
+		max  float64
+	}{
+		{"Get", newServer(0), getReq, 8},
+		{"HotGet", newServer(16), getReq, 5}, // including a stat of the object file
+		{"Put", newServer(0), putReq, 8},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := testing.AllocsPerRun(100, func() {
+				body.Reset("xyzzy")
+				tc.req.Body = body
+				if _, err := tc.s.handleRequest(ctx, tc.req); err != nil {
+					t.Fatalf("Request failed: %v", err)
+				}
+			})
+			t.Logf("%v allocations per request", got)
+			if got > tc.max {
+				t.Errorf("Got %v allocations per request, want at most %v", got, tc.max)
+			}
+		})
+	}
+}
+
+func BenchmarkServer(b *testing.B) {
+	objPath := filepath.Join(b.TempDir(), "object")
+	if err := os.WriteFile(objPath, []byte("xyzzy"), 0600); err != nil {
+		b.Fatalf("Create test object: %v", err)
+	}
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "0b1ec7", objPath, nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return objPath, nil
+		},
+		HotCacheSize: 1000,
+	}
+
+	// Generate a stream of requests for a mix of actions, with one put for
+	// every ten gets.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range b.N {
+		id := []byte{byte(i >> 8), byte(i)}
+		if i%10 == 0 {
+			enc.Encode(&progRequest{ID: int64(i), Command: "put", ActionID: id, OutputID: id, BodySize: 5})
+			enc.Encode([]byte("xyzzy"))
+		} else {
+			enc.Encode(&progRequest{ID: int64(i), Command: "get", ActionID: id})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := s.Run(context.Background(), &buf, io.Discard); err != nil {
+		b.Fatalf("Run: unexpected error: %v", err)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	newServer := func() *Server {
+		return &Server{
+			Get: func(context.Context, string) (string, string, error) { return "", "", nil },
+			Put: func(context.Context, Object) (string, error) {
+				return "", errors.New("unexpected put")
+			},
+			MaxRequestSize: 128,
+		}
+	}
+
+	// Requests that exceed the decoding limits terminate the server.
+	tests := []struct {
+		name, input, want string
+	}{
+		{"LongRequest",
+			`{"ID":1,"Command":"get","ActionID":"` + strings.Repeat("A", 200) + `"}`,
+			errRequestTooLarge.Error()},
+		{"LongBody",
+			`{"ID":1,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":1}` + "\n" +
+				`"` + strings.Repeat("A", 1000) + `"`,
+			errRequestTooLarge.Error()},
+		{"HugeBodySize",
+			`{"ID":1,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":1000000000000000000}`,
+			"invalid body size"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newServer().Run(context.Background(), strings.NewReader(tc.input), io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Run: got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+
+	// Requests with invalid fields are rejected individually.
+	s := newServer()
+	longID := bytes.Repeat([]byte("\x01"), 65)
+	for _, req := range []*progRequest{
+		{ID: 1, Command: "get", ActionID: longID},
+		{ID: 2, Command: "put", ActionID: []byte("\x01"), OutputID: longID},
+		{ID: 3, Command: "put", ActionID: []byte("\x01"), OutputID: []byte("\x02"), BodySize: -1},
+	} {
+		if rsp, err := s.handleRequest(context.Background(), req); err == nil {
+			t.Errorf("Request %d: got %+v, want error", req.ID, rsp)
+		}
+	}
+}
+
+func TestAbandonedRequests(t *testing.T) {
+	started := make(chan struct{})
+	var cause error
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			close(started)
+			<-ctx.Done()
+			cause = context.Cause(ctx)
+			return "", "", ctx.Err()
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return "", errors.New("unexpected put")
+		},
+	}
+
+	// The client sends a get, then closes its end in the middle of the body
+	// of a put, once the get has started.
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, `{"ID":1,"Command":"get","ActionID":"AQ=="}`+"\n")
+		<-started
+		io.WriteString(pw, `{"ID":2,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":5}`+"\n\"eHl6")
+		pw.Close()
+	}()
+	err := s.Run(context.Background(), pr, io.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Run: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if !errors.Is(cause, io.ErrUnexpectedEOF) || !strings.Contains(cause.Error(), "request abandoned") {
+		t.Errorf("Get context cause: got %v, want request abandoned", cause)
+	}
+}
+
+func TestGetOutputID(t *testing.T) {
+	// Whichever field name the client uses for the output ID of a put, the
+	// response to a later get reports it as OutputID, from the hot cache or
+	// from the Get callback.
+	dir := t.TempDir()
+	for _, field := range []string{"OutputID", "ObjectID"} {
+		for _, hot := range []int{0, 16} {
+			t.Run(fmt.Sprintf("%s/hot=%d", field, hot), func(t *testing.T) {
+				var mu sync.Mutex
+				stored := make(map[string]string) // action ID → output ID
+				s := &Server{
+					Get: func(ctx context.Context, actionID string) (string, string, error) {
+						mu.Lock()
+						defer mu.Unlock()
+						oid, ok := stored[actionID]
+						if !ok {
+							return "", "", nil
+						}
+						return oid, filepath.Join(dir, oid), nil
+					},
+					Put: func(ctx context.Context, obj Object) (string, error) {
+						path := filepath.Join(dir, obj.OutputID)
+						if err := os.WriteFile(path, []byte("xyzzy"), 0600); err != nil {
+							return "", err
+						}
+						mu.Lock()
+						defer mu.Unlock()
+						stored[obj.ActionID] = obj.OutputID
+						return path, nil
+					},
+					HotCacheSize: hot,
+					MaxRequests:  1,
+				}
+				in := strings.NewReader(`{"ID":1,"Command":"put","ActionID":"AQ==","` + field + `":"q80=","BodySize":5}
+"eHl6enk="
+{"ID":2,"Command":"get","ActionID":"AQ=="}
+`)
+				var out bytes.Buffer
+				if err := s.Run(context.Background(), in, &out); err != nil {
+					t.Fatalf("Run: unexpected error: %v", err)
+				}
+				dec := json.NewDecoder(&out)
+				for {
+					var rsp map[string]any
+					if err := dec.Decode(&rsp); err != nil {
+						t.Fatal("No response to get")
+					} else if rsp["ID"] != 2.0 {
+						continue
+					}
+					if got := rsp["OutputID"]; got != "q80=" {
+						t.Errorf("Get OutputID: got %v, want q80=", got)
+					}
+					if _, ok := rsp["ObjectID"]; ok {
+						t.Errorf("Get response has an ObjectID field: %v", rsp)
+					}
+					break
+				}
+			})
+		}
+	}
+}
+
+func TestStrictIDs(t *testing.T) {
+	dir := t.TempDir()
+	objPath := filepath.Join(dir, "obj")
+	if err := os.WriteFile(objPath, nil, 0600); err != nil {
+		t.Fatalf("Write object: %v", err)
+	}
+	id := bytes.Repeat([]byte{0xab}, 32)
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			// Report an output ID that is not lowercase hex.
+			return strings.ToUpper(actionID), objPath, nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return objPath, nil
+		},
+		StrictIDs:   true,
+		MaxRequests: 1,
+	}
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, req := range []*progRequest{
+		{ID: 1, Command: "get", ActionID: []byte{1}},
+		{ID: 2, Command: "put", ActionID: id, OutputID: id[:20]},
+		{ID: 3, Command: "get", ActionID: id},
+		{ID: 4, Command: "put", ActionID: id, OutputID: id},
+	} {
+		enc.Encode(req)
+	}
+	var out bytes.Buffer
+	if err := s.Run(context.Background(), &in, &out); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	got := make(map[int64]string)
+	dec := json.NewDecoder(&out)
+	for {
+		var rsp progResponse
+		if err := dec.Decode(&rsp); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		got[rsp.ID] = rsp.Err
+	}
+	if diff := gocmp.Diff(got, map[int64]string{
+		0: "",
+		1: "get: invalid ActionID: got 1 bytes, want 32 (strict)",
+		2: "put: invalid OutputID: got 20 bytes, want 32 (strict)",
+		3: `get: invalid output ID "` + strings.Repeat("AB", 32) + `" from backend (strict)`,
+		4: "",
+	}); diff != "" {
+		t.Errorf("Responses (-got, +want):\n%s", diff)
+	}
+	if got := s.invalidIDs.Value(); got != 3 {
+		t.Errorf("Invalid IDs: got %d, want 3", got)
+	}
+}
+
+func TestRawCallbacks(t *testing.T) {
+	// The raw callbacks get binary IDs, and take precedence over Get and Put.
+	dir := t.TempDir()
+	var mu sync.Mutex
+	stored := make(map[string][]byte) // action ID → output ID
+	s := &Server{
+		Get: func(context.Context, string) (string, string, error) {
+			return "", "", errors.New("unexpected Get")
+		},
+		Put: func(context.Context, Object) (string, error) {
+			return "", errors.New("unexpected Put")
+		},
+		GetRaw: func(ctx context.Context, actionID []byte) ([]byte, string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			oid, ok := stored[string(actionID)]
+			if !ok {
+				return nil, "", nil
+			}
+			return oid, filepath.Join(dir, hex.EncodeToString(oid)), nil
+		},
+		PutRaw: func(ctx context.Context, obj RawObject) (string, error) {
+			path := filepath.Join(dir, hex.EncodeToString(obj.OutputID))
+			if err := os.WriteFile(path, []byte("xyzzy"), 0600); err != nil {
+				return "", err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			stored[string(obj.ActionID)] = bytes.Clone(obj.OutputID)
+			return path, nil
+		},
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"put","ActionID":"AQ==","OutputID":"q80=","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"get","ActionID":"AQ=="}
+`)
+	var out bytes.Buffer
+	if err := s.Run(context.Background(), in, &out); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	objPath := filepath.Join(dir, "abcd")
+	got := make(map[int64]*progResponse)
+	dec := json.NewDecoder(&out)
+	for {
+		var rsp progResponse
+		if err := dec.Decode(&rsp); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		rsp.Time = nil
+		got[rsp.ID] = &rsp
+	}
+	if diff := gocmp.Diff(got, map[int64]*progResponse{
+		0: {KnownCommands: []string{"get", "put"}},
+		1: {ID: 1, Miss: true},
+		2: {ID: 2, DiskPath: objPath},
+		3: {ID: 3, OutputID: []byte("\xab\xcd"), Size: 5, DiskPath: objPath},
+	}, allowUnexported); diff != "" {
+		t.Errorf("Responses (-got, +want):\n%s", diff)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	// Errors of known classes from the callbacks are mapped to responses and
+	// metrics, even when wrapped.
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			switch actionID {
+			case "01":
+				return "", "", fmt.Errorf("read: %w", ErrCorruptObject)
+			case "02":
+				return "", "", fmt.Errorf("fetch: %w", ErrBackendUnavailable)
+			}
+			return "", "", errors.New("get failed")
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			switch obj.ActionID {
+			case "01":
+				return "", fmt.Errorf("store: %w", ErrBackendUnavailable)
+			case "02":
+				return "", fmt.Errorf("store: %w", ErrTooLarge)
+			}
+			return "", errors.New("put failed")
+		},
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"get","ActionID":"Aw=="}
+{"ID":4,"Command":"put","ActionID":"AQ==","OutputID":"q80=","BodySize":5}
+"eHl6enk="
+{"ID":5,"Command":"put","ActionID":"Ag==","OutputID":"q80=","BodySize":5}
+"eHl6enk="
+`)
+	var out bytes.Buffer
+	if err := s.Run(context.Background(), in, &out); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	got := make(map[int64]*progResponse)
+	dec := json.NewDecoder(&out)
+	for {
+		var rsp progResponse
+		if err := dec.Decode(&rsp); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		if rsp.DiskPath != "" {
+			rsp.DiskPath = "recovered"
+		}
+		got[rsp.ID] = &rsp
+	}
+	if diff := gocmp.Diff(got, map[int64]*progResponse{
+		0: {KnownCommands: []string{"get", "put"}},
+		1: {ID: 1, Miss: true},
+		2: {ID: 2, Miss: true},
+		3: {ID: 3, Err: "get 03: get failed"},
+		4: {ID: 4, DiskPath: "recovered"},
+		5: {ID: 5, Err: "put 02: store: object too large"},
+	}, allowUnexported); diff != "" {
+		t.Errorf("Responses (-got, +want):\n%s", diff)
+	}
+
+	if got, want := s.getMissReasons.String(), `{"corrupt": 1, "unavailable": 1}`; got != want {
+		t.Errorf("Miss reasons: got %s, want %s", got, want)
+	}
+	if got := s.putTooLarge.Value(); got != 1 {
+		t.Errorf("Put too large: got %d, want 1", got)
+	}
+}
+
+// testCache is a [Cache] that stores nothing, and records calls to Close.
+type testCache struct{ closed atomic.Int32 }
+
+func (*testCache) Get(context.Context, string) (string, string, error) { return "", "", nil }
+
+func (*testCache) Put(context.Context, Object) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (c *testCache) Close(context.Context) error { c.closed.Add(1); return nil }
+
+func TestSetCache(t *testing.T) {
+	var c testCache
+	var s Server
+	s.SetCache(&c)
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"close"}
+`)
+	var out bytes.Buffer
+	if err := s.Run(context.Background(), in, &out); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), `"KnownCommands":["get","put","close"]`) {
+		t.Errorf("Server did not advertise all commands:\n%s", out.String())
+	}
+	if n := c.closed.Load(); n != 1 {
+		t.Errorf("Close called %d times, want 1", n)
+	}
+
+	// CloseBackend calls Close if it is defined, and otherwise does nothing.
+	if err := CloseBackend(context.Background(), &c); err != nil || c.closed.Load() != 2 {
+		t.Errorf("CloseBackend: got %v, %d calls; want nil, 2 calls", err, c.closed.Load())
+	}
+	if err := CloseBackend(context.Background(), struct{}{}); err != nil {
+		t.Errorf("CloseBackend: got %v, want nil", err)
+	}
+}
+
+// countCache is a [Cache] interceptor that counts the calls to each method.
+type countCache struct {
+	Cache
+	gets, puts, closes atomic.Int32
+}
+
+func (c *countCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	c.gets.Add(1)
+	return c.Cache.Get(ctx, actionID)
+}
+
+func (c *countCache) Put(ctx context.Context, obj Object) (string, error) {
+	c.puts.Add(1)
+	return c.Cache.Put(ctx, obj)
+}
+
+func (c *countCache) Close(ctx context.Context) error {
+	c.closes.Add(1)
+	return c.Cache.Close(ctx)
+}
+
+func TestNewServer(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		var base testCache
+		var outer, inner countCache
+		var wire bytes.Buffer
+		s, err := NewServer(
+			WithCache(&base),
+			WithInterceptor(func(c Cache) Cache { inner.Cache = c; return &inner }),
+			WithInterceptor(func(c Cache) Cache { outer.Cache = c; return &outer }),
+			WithMaxRequests(1),
+			WithMaxBodySize(100, true),
+			WithErrorsAreMisses("put", "put"),
+			WithDumpWire(&wire),
+		)
+		if err != nil {
+			t.Fatalf("NewServer: unexpected error: %v", err)
+		}
+		if s.MaxRequests != 1 || s.MaxBodySize != 100 || !s.DropOversize {
+			t.Errorf("NewServer: settings not applied: %+v", s)
+		}
+		if diff := gocmp.Diff(s.ErrorsAreMisses, []string{"put"}); diff != "" {
+			t.Errorf("ErrorsAreMisses (-got, +want):\n%s", diff)
+		}
+
+		in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"put","ActionID":"AQ==","OutputID":"q80=","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"close"}
+`)
+		if err := s.Run(context.Background(), in, io.Discard); err != nil {
+			t.Fatalf("Run: unexpected error: %v", err)
+		}
+		for _, c := range []*countCache{&inner, &outer} {
+			if g, p, c := c.gets.Load(), c.puts.Load(), c.closes.Load(); g != 1 || p != 1 || c != 1 {
+				t.Errorf("Interceptor: got %d gets, %d puts, %d closes; want 1 each", g, p, c)
+			}
+		}
+		if base.closed.Load() != 1 {
+			t.Error("Base cache was not closed")
+		}
+		if wire.Len() == 0 {
+			t.Error("Wire dump is empty")
+		}
+	})
+
+	t.Run("NoPut", func(t *testing.T) {
+		// An interceptor does not add commands the server did not have.
+		s, err := NewServer(
+			WithGet(func(context.Context, string) (string, string, error) { return "", "", nil }),
+			WithInterceptor(func(c Cache) Cache { return c }),
+		)
+		if err != nil {
+			t.Fatalf("NewServer: unexpected error: %v", err)
+		}
+		if diff := gocmp.Diff(s.commands(), []string{"get", "close"}); diff != "" {
+			t.Errorf("Commands (-got, +want):\n%s", diff)
+		}
+	})
+
+	getRaw := func(context.Context, []byte) ([]byte, string, error) { return nil, "", nil }
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"Negative", []Option{WithMaxRequests(-1)}, "MaxRequests is negative"},
+		{"HitRate", []Option{WithAlarms(1.5, 0, 0)}, "MinHitRate 1.5"},
+		{"DropOversize", []Option{WithMaxBodySize(0, true)}, "DropOversize is set without MaxBodySize"},
+		{"StrictIDs", []Option{WithStrictIDs(true), WithMaxIDLength(20)}, "MaxIDLength is set with StrictIDs"},
+		{"ErrorsAreMisses", []Option{WithErrorsAreMisses("close")}, `unknown command "close"`},
+		{"FallbackToNull", []Option{WithInit(nil, true)}, "FallbackToNull is set without Init"},
+		{"BothGets", []Option{WithCache(new(testCache)), WithGetRaw(getRaw)}, "Get and GetRaw are both set"},
+		{"RawInterceptor", []Option{
+			WithGetRaw(getRaw), WithInterceptor(func(c Cache) Cache { return c }),
+		}, "cannot be used with GetRaw"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewServer(tc.opts...)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("NewServer: got %v, %v; want error containing %q", s, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDumpWire(t *testing.T) {
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return "", errors.New("put failed")
+		},
+		MaxRequests: 1,
+	}
+	var wire bytes.Buffer
+	s.DumpWire(&wire)
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"put","ActionID":"AQ==","ObjectID":"Ag==","BodySize":5}
+"eHl6enk="
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	// Requests are traced as sent, including fields of older clients, and
+	// bodies are redacted. Requests and responses may interleave.
+	got := strings.Split(strings.TrimSuffix(wire.String(), "\n"), "\n")
+	slices.Sort(got)
+	if diff := gocmp.Diff(got, []string{
+		`< {"ID":0,"KnownCommands":["get","put"]}`,
+		`< {"ID":1,"Miss":true}`,
+		`< {"ID":2,"Err":"put 01: put failed"}`,
+		`> <5-byte body redacted>`,
+		`> {"ID":1,"Command":"get","ActionID":"AQ=="}`,
+		`> {"ID":2,"Command":"put","ActionID":"AQ==","ObjectID":"Ag==","BodySize":5}`,
+	}); diff != "" {
+		t.Errorf("Wire dump (-got, +want):\n%s", diff)
+	}
+	if strings.Contains(wire.String(), "eHl6enk=") {
+		t.Error("Wire dump contains the put body")
+	}
+}
+
+func TestAppendJSON(t *testing.T) {
+	now := time.Date(2024, 8, 15, 12, 30, 45, 123456789, time.UTC)
+	tests := []*progResponse{
+		{},
+		{ID: 0, KnownCommands: []string{"get", "put", "close"}},
+		{ID: 1, Miss: true},
+		{ID: 2, OutputID: []byte("\x01\x02\xfe\xff"), Size: 12345, Time: &now, DiskPath: "/path/to/object"},
+		{ID: 3, DiskPath: "/path/with \"quotes\" and \\backslashes\\"},
+		{ID: 4, Err: "get <a&b>: \n\r\t\x00\x1f failed"},
+		{ID: 5, DiskPath: "C:\\Users\\ünïcödé\\日本\u2028\u2029"},
+		{ID: 6, Err: "invalid \xff\xfe utf-8"},
+		{ID: -7, Size: -1},
+	}
+	for _, rsp := range tests {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(rsp); err != nil {
+			t.Fatalf("Encode %+v: %v", rsp, err)
+		}
+		got := rsp.appendJSON(nil)
+		if bytes.Equal(got, buf.Bytes()) {
+			continue
+		}
+
+		// Encoders may differ in how they escape some strings, but the
+		// results must decode the same way.
+		var gotRsp, wantRsp progResponse
+		if !bytes.HasSuffix(got, []byte("\n")) {
+			t.Errorf("appendJSON: got %q, want a trailing newline", got)
+		} else if err := json.Unmarshal(got, &gotRsp); err != nil {
+			t.Errorf("appendJSON: invalid JSON %q: %v", got, err)
+		} else if err := json.Unmarshal(buf.Bytes(), &wantRsp); err != nil {
+			t.Fatalf("Decode %q: %v", buf.Bytes(), err)
+		} else if diff := gocmp.Diff(gotRsp, wantRsp, allowUnexported); diff != "" {
+			t.Errorf("appendJSON %s (-got, +want):\n%s", got, diff)
+		}
+	}
+}
+
+func BenchmarkResponse(b *testing.B) {
+	now := time.Now()
+	rsp := &progResponse{
+		ID:       12345,
+		OutputID: bytes.Repeat([]byte("\xab"), 32),
+		Size:     4096,
+		Time:     &now,
+		DiskPath: "/home/user/.cache/go-build/ab/abababababababababababababababababababababababababababababababab-d",
+	}
+	b.Run("Encoder", func(b *testing.B) {
+		var mu sync.Mutex
+		w := bufio.NewWriter(io.Discard)
+		enc := json.NewEncoder(w)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				enc.Encode(rsp)
+				w.Flush()
+				mu.Unlock()
+			}
+		})
+	})
+	b.Run("Writer", func(b *testing.B) {
+		rw := newResponseWriter(bufio.NewWriter(io.Discard), nil, runtime.NumCPU())
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rw.send(rsp)
+			}
+		})
+		rw.close()
+	})
+}
+
+func TestActiveRequests(t *testing.T) {
+	unblock := make(chan struct{})
+	gotGet := make(chan struct{})
+	start := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			close(gotGet)
+			<-unblock
+			return "", "", nil
+		},
+		Clock: fixedClock(start),
+	}
+	if got := s.ActiveRequests(); len(got) != 0 {
+		t.Errorf("ActiveRequests before Run: got %+v, want none", got)
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQI="}
+`)
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background(), in, io.Discard) }()
+
+	select {
+	case <-gotGet:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Get was not called")
+	}
+	got := s.ActiveRequests()
+	want := []ActiveRequest{{ID: 1, Command: "get", ActionID: "0102", Start: start}}
+	if diff := gocmp.Diff(got, want); diff != "" {
+		t.Errorf("ActiveRequests (-got, +want):\n%s", diff)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if got := s.ActiveRequests(); len(got) != 0 {
+		t.Errorf("ActiveRequests after Run: got %+v, want none", got)
+	}
+}
+
+func TestFallbackToNull(t *testing.T) {
+	initErr := errors.New("storage is offline")
+	var calls atomic.Int32
+	newServer := func(fallback bool) *Server {
+		return &Server{
+			Init: func(context.Context) error { return initErr },
+			Get: func(context.Context, string) (string, string, error) {
+				calls.Add(1)
+				return "", "", nil
+			},
+			Close: func(context.Context) error {
+				calls.Add(1)
+				return nil
+			},
+			FallbackToNull: fallback,
+		}
+	}
+	const input = `{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"put","ActionID":"AQ==","OutputID":"Ag==","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"close"}
+`
+
+	t.Run("Fail", func(t *testing.T) {
+		var out bytes.Buffer
+		err := newServer(false).Run(context.Background(), strings.NewReader(input), &out)
+		if !errors.Is(err, initErr) {
+			t.Errorf("Run: got %v, want %v", err, initErr)
+		}
+		if out.Len() != 0 {
+			t.Errorf("Run: unexpected output %q", out.String())
+		}
+	})
+
+	t.Run("Null", func(t *testing.T) {
+		var out bytes.Buffer
+		var logs []string
+		s := newServer(true)
+		s.Logf = func(msg string, args ...any) { logs = append(logs, fmt.Sprintf(msg, args...)) }
+		if err := s.Run(context.Background(), strings.NewReader(input), &out); err != nil {
+			t.Fatalf("Run: unexpected error: %v", err)
+		}
+		if n := calls.Load(); n != 0 {
+			t.Errorf("Callbacks: got %d calls, want 0", n)
+		}
+		if !slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, initErr.Error()) }) {
+			t.Errorf("Logs do not report the error: %q", logs)
+		}
+		if got := s.Metrics().Get("server").(*expvar.Map).Get("null_mode").String(); got != "1" {
+			t.Errorf("null_mode: got %s, want 1", got)
+		}
+
+		rsps := make(map[int64]progResponse)
+		dec := json.NewDecoder(&out)
+		for dec.More() {
+			var rsp progResponse
+			if err := dec.Decode(&rsp); err != nil {
+				t.Fatalf("Decode response: %v", err)
+			}
+			rsps[rsp.ID] = rsp
+		}
+		if diff := gocmp.Diff(rsps[0].KnownCommands, []string{"get", "put"}); diff != "" {
+			t.Errorf("Commands (-got, +want):\n%s", diff)
+		}
+		if !rsps[1].Miss {
+			t.Errorf("Get: got %+v, want a miss", rsps[1])
+		}
+		if r := rsps[2]; r.Err != "" || r.DiskPath == "" {
+			t.Errorf("Put: got %+v, want success", r)
+		}
+	})
+}
+
+func TestTags(t *testing.T) {
+	dir := t.TempDir()
+	objPath := filepath.Join(dir, "object")
+	if err := os.WriteFile(objPath, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	s := &Server{
+		Get: func(ctx context.Context, actionID string) (string, string, error) {
+			switch actionID {
+			case "01":
+				return "0a", objPath, nil
+			case "03":
+				SetTag(ctx, "retagged")
+			}
+			return "", "", nil
+		},
+		Put: func(ctx context.Context, obj Object) (string, error) {
+			return objPath, nil
+		},
+		Tag: func(ctx context.Context, obj Object) string {
+			if obj.ActionID == "04" {
+				return "" // not counted
+			} else if obj.Size > 0 {
+				return "big"
+			}
+			return "small"
+		},
+		OnEvent: func(e Event) {
+			if e.End {
+				events = append(events, e.Command+":"+e.Tag)
+			}
+		},
+		MaxRequests: 1,
+	}
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"AQ=="}
+{"ID":2,"Command":"get","ActionID":"Ag=="}
+{"ID":3,"Command":"get","ActionID":"Aw=="}
+{"ID":4,"Command":"get","ActionID":"BA=="}
+{"ID":5,"Command":"put","ActionID":"BQ==","OutputID":"Cg==","BodySize":3}
+"YWJj"
+`)
+	if err := s.Run(context.Background(), in, io.Discard); err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+
+	tags := s.Metrics().Get("server").(*expvar.Map).Get("tags").(*expvar.Map)
+	got := make(map[string]map[string]string)
+	tags.Do(func(kv expvar.KeyValue) {
+		got[kv.Key] = make(map[string]string)
+		kv.Value.(*expvar.Map).Do(func(c expvar.KeyValue) { got[kv.Key][c.Key] = c.Value.String() })
+	})
+	if diff := gocmp.Diff(got, map[string]map[string]string{
+		"small": {
+			"get_requests": "2", "get_hits": "1", "get_hit_bytes": "3", "get_misses": "1",
+		},
+		"retagged": {"get_requests": "1", "get_misses": "1"},
+		"big":      {"put_requests": "1", "put_bytes": "3"},
+	}); diff != "" {
+		t.Errorf("Tag metrics (-got, +want):\n%s", diff)
+	}
+	if diff := gocmp.Diff(events, []string{
+		"get:small", "get:small", "get:retagged", "get:", "put:big",
+	}); diff != "" {
+		t.Errorf("Event tags (-got, +want):\n%s", diff)
+	}
+}
+
+// manualClock is a [Clock] whose time changes only when advanced.
+type manualClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// fixedClock is a [Clock] that always reports the same time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
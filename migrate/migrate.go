@@ -0,0 +1,175 @@
+// Package migrate implements support for moving the contents of a cache from
+// one backend to another without losing cached results.
+//
+// A [Cache] serves results from an old backend, while writing new results to
+// both the old and the new backend. While it runs, it keeps statistics on how
+// many of the results found in the old backend are also present in the new
+// one, so that an operator can tell when it is safe to switch over.
+//
+// There are two ways to fill the new backend with existing results: [Copy]
+// copies results from one backend to another in bulk, and with the Backfill
+// option, a Cache copies each result it reads from the old backend that is
+// missing from the new one. Backfilling lets a cache move to new storage
+// gradually, without a cold-cache cliff.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage used by a [Cache]. It is satisfied
+// by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// If true, a result read from the old backend that is missing from the
+	// new backend is copied to the new backend before it is returned.
+	Backfill bool
+}
+
+func (o *Options) backfill() bool { return o != nil && o.Backfill }
+
+// Cache implements a dual-write cache that migrates from one backend to
+// another. Gets are served from the old backend. Puts are written to the old
+// backend, and then copied to the new one.
+type Cache struct {
+	old, new Backend
+	backfill bool
+
+	oldHits    expvar.Int // gets that hit in the old backend
+	newHits    expvar.Int // ... of which the new backend also has the result
+	newPuts    expvar.Int // puts copied to the new backend
+	backfilled expvar.Int // results backfilled to the new backend
+	newErrors  expvar.Int // errors from the new backend
+}
+
+// New constructs a new Cache that migrates from old to new.
+func New(old, new Backend, opts *Options) *Cache {
+	return &Cache{old: old, new: new, backfill: opts.backfill()}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+// Results are read from the old backend. For each hit, Get also checks
+// whether the new backend has the same result, for the coverage statistics,
+// and if not, backfills it if that option is enabled.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	outputID, diskPath, err := c.old.Get(ctx, actionID)
+	if err != nil || (outputID == "" && diskPath == "") {
+		return outputID, diskPath, err
+	}
+	c.oldHits.Add(1)
+	if newID, _, err := c.new.Get(ctx, actionID); err != nil {
+		c.newErrors.Add(1)
+		gocache.Logf(ctx, "migrate: get %s from new backend: %v", actionID, err)
+	} else if newID == outputID {
+		c.newHits.Add(1)
+	} else if c.backfill {
+		if err := copyResult(ctx, c.new, actionID, outputID, diskPath); err != nil {
+			c.newErrors.Add(1)
+			gocache.Logf(ctx, "migrate: backfill %s: %v", actionID, err)
+		} else {
+			c.backfilled.Add(1)
+		}
+	}
+	return outputID, diskPath, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// The object is written to the old backend, and then copied from there to
+// the new one. Errors writing to the new backend are logged, but are not
+// reported to the caller.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	diskPath, err := c.old.Put(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+	if err := putFile(ctx, c.new, obj, diskPath); err != nil {
+		c.newErrors.Add(1)
+		gocache.Logf(ctx, "migrate: put %s to new backend: %v", obj.ActionID, err)
+	} else {
+		c.newPuts.Add(1)
+	}
+	return diskPath, nil
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes both backends, if they have Close methods.
+func (c *Cache) Close(ctx context.Context) error {
+	return errors.Join(gocache.CloseBackend(ctx, c.old), gocache.CloseBackend(ctx, c.new))
+}
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// Coverage returns the fraction of hits in the old backend whose results are
+// also present in the new backend, or 0 if there have been no hits.
+func (c *Cache) Coverage() float64 {
+	if hits := c.oldHits.Value(); hits > 0 {
+		return float64(c.newHits.Value()) / float64(hits)
+	}
+	return 0
+}
+
+// SetMetrics adds the migration statistics for c to m. It has the signature
+// of the SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("migrate_old_hits", &c.oldHits)
+	m.Set("migrate_new_hits", &c.newHits)
+	m.Set("migrate_new_puts", &c.newPuts)
+	m.Set("migrate_backfilled", &c.backfilled)
+	m.Set("migrate_new_errors", &c.newErrors)
+	m.Set("migrate_coverage", expvar.Func(func() any { return c.Coverage() }))
+}
+
+// Copy copies the result for the specified action from src to dst. It
+// reports whether a result was copied; an action that is not present in src
+// is skipped without error.
+func Copy(ctx context.Context, dst, src Backend, actionID string) (bool, error) {
+	outputID, diskPath, err := src.Get(ctx, actionID)
+	if err != nil {
+		return false, fmt.Errorf("get %s: %w", actionID, err)
+	} else if outputID == "" && diskPath == "" {
+		return false, nil // not present
+	}
+	if err := copyResult(ctx, dst, actionID, outputID, diskPath); err != nil {
+		return false, fmt.Errorf("copy %s: %w", actionID, err)
+	}
+	return true, nil
+}
+
+// copyResult writes the result for an action, whose object is stored in the
+// file at diskPath, to dst.
+func copyResult(ctx context.Context, dst Backend, actionID, outputID, diskPath string) error {
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return err
+	}
+	return putFile(ctx, dst, gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	}, diskPath)
+}
+
+// putFile writes obj to b, with the contents of the file at path as its body.
+func putFile(ctx context.Context, b Backend, obj gocache.Object, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	obj.Body = f
+	_, err = b.Put(ctx, obj)
+	return err
+}
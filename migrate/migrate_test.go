@@ -0,0 +1,108 @@
+package migrate_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/migrate"
+)
+
+func newDir(t *testing.T) *cachedir.Dir {
+	t.Helper()
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	return d
+}
+
+func put(t *testing.T, b migrate.Backend, actionID, outputID, body string) {
+	t.Helper()
+	if _, err := b.Put(context.Background(), gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     int64(len(body)),
+		Body:     strings.NewReader(body),
+	}); err != nil {
+		t.Fatalf("Put %q: unexpected error: %v", actionID, err)
+	}
+}
+
+func checkGet(t *testing.T, b migrate.Backend, actionID, wantOutput, wantBody string) {
+	t.Helper()
+	obj, path, err := b.Get(context.Background(), actionID)
+	if err != nil || obj != wantOutput {
+		t.Fatalf("Get %q: got %q, %v; want %q, nil", actionID, obj, err, wantOutput)
+	}
+	if wantOutput == "" {
+		return
+	}
+	if data, err := os.ReadFile(path); err != nil {
+		t.Errorf("Read object: %v", err)
+	} else if string(data) != wantBody {
+		t.Errorf("Object %q: got %q, want %q", actionID, data, wantBody)
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	oldDir, newDir := newDir(t), newDir(t)
+	put(t, oldDir, "a1b2c3", "0b1ec7", "xyzzy") // already in the old backend
+
+	c := migrate.New(oldDir, newDir, nil)
+	put(t, c, "d4e5f6", "0b1ec8", "plugh") // written to both
+
+	// Gets are served from the old backend.
+	checkGet(t, c, "a1b2c3", "0b1ec7", "xyzzy")
+	checkGet(t, c, "d4e5f6", "0b1ec8", "plugh")
+	checkGet(t, c, "ffffff", "", "")
+
+	// Puts are copied to the new backend.
+	checkGet(t, newDir, "d4e5f6", "0b1ec8", "plugh")
+	checkGet(t, newDir, "a1b2c3", "", "")
+
+	if got := c.Coverage(); got != 0.5 {
+		t.Errorf("Coverage: got %v, want 0.5", got)
+	}
+
+	// Copying the remaining action completes the coverage.
+	if ok, err := migrate.Copy(ctx, newDir, oldDir, "a1b2c3"); err != nil || !ok {
+		t.Fatalf("Copy: got %v, %v; want true, nil", ok, err)
+	}
+	checkGet(t, c, "a1b2c3", "0b1ec7", "xyzzy")
+	if got, want := c.Coverage(), 2.0/3; got != want {
+		t.Errorf("Coverage: got %v, want %v", got, want) // 2 of 3 hits
+	}
+	checkGet(t, newDir, "a1b2c3", "0b1ec7", "xyzzy")
+
+	// Copying a missing action does nothing.
+	if ok, err := migrate.Copy(ctx, newDir, oldDir, "ffffff"); err != nil || ok {
+		t.Errorf("Copy: got %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	oldDir, newDir := newDir(t), newDir(t)
+	put(t, oldDir, "a1b2c3", "0b1ec7", "xyzzy")
+	put(t, oldDir, "d4e5f6", "0b1ec8", "plugh")
+
+	c := migrate.New(oldDir, newDir, &migrate.Options{Backfill: true})
+
+	// Reading a result copies it to the new backend.
+	checkGet(t, newDir, "a1b2c3", "", "")
+	checkGet(t, c, "a1b2c3", "0b1ec7", "xyzzy")
+	checkGet(t, newDir, "a1b2c3", "0b1ec7", "xyzzy")
+
+	// Results that were not read are not copied.
+	checkGet(t, newDir, "d4e5f6", "", "")
+
+	// The second read finds the result in the new backend.
+	checkGet(t, c, "a1b2c3", "0b1ec7", "xyzzy")
+	if got := c.Coverage(); got != 0.5 {
+		t.Errorf("Coverage: got %v, want 0.5", got)
+	}
+}
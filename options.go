@@ -0,0 +1,254 @@
+package gocache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// An Option is a setting for [NewServer].
+type Option func(*config)
+
+// config collects the settings for NewServer.
+type config struct {
+	s    *Server
+	wire io.Writer
+	wrap []func(Cache) Cache
+}
+
+// NewServer returns a new [Server] with the given options. It reports an
+// error if the options are invalid, or if they combine settings that do not
+// make sense together, such as DropOversize without MaxBodySize.
+//
+// A Server may also be constructed directly, as a struct, in which case its
+// settings are not checked.
+func NewServer(opts ...Option) (*Server, error) {
+	cfg := &config{s: new(Server)}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	s := cfg.s
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.wrap) != 0 {
+		if s.GetRaw != nil || s.PutRaw != nil {
+			return nil, errors.New("interceptors cannot be used with GetRaw or PutRaw")
+		}
+		var c Cache = funcCache{get: s.Get, put: s.Put, close: s.Close}
+		for _, wrap := range cfg.wrap {
+			c = wrap(c)
+		}
+		if s.Get != nil {
+			s.Get = c.Get
+		}
+		if s.Put != nil {
+			s.Put = c.Put
+		}
+		s.Close = c.Close
+	}
+	s.DumpWire(cfg.wire)
+	return s, nil
+}
+
+// validate reports an error if the settings of s are invalid.
+func (s *Server) validate() error {
+	var errs []error
+	check := func(ok bool, msg string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(msg, args...))
+		}
+	}
+	check(s.MaxRequests >= 0, "MaxRequests is negative")
+	check(s.MaxGetRequests >= 0, "MaxGetRequests is negative")
+	check(s.MaxPutRequests >= 0, "MaxPutRequests is negative")
+	check(s.MaxPutBytes >= 0, "MaxPutBytes is negative")
+	check(s.RequestTimeout >= 0, "RequestTimeout is negative")
+	check(s.HotCacheSize >= 0, "HotCacheSize is negative")
+	check(s.MaxBodySize >= 0, "MaxBodySize is negative")
+	check(s.MaxRequestSize >= 0, "MaxRequestSize is negative")
+	check(s.MaxIDLength >= 0, "MaxIDLength is negative")
+	check(s.AlarmMinRequests >= 0, "AlarmMinRequests is negative")
+	check(s.MinHitRate >= 0 && s.MinHitRate <= 1, "MinHitRate %v is not between 0 and 1", s.MinHitRate)
+	check(s.MaxErrorRate >= 0 && s.MaxErrorRate <= 1, "MaxErrorRate %v is not between 0 and 1", s.MaxErrorRate)
+
+	check(s.Get == nil || s.GetRaw == nil, "Get and GetRaw are both set")
+	check(s.Put == nil || s.PutRaw == nil, "Put and PutRaw are both set")
+	check(!s.DropOversize || s.MaxBodySize > 0, "DropOversize is set without MaxBodySize")
+	check(!s.StrictIDs || s.MaxIDLength == 0, "MaxIDLength is set with StrictIDs")
+	check(!s.FallbackToNull || s.Init != nil, "FallbackToNull is set without Init")
+	for _, cmd := range s.ErrorsAreMisses {
+		check(cmd == "get" || cmd == "put", "ErrorsAreMisses: unknown command %q", cmd)
+	}
+	return errors.Join(errs...)
+}
+
+// funcCache adapts the callbacks of a [Server] to the [Cache] interface, for
+// use by interceptors. A missing callback behaves as it does in the server.
+type funcCache struct {
+	get   func(context.Context, string) (string, string, error)
+	put   func(context.Context, Object) (string, error)
+	close func(context.Context) error
+}
+
+func (f funcCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	if f.get == nil {
+		return "", "", nil
+	}
+	return f.get(ctx, actionID)
+}
+
+func (f funcCache) Put(ctx context.Context, obj Object) (diskPath string, _ error) {
+	if f.put == nil {
+		return "", ErrReadOnly
+	}
+	return f.put(ctx, obj)
+}
+
+func (f funcCache) Close(ctx context.Context) error {
+	if f.close == nil {
+		return nil
+	}
+	return f.close(ctx)
+}
+
+// WithCache sets the Get, Put, and Close callbacks of the server to the
+// methods of c, as [Server.SetCache].
+func WithCache(c Cache) Option { return func(cfg *config) { cfg.s.SetCache(c) } }
+
+// WithGet sets [Server.Get].
+func WithGet(f func(ctx context.Context, actionID string) (outputID, diskPath string, _ error)) Option {
+	return func(cfg *config) { cfg.s.Get = f }
+}
+
+// WithPut sets [Server.Put].
+func WithPut(f func(ctx context.Context, obj Object) (diskPath string, _ error)) Option {
+	return func(cfg *config) { cfg.s.Put = f }
+}
+
+// WithGetRaw sets [Server.GetRaw].
+func WithGetRaw(f func(ctx context.Context, actionID []byte) (outputID []byte, diskPath string, _ error)) Option {
+	return func(cfg *config) { cfg.s.GetRaw = f }
+}
+
+// WithPutRaw sets [Server.PutRaw].
+func WithPutRaw(f func(ctx context.Context, obj RawObject) (diskPath string, _ error)) Option {
+	return func(cfg *config) { cfg.s.PutRaw = f }
+}
+
+// WithClose sets [Server.Close].
+func WithClose(f func(context.Context) error) Option {
+	return func(cfg *config) { cfg.s.Close = f }
+}
+
+// WithInterceptor adds an interceptor, which wraps the cache formed by the
+// Get, Put, and Close callbacks of the server. Interceptors are applied in
+// order, so each wraps the ones before it. The callbacks of the server are
+// replaced by the methods of the outermost cache. If the server has no Get
+// or Put callback, it still does not advertise the corresponding command,
+// but Close is always set, so that interceptors can clean up.
+//
+// Interceptors cannot be combined with GetRaw or PutRaw.
+func WithInterceptor(wrap func(Cache) Cache) Option {
+	return func(cfg *config) { cfg.wrap = append(cfg.wrap, wrap) }
+}
+
+// WithMetrics sets [Server.SetMetrics].
+func WithMetrics(f func(ctx context.Context, m *expvar.Map)) Option {
+	return func(cfg *config) { cfg.s.SetMetrics = f }
+}
+
+// WithInit sets [Server.Init] and [Server.FallbackToNull].
+func WithInit(f func(context.Context) error, fallbackToNull bool) Option {
+	return func(cfg *config) { cfg.s.Init, cfg.s.FallbackToNull = f, fallbackToNull }
+}
+
+// WithLogFunc sets [Server.Logf].
+func WithLogFunc(f func(string, ...any)) Option { return func(cfg *config) { cfg.s.Logf = f } }
+
+// WithMaxRequests sets [Server.MaxRequests].
+func WithMaxRequests(n int) Option { return func(cfg *config) { cfg.s.MaxRequests = n } }
+
+// WithCommandLimits sets [Server.MaxGetRequests] and [Server.MaxPutRequests].
+func WithCommandLimits(gets, puts int) Option {
+	return func(cfg *config) { cfg.s.MaxGetRequests, cfg.s.MaxPutRequests = gets, puts }
+}
+
+// WithMaxPutBytes sets [Server.MaxPutBytes].
+func WithMaxPutBytes(n int64) Option { return func(cfg *config) { cfg.s.MaxPutBytes = n } }
+
+// WithRequestTimeout sets [Server.RequestTimeout].
+func WithRequestTimeout(d time.Duration) Option {
+	return func(cfg *config) { cfg.s.RequestTimeout = d }
+}
+
+// WithReadOnly sets [Server.ReadOnly].
+func WithReadOnly(ro bool) Option { return func(cfg *config) { cfg.s.ReadOnly = ro } }
+
+// WithHotCache sets [Server.HotCacheSize].
+func WithHotCache(n int) Option { return func(cfg *config) { cfg.s.HotCacheSize = n } }
+
+// WithMaxBodySize sets [Server.MaxBodySize] and [Server.DropOversize].
+func WithMaxBodySize(n int64, drop bool) Option {
+	return func(cfg *config) { cfg.s.MaxBodySize, cfg.s.DropOversize = n, drop }
+}
+
+// WithPolicy sets [Server.Policy].
+func WithPolicy(f func(context.Context, Object) Decision) Option {
+	return func(cfg *config) { cfg.s.Policy = f }
+}
+
+// WithMaxRequestSize sets [Server.MaxRequestSize].
+func WithMaxRequestSize(n int64) Option { return func(cfg *config) { cfg.s.MaxRequestSize = n } }
+
+// WithMaxIDLength sets [Server.MaxIDLength].
+func WithMaxIDLength(n int) Option { return func(cfg *config) { cfg.s.MaxIDLength = n } }
+
+// WithStrictIDs sets [Server.StrictIDs].
+func WithStrictIDs(strict bool) Option { return func(cfg *config) { cfg.s.StrictIDs = strict } }
+
+// WithErrorsAreMisses adds the given commands to [Server.ErrorsAreMisses].
+func WithErrorsAreMisses(cmds ...string) Option {
+	return func(cfg *config) {
+		for _, cmd := range cmds {
+			if !slices.Contains(cfg.s.ErrorsAreMisses, cmd) {
+				cfg.s.ErrorsAreMisses = append(cfg.s.ErrorsAreMisses, cmd)
+			}
+		}
+	}
+}
+
+// WithSummaryLogf sets [Server.SummaryLogf].
+func WithSummaryLogf(f func(string, ...any)) Option {
+	return func(cfg *config) { cfg.s.SummaryLogf = f }
+}
+
+// WithAlarms sets [Server.MinHitRate], [Server.MaxErrorRate], and
+// [Server.AlarmMinRequests].
+func WithAlarms(minHitRate, maxErrorRate float64, minRequests int) Option {
+	return func(cfg *config) {
+		cfg.s.MinHitRate, cfg.s.MaxErrorRate, cfg.s.AlarmMinRequests = minHitRate, maxErrorRate, minRequests
+	}
+}
+
+// WithLogRequests sets [Server.LogRequests].
+func WithLogRequests(log bool) Option { return func(cfg *config) { cfg.s.LogRequests = log } }
+
+// WithOnEvent sets [Server.OnEvent].
+func WithOnEvent(f func(Event)) Option { return func(cfg *config) { cfg.s.OnEvent = f } }
+
+// WithTag sets [Server.Tag].
+func WithTag(f func(context.Context, Object) string) Option {
+	return func(cfg *config) { cfg.s.Tag = f }
+}
+
+// WithClock sets [Server.Clock].
+func WithClock(c Clock) Option { return func(cfg *config) { cfg.s.Clock = c } }
+
+// WithDumpWire enables a trace of protocol messages to w, as
+// [Server.DumpWire].
+func WithDumpWire(w io.Writer) Option { return func(cfg *config) { cfg.wire = w } }
@@ -0,0 +1,279 @@
+// Package record implements recording and replay of the messages exchanged
+// between the Go toolchain and a cache server.
+//
+// A [Recorder] wraps the input and output streams of a cache server, such as
+// [github.com/creachadair/gocache.Server], and writes each message that passes
+// through them to a log. The log is a stream of JSON-encoded [Entry] values,
+// one per line. [Replay] reads a log and regenerates the requests it contains,
+// so that a recorded session can be fed back through a server, for example to
+// reproduce a protocol bug.
+//
+// The bodies of "put" requests may be recorded inline, omitted, or stored in
+// a separate directory in files named by their SHA-256 digest.
+package record
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// An Entry is a single message in a recorded session.
+type Entry struct {
+	Time time.Time `json:"time"`
+
+	// Kind is "request" for a message from the client, or "response" for a
+	// message from the server.
+	Kind string `json:"kind"`
+
+	// Message is the message exactly as it was sent.
+	Message json.RawMessage `json:"message"`
+
+	// For a "put" request with a body, Body is the contents of the body, if
+	// it was recorded inline, and BodyHash is its hex-encoded SHA-256 digest.
+	Body     []byte `json:"body,omitempty"`
+	BodyHash string `json:"bodyHash,omitempty"`
+}
+
+// Options are optional settings for a [Recorder]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// If true, the bodies of put requests are not recorded, only their
+	// digests. A session recorded this way can still be replayed, but with
+	// each body replaced by zeroes.
+	ElideBodies bool
+
+	// If non-empty, the bodies of put requests are written to files in this
+	// directory named by their digests, instead of being recorded inline.
+	BodyDir string
+}
+
+func (o *Options) elideBodies() bool { return o != nil && o.ElideBodies }
+
+func (o *Options) bodyDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.BodyDir
+}
+
+// A Recorder writes a log of the messages in a session. A Recorder is safe
+// for concurrent use by multiple goroutines.
+type Recorder struct {
+	elide   bool
+	bodyDir string
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error // the first error writing the log
+}
+
+// New constructs a Recorder that writes a log to w.
+func New(w io.Writer, opts *Options) *Recorder {
+	return &Recorder{
+		elide:   opts.elideBodies(),
+		bodyDir: opts.bodyDir(),
+		enc:     json.NewEncoder(w),
+	}
+}
+
+// Err reports the first error that occurred while writing the log, if any.
+// Errors writing the log do not interrupt the session.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) log(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+func (r *Recorder) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Input returns a reader that delivers the requests read from in, and
+// records them. The messages are delivered one per line, but are otherwise
+// unmodified.
+func (r *Recorder) Input(in io.Reader) io.Reader {
+	return &input{rec: r, dec: json.NewDecoder(in)}
+}
+
+// Output returns a writer that passes responses through to out, and records
+// them.
+func (r *Recorder) Output(out io.Writer) io.Writer { return &output{rec: r, out: out} }
+
+// requestHeader is the subset of a request needed to find its body.
+type requestHeader struct {
+	Command  string
+	BodySize int64
+}
+
+type input struct {
+	rec *Recorder
+	dec *json.Decoder
+	buf []byte // unread data from the current message
+}
+
+// Read implements the [io.Reader] interface.
+func (in *input) Read(data []byte) (int, error) {
+	if len(in.buf) == 0 {
+		if err := in.next(); err != nil {
+			return 0, err
+		}
+	}
+	nr := copy(data, in.buf)
+	in.buf = in.buf[nr:]
+	return nr, nil
+}
+
+// next reads the next request from the input, and its body if it has one,
+// records it, and buffers it for reading.
+func (in *input) next() error {
+	var msg json.RawMessage
+	if err := in.dec.Decode(&msg); err != nil {
+		return err
+	}
+	e := Entry{Time: time.Now().UTC(), Kind: "request", Message: msg}
+	in.buf = append(append(in.buf[:0], msg...), '\n')
+
+	// A put request with a body is followed by the body as a JSON string.
+	var hdr requestHeader
+	if json.Unmarshal(msg, &hdr) == nil && hdr.Command == "put" && hdr.BodySize > 0 {
+		var raw json.RawMessage
+		if err := in.dec.Decode(&raw); err != nil {
+			return err
+		}
+		in.buf = append(append(in.buf, raw...), '\n')
+
+		var body []byte
+		if err := json.Unmarshal(raw, &body); err != nil {
+			in.rec.setErr(fmt.Errorf("decode body: %w", err))
+		} else {
+			in.rec.addBody(&e, body)
+		}
+	}
+	in.rec.log(e)
+	return nil
+}
+
+// addBody adds body to e as specified by the options for r.
+func (r *Recorder) addBody(e *Entry, body []byte) {
+	sum := sha256.Sum256(body)
+	e.BodyHash = hex.EncodeToString(sum[:])
+	if r.bodyDir != "" {
+		path := filepath.Join(r.bodyDir, e.BodyHash)
+		if _, err := os.Stat(path); err != nil {
+			if err := atomicfile.WriteData(path, body, 0644); err != nil {
+				r.setErr(fmt.Errorf("write body: %w", err))
+			}
+		}
+	} else if !r.elide {
+		e.Body = body
+	}
+}
+
+type output struct {
+	rec *Recorder
+	out io.Writer
+
+	mu  sync.Mutex
+	buf []byte // incomplete message
+}
+
+// Write implements the [io.Writer] interface.
+func (o *output) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	o.buf = append(o.buf, data...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		msg := bytes.TrimSpace(o.buf[:i])
+		if len(msg) != 0 {
+			o.rec.log(Entry{Time: time.Now().UTC(), Kind: "response", Message: bytes.Clone(msg)})
+		}
+		o.buf = o.buf[i+1:]
+	}
+	o.mu.Unlock()
+	return o.out.Write(data)
+}
+
+// Replay reads a log written by a [Recorder] from r, and writes the requests
+// it contains to w in the wire format of the cache protocol. Responses in the
+// log are ignored.
+//
+// If the body of a put request was not recorded inline, Replay reads it from
+// a file in bodyDir named by its digest. If bodyDir is empty, the body is
+// replaced by zeroes of the same length.
+func Replay(w io.Writer, r io.Reader, bodyDir string) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read log: %w", err)
+		}
+		if e.Kind != "request" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", e.Message); err != nil {
+			return err
+		}
+
+		var hdr requestHeader
+		if err := json.Unmarshal(e.Message, &hdr); err != nil {
+			return fmt.Errorf("invalid request: %w", err)
+		} else if hdr.Command != "put" || hdr.BodySize == 0 {
+			continue
+		}
+		body, err := e.body(hdr.BodySize, bodyDir)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+			return err
+		}
+	}
+}
+
+// body returns the body of the put request in e, which has the given size.
+func (e *Entry) body(size int64, bodyDir string) ([]byte, error) {
+	switch {
+	case e.Body != nil:
+		return e.Body, nil
+	case bodyDir != "" && e.BodyHash != "":
+		body, err := os.ReadFile(filepath.Join(bodyDir, e.BodyHash))
+		if err != nil {
+			return nil, fmt.Errorf("read body: %w", err)
+		}
+		return body, nil
+	default:
+		return make([]byte, size), nil
+	}
+}
@@ -0,0 +1,96 @@
+package record_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/record"
+	gocmp "github.com/google/go-cmp/cmp"
+)
+
+// session is a script of requests in the wire format. The put body is the
+// base64 encoding of "xyzzy".
+const session = `{"ID":1,"Command":"get","ActionID":"AQI="}
+{"ID":2,"Command":"put","ActionID":"AQI=","OutputID":"AwQ=","BodySize":5}
+"eHl6enk="
+{"ID":3,"Command":"close"}
+`
+
+func TestRecordReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		elide    bool   // whether to elide bodies
+		useDir   bool   // whether to store bodies in a directory
+		wantBody string // the expected replayed body
+	}{
+		{"Inline", false, false, `"eHl6enk="`},
+		{"Elide", true, false, `"AAAAAAA="`},
+		{"BodyDir", false, true, `"eHl6enk="`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var bodyDir string
+			if tc.useDir {
+				bodyDir = t.TempDir()
+			}
+			var logBuf, out bytes.Buffer
+			rec := record.New(&logBuf, &record.Options{ElideBodies: tc.elide, BodyDir: bodyDir})
+
+			dir := t.TempDir()
+			s := &gocache.Server{
+				Get: func(context.Context, string) (string, string, error) { return "", "", nil },
+				Put: func(_ context.Context, obj gocache.Object) (string, error) {
+					path := filepath.Join(dir, obj.OutputID)
+					f, err := os.Create(path)
+					if err != nil {
+						return "", err
+					}
+					defer f.Close()
+					_, err = f.ReadFrom(obj.Body)
+					return path, err
+				},
+				Close:       func(context.Context) error { return nil },
+				MaxRequests: 1,
+			}
+			if err := s.Run(context.Background(), rec.Input(strings.NewReader(session)), rec.Output(&out)); err != nil {
+				t.Fatalf("Run: unexpected error: %v", err)
+			}
+			if err := rec.Err(); err != nil {
+				t.Fatalf("Recorder: unexpected error: %v", err)
+			}
+
+			// The log should contain the requests and the responses.
+			var kinds []string
+			dec := json.NewDecoder(bytes.NewReader(logBuf.Bytes()))
+			for dec.More() {
+				var e record.Entry
+				if err := dec.Decode(&e); err != nil {
+					t.Fatalf("Decode log: %v", err)
+				}
+				kinds = append(kinds, e.Kind)
+			}
+			if got := strings.Count(strings.Join(kinds, " "), "request"); got != 3 {
+				t.Errorf("Log has %d requests, want 3: %v", got, kinds)
+			}
+			if got := strings.Count(strings.Join(kinds, " "), "response"); got != 4 {
+				t.Errorf("Log has %d responses, want 4: %v", got, kinds)
+			}
+
+			// Replaying the log should reproduce the session.
+			var replay bytes.Buffer
+			if err := record.Replay(&replay, &logBuf, bodyDir); err != nil {
+				t.Fatalf("Replay: unexpected error: %v", err)
+			}
+			want := strings.Replace(session, `"eHl6enk="`, tc.wantBody, 1)
+			if diff := gocmp.Diff(replay.String(), want); diff != "" {
+				t.Errorf("Replay (-got, +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,725 @@
+// Package remote implements an HTTP service that shares a cache backend over
+// the network, and a client that uses the service as a cache backend.
+//
+// A [Server] exports any backend with the gocache Get and Put methods, so that
+// a cache can be centralized behind the usual HTTP infrastructure, such as
+// load balancers and TLS-terminating proxies. A [Client] uses a Server as the
+// second level of a cache, behind a local backend that holds the objects read
+// by the toolchain.
+//
+// # Protocol
+//
+// Each action is a resource at the path /v1/action/{id}, where id is the
+// action ID in lower-case hexadecimal digits:
+//
+//   - GET returns the contents of the object for the action, with the output
+//     ID in the Gocache-Output-Id header. If the action is not cached, the
+//     status is 404 Not Found.
+//
+//   - HEAD returns the same headers as GET, without the contents.
+//
+//   - PUT stores the request body as the object for the action, with the
+//     output ID given by the Gocache-Output-Id header. The request must have
+//     a Content-Length. The status is 204 No Content on success. If the output
+//     ID is a SHA-256 digest (64 hexadecimal digits), as it is for the go
+//     command, it must be the digest of the body, or the status is 400 Bad
+//     Request and nothing is stored.
+//
+// To publish the contents of a cache without sending objects the server
+// already has, a client first posts an index of the cache to /v1/missing:
+//
+//   - POST takes a body of lines of the form "actionID outputID", for up to
+//     10000 actions, and returns the action IDs from the request that the
+//     server does not have with the given output ID, one per line.
+//
+// This package was proposed as a gRPC service. It uses HTTP instead, so that
+// the module does not depend on gRPC and its code generator, and so that the
+// service works with ordinary HTTP proxies and load balancers. The protocol
+// is provisional, and may change incompatibly until the design is settled.
+//
+// # Authentication
+//
+// If the server has a token, each request must carry it in an Authorization
+// header of the form "Bearer <token>"; otherwise the status is 401
+// Unauthorized. Tokens are read from a [TokenSource] for each request, so
+// they can be rotated while clients and servers run.
+//
+// For TLS, including client certificates, serve the [Server] with an
+// [http.Server] whose TLSConfig is set, and give the [Client] an
+// [http.Client] whose transport is configured to match.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// OutputIDHeader is the HTTP header that carries the output ID of an object.
+const OutputIDHeader = "Gocache-Output-Id"
+
+// Backend is the interface to the storage used by a [Server] or [Client]. It
+// is satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// ServerOptions are optional settings for a [Server]. A nil *ServerOptions is
+// ready for use and provides default values as described.
+type ServerOptions struct {
+	// If true, the server rejects PUT requests.
+	ReadOnly bool
+
+	// If set, Token returns the bearer token that requests must carry.
+	// If nil, requests are not authenticated.
+	Token TokenSource
+
+	// If set, Logf is used to log errors, and is passed to the backend via
+	// [gocache.WithLogf]. If nil, nothing is logged.
+	Logf func(string, ...any)
+
+	// If set, OnEvent is called when each GET, HEAD, or PUT request with a
+	// valid action ID ends, with an Event describing it, as for
+	// [gocache.Server.OnEvent]. The Command is "get" for GET and HEAD, and
+	// "put" for PUT. OnEvent may be called concurrently, and must not block.
+	OnEvent func(gocache.Event)
+}
+
+func (o *ServerOptions) readOnly() bool { return o != nil && o.ReadOnly }
+
+func (o *ServerOptions) token() TokenSource {
+	if o == nil {
+		return nil
+	}
+	return o.Token
+}
+
+func (o *ServerOptions) logf() func(string, ...any) {
+	if o == nil || o.Logf == nil {
+		return func(string, ...any) {}
+	}
+	return o.Logf
+}
+
+func (o *ServerOptions) onEvent() func(gocache.Event) {
+	if o == nil {
+		return nil
+	}
+	return o.OnEvent
+}
+
+// Server is an [http.Handler] that serves the contents of a [Backend].
+type Server struct {
+	base     Backend
+	readOnly bool
+	token    TokenSource // if nil, requests are not authenticated
+	logf     func(string, ...any)
+	onEvent  func(gocache.Event) // may be nil
+	mux      *http.ServeMux
+}
+
+// NewServer constructs a new Server that serves the contents of base.
+func NewServer(base Backend, opts *ServerOptions) *Server {
+	s := &Server{
+		base:     base,
+		readOnly: opts.readOnly(),
+		token:    opts.token(),
+		logf:     opts.logf(),
+		onEvent:  opts.onEvent(),
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /v1/action/{id}", s.handleGet) // also HEAD
+	s.mux.HandleFunc("PUT /v1/action/{id}", s.handlePut)
+	s.mux.HandleFunc("POST /v1/missing", s.handleMissing)
+	return s
+}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != nil {
+		want, err := s.token()
+		if err != nil {
+			s.logf("read token: %v", err)
+			http.Error(w, "authentication unavailable", http.StatusInternalServerError)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	actionID := r.PathValue("id")
+	if !isHexID(actionID) {
+		http.Error(w, "invalid action ID", http.StatusBadRequest)
+		return
+	}
+	ev := gocache.Event{End: true, Command: "get", ActionID: actionID}
+	defer s.event(&ev, time.Now())
+
+	ctx := gocache.WithLogf(r.Context(), s.logf)
+	outputID, diskPath, err := s.base.Get(ctx, actionID)
+	if err != nil {
+		s.logf("get %s: %v", actionID, err)
+		ev.Err = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if outputID == "" {
+		ev.Miss = true
+		http.Error(w, "action not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(diskPath)
+	if errors.Is(err, os.ErrNotExist) {
+		ev.Miss = true
+		http.Error(w, "action not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logf("get %s: %v", actionID, err)
+		ev.Err = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		s.logf("get %s: %v", actionID, err)
+		ev.Err = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ev.OutputID, ev.Size, ev.DiskPath = outputID, fi.Size(), diskPath
+	w.Header().Set(OutputIDHeader, outputID)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		s.logf("get %s: send object: %v", actionID, err)
+	}
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	actionID, outputID := r.PathValue("id"), r.Header.Get(OutputIDHeader)
+	if s.readOnly {
+		http.Error(w, "cache is read-only", http.StatusForbidden)
+		return
+	} else if !isHexID(actionID) {
+		http.Error(w, "invalid action ID", http.StatusBadRequest)
+		return
+	} else if !isHexID(outputID) {
+		http.Error(w, "invalid output ID", http.StatusBadRequest)
+		return
+	} else if r.ContentLength < 0 {
+		http.Error(w, "missing content length", http.StatusLengthRequired)
+		return
+	}
+	ev := gocache.Event{End: true, Command: "put", ActionID: actionID, OutputID: outputID, Size: r.ContentLength}
+	defer s.event(&ev, time.Now())
+
+	body := io.Reader(r.Body)
+	var vr *verifyReader
+	if want, err := hex.DecodeString(outputID); err == nil && len(want) == sha256.Size {
+		// The go command uses the digest of the object as its output ID. Check
+		// it, so that a client cannot store other contents under the ID.
+		vr = newVerifyReader(r.Body, want, r.ContentLength)
+		body = vr
+	}
+	ctx := gocache.WithLogf(r.Context(), s.logf)
+	var err error
+	if vr == nil || !vr.mismatch { // an empty body is checked at once
+		ev.DiskPath, err = s.base.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     r.ContentLength,
+			Body:     body,
+		})
+	}
+	if vr != nil && vr.mismatch {
+		s.logf("put %s: %v", actionID, errDigestMismatch)
+		ev.Err, ev.DiskPath = errDigestMismatch, ""
+		http.Error(w, errDigestMismatch.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logf("put %s: %v", actionID, err)
+		ev.Err = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// event reports ev to the OnEvent hook of s, if there is one, with the time
+// elapsed since start.
+func (s *Server) event(ev *gocache.Event, start time.Time) {
+	if s.onEvent != nil {
+		ev.Elapsed = time.Since(start)
+		s.onEvent(*ev)
+	}
+}
+
+// maxMissing is the largest number of actions in a request to /v1/missing.
+const maxMissing = 10000
+
+func (s *Server) handleMissing(w http.ResponseWriter, r *http.Request) {
+	ctx := gocache.WithLogf(r.Context(), s.logf)
+	var missing []string
+	sc := bufio.NewScanner(r.Body)
+	for n := 0; sc.Scan(); n++ {
+		if n == maxMissing {
+			http.Error(w, "too many actions", http.StatusRequestEntityTooLarge)
+			return
+		}
+		actionID, outputID, ok := strings.Cut(sc.Text(), " ")
+		if !ok || !isHexID(actionID) || !isHexID(outputID) {
+			http.Error(w, "invalid index entry", http.StatusBadRequest)
+			return
+		}
+		got, _, err := s.base.Get(ctx, actionID)
+		if err != nil {
+			s.logf("missing %s: %v", actionID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if got != outputID {
+			missing = append(missing, actionID)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, id := range missing {
+		fmt.Fprintln(w, id)
+	}
+}
+
+var errDigestMismatch = errors.New("object does not match its output ID")
+
+// verifyReader is an [io.Reader] that checks that the SHA-256 digest of the
+// data read from it matches an expected value. Once the expected number of
+// bytes has been read, it reports errDigestMismatch with the last of them if
+// the digest does not match, so that the backend does not store the object.
+// The check is made at that point, rather than at EOF, in case the backend
+// reads only the expected number of bytes.
+type verifyReader struct {
+	r        io.Reader
+	h        hash.Hash
+	want     []byte
+	left     int64 // bytes remaining before the check
+	mismatch bool  // the check was made and failed
+}
+
+func newVerifyReader(r io.Reader, want []byte, size int64) *verifyReader {
+	v := &verifyReader{r: r, h: sha256.New(), want: want, left: size}
+	if size == 0 {
+		v.mismatch = !bytes.Equal(v.h.Sum(nil), want)
+	}
+	return v
+}
+
+func (v *verifyReader) Read(data []byte) (int, error) {
+	if v.mismatch {
+		return 0, errDigestMismatch
+	}
+	nr, err := v.r.Read(data)
+	v.h.Write(data[:nr])
+	if v.left > 0 {
+		v.left -= int64(nr)
+		if v.left <= 0 && !bytes.Equal(v.h.Sum(nil), v.want) {
+			v.mismatch = true
+			return nr, errDigestMismatch
+		}
+	}
+	return nr, err
+}
+
+// ClientOptions are optional settings for a [Client]. A nil *ClientOptions is
+// ready for use and provides default values as described.
+type ClientOptions struct {
+	// HTTPClient is the client used to send requests to the server.
+	// If nil, it defaults to [http.DefaultClient].
+	HTTPClient *http.Client
+
+	// If set, Token returns the bearer token to send with each request.
+	Token TokenSource
+
+	// MaxBodySize, if positive, is the maximum size in bytes of an object the
+	// client fetches from the server. Larger objects are reported as errors
+	// without being read.
+	MaxBodySize int64
+
+	// MinHitRate, if positive, is the lowest fraction of fetches from the
+	// server that are expected to hit. Once the client has made MinLookups
+	// fetches, if the fraction that hit is lower, it stops fetching from the
+	// server for the rest of its lifetime, and reports misses instead. Puts
+	// are still sent, so that the server cache is populated. This limits the
+	// cost of a cold server cache to the builds that use it.
+	MinHitRate float64
+
+	// MinLookups is the number of fetches the client must make before
+	// MinHitRate is checked. If zero, it defaults to 100.
+	MinLookups int
+}
+
+func (o *ClientOptions) httpClient() *http.Client {
+	if o == nil || o.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return o.HTTPClient
+}
+
+func (o *ClientOptions) token() TokenSource {
+	if o == nil {
+		return nil
+	}
+	return o.Token
+}
+
+func (o *ClientOptions) maxBodySize() int64 {
+	if o == nil {
+		return 0
+	}
+	return o.MaxBodySize
+}
+
+func (o *ClientOptions) minHitRate() float64 {
+	if o == nil {
+		return 0
+	}
+	return o.MinHitRate
+}
+
+func (o *ClientOptions) minLookups() int64 {
+	if o == nil || o.MinLookups <= 0 {
+		return 100
+	}
+	return int64(o.MinLookups)
+}
+
+// Client is a cache backend that uses a remote [Server] behind a local
+// [Backend].
+//
+// Get reports results from the local backend if it has them. Otherwise, it
+// fetches the result from the server, and stores it in the local backend
+// before reporting it. If the output ID is a SHA-256 digest, the contents
+// from the server must match it, or the result is not stored. See also
+// [ClientOptions.MinHitRate].
+//
+// Put stores each object in the local backend, and then sends it to the
+// server. Once the object is stored locally, the put succeeds. If the server
+// does not accept the object, the error is logged, and counted in the
+// metrics reported by SetMetrics.
+type Client struct {
+	url   string // base URL of the server, without a trailing slash
+	local Backend
+	cli   *http.Client
+	token TokenSource // if nil, requests are not authenticated
+	max   int64       // if positive, the maximum object size to fetch
+
+	minHitRate float64 // if positive, bypass the server below this hit rate
+	minLookups int64   // fetches before minHitRate is checked
+
+	lookups   expvar.Int  // fetches from the server
+	hits      expvar.Int  // ... that hit
+	hitBytes  expvar.Int  // bytes fetched by hits
+	bypassed  atomic.Bool // whether fetches from the server have stopped
+	putErrors expvar.Int  // puts not accepted by the server
+}
+
+// NewClient constructs a new Client that uses the server at the given base
+// URL, with results stored locally in local.
+func NewClient(url string, local Backend, opts *ClientOptions) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(url, "/"),
+		local: local,
+		cli:   opts.httpClient(),
+		token: opts.token(),
+		max:   opts.maxBodySize(),
+
+		minHitRate: opts.minHitRate(),
+		minLookups: opts.minLookups(),
+	}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+func (c *Client) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	outputID, diskPath, err := c.local.Get(ctx, actionID)
+	if err != nil || outputID != "" {
+		return outputID, diskPath, err
+	} else if c.bypassed.Load() {
+		return "", "", nil
+	}
+	rsp, err := c.send(ctx, http.MethodGet, actionID, "", nil, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer rsp.Body.Close()
+	hit := rsp.StatusCode != http.StatusNotFound
+	c.checkHitRate(ctx, hit)
+	if !hit {
+		return "", "", nil // cache miss
+	}
+	outputID, err = checkResponse(rsp)
+	if err != nil {
+		return "", "", fmt.Errorf("get %s: %w", actionID, err)
+	} else if c.max > 0 && rsp.ContentLength > c.max {
+		return "", "", fmt.Errorf("get %s: object size %d exceeds the limit of %d",
+			actionID, rsp.ContentLength, c.max)
+	}
+	body := io.Reader(rsp.Body)
+	var vr *verifyReader
+	if want, err := hex.DecodeString(outputID); err == nil && len(want) == sha256.Size {
+		// Check the contents before they are stored, so that the server cannot
+		// put other contents into the local cache under the ID.
+		vr = newVerifyReader(rsp.Body, want, rsp.ContentLength)
+		body = vr
+	}
+	if vr == nil || !vr.mismatch { // an empty body is checked at once
+		diskPath, err = c.local.Put(ctx, gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     rsp.ContentLength,
+			Body:     body,
+		})
+	}
+	if vr != nil && vr.mismatch {
+		return "", "", fmt.Errorf("get %s: %w", actionID, errDigestMismatch)
+	} else if err != nil {
+		return "", "", fmt.Errorf("get %s: store locally: %w", actionID, err)
+	}
+	c.hitBytes.Add(rsp.ContentLength)
+	return outputID, diskPath, nil
+}
+
+// checkHitRate records the result of a fetch from the server, and stops
+// further fetches if the hit rate is too low.
+func (c *Client) checkHitRate(ctx context.Context, hit bool) {
+	if hit {
+		c.hits.Add(1)
+	}
+	c.lookups.Add(1)
+	n := c.lookups.Value()
+	if c.minHitRate <= 0 || n < c.minLookups {
+		return
+	}
+	rate := float64(c.hits.Value()) / float64(n)
+	if rate < c.minHitRate && c.bypassed.CompareAndSwap(false, true) {
+		gocache.Logf(ctx, "remote: hit rate %.1f%% is below %.1f%% after %d lookups; "+
+			"not fetching from the server for the rest of the session", 100*rate, 100*c.minHitRate, n)
+	}
+}
+
+// Stat reports the output ID and size of the object for actionID on the
+// server, without fetching its contents. If the server does not have the
+// action, Stat returns "", 0, nil.
+func (c *Client) Stat(ctx context.Context, actionID string) (outputID string, size int64, _ error) {
+	rsp, err := c.send(ctx, http.MethodHead, actionID, "", nil, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return "", 0, nil
+	}
+	outputID, err = checkResponse(rsp)
+	if err != nil {
+		return "", 0, fmt.Errorf("stat %s: %w", actionID, err)
+	}
+	return outputID, rsp.ContentLength, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Client) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	diskPath, err := c.local.Put(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+	if err := c.putRemote(ctx, obj, diskPath); err != nil {
+		c.putErrors.Add(1)
+		gocache.Logf(ctx, "remote: %v (stored locally)", err)
+	}
+	return diskPath, nil
+}
+
+// putRemote sends obj to the server, with the contents of the file at path
+// as its body.
+func (c *Client) putRemote(ctx context.Context, obj gocache.Object, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", obj.ActionID, err)
+	}
+	defer f.Close()
+	obj.Body = f
+	return c.Upload(ctx, obj)
+}
+
+// Upload sends obj to the server, without storing it in the local backend.
+func (c *Client) Upload(ctx context.Context, obj gocache.Object) error {
+	rsp, err := c.send(ctx, http.MethodPut, obj.ActionID, obj.OutputID, obj.Body, obj.Size)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", obj.ActionID, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("put %s: %w", obj.ActionID, statusError(rsp))
+	}
+	return nil
+}
+
+// Missing reports which of the given actions the server does not have. The
+// keys of index are action IDs, and the values are their output IDs. An
+// action is missing if the server does not have it with the same output ID.
+// The index is sent in batches, so it may be of any size. The result is in
+// order by action ID.
+func (c *Client) Missing(ctx context.Context, index map[string]string) ([]string, error) {
+	var missing []string
+	for batch := range slices.Chunk(slices.Sorted(maps.Keys(index)), maxMissing) {
+		var buf bytes.Buffer
+		for _, id := range batch {
+			fmt.Fprintf(&buf, "%s %s\n", id, index[id])
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/v1/missing", &buf)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if rsp.StatusCode != http.StatusOK {
+			err := statusError(rsp)
+			rsp.Body.Close()
+			return nil, fmt.Errorf("missing: %w", err)
+		}
+		sc := bufio.NewScanner(rsp.Body)
+		for sc.Scan() {
+			missing = append(missing, sc.Text())
+		}
+		rsp.Body.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("missing: %w", err)
+		}
+	}
+	return missing, nil
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the local backend, if it has a Close method.
+func (c *Client) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.local) }
+
+var _ gocache.Cache = (*Client)(nil)
+
+// SetMetrics adds the client statistics for c to m. It has the signature of
+// the SetMetrics field of a [gocache.Server].
+func (c *Client) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("remote_lookups", &c.lookups)
+	m.Set("remote_hits", &c.hits)
+	m.Set("remote_hit_bytes", &c.hitBytes)
+	m.Set("remote_bypassed", expvar.Func(func() any { return c.bypassed.Load() }))
+	m.Set("remote_put_errors", &c.putErrors)
+}
+
+// send sends a request for actionID to the server. If body is not nil, it is
+// sent as the request body with the given output ID and size.
+func (c *Client) send(ctx context.Context, method, actionID, outputID string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+"/v1/action/"+actionID, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set(OutputIDHeader, outputID)
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	return c.do(req)
+}
+
+// do sends req to the server, with the token of c, if it has one.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.token != nil {
+		tok, err := c.token()
+		if err != nil {
+			return nil, fmt.Errorf("read token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	rsp, err := c.cli.Do(req)
+	if err != nil && req.Context().Err() == nil {
+		return nil, fmt.Errorf("%w: %w", gocache.ErrBackendUnavailable, err)
+	}
+	return rsp, err
+}
+
+// checkResponse checks that rsp is a successful response for an object, and
+// returns its output ID.
+func checkResponse(rsp *http.Response) (string, error) {
+	if rsp.StatusCode != http.StatusOK {
+		return "", statusError(rsp)
+	}
+	outputID := rsp.Header.Get(OutputIDHeader)
+	if !isHexID(outputID) {
+		return "", fmt.Errorf("invalid output ID %q", outputID)
+	} else if rsp.ContentLength < 0 {
+		return "", errors.New("missing content length")
+	}
+	return outputID, nil
+}
+
+// statusError returns an error describing the unsuccessful response rsp. If
+// the status means the server is unable to handle requests for now, the error
+// wraps [gocache.ErrBackendUnavailable].
+func statusError(rsp *http.Response) error {
+	var err error
+	msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+	if s := strings.TrimSpace(string(msg)); s != "" {
+		err = fmt.Errorf("server: %s (%s)", rsp.Status, s)
+	} else {
+		err = fmt.Errorf("server: %s", rsp.Status)
+	}
+	switch rsp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("%w: %w", gocache.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// isHexID reports whether id is a valid lower-case hexadecimal ID.
+func isHexID(id string) bool {
+	if id == "" || len(id)%2 != 0 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
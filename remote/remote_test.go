@@ -0,0 +1,507 @@
+package remote_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/gocache/remote"
+)
+
+func newDir(t *testing.T) *cachedir.Dir {
+	t.Helper()
+	d, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	return d
+}
+
+func TestClientServer(t *testing.T) {
+	ctx := context.Background()
+	shared, local1, local2 := newDir(t), newDir(t), newDir(t)
+	hs := httptest.NewServer(remote.NewServer(shared, nil))
+	defer hs.Close()
+
+	c1 := remote.NewClient(hs.URL, local1, nil)
+	c2 := remote.NewClient(hs.URL+"/", local2, nil)
+
+	// Initially, nothing is cached.
+	if oid, _, err := c1.Get(ctx, "a1b2c3"); err != nil || oid != "" {
+		t.Errorf("Get: got %q, %v; want miss", oid, err)
+	}
+	if oid, _, err := c1.Stat(ctx, "a1b2c3"); err != nil || oid != "" {
+		t.Errorf("Stat: got %q, %v; want miss", oid, err)
+	}
+
+	// A put through one client is visible to the server and other clients.
+	path, err := c1.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "xyzzy" {
+		t.Errorf("Put object: got %q, %v; want xyzzy", data, err)
+	}
+	if oid, _, err := shared.Get(ctx, "a1b2c3"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Server Get: got %q, %v; want 0b1ec7", oid, err)
+	}
+	if oid, size, err := c2.Stat(ctx, "a1b2c3"); err != nil || oid != "0b1ec7" || size != 5 {
+		t.Errorf("Stat: got %q, %d, %v; want 0b1ec7, 5, nil", oid, size, err)
+	}
+	oid, path, err := c2.Get(ctx, "a1b2c3")
+	if err != nil || oid != "0b1ec7" {
+		t.Fatalf("Get: got %q, %v; want 0b1ec7", oid, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "xyzzy" {
+		t.Errorf("Get object: got %q, %v; want xyzzy", data, err)
+	}
+
+	// Once fetched, the result is served locally.
+	hs.Close()
+	if oid, _, err := c2.Get(ctx, "a1b2c3"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Get (local): got %q, %v; want 0b1ec7", oid, err)
+	}
+	if _, _, err := c2.Get(ctx, "d4e5f6"); err == nil {
+		t.Error("Get with server down: got nil, want error")
+	}
+
+	// A put succeeds once the object is stored locally, even if the server
+	// does not accept it.
+	if _, err := c2.Put(ctx, gocache.Object{
+		ActionID: "d4e5f6",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Errorf("Put with server down: unexpected error: %v", err)
+	}
+	if oid, _, err := local2.Get(ctx, "d4e5f6"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Local get: got %q, %v; want 0b1ec7", oid, err)
+	}
+	m := new(expvar.Map)
+	c2.SetMetrics(ctx, m)
+	if got := m.Get("remote_put_errors").String(); got != "1" {
+		t.Errorf("remote_put_errors: got %s, want 1", got)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	dir := newDir(t)
+	hs := httptest.NewServer(remote.NewServer(dir, &remote.ServerOptions{ReadOnly: true}))
+	defer hs.Close()
+
+	do := func(method, path, outputID, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if outputID != "" {
+			req.Header.Set(remote.OutputIDHeader, outputID)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	tests := []struct {
+		method, path, outputID string
+		want                   int
+	}{
+		{"GET", "/v1/action/A1B2", "", http.StatusBadRequest},
+		{"GET", "/v1/action/a1b", "", http.StatusBadRequest},
+		{"GET", "/v1/action/a1b2", "", http.StatusNotFound},
+		{"HEAD", "/v1/action/a1b2", "", http.StatusNotFound},
+		{"PUT", "/v1/action/a1b2", "0b1e", http.StatusForbidden},
+		{"POST", "/v1/action/a1b2", "", http.StatusMethodNotAllowed},
+		{"POST", "/v1/missing", "", http.StatusBadRequest}, // body is not an index
+		{"GET", "/v2/action/a1b2", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if got := do(tc.method, tc.path, tc.outputID, "xyzzy"); got != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestPutDigest(t *testing.T) {
+	ctx := context.Background()
+	dir := newDir(t)
+	hs := httptest.NewServer(remote.NewServer(dir, nil))
+	defer hs.Close()
+
+	digest := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	put := func(actionID, outputID, body string) int {
+		t.Helper()
+		req, err := http.NewRequest("PUT", hs.URL+"/v1/action/"+actionID, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set(remote.OutputIDHeader, outputID)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s: %v", actionID, err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	tests := []struct {
+		actionID, outputID, body string
+		want                     int
+	}{
+		{"a1", digest("xyzzy"), "xyzzy", http.StatusNoContent},
+		{"a2", digest("plugh"), "xyzzy", http.StatusBadRequest},
+		{"a3", digest(""), "", http.StatusNoContent},
+		{"a4", digest("xyzzy"), "", http.StatusBadRequest},
+		{"a5", "0b1ec7", "xyzzy", http.StatusNoContent}, // not a digest
+	}
+	for _, tc := range tests {
+		if got := put(tc.actionID, tc.outputID, tc.body); got != tc.want {
+			t.Errorf("PUT %s: got status %d, want %d", tc.actionID, got, tc.want)
+		}
+		oid, _, err := dir.Get(ctx, tc.actionID)
+		if err != nil {
+			t.Fatalf("Get %s: unexpected error: %v", tc.actionID, err)
+		}
+		if stored := oid != ""; stored != (tc.want == http.StatusNoContent) {
+			t.Errorf("Get %s: got output ID %q, stored is %v", tc.actionID, oid, stored)
+		}
+	}
+}
+
+func TestClientVerify(t *testing.T) {
+	ctx := context.Background()
+	digest := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	// The server reports the output ID and contents given by the action ID,
+	// whether or not they match.
+	objects := map[string][2]string{
+		"a1": {digest("xyzzy"), "xyzzy"},
+		"a2": {digest("plugh"), "xyzzy"},
+		"a3": {digest(""), ""},
+		"a4": {digest("xyzzy"), ""},
+		"a5": {"0b1ec7", "xyzzy"}, // not a digest
+		"a6": {digest("too long"), "too long"},
+	}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj, ok := objects[strings.TrimPrefix(r.URL.Path, "/v1/action/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(remote.OutputIDHeader, obj[0])
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj[1])))
+		io.WriteString(w, obj[1])
+	}))
+	defer hs.Close()
+
+	local := newDir(t)
+	c := remote.NewClient(hs.URL, local, &remote.ClientOptions{MaxBodySize: 5})
+	tests := []struct {
+		actionID string
+		ok       bool
+	}{
+		{"a1", true},
+		{"a2", false},
+		{"a3", true},
+		{"a4", false},
+		{"a5", true},
+		{"a6", false},
+	}
+	for _, tc := range tests {
+		oid, _, err := c.Get(ctx, tc.actionID)
+		if got := err == nil; got != tc.ok {
+			t.Errorf("Get %s: got %q, %v; want ok=%v", tc.actionID, oid, err, tc.ok)
+		}
+		lid, _, err := local.Get(ctx, tc.actionID)
+		if err != nil {
+			t.Fatalf("Local get %s: unexpected error: %v", tc.actionID, err)
+		}
+		if stored := lid != ""; stored != tc.ok {
+			t.Errorf("Local get %s: got output ID %q, stored is %v", tc.actionID, lid, stored)
+		}
+	}
+}
+
+func TestClientBypass(t *testing.T) {
+	ctx := context.Background()
+	dir := newDir(t)
+	var mu sync.Mutex
+	var gets int
+	hs := httptest.NewServer(remote.NewServer(dir, &remote.ServerOptions{
+		OnEvent: func(e gocache.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			if e.Command == "get" {
+				gets++
+			}
+		},
+	}))
+	defer hs.Close()
+	numGets := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets
+	}
+
+	local := newDir(t)
+	c := remote.NewClient(hs.URL, local, &remote.ClientOptions{MinHitRate: 0.5, MinLookups: 4})
+
+	// The server has one of the first four actions, so the hit rate is 25%.
+	if _, err := dir.Put(ctx, gocache.Object{
+		ActionID: "a1",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	for _, id := range []string{"a1", "a2", "a3", "a4"} {
+		if _, _, err := c.Get(ctx, id); err != nil {
+			t.Fatalf("Get %s: unexpected error: %v", id, err)
+		}
+	}
+	if n := numGets(); n != 4 {
+		t.Errorf("Server gets: got %d, want 4", n)
+	}
+
+	// Once the client bypasses the server, gets do not reach it.
+	if oid, _, err := c.Get(ctx, "a5"); err != nil || oid != "" {
+		t.Errorf("Get (bypassed): got %q, %v; want miss", oid, err)
+	}
+	if n := numGets(); n != 4 {
+		t.Errorf("Server gets after bypass: got %d, want 4", n)
+	}
+
+	// Results already stored locally are still reported.
+	if oid, _, err := c.Get(ctx, "a1"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Get (local): got %q, %v; want 0b1ec7", oid, err)
+	}
+	m := new(expvar.Map)
+	c.SetMetrics(ctx, m)
+	for name, want := range map[string]string{
+		"remote_lookups":   "4",
+		"remote_hits":      "1",
+		"remote_hit_bytes": "5",
+		"remote_bypassed":  "true",
+	} {
+		if got := m.Get(name).String(); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestMissing(t *testing.T) {
+	ctx := context.Background()
+	dir, local := newDir(t), newDir(t)
+	hs := httptest.NewServer(remote.NewServer(dir, nil))
+	defer hs.Close()
+	c := remote.NewClient(hs.URL, local, nil)
+
+	for _, id := range []string{"a1", "a2"} {
+		if _, err := dir.Put(ctx, gocache.Object{
+			ActionID: id,
+			OutputID: "0b1ec7",
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Fatalf("Put %s: unexpected error: %v", id, err)
+		}
+	}
+
+	// An action is missing if the server does not have it, or has it with a
+	// different output ID.
+	index := map[string]string{"a1": "0b1ec7", "a2": "0b1ec8", "a3": "0b1ec7"}
+	got, err := c.Missing(ctx, index)
+	if err != nil {
+		t.Fatalf("Missing: unexpected error: %v", err)
+	}
+	if want := []string{"a2", "a3"}; !slices.Equal(got, want) {
+		t.Errorf("Missing: got %q, want %q", got, want)
+	}
+
+	// Uploaded objects are stored on the server, but not locally.
+	if err := c.Upload(ctx, gocache.Object{
+		ActionID: "a3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Upload: unexpected error: %v", err)
+	}
+	if oid, _, err := dir.Get(ctx, "a3"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Server get: got %q, %v; want 0b1ec7", oid, err)
+	}
+	if oid, _, err := local.Get(ctx, "a3"); err != nil || oid != "" {
+		t.Errorf("Local get: got %q, %v; want miss", oid, err)
+	}
+	if got, err := c.Missing(ctx, index); err != nil || !slices.Equal(got, []string{"a2"}) {
+		t.Errorf("Missing after upload: got %q, %v; want [a2]", got, err)
+	}
+
+	// Large indexes are sent in batches.
+	big := make(map[string]string)
+	for i := range 25000 {
+		big[fmt.Sprintf("%06x", i)] = "0b1ec7"
+	}
+	if got, err := c.Missing(ctx, big); err != nil || len(got) != len(big) {
+		t.Errorf("Missing (large): got %d, %v; want %d", len(got), err, len(big))
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	ctx := context.Background()
+	dir, local1, local2 := newDir(t), newDir(t), newDir(t)
+	var mu sync.Mutex
+	var events []gocache.Event
+	hs := httptest.NewServer(remote.NewServer(dir, &remote.ServerOptions{
+		OnEvent: func(e gocache.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		},
+	}))
+	defer hs.Close()
+
+	c1 := remote.NewClient(hs.URL, local1, nil)
+	c2 := remote.NewClient(hs.URL, local2, nil)
+	if oid, _, err := c1.Get(ctx, "a1b2c3"); err != nil || oid != "" {
+		t.Errorf("Get: got %q, %v; want miss", oid, err)
+	}
+	if _, err := c1.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if oid, _, err := c2.Get(ctx, "a1b2c3"); err != nil || oid != "0b1ec7" {
+		t.Errorf("Get: got %q, %v; want 0b1ec7", oid, err)
+	}
+
+	// A rejected put is reported with its error.
+	h := sha256.Sum256([]byte("plugh"))
+	req, err := http.NewRequest("PUT", hs.URL+"/v1/action/d4e5f6", strings.NewReader("xyzzy"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set(remote.OutputIDHeader, hex.EncodeToString(h[:]))
+	if rsp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("PUT: %v", err)
+	} else {
+		rsp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	type summary struct {
+		Command, ActionID, OutputID string
+		Size                        int64
+		Miss, Err                   bool
+	}
+	var got []summary
+	for _, e := range events {
+		if !e.End {
+			t.Errorf("Event %+v: End is false", e)
+		}
+		got = append(got, summary{e.Command, e.ActionID, e.OutputID, e.Size, e.Miss, e.Err != nil})
+	}
+	want := []summary{
+		{Command: "get", ActionID: "a1b2c3", Miss: true},
+		{Command: "put", ActionID: "a1b2c3", OutputID: "0b1ec7", Size: 5},
+		{Command: "get", ActionID: "a1b2c3", OutputID: "0b1ec7", Size: 5},
+		{Command: "put", ActionID: "d4e5f6", OutputID: hex.EncodeToString(h[:]), Size: 5, Err: true},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Events:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ctx := context.Background()
+	tokPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokPath, []byte("secret1\n"), 0600); err != nil {
+		t.Fatalf("Write token: %v", err)
+	}
+	dir, local := newDir(t), newDir(t)
+	hs := httptest.NewTLSServer(remote.NewServer(dir, &remote.ServerOptions{
+		Token: remote.StaticToken("secret1"),
+	}))
+	defer hs.Close()
+
+	// Requests without the right token are rejected.
+	anon := remote.NewClient(hs.URL, local, &remote.ClientOptions{HTTPClient: hs.Client()})
+	if _, _, err := anon.Stat(ctx, "a1b2c3"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Stat (no token): got %v, want 401 error", err)
+	}
+	wrong := remote.NewClient(hs.URL, local, &remote.ClientOptions{
+		HTTPClient: hs.Client(),
+		Token:      remote.StaticToken("secret2"),
+	})
+	if _, _, err := wrong.Stat(ctx, "a1b2c3"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Stat (wrong token): got %v, want 401 error", err)
+	}
+
+	// Requests with the right token are accepted.
+	src := remote.TokenFromFile(tokPath)
+	c := remote.NewClient(hs.URL, local, &remote.ClientOptions{HTTPClient: hs.Client(), Token: src})
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Errorf("Put: unexpected error: %v", err)
+	}
+
+	// A token file that changes is read again.
+	if err := os.WriteFile(tokPath, []byte("secret22\n"), 0600); err != nil {
+		t.Fatalf("Write token: %v", err)
+	}
+	if tok, err := src(); err != nil || tok != "secret22" {
+		t.Errorf("Token: got %q, %v; want secret22", tok, err)
+	}
+}
+
+func TestParseTokenSource(t *testing.T) {
+	t.Setenv("TEST_REMOTE_TOKEN", " xyzzy ")
+	src, err := remote.ParseTokenSource("env:TEST_REMOTE_TOKEN")
+	if err != nil {
+		t.Fatalf("ParseTokenSource: unexpected error: %v", err)
+	}
+	if tok, err := src(); err != nil || tok != "xyzzy" {
+		t.Errorf("Token: got %q, %v; want xyzzy", tok, err)
+	}
+	for _, bad := range []string{"", "env", "env:", "xyz:abc", "/path/to/token"} {
+		if _, err := remote.ParseTokenSource(bad); err == nil {
+			t.Errorf("ParseTokenSource(%q): got nil, want error", bad)
+		}
+	}
+}
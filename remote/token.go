@@ -0,0 +1,81 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TokenSource returns the current bearer token used to authenticate
+// requests. It is called for each request, so a source can pick up a token
+// that has been rotated without restarting the client or server.
+type TokenSource func() (string, error)
+
+// StaticToken returns a TokenSource that always returns tok.
+func StaticToken(tok string) TokenSource {
+	return func() (string, error) { return tok, nil }
+}
+
+// TokenFromEnv returns a TokenSource that reads the token from the named
+// environment variable. It reports an error if the variable is unset or
+// empty.
+func TokenFromEnv(name string) TokenSource {
+	return func() (string, error) {
+		tok := strings.TrimSpace(os.Getenv(name))
+		if tok == "" {
+			return "", fmt.Errorf("no token found in $%s", name)
+		}
+		return tok, nil
+	}
+}
+
+// TokenFromFile returns a TokenSource that reads the token from the specified
+// file. Leading and trailing whitespace is removed. The file is read again
+// when its size or modification time changes, so that a token refreshed by
+// another process is used. It reports an error if the file is empty.
+func TokenFromFile(path string) TokenSource {
+	var mu sync.Mutex
+	var tok string
+	var size int64
+	var mtime time.Time
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		} else if tok != "" && fi.Size() == size && fi.ModTime().Equal(mtime) {
+			return tok, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			return "", fmt.Errorf("no token found in %q", path)
+		}
+		tok, size, mtime = string(data), fi.Size(), fi.ModTime()
+		return tok, nil
+	}
+}
+
+// ParseTokenSource parses a token source specification of the form
+// "env:NAME", for [TokenFromEnv], or "file:PATH", for [TokenFromFile].
+func ParseTokenSource(spec string) (TokenSource, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	switch {
+	case !ok || arg == "":
+		return nil, errors.New("token source must be env:NAME or file:PATH")
+	case kind == "env":
+		return TokenFromEnv(arg), nil
+	case kind == "file":
+		return TokenFromFile(arg), nil
+	default:
+		return nil, fmt.Errorf("unknown token source %q", kind)
+	}
+}
@@ -0,0 +1,160 @@
+// Package retry implements a wrapper for a cache backend that retries
+// operations that fail with transient errors.
+//
+// A [Cache] retries a failed Get or Put up to a fixed number of attempts,
+// waiting between attempts with jittered exponential backoff. This keeps
+// brief outages of a backend, such as a network blip, from being reported to
+// the toolchain as errors.
+//
+// A Put is retried only if the body of the object implements [io.Seeker], so
+// that it can be re-read. The bodies passed by [gocache.Server] do.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// MaxAttempts is the maximum number of times to attempt each operation,
+	// including the first. If zero, it defaults to 3.
+	MaxAttempts int
+
+	// BaseDelay is the nominal delay before the first retry. Each later retry
+	// waits twice as long as the one before, up to MaxDelay. Each delay is
+	// chosen at random between half and all of its nominal value.
+	// If zero, it defaults to 100ms.
+	BaseDelay time.Duration
+
+	// MaxDelay is the maximum nominal delay between attempts.
+	// If zero, it defaults to 5s.
+	MaxDelay time.Duration
+
+	// Retryable reports whether an operation that failed with err should be
+	// retried. If nil, all errors are retried except those indicating that
+	// the context for the operation has ended.
+	Retryable func(err error) bool
+}
+
+func (o *Options) maxAttempts() int {
+	if o == nil || o.MaxAttempts <= 0 {
+		return 3
+	}
+	return o.MaxAttempts
+}
+
+func (o *Options) baseDelay() time.Duration {
+	if o == nil || o.BaseDelay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return o.BaseDelay
+}
+
+func (o *Options) maxDelay() time.Duration {
+	if o == nil || o.MaxDelay <= 0 {
+		return 5 * time.Second
+	}
+	return o.MaxDelay
+}
+
+func (o *Options) retryable() func(error) bool {
+	if o == nil || o.Retryable == nil {
+		return isTransient
+	}
+	return o.Retryable
+}
+
+// isTransient is the default error classifier.
+func isTransient(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// Cache implements a retrying wrapper around a [Backend].
+type Cache struct {
+	base      Backend
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	retryable func(error) bool
+}
+
+// New constructs a new Cache that retries failed operations on base.
+func New(base Backend, opts *Options) *Cache {
+	return &Cache{
+		base:      base,
+		attempts:  opts.maxAttempts(),
+		baseDelay: opts.baseDelay(),
+		maxDelay:  opts.maxDelay(),
+		retryable: opts.retryable(),
+	}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	err = c.do(ctx, "get "+actionID, func() (err error) {
+		outputID, diskPath, err = c.base.Get(ctx, actionID)
+		return err
+	})
+	return outputID, diskPath, err
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	body, ok := obj.Body.(io.ReadSeeker)
+	if !ok {
+		return c.base.Put(ctx, obj) // the body cannot be re-read
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return c.base.Put(ctx, obj)
+	}
+	err = c.do(ctx, "put "+obj.ActionID, func() (err error) {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		diskPath, err = c.base.Put(ctx, obj)
+		return err
+	})
+	return diskPath, err
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// do calls f until it succeeds, it fails with an error that is not
+// retryable, the attempts are exhausted, or ctx ends. It returns the error
+// from the last call to f.
+func (c *Cache) do(ctx context.Context, op string, f func() error) error {
+	delay := c.baseDelay
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || i >= c.attempts || !c.retryable(err) {
+			return err
+		}
+		wait := delay/2 + rand.N(delay/2+1)
+		gocache.Logf(ctx, "%s: attempt %d of %d failed: %v (retrying in %v)", op, i, c.attempts, err, wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay = min(2*delay, c.maxDelay)
+	}
+}
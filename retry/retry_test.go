@@ -0,0 +1,131 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/retry"
+)
+
+// flaky is a fake backend whose operations fail until they have been called a
+// given number of times.
+type flaky struct {
+	failures int   // the number of calls to fail
+	err      error // the error to report
+	calls    int
+	bodies   []string // the bodies passed to Put
+}
+
+func (f *flaky) Get(ctx context.Context, actionID string) (string, string, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return "", "", f.err
+	}
+	return "0b1ec7", "/path/to/object", nil
+}
+
+func (f *flaky) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	f.calls++
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", err
+	}
+	f.bodies = append(f.bodies, string(data))
+	if f.calls <= f.failures {
+		return "", f.err
+	}
+	return "/path/to/object", nil
+}
+
+var errFlaky = errors.New("temporary failure")
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	opts := &retry.Options{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	t.Run("GetRecovers", func(t *testing.T) {
+		base := &flaky{failures: 2, err: errFlaky}
+		c := retry.New(base, opts)
+		if obj, _, err := c.Get(ctx, "a1b2c3"); err != nil || obj != "0b1ec7" {
+			t.Errorf("Get: got %q, %v; want 0b1ec7, nil", obj, err)
+		}
+		if base.calls != 3 {
+			t.Errorf("Get made %d calls, want 3", base.calls)
+		}
+	})
+
+	t.Run("GetGivesUp", func(t *testing.T) {
+		base := &flaky{failures: 5, err: errFlaky}
+		c := retry.New(base, opts)
+		if _, _, err := c.Get(ctx, "a1b2c3"); !errors.Is(err, errFlaky) {
+			t.Errorf("Get: got %v, want %v", err, errFlaky)
+		}
+		if base.calls != 3 {
+			t.Errorf("Get made %d calls, want 3", base.calls)
+		}
+	})
+
+	t.Run("NotRetryable", func(t *testing.T) {
+		base := &flaky{failures: 5, err: errFlaky}
+		c := retry.New(base, &retry.Options{
+			BaseDelay: time.Millisecond,
+			Retryable: func(err error) bool { return !errors.Is(err, errFlaky) },
+		})
+		if _, _, err := c.Get(ctx, "a1b2c3"); !errors.Is(err, errFlaky) {
+			t.Errorf("Get: got %v, want %v", err, errFlaky)
+		}
+		if base.calls != 1 {
+			t.Errorf("Get made %d calls, want 1", base.calls)
+		}
+	})
+
+	t.Run("PutRereadsBody", func(t *testing.T) {
+		base := &flaky{failures: 1, err: errFlaky}
+		c := retry.New(base, opts)
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: "a1b2c3",
+			OutputID: "0b1ec7",
+			Size:     5,
+			Body:     strings.NewReader("xyzzy"),
+		}); err != nil {
+			t.Errorf("Put: unexpected error: %v", err)
+		}
+		if len(base.bodies) != 2 || base.bodies[0] != "xyzzy" || base.bodies[1] != "xyzzy" {
+			t.Errorf("Put bodies: got %q, want 2 copies of xyzzy", base.bodies)
+		}
+	})
+
+	t.Run("PutNotSeekable", func(t *testing.T) {
+		base := &flaky{failures: 1, err: errFlaky}
+		c := retry.New(base, opts)
+		if _, err := c.Put(ctx, gocache.Object{
+			ActionID: "a1b2c3",
+			OutputID: "0b1ec7",
+			Size:     5,
+			Body:     io.MultiReader(strings.NewReader("xyzzy")),
+		}); !errors.Is(err, errFlaky) {
+			t.Errorf("Put: got %v, want %v", err, errFlaky)
+		}
+		if base.calls != 1 {
+			t.Errorf("Put made %d calls, want 1", base.calls)
+		}
+	})
+
+	t.Run("ContextEnds", func(t *testing.T) {
+		base := &flaky{failures: 5, err: errFlaky}
+		c := retry.New(base, &retry.Options{MaxAttempts: 5, BaseDelay: time.Hour})
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, _, err := c.Get(cctx, "a1b2c3"); !errors.Is(err, errFlaky) {
+			t.Errorf("Get: got %v, want %v", err, errFlaky)
+		}
+		if base.calls != 1 {
+			t.Errorf("Get made %d calls, want 1", base.calls)
+		}
+	})
+}
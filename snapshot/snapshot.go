@@ -0,0 +1,215 @@
+// Package snapshot defines a streamed format for the contents of a cache, for
+// backups and for moving cache contents from one backend to another.
+//
+// A snapshot is a sequence of lines and object contents. The first line is a
+// JSON header giving the format and version:
+//
+//	{"format":"gocache-snapshot","version":1}
+//
+// Each entry of the snapshot is a JSON [Entry] on a single line, followed
+// immediately by the Size bytes of the object's contents. The contents are
+// not encoded, so a snapshot can be written and read in a single pass without
+// buffering objects in memory.
+//
+// The go command uses the SHA-256 digest of an object as its output ID. When
+// an output ID has the length of a SHA-256 digest, a [Reader] checks the
+// contents of the object against it as they are read.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// Version is the version of the snapshot format written by this package.
+// A [Reader] accepts snapshots with this version or earlier.
+const Version = 1
+
+const formatName = "gocache-snapshot"
+
+// ErrDigestMismatch is reported when reading the contents of an object whose
+// output ID is a SHA-256 digest that the contents do not match.
+var ErrDigestMismatch = errors.New("object does not match its output ID")
+
+// A Snapshotter is a cache backend that can write its contents to a snapshot,
+// and add the contents of a snapshot to itself. It is satisfied by
+// [github.com/creachadair/gocache/cachedir.Dir].
+type Snapshotter interface {
+	// Snapshot writes the contents of the backend to w.
+	Snapshot(w io.Writer) error
+
+	// Restore adds the contents of the snapshot read from r to the backend.
+	Restore(r io.Reader) error
+}
+
+// An Entry describes a single cached action in a snapshot.
+type Entry struct {
+	ActionID string    `json:"actionID"` // lower-case hexadecimal digits
+	OutputID string    `json:"outputID"` // lower-case hexadecimal digits
+	Size     int64     `json:"size"`     // object size in bytes
+	ModTime  time.Time `json:"modTime"`  // when the action was last updated
+}
+
+func (e Entry) check() error {
+	switch {
+	case !isHexID(e.ActionID):
+		return fmt.Errorf("invalid action ID %q", e.ActionID)
+	case !isHexID(e.OutputID):
+		return fmt.Errorf("invalid output ID %q", e.OutputID)
+	case e.Size < 0:
+		return fmt.Errorf("invalid size %d", e.Size)
+	}
+	return nil
+}
+
+// isHexID reports whether id is a valid lower-case hexadecimal ID.
+func isHexID(id string) bool {
+	if id == "" || len(id)%2 != 0 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// A Writer writes a snapshot to an underlying [io.Writer].
+type Writer struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewWriter constructs a Writer that writes a snapshot to w, and writes the
+// snapshot header.
+func NewWriter(w io.Writer) (*Writer, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header{Format: formatName, Version: Version}); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	return &Writer{w: w, enc: enc}, nil
+}
+
+// Add writes an entry to the snapshot, with contents read from body. It
+// reports an error if body has fewer than e.Size bytes.
+func (w *Writer) Add(e Entry, body io.Reader) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	if err := w.enc.Encode(e); err != nil {
+		return fmt.Errorf("write entry: %w", err)
+	}
+	if _, err := io.CopyN(w.w, body, e.Size); err != nil {
+		return fmt.Errorf("write object %s: %w", e.OutputID, err)
+	}
+	return nil
+}
+
+// A Reader reads a snapshot from an underlying [io.Reader].
+type Reader struct {
+	br   *bufio.Reader
+	body *body // the contents of the current entry
+}
+
+// NewReader constructs a Reader that reads a snapshot from r, and checks the
+// snapshot header.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil || h.Format != formatName {
+		return nil, errors.New("not a cache snapshot")
+	} else if h.Version < 1 || h.Version > Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d", h.Version)
+	}
+	return &Reader{br: br}, nil
+}
+
+// Next returns the next entry in the snapshot, and a reader for the contents
+// of its object. The contents must be read before the next call to Next;
+// any contents not read are skipped. At the end of the snapshot, Next returns
+// io.EOF.
+//
+// If the output ID of the entry is a SHA-256 digest, the reader reports
+// [ErrDigestMismatch] at the end of the contents if they do not match it, or
+// Next reports it at once if the object is empty.
+func (r *Reader) Next() (Entry, io.Reader, error) {
+	if r.body != nil {
+		r.body.hash = nil // skipped contents are not checked
+		if _, err := io.Copy(io.Discard, r.body); err != nil {
+			return Entry{}, nil, err
+		}
+		r.body = nil
+	}
+	line, err := r.br.ReadBytes('\n')
+	if errors.Is(err, io.EOF) && len(line) == 0 {
+		return Entry{}, nil, io.EOF
+	} else if err != nil {
+		return Entry{}, nil, fmt.Errorf("read entry: %w", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return Entry{}, nil, fmt.Errorf("invalid entry: %w", err)
+	} else if err := e.check(); err != nil {
+		return Entry{}, nil, fmt.Errorf("invalid entry: %w", err)
+	}
+	r.body = &body{r: r.br, left: e.Size}
+	if want, err := hex.DecodeString(e.OutputID); err == nil && len(want) == sha256.Size {
+		r.body.hash, r.body.want = sha256.New(), want
+		if e.Size == 0 && !bytes.Equal(r.body.hash.Sum(nil), want) {
+			// There are no contents to read, so report the mismatch now.
+			return Entry{}, nil, fmt.Errorf("entry %s: %w", e.ActionID, ErrDigestMismatch)
+		}
+	}
+	return e, r.body, nil
+}
+
+// body is an [io.Reader] for the contents of an entry. It reports
+// io.ErrUnexpectedEOF if the snapshot ends before the contents are complete,
+// and ErrDigestMismatch if hash is set and the contents do not match want.
+type body struct {
+	r    io.Reader
+	left int64 // bytes remaining in the contents
+
+	hash hash.Hash // if non-nil, the digest of the contents read so far
+	want []byte    // the expected digest
+}
+
+// Read implements the [io.Reader] interface.
+func (b *body) Read(data []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(data)) > b.left {
+		data = data[:b.left]
+	}
+	nr, err := b.r.Read(data)
+	b.left -= int64(nr)
+	if errors.Is(err, io.EOF) && b.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if b.hash != nil {
+		b.hash.Write(data[:nr])
+		if b.left == 0 && !bytes.Equal(b.hash.Sum(nil), b.want) {
+			return nr, ErrDigestMismatch
+		}
+	}
+	return nr, err
+}
@@ -0,0 +1,139 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache/snapshot"
+	gocmp "github.com/google/go-cmp/cmp"
+)
+
+func TestRoundTrip(t *testing.T) {
+	when := time.Date(2024, 8, 15, 12, 0, 0, 0, time.UTC)
+	entries := []snapshot.Entry{
+		{ActionID: "a1b2c3", OutputID: "0b1ec7", Size: 5, ModTime: when},
+		{ActionID: "d4e5f6", OutputID: "0b1ec8", Size: 0, ModTime: when},
+		{ActionID: "ffff", OutputID: "0b1ec9", Size: 6, ModTime: when},
+	}
+	bodies := []string{"xyzzy", "", "plughs"}
+
+	var buf bytes.Buffer
+	w, err := snapshot.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("NewWriter: unexpected error: %v", err)
+	}
+	for i, e := range entries {
+		if err := w.Add(e, strings.NewReader(bodies[i])); err != nil {
+			t.Fatalf("Add %q: unexpected error: %v", e.ActionID, err)
+		}
+	}
+
+	r, err := snapshot.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader: unexpected error: %v", err)
+	}
+	var got []snapshot.Entry
+	var gotBodies []string
+	for i := 0; ; i++ {
+		e, body, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		}
+		got = append(got, e)
+		if i == 0 {
+			continue // leave the body unread; Next should skip it
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("Read body: unexpected error: %v", err)
+		}
+		gotBodies = append(gotBodies, string(data))
+	}
+	if diff := gocmp.Diff(got, entries); diff != "" {
+		t.Errorf("Entries (-got, +want):\n%s", diff)
+	}
+	if diff := gocmp.Diff(gotBodies, bodies[1:]); diff != "" {
+		t.Errorf("Bodies (-got, +want):\n%s", diff)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	const header = `{"format":"gocache-snapshot","version":1}` + "\n"
+
+	t.Run("NotSnapshot", func(t *testing.T) {
+		if _, err := snapshot.NewReader(strings.NewReader("{}\n")); err == nil {
+			t.Error("NewReader: got nil, want error")
+		}
+	})
+	t.Run("FutureVersion", func(t *testing.T) {
+		r := strings.NewReader(`{"format":"gocache-snapshot","version":99}` + "\n")
+		if _, err := snapshot.NewReader(r); err == nil || !strings.Contains(err.Error(), "version 99") {
+			t.Errorf("NewReader: got %v, want version error", err)
+		}
+	})
+	t.Run("InvalidID", func(t *testing.T) {
+		r, err := snapshot.NewReader(strings.NewReader(header +
+			`{"actionID":"../../etc","outputID":"0b1ec7","size":0}` + "\n"))
+		if err != nil {
+			t.Fatalf("NewReader: unexpected error: %v", err)
+		}
+		if _, _, err := r.Next(); err == nil {
+			t.Error("Next: got nil, want error")
+		}
+		if err := new(snapshot.Writer).Add(snapshot.Entry{ActionID: "A1", OutputID: "b2"}, nil); err == nil {
+			t.Error("Add: got nil, want error")
+		}
+	})
+	t.Run("DigestMismatch", func(t *testing.T) {
+		const (
+			good = "184858a00fd7971f810848266ebcecee5e8b69972c5ffaed622f5ee078671aed" // xyzzy
+			bad  = "0000000000000000000000000000000000000000000000000000000000000000"
+		)
+		r, err := snapshot.NewReader(strings.NewReader(header +
+			`{"actionID":"a1","outputID":"` + good + `","size":5}` + "\nxyzzy" +
+			`{"actionID":"a2","outputID":"` + bad + `","size":5}` + "\nxyzzy" +
+			`{"actionID":"a3","outputID":"` + bad + `","size":5}` + "\nxyzzy" +
+			`{"actionID":"a4","outputID":"` + bad + `","size":0}` + "\n"))
+		if err != nil {
+			t.Fatalf("NewReader: unexpected error: %v", err)
+		}
+		next := func() io.Reader {
+			t.Helper()
+			_, body, err := r.Next()
+			if err != nil {
+				t.Fatalf("Next: unexpected error: %v", err)
+			}
+			return body
+		}
+		if data, err := io.ReadAll(next()); err != nil || string(data) != "xyzzy" {
+			t.Errorf("Read a1: got %q, %v; want xyzzy, nil", data, err)
+		}
+		if _, err := io.ReadAll(next()); !errors.Is(err, snapshot.ErrDigestMismatch) {
+			t.Errorf("Read a2: got %v, want %v", err, snapshot.ErrDigestMismatch)
+		}
+		next() // skipped contents are not checked
+		if _, _, err := r.Next(); !errors.Is(err, snapshot.ErrDigestMismatch) {
+			t.Errorf("Next a4: got %v, want %v", err, snapshot.ErrDigestMismatch)
+		}
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		r, err := snapshot.NewReader(strings.NewReader(header +
+			`{"actionID":"a1b2c3","outputID":"0b1ec7","size":10}` + "\nxyz"))
+		if err != nil {
+			t.Fatalf("NewReader: unexpected error: %v", err)
+		}
+		_, body, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: unexpected error: %v", err)
+		}
+		if _, err := io.ReadAll(body); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Read body: got %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+}
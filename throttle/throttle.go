@@ -0,0 +1,224 @@
+// Package throttle implements a wrapper for a cache backend that limits the
+// bandwidth and concurrency of transfers.
+//
+// A [Cache] limits the rate at which object bytes are passed to and from the
+// underlying backend, and the number of gets and puts in progress at once,
+// with separate limits for each. This keeps a build that fills or reads a
+// remote cache from saturating a shared network link.
+//
+// The bytes of a put are limited as the backend reads the body of the object.
+// The wrapper cannot see the bytes of a get while the backend transfers them,
+// so each get is charged for the size of its object when the backend returns,
+// and Get waits until the charge is within the limit before it reports the
+// result. Over time, the rates are the same either way.
+package throttle
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and imposes no limits.
+type Options struct {
+	// GetRate and PutRate are the maximum average number of object bytes per
+	// second read by gets and written by puts. Transfers may burst up to one
+	// second's worth of bytes above the average. If zero, the rate is not
+	// limited.
+	GetRate, PutRate int64
+
+	// MaxGets and MaxPuts are the maximum numbers of gets and puts that may
+	// be in progress at once. If zero, the number is not limited.
+	MaxGets, MaxPuts int
+}
+
+func (o *Options) getRate() int64 {
+	if o == nil {
+		return 0
+	}
+	return o.GetRate
+}
+
+func (o *Options) putRate() int64 {
+	if o == nil {
+		return 0
+	}
+	return o.PutRate
+}
+
+func (o *Options) maxGets() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxGets
+}
+
+func (o *Options) maxPuts() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxPuts
+}
+
+// Cache limits the bandwidth and concurrency of transfers to a [Backend].
+type Cache struct {
+	base Backend
+
+	getRate, putRate *limiter
+	getSem, putSem   chan struct{}
+}
+
+// New constructs a new Cache that limits transfers to base.
+func New(base Backend, opts *Options) *Cache {
+	return &Cache{
+		base:    base,
+		getRate: newLimiter(opts.getRate()),
+		putRate: newLimiter(opts.putRate()),
+		getSem:  newSemaphore(opts.maxGets()),
+		putSem:  newSemaphore(opts.maxPuts()),
+	}
+}
+
+// Get implements the corresponding method of the gocache service interface.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	if err := acquire(ctx, c.getSem); err != nil {
+		return "", "", err
+	}
+	defer release(c.getSem)
+
+	outputID, diskPath, err = c.base.Get(ctx, actionID)
+	if err != nil || outputID == "" || c.getRate == nil {
+		return outputID, diskPath, err
+	}
+	if fi, err := os.Stat(diskPath); err == nil {
+		if err := c.getRate.wait(ctx, fi.Size()); err != nil {
+			return "", "", err
+		}
+	}
+	return outputID, diskPath, nil
+}
+
+// Put implements the corresponding method of the gocache service interface.
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, err error) {
+	if err := acquire(ctx, c.putSem); err != nil {
+		return "", err
+	}
+	defer release(c.putSem)
+
+	if c.putRate != nil {
+		obj.Body = &reader{ctx: ctx, r: obj.Body, lim: c.putRate}
+	}
+	return c.base.Put(ctx, obj)
+}
+
+// Close implements the corresponding method of the gocache service interface.
+// It closes the underlying backend, if it has a Close method.
+func (c *Cache) Close(ctx context.Context) error { return gocache.CloseBackend(ctx, c.base) }
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// newSemaphore returns a semaphore with n slots, or nil if n ≤ 0.
+func newSemaphore(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquire waits for a slot in sem, if sem is not nil.
+func acquire(ctx context.Context, sem chan struct{}) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case sem <- struct{}{}:
+		return nil
+	}
+}
+
+// release returns a slot to sem, if sem is not nil.
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// A limiter limits the average rate of a stream of bytes, allowing bursts of
+// up to one second's worth of bytes.
+type limiter struct {
+	perByte time.Duration // the time allotted to each byte
+
+	mu   sync.Mutex
+	next time.Time // when the bytes charged so far are paid for
+}
+
+// newLimiter returns a limiter for rate bytes per second, or nil if rate ≤ 0.
+func newLimiter(rate int64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{perByte: max(time.Second/time.Duration(rate), 1)}
+}
+
+// wait charges n bytes to l, and waits until the charge is within the limit.
+func (l *limiter) wait(ctx context.Context, n int64) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * l.perByte)
+	delay := l.next.Sub(now) - time.Second
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-t.C:
+		return nil
+	}
+}
+
+// maxChunk is the largest number of bytes a reader returns in one call, so
+// that the limiter is charged in small steps.
+const maxChunk = 32 << 10
+
+// reader is an [io.Reader] whose reads are limited by a limiter.
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *limiter
+}
+
+// Read implements the [io.Reader] interface.
+func (r *reader) Read(data []byte) (int, error) {
+	if len(data) > maxChunk {
+		data = data[:maxChunk]
+	}
+	nr, err := r.r.Read(data)
+	if nr > 0 {
+		if werr := r.lim.wait(r.ctx, int64(nr)); werr != nil {
+			return nr, werr
+		}
+	}
+	return nr, err
+}
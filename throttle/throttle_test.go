@@ -0,0 +1,118 @@
+package throttle_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/throttle"
+)
+
+// fakeBackend is a fake backend that serves a single object from a file.
+type fakeBackend struct {
+	path    string        // the object file
+	started chan struct{} // if non-nil, puts send to it when they begin
+	block   chan struct{} // if non-nil, puts block until it is closed
+}
+
+func (f *fakeBackend) Get(ctx context.Context, actionID string) (string, string, error) {
+	return "0b1ec7", f.path, nil
+}
+
+func (f *fakeBackend) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	if f.started != nil {
+		f.started <- struct{}{}
+	}
+	if f.block != nil {
+		<-f.block
+	}
+	if _, err := io.Copy(io.Discard, obj.Body); err != nil {
+		return "", err
+	}
+	return f.path, nil
+}
+
+func newFakeBackend(t *testing.T, size int) *fakeBackend {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Write object: %v", err)
+	}
+	return &fakeBackend{path: path}
+}
+
+func TestRate(t *testing.T) {
+	ctx := context.Background()
+	base := newFakeBackend(t, 1200)
+	c := throttle.New(base, &throttle.Options{GetRate: 1000, PutRate: 1000})
+
+	// The first second's worth of bytes is not delayed; the remainder is.
+	start := time.Now()
+	if _, _, err := c.Get(ctx, "a1b2c3"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("Get took %v, want about 200ms", d)
+	}
+
+	start = time.Now()
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     1300,
+		Body:     strings.NewReader(strings.Repeat("x", 1300)),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("Put took %v, want about 300ms", d)
+	}
+
+	// A canceled wait reports an error.
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.Get(cctx, "a1b2c3"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	ctx := context.Background()
+	base := newFakeBackend(t, 5)
+	base.started = make(chan struct{}, 1)
+	base.block = make(chan struct{})
+	c := throttle.New(base, &throttle.Options{MaxPuts: 1})
+
+	newObj := func() gocache.Object {
+		return gocache.Object{ActionID: "a1b2c3", OutputID: "0b1ec7", Size: 5, Body: strings.NewReader("xyzzy")}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Put(ctx, newObj())
+		errc <- err
+	}()
+
+	// While one put is in progress, another waits.
+	<-base.started
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Put(cctx, newObj()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Put: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Gets are not limited by the put limit.
+	if _, _, err := c.Get(ctx, "a1b2c3"); err != nil {
+		t.Errorf("Get: unexpected error: %v", err)
+	}
+
+	close(base.block)
+	if err := <-errc; err != nil {
+		t.Errorf("Put: unexpected error: %v", err)
+	}
+}
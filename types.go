@@ -1,8 +1,11 @@
 package gocache
 
 import (
+	"encoding/base64"
 	"io"
+	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
 // progRequest is a JSON encoded request from the client.
@@ -42,6 +45,8 @@ type progRequest struct {
 
 	// BodySize is the number of bytes of Body. If zero, the body isn't written.
 	BodySize int64 `json:",omitempty"`
+
+	backendTime time.Duration // time spent in the Get or Put callback
 }
 
 // outputID returns the output ID from r, preferring OutputID if it is present,
@@ -81,4 +86,104 @@ type progResponse struct {
 	// a "get" request's ActionID (on cache hit) or a "put" request's
 	// provided ObjectID.
 	DiskPath string `json:",omitempty"`
+
+	missReason string // for a "get" miss, the reason (not sent to the client)
+}
+
+// appendJSON appends the JSON encoding of r to buf, followed by a newline, and
+// returns the extended slice. The result is the same as encoding r with a
+// [json.Encoder], but does not allocate if buf has enough capacity.
+func (r *progResponse) appendJSON(buf []byte) []byte {
+	buf = append(buf, `{"ID":`...)
+	buf = strconv.AppendInt(buf, r.ID, 10)
+	if r.Err != "" {
+		buf = append(buf, `,"Err":`...)
+		buf = appendString(buf, r.Err)
+	}
+	if len(r.KnownCommands) != 0 {
+		buf = append(buf, `,"KnownCommands":[`...)
+		for i, c := range r.KnownCommands {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendString(buf, c)
+		}
+		buf = append(buf, ']')
+	}
+	if r.Miss {
+		buf = append(buf, `,"Miss":true`...)
+	}
+	if len(r.OutputID) != 0 {
+		buf = append(buf, `,"OutputID":"`...)
+		buf = base64.StdEncoding.AppendEncode(buf, r.OutputID)
+		buf = append(buf, '"')
+	}
+	if r.Size != 0 {
+		buf = append(buf, `,"Size":`...)
+		buf = strconv.AppendInt(buf, r.Size, 10)
+	}
+	if r.Time != nil {
+		buf = append(buf, `,"Time":"`...)
+		buf = r.Time.AppendFormat(buf, time.RFC3339Nano)
+		buf = append(buf, '"')
+	}
+	if r.DiskPath != "" {
+		buf = append(buf, `,"DiskPath":`...)
+		buf = appendString(buf, r.DiskPath)
+	}
+	return append(buf, "}\n"...)
+}
+
+// appendString appends s to buf as a JSON string, escaped as by
+// [json.Marshal]. Invalid UTF-8 is replaced by U+FFFD.
+func appendString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= ' ' && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[c&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
 }
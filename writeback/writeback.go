@@ -0,0 +1,261 @@
+// Package writeback implements a wrapper for a cache backend that stores
+// objects in the background.
+//
+// A [Cache] acknowledges each Put as soon as the body of the object has been
+// written to a local spool directory, and passes the object to the underlying
+// backend in the background. This improves throughput when storing objects in
+// the backend is slow, for example because it compresses or uploads them.
+//
+// The path reported by Put, and by Get for an object put through the Cache,
+// is the path of the spooled copy. Spooled copies are kept until [Cache.Close],
+// so that the toolchain can read them. Call [Cache.Flush] to wait for pending
+// puts to complete.
+//
+// Pending puts are held only in memory: if the process exits without calling
+// Close, puts that were not yet stored are lost, and their results are later
+// reported as cache misses.
+package writeback
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/creachadair/gocache"
+)
+
+// Backend is the interface to the storage wrapped by a [Cache]. It is
+// satisfied by [github.com/creachadair/gocache/cachedir.Dir].
+type Backend interface {
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error)
+	Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error)
+}
+
+// Options are optional settings for a [Cache]. A nil *Options is ready for
+// use and provides default values as described.
+type Options struct {
+	// SpoolDir is the directory in which to create the spool directory for
+	// objects that are waiting to be stored. If empty, it defaults to
+	// [os.TempDir].
+	SpoolDir string
+
+	// MaxPending is the maximum number of puts that may be waiting to be
+	// stored. When this many are pending, Put blocks until one completes.
+	// If zero, it defaults to 64.
+	MaxPending int
+
+	// Workers is the maximum number of objects passed to the backend
+	// concurrently. If zero, it defaults to 4.
+	Workers int
+}
+
+func (o *Options) spoolDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.SpoolDir
+}
+
+func (o *Options) maxPending() int {
+	if o == nil || o.MaxPending <= 0 {
+		return 64
+	}
+	return o.MaxPending
+}
+
+func (o *Options) workers() int {
+	if o == nil || o.Workers <= 0 {
+		return 4
+	}
+	return o.Workers
+}
+
+// Cache implements a write-behind cache for an underlying backend.
+type Cache struct {
+	base    Backend
+	spool   string        // the spool directory
+	pending chan struct{} // one slot per put not yet stored
+	workers chan struct{} // one slot per active call to base.Put
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	local    map[string]entry // action ID → spooled result
+	firstErr error            // the first error since the last flush
+	numErrs  int              // the number of errors since the last flush
+
+	numPending expvar.Int // puts waiting to be stored
+	numStored  expvar.Int // puts stored in the backend
+	numFailed  expvar.Int // puts that failed to be stored
+}
+
+// entry is the result of a put spooled by a Cache.
+type entry struct {
+	outputID string
+	path     string
+}
+
+// New constructs a new Cache that stores objects in base. It creates a spool
+// directory, which is removed by [Cache.Close].
+func New(base Backend, opts *Options) (*Cache, error) {
+	spool, err := os.MkdirTemp(opts.spoolDir(), "gocache-writeback-*")
+	if err != nil {
+		return nil, fmt.Errorf("create spool directory: %w", err)
+	}
+	return &Cache{
+		base:    base,
+		spool:   spool,
+		pending: make(chan struct{}, opts.maxPending()),
+		workers: make(chan struct{}, opts.workers()),
+		local:   make(map[string]entry),
+	}, nil
+}
+
+// Get implements the corresponding method of the gocache service interface.
+// Results put through c are reported from the spool, whether or not they
+// have been stored in the backend.
+func (c *Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+	c.mu.Lock()
+	e, ok := c.local[actionID]
+	c.mu.Unlock()
+	if ok {
+		return e.outputID, e.path, nil
+	}
+	return c.base.Get(ctx, actionID)
+}
+
+// Put implements the corresponding method of the gocache service interface.
+// It returns once the object has been spooled, and stores it in the backend
+// in the background. Errors storing the object are logged, and reported by
+// the next call to [Cache.Flush].
+func (c *Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+	select {
+	case c.pending <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	path, err := c.spoolObject(obj)
+	if err != nil {
+		<-c.pending
+		return "", err
+	}
+	c.mu.Lock()
+	c.local[obj.ActionID] = entry{outputID: obj.OutputID, path: path}
+	c.mu.Unlock()
+
+	c.numPending.Add(1)
+	c.wg.Add(1)
+	obj.Body = nil
+	go c.store(context.WithoutCancel(ctx), obj, path)
+	return path, nil
+}
+
+// spoolObject writes the body of obj to a new file in the spool directory,
+// and returns the path of the file.
+func (c *Cache) spoolObject(obj gocache.Object) (string, error) {
+	f, err := os.CreateTemp(c.spool, "object-*")
+	if err != nil {
+		return "", err
+	}
+	nw, err := io.Copy(f, obj.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && nw != obj.Size {
+		err = fmt.Errorf("object size: got %d bytes, want %d", nw, obj.Size)
+	}
+	if err == nil && !obj.ModTime.IsZero() {
+		err = os.Chtimes(f.Name(), obj.ModTime, obj.ModTime)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("spool %s: %w", obj.ActionID, err)
+	}
+	return f.Name(), nil
+}
+
+// store writes obj to the backend, with the contents of the spooled file at
+// path as its body.
+func (c *Cache) store(ctx context.Context, obj gocache.Object, path string) {
+	defer c.wg.Done()
+	defer func() { <-c.pending }()
+	defer c.numPending.Add(-1)
+
+	c.workers <- struct{}{}
+	defer func() { <-c.workers }()
+
+	err := putFile(ctx, c.base, obj, path)
+	if err == nil {
+		c.numStored.Add(1)
+		return
+	}
+	c.numFailed.Add(1)
+	gocache.Logf(ctx, "writeback: put %s: %v", obj.ActionID, err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.numErrs == 0 {
+		c.firstErr = fmt.Errorf("put %s: %w", obj.ActionID, err)
+	}
+	c.numErrs++
+}
+
+// Flush blocks until all pending puts have been stored in the backend, or
+// until ctx ends. It reports an error if any puts failed since the previous
+// call to Flush.
+func (c *Cache) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() { c.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err, n := c.firstErr, c.numErrs
+	c.firstErr, c.numErrs = nil, 0
+	if n > 1 {
+		return fmt.Errorf("%d puts failed; first: %w", n, err)
+	}
+	return err
+}
+
+// Close flushes pending puts, as for [Cache.Flush], and then removes the
+// spool directory and closes the underlying backend, if it has a Close
+// method. Paths reported by c are not valid once Close returns. It has the
+// signature of the Close field of a [gocache.Server].
+func (c *Cache) Close(ctx context.Context) error {
+	err := c.Flush(ctx)
+	if ctx.Err() != nil {
+		return err // pending puts may still need the spool
+	}
+	c.mu.Lock()
+	clear(c.local)
+	c.mu.Unlock()
+	return errors.Join(err, os.RemoveAll(c.spool), gocache.CloseBackend(ctx, c.base))
+}
+
+var _ gocache.Cache = (*Cache)(nil)
+
+// SetMetrics adds the write-behind statistics for c to m. It has the
+// signature of the SetMetrics field of a [gocache.Server].
+func (c *Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("writeback_pending", &c.numPending)
+	m.Set("writeback_stored", &c.numStored)
+	m.Set("writeback_failed", &c.numFailed)
+}
+
+// putFile writes obj to b, with the contents of the file at path as its body.
+func putFile(ctx context.Context, b Backend, obj gocache.Object, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	obj.Body = f
+	_, err = b.Put(ctx, obj)
+	return err
+}
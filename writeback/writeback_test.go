@@ -0,0 +1,135 @@
+package writeback_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/writeback"
+)
+
+// slowBackend is a fake backend whose puts block until released.
+type slowBackend struct {
+	release chan struct{}
+	err     error // if non-nil, the error reported by Put
+
+	mu     sync.Mutex
+	bodies map[string]string // action ID → body
+}
+
+func newSlowBackend() *slowBackend {
+	return &slowBackend{release: make(chan struct{}), bodies: make(map[string]string)}
+}
+
+func (s *slowBackend) Get(ctx context.Context, actionID string) (string, string, error) {
+	return "", "", nil
+}
+
+func (s *slowBackend) Put(ctx context.Context, obj gocache.Object) (string, error) {
+	<-s.release
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", err
+	} else if s.err != nil {
+		return "", s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[obj.ActionID] = string(data)
+	return "/path/to/" + obj.OutputID, nil
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	base := newSlowBackend()
+	c, err := writeback.New(base, &writeback.Options{SpoolDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+
+	// Put returns before the backend has stored the object.
+	path, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	})
+	if err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "xyzzy" {
+		t.Errorf("Spooled object: got %q, %v; want xyzzy", data, err)
+	}
+
+	// The result is visible to Get while the put is pending.
+	if obj, got, err := c.Get(ctx, "a1b2c3"); err != nil || obj != "0b1ec7" || got != path {
+		t.Errorf("Get: got %q, %q, %v; want 0b1ec7, %q, nil", obj, got, err, path)
+	}
+
+	// Flush does not return while the put is pending...
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Flush(cctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Flush: got %v, want %v", err, context.Canceled)
+	}
+
+	// ...and once the backend completes it, the object is stored.
+	close(base.release)
+	if err := c.Flush(ctx); err != nil {
+		t.Errorf("Flush: unexpected error: %v", err)
+	}
+	if got := base.bodies["a1b2c3"]; got != "xyzzy" {
+		t.Errorf("Stored body: got %q, want xyzzy", got)
+	}
+
+	// Close removes the spooled objects.
+	if err := c.Close(ctx); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Spooled object still exists after Close: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	base := newSlowBackend()
+	base.err = errors.New("backend failed")
+	close(base.release)
+	c, err := writeback.New(base, &writeback.Options{SpoolDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	defer c.Close(ctx)
+
+	// A body with the wrong size is reported by Put.
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "a1b2c3",
+		OutputID: "0b1ec7",
+		Size:     10,
+		Body:     strings.NewReader("xyzzy"),
+	}); err == nil {
+		t.Error("Put with short body: got nil, want error")
+	}
+
+	// An error from the backend is reported by Flush, once.
+	if _, err := c.Put(ctx, gocache.Object{
+		ActionID: "d4e5f6",
+		OutputID: "0b1ec7",
+		Size:     5,
+		Body:     strings.NewReader("xyzzy"),
+	}); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if err := c.Flush(ctx); !errors.Is(err, base.err) {
+		t.Errorf("Flush: got %v, want %v", err, base.err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Errorf("Flush again: unexpected error: %v", err)
+	}
+}